@@ -0,0 +1,41 @@
+/** ID of the ticket marked active the last time, to only flash it when it changes */
+let markedTicketId = null;
+
+/**
+ * Marks the ticket named by #active-ticket in the ticket list. In facilitated
+ * rooms the estimation form of every other ticket is hidden as well.
+ */
+function markActiveTicket() {
+    const activeTicket = document.getElementById("active-ticket");
+    if (!activeTicket) {
+        return;
+    }
+    const ticketId = activeTicket.dataset.ticketId;
+    const facilitated = activeTicket.dataset.facilitated === "true";
+
+    document.querySelectorAll("ui-flashing-div[data-ticket-id]").forEach(
+        /** @param {HTMLElement} element */
+        (element) => {
+            const isActive = element.dataset.ticketId === ticketId;
+            element.setAttribute("data-active", String(isActive));
+            element.setAttribute(
+                "data-waiting",
+                String(facilitated && !isActive),
+            );
+        },
+    );
+
+    if (ticketId !== markedTicketId && markedTicketId !== null) {
+        /** @type {import("./components/flashing-div").FlashingDiv} */
+        const ticketElement = document.querySelector(
+            `ui-flashing-div[data-ticket-id="${ticketId}"]`,
+        );
+        ticketElement?.flash();
+    }
+    markedTicketId = ticketId;
+}
+
+// Tickets and the active ticket are both swapped in over the websocket
+document.addEventListener("htmx:oobAfterSwap", markActiveTicket);
+document.addEventListener("htmx:afterSwap", markActiveTicket);
+markActiveTicket();
@@ -0,0 +1,40 @@
+/**
+ * Countdown shows the time left until its data-ends-at timestamp, e.g. of the
+ * voting timer of a ticket. It stays empty without one.
+ * @class Countdown
+ */
+export class Countdown extends HTMLElement {
+    connectedCallback() {
+        this.tick();
+        this.interval = setInterval(() => this.tick(), 1_000);
+    }
+
+    disconnectedCallback() {
+        clearInterval(this.interval);
+    }
+
+    tick() {
+        const endsAt = this.dataset.endsAt;
+        if (!endsAt) {
+            this.textContent = "";
+            clearInterval(this.interval);
+            return;
+        }
+
+        const secondsLeft = Math.max(
+            0,
+            Math.ceil((new Date(endsAt).getTime() - Date.now()) / 1_000),
+        );
+        if (secondsLeft === 0) {
+            this.textContent = "Time is up";
+            clearInterval(this.interval);
+            return;
+        }
+
+        const minutes = Math.floor(secondsLeft / 60);
+        const seconds = String(secondsLeft % 60).padStart(2, "0");
+        this.textContent = `Time left: ${minutes}:${seconds}`;
+    }
+}
+
+customElements.define("ui-countdown", Countdown);
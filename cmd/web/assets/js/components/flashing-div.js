@@ -10,6 +10,15 @@ export class FlashingDiv extends HTMLElement {
 
     connectedCallback() {
         this.render();
+        // New tickets reach the tab which added them too, keep only one
+        if (this.hasAttribute("replaces-ticket")) {
+            this.removeAttribute("replaces-ticket");
+            document
+                .querySelectorAll(
+                    `ui-flashing-div[data-ticket-id="${this.dataset.ticketId}"]`,
+                )
+                .forEach((other) => other !== this && other.remove());
+        }
         if (this.hasAttribute("flash")) {
             this.flash();
         }
@@ -6,6 +6,11 @@ class ModalElement extends HTMLElement {
     connectedCallback() {
         this.render();
         this.setupEventListeners();
+        if (this.hasAttribute("open")) {
+            /** @type {HTMLElement} */
+            const popover = this.shadowRoot.querySelector("[popover]");
+            popover?.showPopover();
+        }
     }
 
     setupEventListeners() {
@@ -1,5 +1,17 @@
-/** @param {HTMLFormElement} form */
-function validateEstimation(form) {
+/**
+ * @param {HTMLFormElement} form
+ * @param {HTMLElement | null} submitter
+ */
+function validateEstimation(form, submitter) {
+    // Votes without a value need no estimate
+    if (submitter?.getAttribute("name") === "kind") {
+        return true;
+    }
+
+    if (form.querySelector('input[name="cardEstimate"]')) {
+        return validateCardEstimation(form);
+    }
+
     /** @type {HTMLInputElement} */
     const weekInput = form.querySelector('input[name="weekEstimate"]');
     /** @type {HTMLInputElement} */
@@ -43,6 +55,19 @@ function validateEstimation(form) {
     return true; // Allow form submission
 }
 
+/** @param {HTMLFormElement} form */
+function validateCardEstimation(form) {
+    if (!form.querySelector('input[name="cardEstimate"]:checked')) {
+        // Card inputs are hidden, so they can't show a validation bubble
+        document.dispatchEvent(
+            new ToastEvent({ message: "Please pick a card", level: "error" }),
+        );
+        return false;
+    }
+
+    return true;
+}
+
 /**
  * Clears validation errors when user inputs new values
  * @param {Event} event
@@ -0,0 +1,98 @@
+/**
+ * Looks like a WebSocket to the htmx ws extension, but receives the room
+ * events as server-sent events. Used when proxies don't let websockets through.
+ * Messages sent to the server are posted once the stream told us its ID.
+ */
+export class EventStreamSocket extends EventTarget {
+    static CONNECTING = 0;
+    static OPEN = 1;
+    static CLOSING = 2;
+    static CLOSED = 3;
+
+    CONNECTING = EventStreamSocket.CONNECTING;
+    OPEN = EventStreamSocket.OPEN;
+    CLOSING = EventStreamSocket.CLOSING;
+    CLOSED = EventStreamSocket.CLOSED;
+
+    /** @type {((e: Event) => void) | null} */
+    onopen = null;
+    /** @type {((e: CloseEvent) => void) | null} */
+    onclose = null;
+    /** @type {((e: Event) => void) | null} */
+    onerror = null;
+
+    /** @type {string|null} */
+    #streamURL = null;
+    /** @type {string[]} */
+    #queue = [];
+
+    /**
+     * @param {string} url websocket URL of the room, e.g. ws://host/ws/1?lastSeq=3
+     */
+    constructor(url) {
+        super();
+        this.url = url;
+        this.readyState = EventStreamSocket.CONNECTING;
+
+        const streamURL = new URL(url);
+        streamURL.protocol = streamURL.protocol === "wss:" ? "https:" : "http:";
+        streamURL.pathname = `${streamURL.pathname}/events`;
+        this.source = new EventSource(streamURL);
+
+        this.source.onopen = (e) => {
+            this.readyState = EventStreamSocket.OPEN;
+            this.onopen?.(e);
+        };
+        this.source.onmessage = (e) => {
+            this.dispatchEvent(new MessageEvent("message", { data: e.data }));
+        };
+        // Sent again with a new ID whenever the browser reconnects the stream
+        this.source.addEventListener("stream", (e) => {
+            const postURL = new URL(streamURL);
+            postURL.search = "";
+            postURL.pathname = `${postURL.pathname}/${e.data}`;
+            this.#streamURL = postURL.toString();
+            for (const message of this.#queue.splice(0)) {
+                this.send(message);
+            }
+        });
+        this.source.onerror = (e) => {
+            this.onerror?.(e);
+            // The browser retries on its own unless the server refused the stream
+            if (this.source.readyState === EventSource.CLOSED) {
+                this.#closed(1006);
+            }
+        };
+    }
+
+    /**
+     * @param {string} message
+     */
+    send(message) {
+        if (this.#streamURL === null) {
+            this.#queue.push(message);
+            return;
+        }
+        fetch(this.#streamURL, {
+            method: "POST",
+            body: message,
+            headers: { "Content-Type": "application/json" },
+        }).catch((e) => console.error("Error posting to event stream", e));
+    }
+
+    close() {
+        this.source.close();
+        this.#closed(1000);
+    }
+
+    /**
+     * @param {number} code
+     */
+    #closed(code) {
+        if (this.readyState === EventStreamSocket.CLOSED) {
+            return;
+        }
+        this.readyState = EventStreamSocket.CLOSED;
+        this.onclose?.(new CloseEvent("close", { code }));
+    }
+}
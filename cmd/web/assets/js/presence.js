@@ -0,0 +1,54 @@
+const IDLE_AFTER_MS = 2 * 60_000;
+
+/** @type {{ send: (message: string) => void } | null} */
+let socket = null;
+let isIdle = false;
+let idleTimeout = null;
+
+htmx.on("htmx:wsOpen", function (event) {
+    socket = event.detail.socketWrapper;
+    isIdle = false;
+    setIdle(document.hidden);
+    resetIdleTimeout();
+});
+
+htmx.on("htmx:wsClose", function () {
+    socket = null;
+});
+
+document.addEventListener("visibilitychange", function () {
+    setIdle(document.hidden);
+    resetIdleTimeout();
+});
+
+for (const eventName of ["pointerdown", "pointermove", "keydown", "scroll"]) {
+    document.addEventListener(
+        eventName,
+        function () {
+            setIdle(false);
+            resetIdleTimeout();
+        },
+        { passive: true },
+    );
+}
+
+function resetIdleTimeout() {
+    clearTimeout(idleTimeout);
+    idleTimeout = setTimeout(() => setIdle(true), IDLE_AFTER_MS);
+}
+
+/**
+ * @param {boolean} idle
+ */
+function setIdle(idle) {
+    if (idle === isIdle || socket === null) {
+        return;
+    }
+    isIdle = idle;
+    socket.send(
+        JSON.stringify({
+            messageType: "presence",
+            data: { idle },
+        }),
+    );
+}
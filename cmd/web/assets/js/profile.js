@@ -0,0 +1,3 @@
+document.addEventListener("profileUpdated", () => {
+    document.dispatchEvent(new CloseModalEvent());
+});
@@ -1,28 +1,132 @@
-let wsHasConnectedBefore = false;
+import { EventStreamSocket } from "./event-stream-socket.js";
+
+/**
+ * Sequence number of the last room event applied to the page, sent when
+ * reconnecting so the server replays only the events missed in the meantime.
+ * @type {string|null}
+ */
+let lastSeq = null;
 let isRefetching = false;
 
-htmx.on("htmx:wsOpen", async function () {
-    if (!wsHasConnectedBefore) {
-        wsHasConnectedBefore = true;
-        return;
+/**
+ * Websockets which closed before ever opening, e.g. because a proxy refused
+ * the upgrade. After a couple of them the room falls back to server-sent events.
+ */
+const FAILED_WEBSOCKETS_BEFORE_FALLBACK = 2;
+let failedWebSockets = 0;
+let hasOpenedWebSocket = false;
+
+htmx.on("htmx:wsOpen", function () {
+    if (!isEventStream()) {
+        hasOpenedWebSocket = true;
+    }
+});
+
+htmx.on("htmx:wsClose", function () {
+    if (!hasOpenedWebSocket) {
+        failedWebSockets++;
+    }
+});
+
+function isEventStream() {
+    return !hasOpenedWebSocket && failedWebSockets >= FAILED_WEBSOCKETS_BEFORE_FALLBACK;
+}
+
+const createWebSocket = htmx.createWebSocket;
+htmx.createWebSocket = function (url) {
+    const seq =
+        lastSeq ??
+        document.querySelector("[data-last-seq]")?.getAttribute("data-last-seq");
+    if (seq !== null && seq !== undefined) {
+        const withSeq = new URL(url);
+        withSeq.searchParams.set("lastSeq", seq);
+        url = withSeq.toString();
+    }
+
+    if (isEventStream()) {
+        console.log("Websocket can't connect, falling back to server-sent events");
+        return new EventStreamSocket(url);
+    }
+
+    if (createWebSocket) {
+        return createWebSocket(url);
     }
+    const socket = new WebSocket(url, []);
+    socket.binaryType = htmx.config.wsBinaryType;
+    return socket;
+};
+
+htmx.on(
+    "htmx:wsBeforeMessage",
+    /** @param {CustomEvent} e */
+    function (e) {
+        /** @type {string} */
+        const message = e.detail.message;
+
+        const seq = messageSeq(message);
+        if (seq !== null) {
+            lastSeq = seq;
+        }
+
+        // The missed events are no longer kept, fetch the room again
+        if (isJsonWebSocketMessage(message, "resync")) {
+            refetch();
+        }
+
+        // The controls of the page depend on the role of the user
+        if (isJsonWebSocketMessage(message, "roleChanged")) {
+            window.location.reload();
+        }
+    },
+);
+
+/**
+ * Events carry their sequence number as the seq field of JSON messages or a
+ * leading comment of HTML fragments
+ * @param {string} message
+ * @returns {string|null}
+ */
+function messageSeq(message) {
+    if (typeof message !== "string") {
+        return null;
+    }
+
+    const comment = /^<!--seq:(\d+)-->/.exec(message);
+    if (comment) {
+        return comment[1];
+    }
+
+    if (message.startsWith("{")) {
+        try {
+            const seq = JSON.parse(message).seq;
+            return seq === undefined ? null : String(seq);
+        } catch (e) {
+            return null;
+        }
+    }
+
+    return null;
+}
+
+async function refetch() {
     if (isRefetching) {
         return;
     }
+    isRefetching = true;
 
     while (hasFocusedInput()) {
         console.log("Waiting for input to be unfocused...");
         await new Promise((resolve) => setTimeout(resolve, 3_000));
     }
 
-    console.log("Reconnecting...");
+    console.log("Refetching room...");
     htmx.ajax("get", window.location.pathname, {
         target: "#ticket-list",
         select: "#ticket-list",
     }).then(function () {
         isRefetching = false;
     });
-});
+}
 
 function hasFocusedInput() {
     return document.activeElement.tagName === "INPUT";
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"slices"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
+)
+
+// Consensus is how close the votes of a revealed round are
+type Consensus string
+
+const (
+	// ConsensusNone is used for rounds with fewer than two votes
+	ConsensusNone  Consensus = ""
+	ConsensusFull  Consensus = "consensus"
+	ConsensusNear  Consensus = "near"
+	ConsensusSplit Consensus = "split"
+)
+
+// ConsensusThresholds are how many steps of the deck the lowest and the
+// highest vote of a round can be apart for a consensus or a near consensus
+type ConsensusThresholds struct {
+	Consensus int
+	Near      int
+}
+
+var DefaultConsensusThresholds = ConsensusThresholds{Consensus: 0, Near: 1}
+
+// Valid reports whether a consensus is at most as wide as a near consensus
+func (c ConsensusThresholds) Valid() bool {
+	return c.Consensus >= 0 && c.Near >= c.Consensus
+}
+
+// RoundConsensus classifies the votes of a round
+type RoundConsensus struct {
+	Level Consensus
+	// Steps of the deck between the lowest and the highest vote
+	Steps int
+	// Who voted the lowest and the highest, empty on consensus so nobody is
+	// asked to explain their vote without reason
+	LowestVoters  []uint
+	HighestVoters []uint
+}
+
+// Revote reports whether the votes are too far apart for a final estimate
+func (r RoundConsensus) Revote() bool {
+	return r.Level == ConsensusSplit
+}
+
+// ClassifyRound compares the spread of the votes to the thresholds of the
+// room. Votes are compared by the cards they fall on, so the thresholds mean
+// the same for every deck. LLM estimates aren't votes and are left out, as
+// are votes without a value.
+func ClassifyRound(deck Deck, votes []Estimate, thresholds ConsensusThresholds) RoundConsensus {
+	var lowest, highest *Estimate
+	voteCount := 0
+	for i := range votes {
+		if votes[i].UserID == nil || !votes[i].HasValue() {
+			continue
+		}
+		voteCount++
+		if lowest == nil || votes[i].Estimate < lowest.Estimate {
+			lowest = &votes[i]
+		}
+		if highest == nil || votes[i].Estimate > highest.Estimate {
+			highest = &votes[i]
+		}
+	}
+	if voteCount < 2 {
+		return RoundConsensus{}
+	}
+
+	consensus := RoundConsensus{Steps: deck.StepsApart(lowest.Estimate, highest.Estimate)}
+	switch {
+	case consensus.Steps <= thresholds.Consensus:
+		consensus.Level = ConsensusFull
+		return consensus
+	case consensus.Steps <= thresholds.Near:
+		consensus.Level = ConsensusNear
+	default:
+		consensus.Level = ConsensusSplit
+	}
+
+	for _, vote := range votes {
+		if vote.UserID == nil || !vote.HasValue() {
+			continue
+		}
+		if deck.StepsApart(vote.Estimate, lowest.Estimate) == 0 {
+			consensus.LowestVoters = append(consensus.LowestVoters, *vote.UserID)
+		}
+		if deck.StepsApart(vote.Estimate, highest.Estimate) == 0 {
+			consensus.HighestVoters = append(consensus.HighestVoters, *vote.UserID)
+		}
+	}
+
+	return consensus
+}
+
+// Outlier tells whether the vote was one of the lowest or the highest, empty
+// if it wasn't or the round reached consensus
+func (r RoundConsensus) Outlier(vote Estimate) string {
+	switch {
+	case vote.UserID == nil || !vote.HasValue():
+		return ""
+	case slices.Contains(r.LowestVoters, *vote.UserID):
+		return ticket.OutlierLowest
+	case slices.Contains(r.HighestVoters, *vote.UserID):
+		return ticket.OutlierHighest
+	default:
+		return ""
+	}
+}
+
+func (r RoundConsensus) ToProps() *ticket.ConsensusProps {
+	if r.Level == ConsensusNone {
+		return nil
+	}
+	return &ticket.ConsensusProps{
+		Level:  string(r.Level),
+		Steps:  r.Steps,
+		Revote: r.Revote(),
+	}
+}
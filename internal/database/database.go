@@ -72,8 +72,29 @@ func New(dbUrl string) *Database {
 	// SetConnMaxLifetime sets the maximum amount of time a connection may be reused.
 	sqlDB.SetConnMaxLifetime(time.Hour)
 
+	// Memberships carry the role of the user in the room
+	if err := db.SetupJoinTable(&Room{}, "Users", &RoomUser{}); err != nil {
+		log.Fatalf("failed to set up room_users: %v", err)
+	}
+	if err := db.SetupJoinTable(&User{}, "InRoom", &RoomUser{}); err != nil {
+		log.Fatalf("failed to set up room_users: %v", err)
+	}
+
+	// Concurrent votes could store a user's vote twice before votes were
+	// unique per round, keep the newest so the unique index can be created
+	if db.Migrator().HasTable(&Estimate{}) {
+		if err := db.Exec(`
+			UPDATE estimates SET deleted_at = now()
+			WHERE deleted_at IS NULL AND user_id IS NOT NULL AND id NOT IN (
+				SELECT MAX(id) FROM estimates
+				WHERE deleted_at IS NULL AND user_id IS NOT NULL
+				GROUP BY ticket_id, user_id, round)`).Error; err != nil {
+			log.Fatalf("failed to remove duplicate votes: %v", err)
+		}
+	}
+
 	// AutoMigrate
-	db.AutoMigrate(&User{}, &Room{}, &Ticket{}, &Estimate{})
+	db.AutoMigrate(&User{}, &Room{}, &Ticket{}, &Estimate{}, &LLMJob{}, &LLMEstimateExample{}, &LLMRecommendation{}, &RoomEvent{}, &RoomInvite{}, &RoomPresence{}, &PasscodeAttempt{})
 
 	dbInstance = &Database{
 		DB:    db,
@@ -84,6 +105,12 @@ func New(dbUrl string) *Database {
 	return dbInstance
 }
 
+// URL returns the connection string, for connections outside of the pool
+// such as LISTEN
+func (s *Database) URL() string {
+	return s.dbUrl
+}
+
 // Health checks the health of the database connection by pinging the database.
 // It returns a map with keys indicating various health statistics.
 func (s *Database) Health() map[string]string {
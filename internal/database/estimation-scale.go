@@ -0,0 +1,232 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type EstimationScale string
+
+const (
+	ScaleHours             EstimationScale = "hours"
+	ScaleFibonacci         EstimationScale = "fibonacci"
+	ScaleModifiedFibonacci EstimationScale = "modified_fibonacci"
+	ScalePowersOfTwo       EstimationScale = "powers_of_two"
+	ScaleTShirt            EstimationScale = "tshirt"
+	ScaleCustom            EstimationScale = "custom"
+)
+
+var ErrInvalidEstimationScale = errors.New("invalid estimation scale")
+
+// EstimationCard is a single card of an estimation deck. Value is what gets
+// stored on the estimate and used for statistics.
+type EstimationCard struct {
+	Label string
+	Value float64
+}
+
+// Deck describes how a room estimates. The hours scale has no cards, estimates
+// are entered as weeks, days and hours instead.
+type Deck struct {
+	Scale   EstimationScale
+	Cards   []EstimationCard
+	numeric bool
+}
+
+func numericCards(values ...float64) []EstimationCard {
+	cards := make([]EstimationCard, len(values))
+	for i, v := range values {
+		cards[i] = EstimationCard{Label: formatNumber(v), Value: v}
+	}
+	return cards
+}
+
+func ParseEstimationScale(scale string) (EstimationScale, error) {
+	switch s := EstimationScale(scale); s {
+	case "":
+		return ScaleHours, nil
+	case ScaleHours, ScaleFibonacci, ScaleModifiedFibonacci, ScalePowersOfTwo, ScaleTShirt, ScaleCustom:
+		return s, nil
+	default:
+		return "", ErrInvalidEstimationScale
+	}
+}
+
+// ParseCustomScale validates a comma separated list of card labels.
+func ParseCustomScale(customScale string) (string, error) {
+	labels := splitCustomScale(customScale)
+	if len(labels) < 2 {
+		return "", fmt.Errorf("%w: custom deck needs at least two cards", ErrInvalidEstimationScale)
+	}
+	seen := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		if seen[label] {
+			return "", fmt.Errorf("%w: duplicate card %q", ErrInvalidEstimationScale, label)
+		}
+		seen[label] = true
+	}
+
+	return strings.Join(labels, ","), nil
+}
+
+func splitCustomScale(customScale string) []string {
+	labels := make([]string, 0)
+	for _, label := range strings.Split(customScale, ",") {
+		label = strings.TrimSpace(label)
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+func NewDeck(scale EstimationScale, customScale string) Deck {
+	switch scale {
+	case ScaleFibonacci:
+		return Deck{Scale: scale, Cards: numericCards(0, 1, 2, 3, 5, 8, 13, 21), numeric: true}
+	case ScaleModifiedFibonacci:
+		return Deck{Scale: scale, Cards: numericCards(0, 0.5, 1, 2, 3, 5, 8, 13, 20, 40, 100), numeric: true}
+	case ScalePowersOfTwo:
+		return Deck{Scale: scale, Cards: numericCards(0, 1, 2, 4, 8, 16, 32, 64), numeric: true}
+	case ScaleTShirt:
+		return Deck{Scale: scale, Cards: []EstimationCard{
+			{Label: "XS", Value: 1},
+			{Label: "S", Value: 2},
+			{Label: "M", Value: 3},
+			{Label: "L", Value: 5},
+			{Label: "XL", Value: 8},
+			{Label: "XXL", Value: 13},
+		}}
+	case ScaleCustom:
+		labels := splitCustomScale(customScale)
+		cards := make([]EstimationCard, len(labels))
+		numeric := true
+		for i, label := range labels {
+			value, err := strconv.ParseFloat(label, 64)
+			if err != nil {
+				numeric = false
+			}
+			cards[i] = EstimationCard{Label: label, Value: value}
+		}
+		if !numeric {
+			// Non numeric decks are ranked by the position of the card
+			for i := range cards {
+				cards[i].Value = float64(i + 1)
+			}
+		}
+		return Deck{Scale: scale, Cards: cards, numeric: numeric}
+	default:
+		return Deck{Scale: ScaleHours, numeric: true}
+	}
+}
+
+func (d Deck) IsTimeBased() bool {
+	return d.Scale == ScaleHours
+}
+
+// CardLabels returns the labels of the cards in the deck, empty for the hours scale
+func (d Deck) CardLabels() []string {
+	labels := make([]string, len(d.Cards))
+	for i, card := range d.Cards {
+		labels[i] = card.Label
+	}
+	return labels
+}
+
+func (d Deck) CardValue(label string) (float64, bool) {
+	for _, card := range d.Cards {
+		if card.Label == label {
+			return card.Value, true
+		}
+	}
+	return 0, false
+}
+
+// NearestCard returns the card whose value is closest to the given value
+func (d Deck) NearestCard(value float64) EstimationCard {
+	var nearest EstimationCard
+	bestDistance := math.Inf(1)
+	for _, card := range d.Cards {
+		if distance := math.Abs(card.Value - value); distance < bestDistance {
+			bestDistance = distance
+			nearest = card
+		}
+	}
+	return nearest
+}
+
+// Usual steps of an estimate in hours, the hours scale has no cards to step through
+var hourSteps = []float64{1, 2, 4, 8, 16, 24, 40, 80, 120, 160}
+
+func (d Deck) stepIndex(value float64) int {
+	steps := hourSteps
+	if !d.IsTimeBased() {
+		steps = make([]float64, len(d.Cards))
+		for i, card := range d.Cards {
+			steps[i] = card.Value
+		}
+	}
+
+	nearest := 0
+	bestDistance := math.Inf(1)
+	for i, step := range steps {
+		if distance := math.Abs(step - value); distance < bestDistance {
+			bestDistance = distance
+			nearest = i
+		}
+	}
+	return nearest
+}
+
+// StepsApart returns how many cards apart the estimates are, after rounding
+// each of them to the nearest card
+func (d Deck) StepsApart(a float64, b float64) int {
+	steps := d.stepIndex(a) - d.stepIndex(b)
+	if steps < 0 {
+		return -steps
+	}
+	return steps
+}
+
+// Format pretty prints a single estimate or an aggregate (average, median) of estimates
+func (d Deck) Format(estimate float64) string {
+	if d.IsTimeBased() {
+		return formatHours(estimate)
+	}
+	if !d.numeric {
+		return d.NearestCard(estimate).Label
+	}
+	return fmt.Sprintf("%s pts", formatNumber(estimate))
+}
+
+func (d Deck) FormatDeviation(deviation float64) string {
+	if d.IsTimeBased() {
+		return fmt.Sprintf("%.2fh", deviation)
+	}
+	return fmt.Sprintf("%.2f", deviation)
+}
+
+// FormatTotal pretty prints a sum of estimates. Sums of non numeric cards are
+// shown in points, since a sum of T-shirt sizes has no label of its own.
+func (d Deck) FormatTotal(total float64) string {
+	if d.IsTimeBased() {
+		return formatHours(total)
+	}
+	return fmt.Sprintf("%s pts", formatNumber(total))
+}
+
+func formatHours(estimate float64) string {
+	hours := int(estimate)
+	weeks := hours / 40
+	days := (hours % 40) / 8
+	hours = hours % 8
+
+	return fmt.Sprintf("%dw %dd %dh", weeks, days, hours)
+}
+
+func formatNumber(value float64) string {
+	return strconv.FormatFloat(math.Round(value*10)/10, 'f', -1, 64)
+}
@@ -0,0 +1,18 @@
+package database
+
+import "gorm.io/gorm"
+
+// LLMEstimateExample is a closed ticket which was given to the LLM as an
+// example of how the team estimates, when estimating the job's ticket
+type LLMEstimateExample struct {
+	gorm.Model
+	LLMJobID        uint `gorm:"index"`
+	ExampleTicketID uint
+	// Room of the example ticket, examples from the owner's other rooms are
+	// only named to the owner
+	RoomID uint
+	Name   string
+	// Final median estimate of the example ticket, in hours
+	Estimate   float64
+	Similarity float64
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
+	"gorm.io/gorm"
+)
+
+type LLMJobStatus string
+
+const (
+	LLMJobPending   LLMJobStatus = "pending"
+	LLMJobRunning   LLMJobStatus = "running"
+	LLMJobSucceeded LLMJobStatus = "succeeded"
+	LLMJobFailed    LLMJobStatus = "failed"
+)
+
+// LLMJob is a queued request for an LLM estimate of a ticket. Jobs are kept in
+// the database so they survive restarts.
+type LLMJob struct {
+	gorm.Model
+	TicketID    uint `gorm:"uniqueIndex"`
+	RoomID      uint
+	TicketKey   string
+	Description string
+	Status      LLMJobStatus `gorm:"default:pending;index:idx_llm_jobs_status_run_after"`
+	Attempts    int
+	RunAfter    time.Time `gorm:"index:idx_llm_jobs_status_run_after"`
+	StartedAt   *time.Time
+	FinishedAt  *time.Time
+	LastError   string
+	// Provider of the estimator which ran the job
+	Provider string
+	Examples []LLMEstimateExample
+}
+
+// StatusProps shows the progress of the job. Examples from the owner's other
+// rooms are only listed for the owner, moderators see how many there were.
+func (j *LLMJob) StatusProps(isOwner bool) *ticket.LlmJobStatusProps {
+	hours := NewDeck(ScaleHours, "")
+	status := &ticket.LlmJobStatusProps{
+		TicketID:  j.TicketID,
+		Status:    string(j.Status),
+		Attempts:  j.Attempts,
+		LastError: j.LastError,
+		Examples:  make([]ticket.LlmExampleProps, 0, len(j.Examples)),
+	}
+	for _, example := range j.Examples {
+		if example.RoomID != j.RoomID && !isOwner {
+			status.OtherRoomExamples++
+			continue
+		}
+		status.Examples = append(status.Examples, ticket.LlmExampleProps{
+			Name:       example.Name,
+			Estimate:   hours.Format(example.Estimate),
+			Similarity: fmt.Sprintf("%.0f%%", example.Similarity*100),
+		})
+	}
+
+	return status
+}
@@ -0,0 +1,37 @@
+package database
+
+import (
+	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
+	"gorm.io/gorm"
+)
+
+type LLMConfidence string
+
+const (
+	LLMConfidenceLow    LLMConfidence = "low"
+	LLMConfidenceMedium LLMConfidence = "medium"
+	LLMConfidenceHigh   LLMConfidence = "high"
+)
+
+// LLMRecommendation is the reasoning the LLM gave for its estimate
+type LLMRecommendation struct {
+	gorm.Model
+	EstimateID uint `gorm:"uniqueIndex"`
+	Rationale  string
+	Risks      []string `gorm:"serializer:json"`
+	Confidence LLMConfidence
+}
+
+// ToLlmEstimateProps formats the LLM estimate along with its reasoning, which
+// is nil for estimates made before reasoning was stored
+func ToLlmEstimateProps(deck Deck, estimate Estimate, recommendation *LLMRecommendation) ticket.LlmEstimateProps {
+	props := ticket.LlmEstimateProps{
+		Estimate: deck.Format(estimate.Estimate),
+	}
+	if recommendation != nil {
+		props.Rationale = recommendation.Rationale
+		props.Risks = recommendation.Risks
+		props.Confidence = string(recommendation.Confidence)
+	}
+	return props
+}
@@ -1,11 +1,17 @@
 package database
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
 	"gorm.io/gorm"
 )
 
 type User struct {
 	gorm.Model
+	DisplayName string
+	Color       string
 	CreatedRoom []Room `gorm:"foreignKey:CreatedBy"`
 	InRoom      []Room `gorm:"many2many:room_users;"`
 	Estimates   []Estimate
@@ -13,17 +19,186 @@ type User struct {
 
 type Room struct {
 	gorm.Model
-	CreatedBy             uint
-	Name                  string
-	AllowLLMEstimation    bool `gorm:"default:false"`
+	CreatedBy          uint
+	Name               string
+	AllowLLMEstimation bool            `gorm:"default:false"`
+	EstimationScale    EstimationScale `gorm:"default:hours"`
+	CustomScale        string
+	// LLM provider used for estimates in this room, empty for the default one
+	LLMProvider string
+	// Sequence number of the newest realtime event of the room
+	EventSeq uint64 `gorm:"not null;default:0"`
+	// Salted hash of the passcode invited users have to enter to join, empty
+	// if the invite link is enough
+	PasscodeHash string
+	// Facilitated rooms only vote on the active ticket picked by the owner or
+	// a moderator, other rooms vote on every open ticket at once
+	Facilitated bool `gorm:"default:false"`
+	// Ticket the room is estimating right now, nil if none was picked
+	ActiveTicketID *uint
+	// Length of the voting timer started on a ticket when no other is given,
+	// 0 if the room has no default
+	VotingTimerSeconds int `gorm:"not null;default:0"`
+	// What happens to a ticket once everyone present voted or its timer ran out
+	AutoFinish AutoFinish
+	// Three-point rooms ask every estimator for an optimistic, a most likely
+	// and a pessimistic value, it can't be changed once the room is created
+	ThreePoint bool `gorm:"default:false"`
+	// Steps of the deck the votes of a round can be apart for a consensus and
+	// for a near consensus, further apart calls for a re-vote
+	ConsensusSteps        int `gorm:"not null;default:0"`
+	NearConsensusSteps    int `gorm:"not null;default:1"`
+	Invites               []RoomInvite
 	Tickets               []Ticket
 	TicketsWithStatistics []TicketWithEstimateStatistics `gorm:"-"`
 	Users                 []User                         `gorm:"many2many:room_users;"`
 }
 
+// RoomRole is what a member is allowed to do in a room
+type RoomRole string
+
+// AutoFinish is what the server does with a ticket once everyone present
+// voted on it or its voting timer ran out
+type AutoFinish string
+
+const (
+	AutoFinishOff    AutoFinish = ""
+	AutoFinishReveal AutoFinish = "reveal"
+	AutoFinishClose  AutoFinish = "close"
+)
+
+// RoomUser is the membership of a user in a room, the join table of Room.Users
+type RoomUser struct {
+	RoomID uint     `gorm:"primaryKey"`
+	UserID uint     `gorm:"primaryKey"`
+	Role   RoomRole `gorm:"not null;default:estimator"`
+}
+
+// RoomInvite is a link users join the room with. The token is the secret
+// part of the link.
+type RoomInvite struct {
+	gorm.Model
+	RoomID    uint   `gorm:"not null;index"`
+	Token     string `gorm:"not null;uniqueIndex"`
+	CreatedBy uint
+	// Role the invited users get in the room
+	Role      RoomRole `gorm:"not null;default:estimator"`
+	ExpiresAt *time.Time
+	RevokedAt *time.Time
+}
+
+// Active reports whether users can still join with the invite
+func (i RoomInvite) Active(now time.Time) bool {
+	return i.RevokedAt == nil && (i.ExpiresAt == nil || now.Before(*i.ExpiresAt))
+}
+
+// PasscodeAttempt counts the passcodes tried for an invite or by a user, so
+// passcodes can't be guessed
+type PasscodeAttempt struct {
+	Key string `gorm:"primaryKey"`
+	// Wrong passcodes and attempts still being checked, in the current window
+	Attempts     int
+	WindowEndsAt time.Time
+}
+
 type Estimate struct {
 	gorm.Model
-	TicketID uint
-	UserID   *uint
-	Estimate int
+	// A user votes once per round, LLM estimates have no user
+	TicketID uint  `gorm:"uniqueIndex:idx_estimates_vote,where:deleted_at IS NULL"`
+	UserID   *uint `gorm:"uniqueIndex:idx_estimates_vote,where:deleted_at IS NULL"`
+	User     *User
+	// The PERT expected value for three-point estimates
+	Estimate float64
+	// Values of three-point estimates, nil in other rooms
+	Optimistic  *float64
+	MostLikely  *float64
+	Pessimistic *float64
+	// Votes without a value don't count towards the statistics, Estimate is 0
+	Kind EstimateKind `gorm:"not null;default:''"`
+	// Voting round the estimate was given in, previous rounds are kept as history
+	Round int `gorm:"default:1;uniqueIndex:idx_estimates_vote,where:deleted_at IS NULL"`
+	// Reasoning behind the estimate, only set for LLM estimates
+	Recommendation *LLMRecommendation `gorm:"foreignKey:EstimateID"`
+}
+
+// EstimateKind tells votes with a value apart from those of voters who can't
+// or won't give one
+type EstimateKind string
+
+const (
+	EstimateValue   EstimateKind = ""
+	EstimateUnsure  EstimateKind = "unsure"
+	EstimateBreak   EstimateKind = "break"
+	EstimateAbstain EstimateKind = "abstain"
+)
+
+func ParseEstimateKind(kind string) (EstimateKind, bool) {
+	switch k := EstimateKind(kind); k {
+	case EstimateValue, EstimateUnsure, EstimateBreak, EstimateAbstain:
+		return k, true
+	default:
+		return "", false
+	}
+}
+
+// Label is how a vote without a value is shown in place of the estimate
+func (k EstimateKind) Label() string {
+	switch k {
+	case EstimateUnsure:
+		return "?"
+	case EstimateBreak:
+		return "☕"
+	case EstimateAbstain:
+		return "Abstain"
+	default:
+		return ""
+	}
+}
+
+// HasValue reports whether the estimate counts towards the statistics
+func (e Estimate) HasValue() bool {
+	return e.Kind == EstimateValue
+}
+
+func (e Estimate) IsThreePoint() bool {
+	return e.Optimistic != nil && e.MostLikely != nil && e.Pessimistic != nil
+}
+
+// Format shows the estimate, or what the voter picked instead of a value
+func (e Estimate) Format(deck Deck) string {
+	if !e.HasValue() {
+		return e.Kind.Label()
+	}
+	if e.IsThreePoint() {
+		return fmt.Sprintf("%s / %s / %s", deck.Format(*e.Optimistic), deck.Format(*e.MostLikely), deck.Format(*e.Pessimistic))
+	}
+	return deck.Format(e.Estimate)
+}
+
+// Voter returns the user who gave the estimate, User has to be preloaded for
+// the voter to have a name
+func (e Estimate) Voter() User {
+	if e.User != nil {
+		return *e.User
+	}
+	if e.UserID != nil {
+		return User{Model: gorm.Model{ID: *e.UserID}}
+	}
+	return User{}
+}
+
+func (e Estimate) ToVoteProps(deck Deck) ticket.VoteProps {
+	return ticket.VoteProps{
+		Voter:    e.Voter().Avatar(),
+		Estimate: e.Format(deck),
+		Kind:     string(e.Kind),
+	}
+}
+
+func (r Room) Deck() Deck {
+	return NewDeck(r.EstimationScale, r.CustomScale)
+}
+
+func (r Room) ConsensusThresholds() ConsensusThresholds {
+	return ConsensusThresholds{Consensus: r.ConsensusSteps, Near: r.NearConsensusSteps}
 }
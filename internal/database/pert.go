@@ -0,0 +1,37 @@
+package database
+
+import (
+	"fmt"
+	"math"
+)
+
+// pertConfidence is how many standard deviations the range of a three-point
+// estimate spans around the expected value, two cover about 95% of outcomes
+const pertConfidence = 2
+
+// PERTExpected weights the most likely value of a three-point estimate four
+// times as much as the optimistic and the pessimistic one
+func PERTExpected(optimistic float64, mostLikely float64, pessimistic float64) float64 {
+	return (optimistic + 4*mostLikely + pessimistic) / 6
+}
+
+func PERTStdDev(optimistic float64, pessimistic float64) float64 {
+	return (pessimistic - optimistic) / 6
+}
+
+func pertRange(expected float64, stdDev float64) (float64, float64) {
+	return math.Max(0, expected-pertConfidence*stdDev), expected + pertConfidence*stdDev
+}
+
+// FormatRange pretty prints the range a three-point estimate likely falls in
+func (d Deck) FormatRange(expected float64, stdDev float64) string {
+	low, high := pertRange(expected, stdDev)
+	return fmt.Sprintf("%s – %s", d.Format(low), d.Format(high))
+}
+
+// FormatTotalRange pretty prints the range a sum of three-point estimates
+// likely falls in
+func (d Deck) FormatTotalRange(expected float64, stdDev float64) string {
+	low, high := pertRange(expected, stdDev)
+	return fmt.Sprintf("%s – %s", d.FormatTotal(low), d.FormatTotal(high))
+}
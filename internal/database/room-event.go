@@ -0,0 +1,17 @@
+package database
+
+import "time"
+
+// RoomEvent is a realtime update published to every instance of the app. Only
+// the newest events of each room are kept, so they don't need soft deletes.
+type RoomEvent struct {
+	ID      uint   `gorm:"primarykey"`
+	RoomID  uint   `gorm:"index:idx_room_events_room_seq"`
+	Seq     uint64 `gorm:"index:idx_room_events_room_seq"`
+	Type    string
+	Route   string
+	Payload []byte
+	// Payload for clients of the JSON websocket protocol
+	JSONPayload []byte
+	CreatedAt   time.Time `gorm:"index"`
+}
@@ -0,0 +1,15 @@
+package database
+
+import "time"
+
+// RoomPresence is the status of a user in a room as seen by one instance of
+// the app. Instances renew the lease of their rows while they run, rows of
+// instances which stopped count as offline.
+type RoomPresence struct {
+	InstanceID string `gorm:"primaryKey"`
+	RoomID     uint   `gorm:"primaryKey;autoIncrement:false"`
+	UserID     uint   `gorm:"primaryKey;autoIncrement:false"`
+	Status     string `gorm:"not null"`
+	LastSeen   time.Time
+	ExpiresAt  time.Time `gorm:"index"`
+}
@@ -10,17 +10,22 @@ import (
 
 type Ticket struct {
 	gorm.Model
-	Name          string
-	Description   string
-	JiraKey       *string
-	ClosedAt      *time.Time
-	Hidden        bool `gorm:"default:false"`
+	Name         string
+	Description  string
+	JiraKey      *string
+	ClosedAt     *time.Time
+	RevealedAt   *time.Time
+	Hidden       bool `gorm:"default:false"`
+	CurrentRound int  `gorm:"default:1"`
+	// When the voting timer of the current round runs out, nil if none runs
+	VotingEndsAt  *time.Time `gorm:"index"`
 	RoomID        uint
 	Room          Room `gorm:"foreignKey:RoomID"`
 	CreatedBy     uint
 	Estimates     []Estimate
 	LlmEstimateID *uint
 	LlmEstimate   *Estimate `gorm:"foreignKey:LlmEstimateID"`
+	LlmJob        *LLMJob   `gorm:"foreignKey:TicketID"`
 }
 
 type TicketWithEstimateStatistics struct {
@@ -28,12 +33,48 @@ type TicketWithEstimateStatistics struct {
 	AverageEstimate float64
 	MedianEstimate  float64
 	StdDevEstimate  float64
-	UsersEstimate   *int
-	EstimateCount   int
+	// Average uncertainty of the voters' three-point estimates
+	PertStdDev    float64
+	UsersEstimate *float64
+	// Kind of the user's estimate, nil if they didn't vote
+	UsersEstimateKind *EstimateKind
+	// Votes of the current round the statistics are computed from
+	ValueCount    int
+	EstimateCount int
+	// Voters in the room right now
+	PresentCount    int
 	UserCount       int
+	EstimationScale EstimationScale
+	CustomScale     string
+	ThreePoint      bool
+	// Consensus thresholds of the room
+	ConsensusSteps     int
+	NearConsensusSteps int
+	CreatedByName      string
+	CreatedByColor     string
+	// Votes of the current round, only loaded once they are revealed
+	Votes []Estimate `gorm:"-"`
+}
+
+// EveryoneVoted reports whether every voter present in the room voted. Nobody
+// being present doesn't count, or the first vote sent without a connection to
+// the room would finish voting.
+func (t *TicketWithEstimateStatistics) EveryoneVoted() bool {
+	return t.PresentCount > 0 && t.EstimateCount >= t.UserCount
+}
+
+// IsRevealed reports whether the votes of the current round can be shown.
+// Closing a ticket reveals its votes.
+func (t *Ticket) IsRevealed() bool {
+	return t.RevealedAt != nil || t.ClosedAt != nil
+}
+
+func (t *TicketWithEstimateStatistics) Deck() Deck {
+	return NewDeck(t.EstimationScale, t.CustomScale)
 }
 
 func (t *TicketWithEstimateStatistics) ToDetailProp(isOwner bool) ticket.TicketDetailProps {
+	deck := t.Deck()
 	ticket := &ticket.TicketDetailProps{
 		ID:              t.ID,
 		JiraKey:         t.JiraKey,
@@ -43,15 +84,60 @@ func (t *TicketWithEstimateStatistics) ToDetailProp(isOwner bool) ticket.TicketD
 		EstimatedBy:     fmt.Sprintf("%d/%d", t.EstimateCount, t.UserCount),
 		IsClosed:        t.ClosedAt != nil,
 		IsHidden:        t.Hidden,
-		AverageEstimate: prettyPrintEstimate(t.AverageEstimate),
-		MedianEstimate:  prettyPrintEstimate(t.MedianEstimate),
-		StdEstimate:     fmt.Sprintf("%.2fh", t.StdDevEstimate),
+		IsRevealed:      t.IsRevealed(),
+		AverageEstimate: deck.Format(t.AverageEstimate),
+		MedianEstimate:  deck.Format(t.MedianEstimate),
+		StdEstimate:     deck.FormatDeviation(t.StdDevEstimate),
 		HasEstimate:     t.UsersEstimate != nil,
+		EstimationCards: deck.CardLabels(),
+		Round:           t.CurrentRound,
+		ThreePoint:      t.ThreePoint,
+		VotingEndsAt:    t.VotingEndsAt,
+		CreatedBy: User{
+			Model:       gorm.Model{ID: t.CreatedBy},
+			DisplayName: t.CreatedByName,
+			Color:       t.CreatedByColor,
+		}.Avatar(),
+	}
+
+	if t.UsersEstimate != nil {
+		usersEstimate := Estimate{Estimate: *t.UsersEstimate}
+		if t.UsersEstimateKind != nil {
+			usersEstimate.Kind = *t.UsersEstimateKind
+		}
+		ticket.UserEstimate = fmt.Sprintf("Your estimate: %s", usersEstimate.Format(deck))
+	}
+
+	if ticket.IsRevealed {
+		consensus := ClassifyRound(deck, t.Votes, ConsensusThresholds{Consensus: t.ConsensusSteps, Near: t.NearConsensusSteps})
+		for _, vote := range t.Votes {
+			voteProps := vote.ToVoteProps(deck)
+			voteProps.Outlier = consensus.Outlier(vote)
+			ticket.Votes = append(ticket.Votes, voteProps)
+		}
+		ticket.Consensus = consensus.ToProps()
+		if t.ValueCount == 0 {
+			// Nobody gave a value, there is nothing to compute statistics from
+			ticket.AverageEstimate = "-"
+			ticket.MedianEstimate = "-"
+			ticket.StdEstimate = "-"
+		} else if t.ThreePoint {
+			ticket.ExpectedRange = deck.FormatRange(t.AverageEstimate, t.PertStdDev)
+		}
+	} else {
+		// Statistics anchor voters who haven't voted yet, so they are only sent once revealed
+		ticket.AverageEstimate = ""
+		ticket.MedianEstimate = ""
+		ticket.StdEstimate = ""
 	}
 
 	if t.LlmEstimate != nil {
-		prettyLlmEstimate := prettyPrintEstimate(float64(t.LlmEstimate.Estimate))
-		ticket.LlmEstimate = &prettyLlmEstimate
+		llmEstimate := ToLlmEstimateProps(deck, *t.LlmEstimate, t.LlmEstimate.Recommendation)
+		ticket.LlmEstimate = &llmEstimate
+	}
+
+	if isOwner && t.LlmJob != nil {
+		ticket.LlmJobStatus = t.LlmJob.StatusProps(false)
 	}
 
 	if !isOwner {
@@ -60,11 +146,3 @@ func (t *TicketWithEstimateStatistics) ToDetailProp(isOwner bool) ticket.TicketD
 
 	return *ticket
 }
-
-func prettyPrintEstimate(estimate float64) string {
-	weeks := int(estimate / 40)
-	days := int((int(estimate) % 40) / 8)
-	hours := int(estimate) % 8
-
-	return fmt.Sprintf("%dw %dd %dh", weeks, days, hours)
-}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/user"
+)
+
+// AvatarColors are the colors a user can pick for their avatar
+var AvatarColors = []string{
+	"#7c3aed",
+	"#db2777",
+	"#dc2626",
+	"#ea580c",
+	"#ca8a04",
+	"#16a34a",
+	"#0891b2",
+	"#2563eb",
+}
+
+func IsAvatarColor(color string) bool {
+	for _, c := range AvatarColors {
+		if c == color {
+			return true
+		}
+	}
+	return false
+}
+
+// Name returns the display name of the user, users who haven't picked one
+// are shown by their ID
+func (u User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return fmt.Sprintf("User #%d", u.ID)
+}
+
+// Initials returns up to two letters shown in the user's avatar
+func (u User) Initials() string {
+	if u.DisplayName == "" {
+		return "?"
+	}
+
+	initials := make([]rune, 0, 2)
+	for _, word := range strings.Fields(u.DisplayName) {
+		for _, r := range word {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				initials = append(initials, unicode.ToUpper(r))
+				break
+			}
+		}
+		if len(initials) == 2 {
+			break
+		}
+	}
+	if len(initials) == 0 {
+		return "?"
+	}
+	return string(initials)
+}
+
+// AvatarColor returns the picked color, or a color derived from the ID so the
+// user keeps the same color until they pick one
+func (u User) AvatarColor() string {
+	if IsAvatarColor(u.Color) {
+		return u.Color
+	}
+	return AvatarColors[u.ID%uint(len(AvatarColors))]
+}
+
+func (u User) Avatar() user.AvatarProps {
+	return user.AvatarProps{
+		Name:     u.Name(),
+		Initials: u.Initials(),
+		Color:    u.AvatarColor(),
+	}
+}
+
+func (u User) ToProfileProps() user.ProfileProps {
+	return user.ProfileProps{
+		Avatar:      u.Avatar(),
+		DisplayName: u.DisplayName,
+		Color:       u.AvatarColor(),
+		Colors:      AvatarColors,
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/markojerkic/spring-planing/internal/service"
+)
+
+// eventStreamConn sends the room events of the hub as server-sent events, for
+// clients behind proxies which don't let websockets through
+type eventStreamConn struct {
+	// The handler writes the stream's ID next to the hub's writer
+	mutex      sync.Mutex
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+	// Closed once the hub is done with the connection
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newEventStreamConn(writer http.ResponseWriter) *eventStreamConn {
+	return &eventStreamConn{
+		writer:     writer,
+		controller: http.NewResponseController(writer),
+		closed:     make(chan struct{}),
+	}
+}
+
+// writeEvent writes a single event, every line of the data prefixed with data:
+func (e *eventStreamConn) writeEvent(event string, id uint64, data []byte) error {
+	var frame bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&frame, "event: %s\n", event)
+	}
+	// Browsers send the last ID back when reconnecting, to get the missed events
+	if id != 0 {
+		fmt.Fprintf(&frame, "id: %d\n", id)
+	}
+	for line := range bytes.SplitSeq(data, []byte("\n")) {
+		frame.WriteString("data: ")
+		frame.Write(bytes.TrimSuffix(line, []byte("\r")))
+		frame.WriteString("\n")
+	}
+	frame.WriteString("\n")
+
+	return e.write(frame.Bytes())
+}
+
+func (e *eventStreamConn) write(frame []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if _, err := e.writer.Write(frame); err != nil {
+		return err
+	}
+	return e.controller.Flush()
+}
+
+func (e *eventStreamConn) WriteMessage(messageType int, data []byte) error {
+	if messageType == websocket.PingMessage {
+		// Comments keep proxies from closing the idle stream
+		return e.write([]byte(": ping\n\n"))
+	}
+	return e.writeEvent("", service.FrameSeq(data), data)
+}
+
+func (e *eventStreamConn) SetWriteDeadline(t time.Time) error {
+	return e.controller.SetWriteDeadline(t)
+}
+
+func (e *eventStreamConn) Close() error {
+	e.closeOnce.Do(func() { close(e.closed) })
+	return nil
+}
+
+var _ service.WebSocketConn = &eventStreamConn{}
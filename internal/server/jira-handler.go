@@ -41,7 +41,7 @@ func (j *JiraRouter) bulkImportJiraTicketsHandler(ctx echo.Context) error {
 
 	tickets, err := j.jiraService.BulkImportTickets(ctx, user.ID, uint(roomID), filter)
 	if err != nil {
-		return ctx.String(500, "Error bulk importing tickets")
+		return serviceError(ctx, err, "Error bulk importing tickets")
 	}
 
 	ctx.Response().Header().Add("Hx-Trigger", `{"createdTicket": true}`)
@@ -156,15 +156,19 @@ func (j *JiraRouter) writeEstimate(ctx echo.Context) error {
 		return ctx.String(500, "Error getting user")
 	}
 
-	ticket, err := j.ticketService.GetTicket(ctx.Request().Context(), j.db, user.ID, nil, uint(id))
+	ticket, err := j.ticketService.GetAuthorizedTicket(ctx.Request().Context(), user.ID, uint(id), service.ActionWriteJiraEstimate)
 	if err != nil {
-		slog.Error("Error getting ticket for estimate", slog.Any("error", err))
+		return serviceError(ctx, err, "Error getting ticket for estimate")
 	}
 
 	if ticket.JiraKey == nil {
 		return ctx.String(400, "Ticket is not linked to Jira")
 	}
 
+	if !ticket.Deck().IsTimeBased() {
+		return ctx.String(400, "Only estimates in hours can be written to Jira")
+	}
+
 	var estimateHours int
 	estimateType := ctx.Param("type")
 
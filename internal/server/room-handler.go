@@ -1,9 +1,11 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/markojerkic/spring-planing/cmd/web/components/room"
@@ -18,17 +20,30 @@ import (
 
 type RoomRouter struct {
 	roomService   *service.RoomService
+	members       *service.RoomMemberService
+	invites       *service.RoomInviteService
 	ticketService *service.TicketService
+	estimators    *service.Estimators
+	webSocket     *service.WebSocketService
 	db            *gorm.DB
 	group         *echo.Group
 }
 
 func (r *RoomRouter) createRoomHandler(ctx echo.Context) error {
 	user := ctx.Get("user").(database.User)
-	name := ctx.FormValue("roomName")
-	allowLLM := ctx.FormValue("allowLLM") == "on"
+	form := service.CreateRoomForm{
+		RoomName:        ctx.FormValue("roomName"),
+		AllowLLM:        ctx.FormValue("allowLLM") == "on",
+		EstimationScale: ctx.FormValue("estimationScale"),
+		CustomScale:     ctx.FormValue("customScale"),
+		ThreePoint:      ctx.FormValue("threePoint") == "on",
+		Passcode:        ctx.Request().PostFormValue("passcode"),
+	}
 
-	createdRoom, err := r.roomService.CreateRoom(ctx.Request().Context(), user.ID, name, allowLLM)
+	createdRoom, err := r.roomService.CreateRoom(ctx.Request().Context(), user.ID, form)
+	if errors.Is(err, database.ErrInvalidEstimationScale) {
+		return ctx.String(400, err.Error())
+	}
 	if err != nil {
 		ctx.Logger().Errorf("Error creating room: %v", err)
 		return ctx.String(500, "Error creating room")
@@ -38,14 +53,15 @@ func (r *RoomRouter) createRoomHandler(ctx echo.Context) error {
 }
 
 func (r *RoomRouter) roomTicketsHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
 	roomId, err := strconv.Atoi(ctx.Param("id"))
 	if err != nil {
 		return ctx.String(400, "Invalid room id")
 	}
 
-	tickets, err := r.roomService.GetTicketList(ctx.Request().Context(), uint(roomId))
+	tickets, err := r.roomService.GetTicketList(ctx.Request().Context(), uint(roomId), user.ID)
 	if err != nil {
-		return ctx.String(500, "Error getting tickets")
+		return serviceError(ctx, err, "Error getting tickets")
 	}
 	return ctx.JSON(200, tickets)
 }
@@ -59,22 +75,83 @@ func (r *RoomRouter) roomDetailsHandler(ctx echo.Context) error {
 		return ctx.String(400, "Invalid room id")
 	}
 
+	// Read before loading the room, so events sent while the page loads are replayed
+	lastEventSeq := r.webSocket.LastSeq(ctx.Request().Context(), uint(roomID))
+
 	roomDetails, err := r.roomService.GetRoom(ctx.Request().Context(), uint(roomID), user.ID)
+	if errors.Is(err, service.ErrForbidden) {
+		ctx.Response().WriteHeader(403)
+		return room.NoRoomAccessPage("Ask a member of the room for an invite link.").
+			Render(ctx.Request().Context(), ctx.Response().Writer)
+	}
 	if err != nil {
 		ctx.Logger().Errorf("Error getting room: %v", err)
 		util.AddToastHeader(ctx, "Room not found", util.INFO)
 		return ctx.String(500, "Error getting room")
 	}
 
+	role, err := r.roomService.Authorize(ctx.Request().Context(), uint(roomID), user.ID, service.ActionViewRoom)
+	if err != nil {
+		return serviceError(ctx, err, "Error getting room")
+	}
+	// Moderators run the estimation like owners, but only owners manage the room
+	isFacilitator := service.RoleCan(role, service.ActionCloseTicket)
+	isOwner := service.RoleCan(role, service.ActionManageMembers)
+
 	tickets := roomDetails.TicketsWithStatistics
 	ticketDetails := make([]ticket.TicketDetailProps, len(tickets))
-	isOwner := roomDetails.CreatedBy == user.ID
 	for i, t := range tickets {
-		ticketDetails[i] = t.ToDetailProp(isOwner)
+		ticketDetails[i] = t.ToDetailProp(isFacilitator)
+		ticketDetails[i].IsObserver = role == service.RoleObserver
+		if isOwner && t.LlmJob != nil {
+			ticketDetails[i].LlmJobStatus = t.LlmJob.StatusProps(true)
+		}
+	}
+
+	activeTicket, err := r.ticketService.GetActiveTicket(ctx.Request().Context(), uint(roomID), user.ID)
+	if err != nil {
+		ctx.Logger().Errorf("Error getting active ticket: %v", err)
 	}
 
 	totalEstimated, err := r.roomService.GetTotalEstimateOfRoom(ctx.Request().Context(), uint(roomID))
 
+	presence, err := r.roomService.GetPresenceRoster(ctx.Request().Context(), uint(roomID))
+	if err != nil {
+		ctx.Logger().Errorf("Error getting presence roster: %v", err)
+	}
+
+	var llmAccuracy room.LlmAccuracyProps
+	if isOwner {
+		llmAccuracy, err = r.roomService.GetLLMAccuracy(ctx.Request().Context(), uint(roomID))
+		if err != nil {
+			ctx.Logger().Errorf("Error getting LLM accuracy: %v", err)
+		}
+	}
+
+	var members room.MembersProps
+	var invites room.InvitesProps
+	if isOwner {
+		members, err = r.members.GetMembers(ctx.Request().Context(), uint(roomID), user.ID)
+		if err != nil {
+			ctx.Logger().Errorf("Error getting room members: %v", err)
+		}
+		invites, err = r.invites.GetInvites(ctx.Request().Context(), uint(roomID), user.ID)
+		if err != nil {
+			ctx.Logger().Errorf("Error getting room invites: %v", err)
+		}
+	}
+	shareLink, err := r.invites.ShareLink(ctx.Request().Context(), uint(roomID), user.ID)
+	if err != nil {
+		ctx.Logger().Errorf("Error getting share link: %v", err)
+	}
+
+	owner := database.User{Model: gorm.Model{ID: roomDetails.CreatedBy}}
+	for _, u := range roomDetails.Users {
+		if u.ID == roomDetails.CreatedBy {
+			owner = u
+		}
+	}
+
 	_, isJiraUser := ctx.Get(auth.JiraClientInfoKey).(*auth.JiraClientInfo)
 	return room.RoomPage(room.RoomPageProps{
 		ID:                 roomDetails.ID,
@@ -83,9 +160,29 @@ func (r *RoomRouter) roomDetailsHandler(ctx echo.Context) error {
 		IsCurrentUserOwner: isOwner,
 		TotalEstimated:     totalEstimated,
 		IsJiraUser:         isJiraUser,
-		IsLlmEnabled:       roomDetails.AllowLLMEstimation,
+		LlmSettings:        r.llmSettings(*roomDetails),
+		LlmAccuracy:        llmAccuracy,
+		LastEventSeq:       lastEventSeq,
 		Tickets:            ticketDetails,
-	}, isOwner).Render(ctx.Request().Context(), ctx.Response().Writer)
+		ActiveTicket:       activeTicket,
+		Voting: room.VotingSettingsProps{
+			RoomID:       roomDetails.ID,
+			TimerSeconds: roomDetails.VotingTimerSeconds,
+			AutoFinish:   string(roomDetails.AutoFinish),
+		},
+		Consensus: room.ConsensusSettingsProps{
+			RoomID:             roomDetails.ID,
+			ConsensusSteps:     roomDetails.ConsensusSteps,
+			NearConsensusSteps: roomDetails.NearConsensusSteps,
+		},
+		Presence:      presence,
+		Members:       members,
+		Invites:       invites,
+		ShareLink:     shareLink,
+		Owner:         owner.Avatar(),
+		CurrentUser:   user.ToProfileProps(),
+		PromptProfile: user.DisplayName == "",
+	}, isFacilitator).Render(ctx.Request().Context(), ctx.Response().Writer)
 }
 
 func (r *RoomRouter) deleteRoomHandler(ctx echo.Context) error {
@@ -97,7 +194,7 @@ func (r *RoomRouter) deleteRoomHandler(ctx echo.Context) error {
 	user := ctx.Get("user").(database.User)
 	rooms, err := r.roomService.DeleteRoom(ctx.Request().Context(), uint(id), user.ID)
 	if err != nil {
-		return ctx.String(500, "Error deleting room")
+		return serviceError(ctx, err, "Error deleting room")
 	}
 
 	return homepage.RoomsPage(rooms, user.ID).Render(ctx.Request().Context(), ctx.Response().Writer)
@@ -110,29 +207,16 @@ func (r *RoomRouter) allowLlmEstimationHandler(ctx echo.Context) error {
 		return ctx.String(400, "Invalid room id")
 	}
 	allowLlmEstimation := ctx.FormValue("allowLLM") == "on"
-	slog.Debug("Allow LLM estimation", "roomId", roomID, "allowLlmEstimation", allowLlmEstimation)
-
-	if err := r.db.WithContext(ctx.Request().Context()).
-		Transaction(func(tx *gorm.DB) error {
-			var room database.Room
-			if err := tx.First(&room, uint(roomID)).Error; err != nil {
-				return err
-			}
+	llmProvider := ctx.FormValue("llmProvider")
+	slog.Debug("Allow LLM estimation", "roomId", roomID, "allowLlmEstimation", allowLlmEstimation, "llmProvider", llmProvider)
 
-			if room.CreatedBy != user.ID {
-				return gorm.ErrRecordNotFound
-			}
-
-			if err := tx.Model(&database.Room{}).
-				Where("id = ?", roomID).
-				Update("allow_llm_estimation", allowLlmEstimation).Error; err != nil {
-				return err
-			}
+	if llmProvider != "" && !r.estimators.IsConfigured(llmProvider) {
+		return ctx.String(400, "Unknown LLM provider")
+	}
 
-			return nil
-		}); err != nil {
-		slog.Error("Error updating room", "error", err)
-		return ctx.String(500, "Error updating room")
+	updatedRoom, err := r.roomService.UpdateLLMSettings(ctx.Request().Context(), uint(roomID), user.ID, allowLlmEstimation, llmProvider)
+	if err != nil {
+		return serviceError(ctx, err, "Error updating room")
 	}
 
 	var toastMessage string
@@ -146,16 +230,283 @@ func (r *RoomRouter) allowLlmEstimationHandler(ctx echo.Context) error {
 		return ctx.String(500, "Error adding toast header")
 	}
 
-	return room.AllowLlmEstimationForm(allowLlmEstimation).Render(ctx.Request().Context(), ctx.Response().Writer)
+	return room.LlmSettings(r.llmSettings(*updatedRoom)).Render(ctx.Request().Context(), ctx.Response().Writer)
+}
+
+func (r *RoomRouter) llmAccuracyHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+
+	report, err := r.roomService.GetOwnerLLMAccuracy(ctx.Request().Context(), user.ID)
+	if err != nil {
+		ctx.Logger().Errorf("Error getting LLM accuracy: %v", err)
+		return ctx.String(500, "Error getting LLM accuracy")
+	}
+
+	return room.LlmAccuracyPage(report).Render(ctx.Request().Context(), ctx.Response().Writer)
+}
+
+func (r *RoomRouter) setMemberRoleHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	memberID, err := strconv.Atoi(ctx.Param("userID"))
+	if err != nil {
+		return ctx.String(400, "Invalid user id")
+	}
+	role, err := service.ParseRoomRole(ctx.FormValue("role"))
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	err = r.members.SetRole(ctx.Request().Context(), uint(roomID), user.ID, uint(memberID), role)
+	if errors.Is(err, service.ErrInvalidRole) || errors.Is(err, service.ErrOwnerRole) {
+		util.AddToastHeader(ctx, err.Error(), util.ERROR)
+		return ctx.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(ctx, err, "Error changing role")
+	}
+
+	members, err := r.members.GetMembers(ctx.Request().Context(), uint(roomID), user.ID)
+	if err != nil {
+		return serviceError(ctx, err, "Error getting room members")
+	}
+	util.AddToastHeader(ctx, "Role changed", util.INFO)
+	return room.Members(members).Render(ctx.Request().Context(), ctx.Response().Writer)
+}
+
+func (r *RoomRouter) transferOwnershipHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	newOwnerID, err := strconv.Atoi(ctx.FormValue("userId"))
+	if err != nil {
+		return ctx.String(400, "Invalid user id")
+	}
+
+	if err := r.members.TransferOwnership(ctx.Request().Context(), uint(roomID), user.ID, uint(newOwnerID)); err != nil {
+		return serviceError(ctx, err, "Error transferring the room")
+	}
+
+	ctx.Response().Header().Set("HX-Refresh", "true")
+	return ctx.NoContent(200)
+}
+
+// joinRoomHandler joins the room with the invite link, asking for the
+// passcode if the room has one
+func (r *RoomRouter) joinRoomHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	token := ctx.Param("token")
+
+	// Only read from the body, passcodes in the query string end up in logs
+	roomID, err := r.invites.Join(ctx.Request().Context(), token, user.ID, ctx.Request().PostFormValue("passcode"))
+	if errors.Is(err, service.ErrInvalidInvite) {
+		ctx.Response().WriteHeader(404)
+		return room.NoRoomAccessPage(err.Error()).Render(ctx.Request().Context(), ctx.Response().Writer)
+	}
+	if errors.Is(err, service.ErrPasscodeRequired) || errors.Is(err, service.ErrWrongPasscode) || errors.Is(err, service.ErrTooManyAttempts) {
+		invitedRoom, roomErr := r.invites.InvitedRoom(ctx.Request().Context(), token)
+		if roomErr != nil {
+			return serviceError(ctx, roomErr, "Error joining room")
+		}
+		props := room.JoinRoomProps{Token: token, RoomName: invitedRoom.Name}
+		if !errors.Is(err, service.ErrPasscodeRequired) {
+			props.Error = err.Error()
+		}
+		if errors.Is(err, service.ErrTooManyAttempts) {
+			ctx.Response().WriteHeader(429)
+		}
+		return room.JoinRoomPage(props).Render(ctx.Request().Context(), ctx.Response().Writer)
+	}
+	if err != nil {
+		return serviceError(ctx, err, "Error joining room")
+	}
+
+	return ctx.Redirect(302, fmt.Sprintf("/room/%d", roomID))
+}
+
+func (r *RoomRouter) renderInvites(ctx echo.Context, roomID uint, userID uint) error {
+	invites, err := r.invites.GetInvites(ctx.Request().Context(), roomID, userID)
+	if err != nil {
+		return serviceError(ctx, err, "Error getting invites")
+	}
+	return room.Invites(invites).Render(ctx.Request().Context(), ctx.Response().Writer)
+}
+
+func (r *RoomRouter) createInviteHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	role, err := service.ParseRoomRole(ctx.FormValue("role"))
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+	var validFor time.Duration
+	if value := ctx.FormValue("validFor"); value != "" {
+		if validFor, err = time.ParseDuration(value); err != nil {
+			return ctx.String(400, "Invalid expiry")
+		}
+	}
+
+	_, err = r.invites.CreateInvite(ctx.Request().Context(), uint(roomID), user.ID, role, validFor)
+	if errors.Is(err, service.ErrInvalidRole) || errors.Is(err, service.ErrInvalidValidity) {
+		return ctx.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(ctx, err, "Error creating invite")
+	}
+
+	util.AddToastHeader(ctx, "Invite link created", util.INFO)
+	return r.renderInvites(ctx, uint(roomID), user.ID)
+}
+
+func (r *RoomRouter) revokeInviteHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	inviteID, err := strconv.Atoi(ctx.Param("inviteID"))
+	if err != nil {
+		return ctx.String(400, "Invalid invite id")
+	}
+
+	if err := r.invites.RevokeInvite(ctx.Request().Context(), uint(roomID), user.ID, uint(inviteID)); err != nil {
+		return serviceError(ctx, err, "Error revoking invite")
+	}
+
+	util.AddToastHeader(ctx, "Invite link revoked", util.INFO)
+	return r.renderInvites(ctx, uint(roomID), user.ID)
+}
+
+func (r *RoomRouter) setPasscodeHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	passcode := ctx.Request().PostFormValue("passcode")
+
+	if err := r.invites.SetPasscode(ctx.Request().Context(), uint(roomID), user.ID, passcode); err != nil {
+		return serviceError(ctx, err, "Error changing passcode")
+	}
+
+	if passcode == "" {
+		util.AddToastHeader(ctx, "Passcode removed", util.INFO)
+	} else {
+		util.AddToastHeader(ctx, "Passcode changed", util.INFO)
+	}
+	return r.renderInvites(ctx, uint(roomID), user.ID)
+}
+
+func (r *RoomRouter) setFacilitatedHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	facilitated := ctx.FormValue("facilitated") == "on"
+
+	// The active ticket is sent to every connection in the room, including the owner's
+	if err := r.ticketService.SetFacilitated(ctx.Request().Context(), uint(roomID), user.ID, facilitated); err != nil {
+		return serviceError(ctx, err, "Error changing facilitation")
+	}
+
+	if facilitated {
+		util.AddToastHeader(ctx, "Estimating one ticket at a time", util.INFO)
+	} else {
+		util.AddToastHeader(ctx, "Every open ticket can be estimated", util.INFO)
+	}
+	return ctx.NoContent(204)
+}
+
+func (r *RoomRouter) votingSettingsHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	timerSeconds, err := strconv.Atoi(ctx.FormValue("timerSeconds"))
+	if err != nil {
+		return ctx.String(400, "Invalid timer length")
+	}
+	autoFinish, err := service.ParseAutoFinish(ctx.FormValue("autoFinish"))
+	if err != nil {
+		return ctx.String(400, err.Error())
+	}
+
+	err = r.ticketService.UpdateVotingSettings(ctx.Request().Context(), uint(roomID), user.ID,
+		time.Duration(timerSeconds)*time.Second, autoFinish)
+	if errors.Is(err, service.ErrInvalidTimer) {
+		return ctx.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(ctx, err, "Error updating voting settings")
+	}
+
+	util.AddToastHeader(ctx, "Voting settings saved", util.INFO)
+	return ctx.NoContent(204)
+}
+
+func (r *RoomRouter) consensusSettingsHandler(ctx echo.Context) error {
+	user := ctx.Get("user").(database.User)
+	roomID, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil {
+		return ctx.String(400, "Invalid room id")
+	}
+	consensusSteps, err := strconv.Atoi(ctx.FormValue("consensusSteps"))
+	if err != nil {
+		return ctx.String(400, "Invalid consensus threshold")
+	}
+	nearConsensusSteps, err := strconv.Atoi(ctx.FormValue("nearConsensusSteps"))
+	if err != nil {
+		return ctx.String(400, "Invalid near consensus threshold")
+	}
+
+	err = r.ticketService.UpdateConsensusThresholds(ctx.Request().Context(), uint(roomID), user.ID,
+		database.ConsensusThresholds{Consensus: consensusSteps, Near: nearConsensusSteps})
+	if errors.Is(err, service.ErrInvalidConsensus) {
+		return ctx.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(ctx, err, "Error updating consensus thresholds")
+	}
+
+	util.AddToastHeader(ctx, "Consensus thresholds saved", util.INFO)
+	return ctx.NoContent(204)
+}
+
+func (r *RoomRouter) llmSettings(roomDetails database.Room) room.LlmSettingsProps {
+	return room.LlmSettingsProps{
+		Enabled:         roomDetails.AllowLLMEstimation,
+		TimeBased:       roomDetails.Deck().IsTimeBased(),
+		Provider:        roomDetails.LLMProvider,
+		DefaultProvider: r.estimators.Default(),
+		Providers:       r.estimators.Providers(),
+	}
 }
 
 func newRoomRouter(roomService *service.RoomService,
+	members *service.RoomMemberService,
+	invites *service.RoomInviteService,
 	ticketService *service.TicketService,
+	estimators *service.Estimators,
+	webSocket *service.WebSocketService,
 	db *gorm.DB,
 	group *echo.Group) *RoomRouter {
 	r := &RoomRouter{
 		roomService:   roomService,
+		members:       members,
+		invites:       invites,
 		ticketService: ticketService,
+		estimators:    estimators,
+		webSocket:     webSocket,
 		db:            db,
 		group:         group,
 	}
@@ -165,6 +516,9 @@ func newRoomRouter(roomService *service.RoomService,
 		return room.CreateRoom(isJiraUser).Render(c.Request().Context(), c.Response().Writer)
 	})
 	e.POST("", r.createRoomHandler)
+	e.GET("/llm-accuracy", r.llmAccuracyHandler)
+	e.GET("/join/:token", r.joinRoomHandler)
+	e.POST("/join/:token", r.joinRoomHandler)
 	e.GET("/:id", func(c echo.Context) error {
 		if c.Request().Header.Get("Accept") == "application/json" {
 			return r.roomTicketsHandler(c)
@@ -174,6 +528,14 @@ func newRoomRouter(roomService *service.RoomService,
 	})
 	e.DELETE("/:id", r.deleteRoomHandler)
 	e.POST("/allow-llm-estimation", r.allowLlmEstimationHandler)
+	e.POST("/:id/members/:userID", r.setMemberRoleHandler)
+	e.POST("/:id/owner", r.transferOwnershipHandler)
+	e.POST("/:id/invites", r.createInviteHandler)
+	e.DELETE("/:id/invites/:inviteID", r.revokeInviteHandler)
+	e.POST("/:id/passcode", r.setPasscodeHandler)
+	e.POST("/:id/facilitation", r.setFacilitatedHandler)
+	e.POST("/:id/voting", r.votingSettingsHandler)
+	e.POST("/:id/consensus", r.consensusSettingsHandler)
 
 	return r
 }
@@ -39,18 +39,37 @@ func (s *Server) RegisterRoutes() http.Handler {
 	fileServer := http.FileServer(http.FS(web.Files))
 	e.GET("/assets/*", echo.WrapHandler(fileServer))
 
-	roomTicketService := service.NewRoomTicketService(s.db)
-	roomService := service.NewRoomService(s.db, roomTicketService)
-	websocketService := service.NewWebSocketService(roomService)
-	llmService := service.NewLLMService(websocketService, s.db)
+	presenceStore, err := service.NewPresenceStoreFromEnv(s.db)
+	if err != nil {
+		panic(err)
+	}
+	presenceService := service.NewPresenceServiceWithStore(presenceStore)
+	roomTicketService := service.NewRoomTicketService(s.db, presenceService)
+	roomService := service.NewRoomService(s.db, roomTicketService, presenceService)
+	backplane, err := service.NewBackplaneFromEnv(s.db)
+	if err != nil {
+		panic(err)
+	}
+	websocketService := service.NewWebSocketService(roomService, presenceService, backplane)
+	estimators, err := service.NewEstimatorsFromEnv()
+	if err != nil {
+		panic(err)
+	}
+	llmService := service.NewLLMService(websocketService, s.db, estimators)
 	ticketService := service.NewTicketService(s.db, roomTicketService, llmService, websocketService)
+	websocketService.OnCommand(service.NewWebSocketCommandService(s.db, ticketService, roomService, presenceService, websocketService))
+	service.NewVotingTimerService(s.db, ticketService)
 	jiraService := service.NewJiraService(ticketService)
+	userService := service.NewUserService(s.db)
+	roomMemberService := service.NewRoomMemberService(s.db, websocketService)
+	roomInviteService := service.NewRoomInviteService(s.db)
 
 	auth.NewOAuthRouter(e.Group("/auth/jira"))
-	newRoomRouter(roomService, ticketService, s.db.DB, e.Group("/room"))
+	newRoomRouter(roomService, roomMemberService, roomInviteService, ticketService, estimators, websocketService, s.db.DB, e.Group("/room"))
 	newTicketRouter(ticketService, jiraService, s.db.DB, e.Group("/ticket"))
 	newWebsocketRouter(websocketService, roomService, e.Group("/ws"))
 	newJiraRouter(jiraService, s.db.DB, e.Group("/jira"))
+	newUserRouter(userService, websocketService, e.Group("/user"))
 	e.GET("/", homepage.HomepageHandler(roomService))
 	e.GET("/rooms", homepage.RoomsHandler(roomService))
 	e.GET("/privacy", echo.WrapHandler(templ.Handler(privacy.PrivacyPage())))
@@ -126,6 +126,12 @@ func (s *Server) cleanup(ctx context.Context) error {
 			slog.Error("Failed to delete rooms", slog.Any("error", err))
 			return err
 		}
+		// Realtime events are only needed while they're being delivered
+		if err := tx.Where("created_at < NOW() - INTERVAL '1 day'").
+			Delete(&database.RoomEvent{}).Error; err != nil {
+			slog.Error("Failed to delete room events", slog.Any("error", err))
+			return err
+		}
 		// Delete users which have no non-deleted rooms or estimates
 		if err := tx.Model(&database.User{}).
 			Where("id NOT IN (SELECT user_id FROM estimates WHERE user_id IS NOT NULL AND deleted_at IS NULL)").
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/labstack/echo/v4"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"gorm.io/gorm"
+)
+
+// serviceError responds to an error of the service layer, telling the user
+// when they aren't allowed to do something or it doesn't exist
+func serviceError(c echo.Context, err error, message string) error {
+	switch {
+	case errors.Is(err, service.ErrForbidden):
+		return c.String(403, "You are not allowed to do this in this room")
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.String(404, "Not found")
+	default:
+		c.Logger().Errorf("%s: %v", message, err)
+		return c.String(500, message)
+	}
+}
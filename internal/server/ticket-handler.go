@@ -1,8 +1,11 @@
 package server
 
 import (
+	"errors"
+	"fmt"
 	"log/slog"
 	"strconv"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
@@ -31,9 +34,11 @@ func (r *TicketRouter) estimateTicketHandler(c echo.Context) error {
 	user := c.Get("user").(database.User)
 
 	estimate, err := r.ticketService.EstimateTicket(c.Request().Context(), user.ID, form)
+	if errors.Is(err, service.ErrInvalidEstimate) {
+		return c.String(400, "Invalid estimate")
+	}
 	if err != nil {
-		c.Logger().Errorf("Error estimating ticket: %v", err)
-		return c.String(500, "Error estimating ticket")
+		return serviceError(c, err, "Error estimating ticket")
 	}
 
 	util.AddToastHeader(c, "Estimate submitted successfully!", util.INFO)
@@ -55,8 +60,7 @@ func (r *TicketRouter) createTicketHandler(c echo.Context) error {
 
 	_, allTickets, err := r.ticketService.CreateTicket(c, user.ID, form)
 	if err != nil {
-		c.Logger().Errorf("Error creating ticket: %v", err)
-		return c.String(500, "Error creating ticket")
+		return serviceError(c, err, "Error creating ticket")
 	}
 
 	tickets := make([]ticket.TicketDetailProps, len(allTickets))
@@ -77,9 +81,10 @@ func (r *TicketRouter) ticketEstimatesHandler(c echo.Context) error {
 	if err != nil {
 		return c.String(400, "Invalid ticket id")
 	}
-	estimates, err := r.ticketService.GetTicketEstimates(c.Request().Context(), int32(ticketID))
+	user := c.Get("user").(database.User)
+	estimates, err := r.ticketService.GetTicketEstimates(c.Request().Context(), int32(ticketID), user.ID)
 	if err != nil {
-		return c.String(500, "Error getting ticket estimates")
+		return serviceError(c, err, "Error getting ticket estimates")
 	}
 
 	return ticket.EstimatesPopupContent(estimates).Render(c.Request().Context(), c.Response().Writer)
@@ -92,8 +97,12 @@ func (r *TicketRouter) closeTicketHandler(c echo.Context) error {
 	}
 	user := c.Get("user").(database.User)
 
-	if _, err := r.ticketService.CloseTicket(c.Request().Context(), uint(ticketID), user.ID); err != nil {
-		return c.String(500, "Error closing ticket")
+	_, err = r.ticketService.CloseTicket(c.Request().Context(), uint(ticketID), user.ID)
+	if errors.Is(err, service.ErrInvalidTicket) {
+		return c.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(c, err, "Error closing ticket")
 	}
 
 	ticketDetail, err := r.ticketService.GetTicket(c.Request().Context(), r.db, user.ID, nil, uint(ticketID))
@@ -108,6 +117,163 @@ func (r *TicketRouter) closeTicketHandler(c echo.Context) error {
 	return ticket.TicketDetail(ticketDetail.ToDetailProp(true), true).Render(c.Request().Context(), c.Response().Writer)
 }
 
+func (r *TicketRouter) reopenTicketHandler(c echo.Context) error {
+	ticketID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.String(400, "Invalid ticket id")
+	}
+	user := c.Get("user").(database.User)
+
+	ticketDetail, err := r.ticketService.ReopenTicket(c.Request().Context(), uint(ticketID), user.ID)
+	if errors.Is(err, service.ErrInvalidTicket) {
+		return c.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(c, err, "Error reopening ticket")
+	}
+
+	util.AddToastHeader(c, "Ticket reopened!", util.INFO)
+
+	return ticket.TicketDetail(ticketDetail.ToDetailProp(true), true).Render(c.Request().Context(), c.Response().Writer)
+}
+
+func (r *TicketRouter) updateTicketHandler(c echo.Context) error {
+	var form service.UpdateTicketForm
+	if err := c.Bind(&form); err != nil {
+		return c.String(400, "Invalid request")
+	}
+	if err := c.Validate(form); err != nil {
+		c.Logger().Errorf("Error validating form: %v", err)
+		return c.String(400, "Form validation failed. Please check your input.")
+	}
+	user := c.Get("user").(database.User)
+
+	// The new name and description are sent to every connection in the room, including the owner's
+	_, err := r.ticketService.UpdateTicket(c.Request().Context(), user.ID, form)
+	if errors.Is(err, service.ErrInvalidTicket) {
+		return c.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(c, err, "Error updating ticket")
+	}
+
+	util.AddToastHeader(c, "Ticket updated!", util.INFO)
+
+	return c.NoContent(204)
+}
+
+func (r *TicketRouter) deleteTicketHandler(c echo.Context) error {
+	ticketID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.String(400, "Invalid ticket id")
+	}
+	user := c.Get("user").(database.User)
+
+	// The ticket is removed from every page of the room, including the owner's
+	if err := r.ticketService.DeleteTicket(c.Request().Context(), uint(ticketID), user.ID); err != nil {
+		return serviceError(c, err, "Error deleting ticket")
+	}
+
+	util.AddToastHeader(c, "Ticket deleted!", util.INFO)
+
+	return c.NoContent(204)
+}
+
+func (r *TicketRouter) activateTicketHandler(c echo.Context) error {
+	ticketID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.String(400, "Invalid ticket id")
+	}
+	user := c.Get("user").(database.User)
+
+	// The active ticket is sent to every connection in the room, including the owner's
+	err = r.ticketService.SetActiveTicket(c.Request().Context(), uint(ticketID), user.ID)
+	if errors.Is(err, service.ErrInvalidTicket) {
+		return c.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(c, err, "Error setting active ticket")
+	}
+
+	return c.NoContent(204)
+}
+
+func (r *TicketRouter) startTimerHandler(c echo.Context) error {
+	ticketID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.String(400, "Invalid ticket id")
+	}
+	var seconds int
+	if s := c.FormValue("seconds"); s != "" {
+		if seconds, err = strconv.Atoi(s); err != nil {
+			return c.String(400, "Invalid timer length")
+		}
+	}
+	user := c.Get("user").(database.User)
+
+	// The countdown is sent to every connection in the room, including the owner's
+	_, err = r.ticketService.StartVotingTimer(c.Request().Context(), uint(ticketID), user.ID, time.Duration(seconds)*time.Second)
+	if errors.Is(err, service.ErrInvalidTimer) {
+		return c.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(c, err, "Error starting timer")
+	}
+
+	return c.NoContent(204)
+}
+
+func (r *TicketRouter) stopTimerHandler(c echo.Context) error {
+	ticketID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.String(400, "Invalid ticket id")
+	}
+	user := c.Get("user").(database.User)
+
+	if err := r.ticketService.StopVotingTimer(c.Request().Context(), uint(ticketID), user.ID); err != nil {
+		return serviceError(c, err, "Error stopping timer")
+	}
+
+	return c.NoContent(204)
+}
+
+func (r *TicketRouter) newRoundHandler(c echo.Context) error {
+	ticketID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.String(400, "Invalid ticket id")
+	}
+	user := c.Get("user").(database.User)
+
+	ticketDetail, err := r.ticketService.StartNewRound(c.Request().Context(), uint(ticketID), user.ID)
+	if errors.Is(err, service.ErrInvalidTicket) {
+		return c.String(400, err.Error())
+	}
+	if err != nil {
+		return serviceError(c, err, "Error starting new round")
+	}
+
+	util.AddToastHeader(c, fmt.Sprintf("Round %d started!", ticketDetail.CurrentRound), util.INFO)
+
+	return ticket.TicketDetail(ticketDetail.ToDetailProp(true), true).Render(c.Request().Context(), c.Response().Writer)
+}
+
+func (r *TicketRouter) revealTicketHandler(c echo.Context) error {
+	ticketID, err := strconv.Atoi(c.FormValue("id"))
+	if err != nil {
+		return c.String(400, "Invalid ticket id")
+	}
+	user := c.Get("user").(database.User)
+
+	// The revealed ticket is sent to every connection in the room, including the owner's
+	if _, err := r.ticketService.RevealTicket(c.Request().Context(), uint(ticketID), user.ID); err != nil {
+		return serviceError(c, err, "Error revealing votes")
+	}
+
+	util.AddToastHeader(c, "Votes revealed!", util.INFO)
+
+	return c.NoContent(204)
+}
+
 func (r *TicketRouter) hideAllTicketsHandler(c echo.Context) error {
 	sRoomId := c.FormValue("roomId")
 	roomID, err := strconv.Atoi(sRoomId)
@@ -115,9 +281,11 @@ func (r *TicketRouter) hideAllTicketsHandler(c echo.Context) error {
 		return c.String(400, "Invalid room id")
 	}
 
-	err = r.ticketService.HideAllTickets(c.Request().Context(), uint(roomID))
+	user := c.Get("user").(database.User)
+
+	err = r.ticketService.HideAllTickets(c.Request().Context(), uint(roomID), user.ID)
 	if err != nil {
-		return c.String(500, "Error hiding ticket")
+		return serviceError(c, err, "Error hiding tickets")
 	}
 
 	return c.NoContent(204)
@@ -129,9 +297,11 @@ func (r *TicketRouter) hideTicketHandler(c echo.Context) error {
 	if err != nil {
 		return c.String(400, "Invalid ticket id")
 	}
-	updatedTicket, err := r.ticketService.HideTicket(c.Request().Context(), uint(ticketID))
+	user := c.Get("user").(database.User)
+
+	updatedTicket, err := r.ticketService.HideTicket(c.Request().Context(), uint(ticketID), user.ID)
 	if err != nil {
-		return c.String(500, "Error hiding ticket")
+		return serviceError(c, err, "Error hiding ticket")
 	}
 
 	if updatedTicket.Hidden {
@@ -159,6 +329,14 @@ func newTicketRouter(ticketService *service.TicketService,
 	e.POST("/hide-all", r.hideAllTicketsHandler)
 	e.POST("/estimate", r.estimateTicketHandler)
 	e.POST("/close", r.closeTicketHandler)
+	e.POST("/reopen", r.reopenTicketHandler)
+	e.POST("/update", r.updateTicketHandler)
+	e.POST("/delete", r.deleteTicketHandler)
+	e.POST("/activate", r.activateTicketHandler)
+	e.POST("/timer", r.startTimerHandler)
+	e.POST("/timer/stop", r.stopTimerHandler)
+	e.POST("/round", r.newRoundHandler)
+	e.POST("/reveal", r.revealTicketHandler)
 	e.GET("/estimates/:id", r.ticketEstimatesHandler)
 
 	return r
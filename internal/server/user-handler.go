@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/labstack/echo/v4"
+	"github.com/markojerkic/spring-planing/cmd/web/components/user"
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/markojerkic/spring-planing/internal/util"
+)
+
+type UserRouter struct {
+	userService      *service.UserService
+	websocketService *service.WebSocketService
+	group            *echo.Group
+}
+
+func (r *UserRouter) profileHandler(c echo.Context) error {
+	currentUser := c.Get("user").(database.User)
+
+	return user.ProfileForm(currentUser.ToProfileProps()).Render(c.Request().Context(), c.Response().Writer)
+}
+
+func (r *UserRouter) updateProfileHandler(c echo.Context) error {
+	currentUser := c.Get("user").(database.User)
+
+	var form service.UpdateProfileForm
+	if err := c.Bind(&form); err != nil {
+		return c.String(400, "Invalid form")
+	}
+
+	updatedUser, err := r.userService.UpdateProfile(c.Request().Context(), currentUser.ID, form)
+	if errors.Is(err, service.ErrInvalidProfile) {
+		util.AddToastHeader(c, err.Error(), util.ERROR)
+		return c.String(400, err.Error())
+	}
+	if err != nil {
+		c.Logger().Errorf("Error updating profile: %v", err)
+		return c.String(500, "Error updating profile")
+	}
+
+	// Rooms the user is in show the new name right away
+	go r.websocketService.SendPresenceOfUser(updatedUser.ID)
+
+	c.Response().Header().Set("HX-Trigger", `{"profileUpdated": true}`)
+	util.AddToastHeader(c, "Profile updated", util.INFO)
+	return user.UpdatedProfile(updatedUser.ToProfileProps()).Render(c.Request().Context(), c.Response().Writer)
+}
+
+func newUserRouter(userService *service.UserService, websocketService *service.WebSocketService, group *echo.Group) *UserRouter {
+	r := &UserRouter{
+		userService:      userService,
+		websocketService: websocketService,
+		group:            group,
+	}
+	e := r.group
+
+	e.GET("/profile", r.profileHandler)
+	e.POST("/profile", r.updateProfileHandler)
+
+	return r
+}
@@ -1,7 +1,11 @@
 package server
 
 import (
+	"errors"
+	"io"
+	"slices"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
@@ -15,9 +19,22 @@ type WebSocketRouter struct {
 	group       *echo.Group
 }
 
+// Largest message event stream clients can post
+const maxStreamMessageSize = 64 * 1024
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	Subprotocols:    []string{service.JSONSubprotocol},
+}
+
+// requestedSubprotocol returns the JSON subprotocol if the client asked for it,
+// the upgrader picks it in that case
+func requestedSubprotocol(c echo.Context) string {
+	if slices.Contains(websocket.Subprotocols(c.Request()), service.JSONSubprotocol) {
+		return service.JSONSubprotocol
+	}
+	return ""
 }
 
 func (r *WebSocketRouter) webSocketHandler(c echo.Context) error {
@@ -26,16 +43,103 @@ func (r *WebSocketRouter) webSocketHandler(c echo.Context) error {
 	if err != nil {
 		return c.String(400, "Invalid room roomID")
 	}
+	protocol, err := service.ParseProtocol(c.QueryParam("protocol"), requestedSubprotocol(c))
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+
+	role, err := r.roomService.Authorize(c.Request().Context(), uint(roomId), user.ID, service.ActionViewRoom)
+	if err != nil {
+		return serviceError(c, err, "Error joining room")
+	}
 
 	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
-	isOwner := r.roomService.GetIsOwner(c.Request().Context(), uint(roomId), user.ID)
-	r.service.Register(conn, uint(roomId), isOwner)
 
+	// Set by reconnecting clients to get the events they missed
+	var lastSeq *uint64
+	if seq, err := strconv.ParseUint(c.QueryParam("lastSeq"), 10, 64); err == nil {
+		lastSeq = &seq
+	}
+	r.service.Register(conn, uint(roomId), user.ID, role, protocol, lastSeq)
+
+	return nil
+
+}
+
+// eventStreamHandler streams the room events as server-sent events, for
+// clients which can't open a websocket
+func (r *WebSocketRouter) eventStreamHandler(c echo.Context) error {
+	user := c.Get("user").(database.User)
+	roomId, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.String(400, "Invalid room roomID")
+	}
+	protocol, err := service.ParseProtocol(c.QueryParam("protocol"), "")
+	if err != nil {
+		return c.String(400, err.Error())
+	}
+	role, err := r.roomService.Authorize(c.Request().Context(), uint(roomId), user.ID, service.ActionViewRoom)
+	if err != nil {
+		return serviceError(c, err, "Error joining room")
+	}
+
+	// Browsers send the ID of the last event when reconnecting on their own
+	var lastSeq *uint64
+	if seq, err := strconv.ParseUint(c.Request().Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		lastSeq = &seq
+	} else if seq, err := strconv.ParseUint(c.QueryParam("lastSeq"), 10, 64); err == nil {
+		lastSeq = &seq
+	}
+
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, "text/event-stream")
+	header.Set(echo.HeaderCacheControl, "no-cache")
+	header.Set(echo.HeaderConnection, "keep-alive")
+	// Keeps nginx from buffering the stream
+	header.Set("X-Accel-Buffering", "no")
+	c.Response().WriteHeader(200)
+
+	conn := newEventStreamConn(c.Response())
+	client, streamID := r.service.RegisterStream(conn, uint(roomId), user.ID, role, protocol, lastSeq)
+	defer r.service.Disconnect(client)
+
+	// Tells the client where to post what it would send over a websocket
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := conn.writeEvent("stream", 0, []byte(streamID)); err != nil {
+		return nil
+	}
+
+	select {
+	case <-c.Request().Context().Done():
+	case <-conn.closed:
+	}
 	return nil
+}
+
+// postToStreamHandler takes the messages of event stream clients, the same
+// ones websocket clients send over the socket
+func (r *WebSocketRouter) postToStreamHandler(c echo.Context) error {
+	user := c.Get("user").(database.User)
+	data, err := io.ReadAll(io.LimitReader(c.Request().Body, maxStreamMessageSize))
+	if err != nil {
+		return c.String(400, "Invalid message")
+	}
+
+	if err := r.service.PostToStream(c.Param("streamID"), user.ID, data); err != nil {
+		if errors.Is(err, service.ErrStreamNotFound) {
+			return c.String(404, "Stream not found")
+		}
+		return c.String(500, "Error handling message")
+	}
+	return c.NoContent(202)
+}
 
+// protocolHandler documents the messages of the JSON protocol
+func (r *WebSocketRouter) protocolHandler(c echo.Context) error {
+	return c.JSON(200, service.JSONProtocolSchema())
 }
 
 func newWebsocketRouter(
@@ -49,7 +153,10 @@ func newWebsocketRouter(
 	}
 	e := r.group
 
+	e.GET("/protocol", r.protocolHandler)
 	e.GET("/:id", r.webSocketHandler)
+	e.GET("/:id/events", r.eventStreamHandler)
+	e.POST("/:id/events/:streamID", r.postToStreamHandler)
 
 	return r
 }
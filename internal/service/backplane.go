@@ -0,0 +1,614 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/markojerkic/spring-planing/internal/database"
+	"gorm.io/gorm"
+)
+
+const (
+	BackplaneLocal    = "local"
+	BackplanePostgres = "postgres"
+
+	roomEventsChannel  = "room_events"
+	roomNoticesChannel = "room_notices"
+	// NOTIFY payloads have to be shorter than 8000 bytes
+	roomNoticeMaximumSize = 7900
+	// Events kept per room for clients catching up after reconnecting
+	roomEventLogSize = 256
+	// Waits between attempts to listen again after losing the connection
+	backplaneRetryBase    = time.Second
+	backplaneRetryMaximum = 30 * time.Second
+	// Allowed difference between the clocks of the instances, when looking for
+	// events published while disconnected
+	backplaneClockSkew = time.Minute
+)
+
+type RoomEventType string
+
+const (
+	// The payload is sent as is to the matching connections of the room
+	RoomEventMessage RoomEventType = "message"
+	// Every instance renders the presence roster for its own connections, sent
+	// as a notice
+	RoomEventPresence RoomEventType = "presence"
+	// Every instance moves the connections of a member whose role changed
+	RoomEventRoleChanged RoomEventType = "roleChanged"
+	// The instance missed events of the room, its connections have to fetch the
+	// whole room again. Only delivered, never published.
+	RoomEventResync RoomEventType = "resync"
+)
+
+// ErrEventLogRolledOver means some of the requested events are no longer kept,
+// so the client has to fetch the whole room again
+var ErrEventLogRolledOver = errors.New("room event log rolled over")
+
+// RoomEvent is a realtime update for the connections of a room matching the route
+type RoomEvent struct {
+	Type   RoomEventType
+	RoomID uint
+	// Increases by one with every event of the room, set when publishing
+	Seq   uint64
+	Route Route
+	// The update for clients of the HTML protocol
+	Payload []byte
+	// The same update for clients of the JSON protocol
+	JSONPayload []byte
+}
+
+// Backplane delivers room events to every instance of the app, including the
+// one publishing them, so users connected to different instances see the same
+// updates. Events of a room are delivered in the order of their sequence numbers.
+type Backplane interface {
+	Publish(ctx context.Context, event RoomEvent) error
+	// Notify delivers the event without numbering or keeping it, for updates
+	// clients don't need to replay, like presence. It is delivered after the
+	// events of the room published before it.
+	Notify(ctx context.Context, event RoomEvent) error
+	// Subscribe sets the function events are delivered to. It is called once,
+	// before anything is published.
+	Subscribe(deliver func(RoomEvent))
+	// Watch delivers the events of the room to this instance from now on,
+	// called whenever a connection to the room registers
+	Watch(roomID uint)
+	// Forget stops delivering the room, once its last connection on this
+	// instance left
+	Forget(roomID uint)
+	// EventsSince returns the events of the room published after the sequence
+	// number, oldest first, or ErrEventLogRolledOver if some are no longer kept
+	EventsSince(ctx context.Context, roomID uint, seq uint64) ([]RoomEvent, error)
+	// LastSeq returns the sequence number of the newest event of the room
+	LastSeq(ctx context.Context, roomID uint) (uint64, error)
+}
+
+// checkEventLog returns ErrEventLogRolledOver unless the events are all the
+// events after seq, up to the last one
+func checkEventLog(seq uint64, lastSeq uint64, events []RoomEvent) error {
+	// The log was reset, e.g. after restarting with the local backplane
+	if seq > lastSeq {
+		return ErrEventLogRolledOver
+	}
+	if seq < lastSeq && (len(events) == 0 || events[0].Seq != seq+1) {
+		return ErrEventLogRolledOver
+	}
+	return nil
+}
+
+type localRoomLog struct {
+	mutex  sync.Mutex
+	seq    uint64
+	events []RoomEvent
+}
+
+// LocalBackplane delivers events within the process, for single instance deployments
+type LocalBackplane struct {
+	mutex   sync.Mutex
+	rooms   map[uint]*localRoomLog
+	deliver func(RoomEvent)
+}
+
+func (l *LocalBackplane) roomLog(roomID uint) *localRoomLog {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	log, ok := l.rooms[roomID]
+	if !ok {
+		log = &localRoomLog{}
+		l.rooms[roomID] = log
+	}
+	return log
+}
+
+func (l *LocalBackplane) Publish(ctx context.Context, event RoomEvent) error {
+	log := l.roomLog(event.RoomID)
+	// Held while delivering, so events of the room are delivered in order
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	log.seq++
+	event.Seq = log.seq
+	log.events = append(log.events, event)
+	if len(log.events) > roomEventLogSize {
+		log.events = log.events[len(log.events)-roomEventLogSize:]
+	}
+
+	if l.deliver != nil {
+		l.deliver(event)
+	}
+	return nil
+}
+
+func (l *LocalBackplane) Notify(ctx context.Context, event RoomEvent) error {
+	log := l.roomLog(event.RoomID)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	event.Seq = 0
+	if l.deliver != nil {
+		l.deliver(event)
+	}
+	return nil
+}
+
+func (l *LocalBackplane) Subscribe(deliver func(RoomEvent)) {
+	l.deliver = deliver
+}
+
+// Watch does nothing, the process gets the events of every room
+func (l *LocalBackplane) Watch(roomID uint) {}
+
+func (l *LocalBackplane) Forget(roomID uint) {}
+
+func (l *LocalBackplane) EventsSince(ctx context.Context, roomID uint, seq uint64) ([]RoomEvent, error) {
+	log := l.roomLog(roomID)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	var events []RoomEvent
+	for _, event := range log.events {
+		if event.Seq > seq {
+			events = append(events, event)
+		}
+	}
+	if err := checkEventLog(seq, log.seq, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (l *LocalBackplane) LastSeq(ctx context.Context, roomID uint) (uint64, error) {
+	log := l.roomLog(roomID)
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	return log.seq, nil
+}
+
+func NewLocalBackplane() *LocalBackplane {
+	return &LocalBackplane{rooms: make(map[uint]*localRoomLog)}
+}
+
+// PostgresBackplane stores events in the room_events table and announces them
+// with NOTIFY. Every instance LISTENs on its own connection and loads the
+// announced events, since rendered updates don't fit into a NOTIFY payload.
+// Sequence numbers come from the room's row, whose lock also makes the events
+// of a room commit, and so get announced, in order. Notices aren't stored, they
+// are sent whole in the NOTIFY payload.
+type PostgresBackplane struct {
+	db      *database.Database
+	deliver func(RoomEvent)
+	mutex   sync.Mutex
+	rooms   map[uint]*roomDelivery
+}
+
+// roomDelivery tracks what this instance delivered of a room it has
+// connections to. Every room is delivered by its own goroutine, so a slow room
+// doesn't hold up the others.
+type roomDelivery struct {
+	// Whether the instance has connections to the room. Once it has none, the
+	// delivery is removed as soon as nothing is being delivered.
+	watched bool
+	// Sequence number of the newest delivered event, unknown until an event of
+	// the room is heard of
+	lastSeq  uint64
+	seqKnown bool
+	// Sequence number of the newest announced event
+	announcedSeq uint64
+	// Whether events after lastSeq may have been published
+	pending bool
+	// Notices waiting for the events announced before them
+	notices []RoomEvent
+	// Whether a goroutine is delivering the room
+	draining bool
+}
+
+// roomAnnouncement is the NOTIFY payload of a stored event
+func roomAnnouncement(roomID uint, seq uint64) string {
+	return fmt.Sprintf("%d:%d", roomID, seq)
+}
+
+func parseRoomAnnouncement(payload string) (uint, uint64, error) {
+	room, seq, ok := strings.Cut(payload, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid room event announcement %q", payload)
+	}
+	roomID, err := strconv.ParseUint(room, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	eventSeq, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(roomID), eventSeq, nil
+}
+
+func (p *PostgresBackplane) Publish(ctx context.Context, event RoomEvent) error {
+	return p.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var seq uint64
+		if err := tx.Raw("UPDATE rooms SET event_seq = event_seq + 1 WHERE id = ? RETURNING event_seq", event.RoomID).
+			Scan(&seq).Error; err != nil {
+			return err
+		}
+
+		roomEvent := database.RoomEvent{
+			RoomID:      event.RoomID,
+			Seq:         seq,
+			Type:        string(event.Type),
+			Route:       string(event.Route),
+			Payload:     event.Payload,
+			JSONPayload: event.JSONPayload,
+		}
+		if err := tx.Create(&roomEvent).Error; err != nil {
+			return err
+		}
+		if seq > roomEventLogSize {
+			if err := tx.Where("room_id = ? AND seq <= ?", event.RoomID, seq-roomEventLogSize).
+				Delete(&database.RoomEvent{}).Error; err != nil {
+				return err
+			}
+		}
+
+		// Notifications are only sent once the transaction commits
+		return tx.Exec("SELECT pg_notify(?, ?)", roomEventsChannel, roomAnnouncement(event.RoomID, seq)).Error
+	})
+}
+
+func (p *PostgresBackplane) Notify(ctx context.Context, event RoomEvent) error {
+	event.Seq = 0
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if len(payload) > roomNoticeMaximumSize {
+		return fmt.Errorf("room notice of %d bytes doesn't fit into a notification", len(payload))
+	}
+	return p.db.DB.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", roomNoticesChannel, string(payload)).Error
+}
+
+func (p *PostgresBackplane) Subscribe(deliver func(RoomEvent)) {
+	p.deliver = deliver
+	go p.listen()
+}
+
+// listen keeps a connection LISTENing for events, reconnecting with
+// exponential backoff whenever it is lost
+func (p *PostgresBackplane) listen() {
+	retry := backplaneRetryBase
+	var disconnectedAt time.Time
+	for {
+		connected := false
+		err := p.listenOnce(context.Background(), disconnectedAt, func() {
+			retry = backplaneRetryBase
+			connected = true
+		})
+		if connected {
+			disconnectedAt = time.Now()
+		}
+		slog.Error("Lost connection listening for room events", slog.Any("error", err), slog.Duration("retry", retry))
+
+		time.Sleep(retry)
+		retry = min(retry*2, backplaneRetryMaximum)
+	}
+}
+
+func (p *PostgresBackplane) listenOnce(ctx context.Context, disconnectedAt time.Time, connected func()) error {
+	conn, err := pgx.Connect(ctx, p.db.URL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+
+	for _, channel := range []string{roomEventsChannel, roomNoticesChannel} {
+		if _, err := conn.Exec(ctx, "LISTEN "+channel); err != nil {
+			return err
+		}
+	}
+	connected()
+
+	if !disconnectedAt.IsZero() {
+		if err := p.catchUp(ctx, disconnectedAt); err != nil {
+			return err
+		}
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch notification.Channel {
+		case roomEventsChannel:
+			roomID, seq, err := parseRoomAnnouncement(notification.Payload)
+			if err != nil {
+				slog.Error("Invalid room event notification", slog.String("payload", notification.Payload), slog.Any("error", err))
+				continue
+			}
+			p.announce(roomID, seq)
+		case roomNoticesChannel:
+			var notice RoomEvent
+			if err := json.Unmarshal([]byte(notification.Payload), &notice); err != nil {
+				slog.Error("Invalid room notice", slog.String("payload", notification.Payload), slog.Any("error", err))
+				continue
+			}
+			p.notice(notice)
+		}
+	}
+}
+
+// catchUp looks for events published while the listener was disconnected. The
+// rooms delivered before are loaded from their last delivered event, other
+// rooms from their first event since the disconnect.
+func (p *PostgresBackplane) catchUp(ctx context.Context, disconnectedAt time.Time) error {
+	var missed []struct {
+		RoomID uint
+		Seq    uint64
+	}
+	if err := p.db.DB.WithContext(ctx).Model(&database.RoomEvent{}).
+		Select("room_id, MIN(seq) AS seq").
+		Where("created_at >= ?", disconnectedAt.Add(-backplaneClockSkew)).
+		Group("room_id").
+		Scan(&missed).Error; err != nil {
+		return err
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, room := range missed {
+		p.roomDelivery(room.RoomID, room.Seq)
+	}
+	for roomID, delivery := range p.rooms {
+		if delivery.seqKnown {
+			delivery.pending = true
+			p.drain(roomID, delivery)
+		}
+	}
+	return nil
+}
+
+// roomDelivery returns the delivery of the room, nil unless the room is
+// watched. The first event heard of is the first one delivered, pass 0 if
+// there was none. p.mutex must be held.
+func (p *PostgresBackplane) roomDelivery(roomID uint, seq uint64) *roomDelivery {
+	delivery, ok := p.rooms[roomID]
+	if !ok || !delivery.watched {
+		return nil
+	}
+	if !delivery.seqKnown && seq != 0 {
+		delivery.lastSeq = seq - 1
+		delivery.seqKnown = true
+	}
+	return delivery
+}
+
+func (p *PostgresBackplane) Watch(roomID uint) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delivery, ok := p.rooms[roomID]
+	if !ok {
+		delivery = &roomDelivery{}
+		p.rooms[roomID] = delivery
+	}
+	delivery.watched = true
+}
+
+// Forget removes the delivery of the room, or leaves it to the goroutine
+// delivering the room
+func (p *PostgresBackplane) Forget(roomID uint) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delivery, ok := p.rooms[roomID]
+	if !ok {
+		return
+	}
+	delivery.watched = false
+	if !delivery.draining {
+		delete(p.rooms, roomID)
+	}
+}
+
+// announce delivers the events of the room up to the announced one
+func (p *PostgresBackplane) announce(roomID uint, seq uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delivery := p.roomDelivery(roomID, seq)
+	if delivery == nil || seq <= delivery.lastSeq {
+		return
+	}
+	delivery.announcedSeq = max(delivery.announcedSeq, seq)
+	delivery.pending = true
+	p.drain(roomID, delivery)
+}
+
+// notice delivers the notice after the events announced before it
+func (p *PostgresBackplane) notice(notice RoomEvent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delivery := p.roomDelivery(notice.RoomID, 0)
+	if delivery == nil {
+		return
+	}
+	delivery.notices = append(delivery.notices, notice)
+	p.drain(notice.RoomID, delivery)
+}
+
+// drain starts delivering the room unless it is being delivered already or
+// was forgotten. p.mutex must be held.
+func (p *PostgresBackplane) drain(roomID uint, delivery *roomDelivery) {
+	if delivery.draining || !delivery.watched {
+		return
+	}
+	delivery.draining = true
+	go p.deliverRoom(roomID, delivery)
+}
+
+// deliverRoom delivers the pending events and notices of the room in order.
+// Events which are no longer kept can't be delivered, the room's connections
+// get a resync event instead.
+func (p *PostgresBackplane) deliverRoom(roomID uint, delivery *roomDelivery) {
+	for {
+		p.mutex.Lock()
+		if !delivery.watched {
+			delivery.draining = false
+			delete(p.rooms, roomID)
+			p.mutex.Unlock()
+			return
+		}
+		if !delivery.pending && len(delivery.notices) == 0 {
+			delivery.draining = false
+			p.mutex.Unlock()
+			return
+		}
+		pending, notices, lastSeq, announcedSeq := delivery.pending, delivery.notices, delivery.lastSeq, delivery.announcedSeq
+		delivery.pending, delivery.notices = false, nil
+		p.mutex.Unlock()
+
+		if pending {
+			var events []database.RoomEvent
+			if err := p.db.DB.
+				Where("room_id = ? AND seq > ?", roomID, lastSeq).
+				Order("seq").
+				Find(&events).Error; err != nil {
+				slog.Error("Error loading room events", slog.Any("room", roomID), slog.Any("error", err))
+
+				// Tried again later, the notices still wait for the events
+				p.mutex.Lock()
+				delivery.pending = true
+				delivery.notices = append(notices, delivery.notices...)
+				delivery.draining = false
+				p.mutex.Unlock()
+				time.AfterFunc(backplaneRetryBase, func() {
+					p.mutex.Lock()
+					defer p.mutex.Unlock()
+					p.drain(roomID, delivery)
+				})
+				return
+			}
+
+			missed := (len(events) == 0 && announcedSeq > lastSeq) ||
+				(len(events) > 0 && events[0].Seq != lastSeq+1)
+			if missed {
+				slog.Warn("Room events were pruned before they were delivered", slog.Any("room", roomID), slog.Any("seq", lastSeq))
+				p.deliver(RoomEvent{Type: RoomEventResync, RoomID: roomID, Route: Route(fmt.Sprintf("room/%d/*", roomID))})
+				lastSeq = max(lastSeq, announcedSeq)
+			}
+			for _, event := range events {
+				p.deliver(toRoomEvent(event))
+				lastSeq = event.Seq
+			}
+
+			p.mutex.Lock()
+			delivery.lastSeq = max(delivery.lastSeq, lastSeq)
+			p.mutex.Unlock()
+		}
+
+		for _, notice := range notices {
+			p.deliver(notice)
+		}
+	}
+}
+
+func toRoomEvent(event database.RoomEvent) RoomEvent {
+	return RoomEvent{
+		Type:        RoomEventType(event.Type),
+		RoomID:      event.RoomID,
+		Seq:         event.Seq,
+		Route:       Route(event.Route),
+		Payload:     event.Payload,
+		JSONPayload: event.JSONPayload,
+	}
+}
+
+func (p *PostgresBackplane) EventsSince(ctx context.Context, roomID uint, seq uint64) ([]RoomEvent, error) {
+	var roomEvents []database.RoomEvent
+	if err := p.db.DB.WithContext(ctx).
+		Where("room_id = ? AND seq > ?", roomID, seq).
+		Order("seq").
+		Find(&roomEvents).Error; err != nil {
+		return nil, err
+	}
+	events := make([]RoomEvent, len(roomEvents))
+	for i, event := range roomEvents {
+		events[i] = toRoomEvent(event)
+	}
+
+	lastSeq, err := p.LastSeq(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkEventLog(seq, lastSeq, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (p *PostgresBackplane) LastSeq(ctx context.Context, roomID uint) (uint64, error) {
+	var seq uint64
+	if err := p.db.DB.WithContext(ctx).Model(&database.Room{}).
+		Select("event_seq").
+		Where("id = ?", roomID).
+		Scan(&seq).Error; err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+func NewPostgresBackplane(db *database.Database) *PostgresBackplane {
+	if db == nil {
+		panic("db cannot be nil")
+	}
+
+	return &PostgresBackplane{db: db, rooms: make(map[uint]*roomDelivery)}
+}
+
+// NewBackplaneFromEnv picks the backplane with REALTIME_BACKPLANE, postgres by
+// default so replicas of the app share their updates
+func NewBackplaneFromEnv(db *database.Database) (Backplane, error) {
+	switch backplane := getEnv("REALTIME_BACKPLANE"); backplane {
+	case "", BackplanePostgres:
+		return NewPostgresBackplane(db), nil
+	case BackplaneLocal:
+		return NewLocalBackplane(), nil
+	default:
+		return nil, fmt.Errorf("unknown realtime backplane %q", backplane)
+	}
+}
+
+var _ Backplane = &LocalBackplane{}
+var _ Backplane = &PostgresBackplane{}
@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/room"
+	"github.com/markojerkic/spring-planing/internal/database"
+)
+
+// LLMAccuracySample is a closed ticket with both an LLM suggestion and a team estimate
+type LLMAccuracySample struct {
+	TicketID    uint
+	RoomID      uint
+	LLMEstimate float64
+	// Median estimate of the team in the final round
+	TeamEstimate float64
+}
+
+type LLMAccuracy struct {
+	Tickets           int
+	MeanAbsoluteError float64
+	// Mean of the LLM estimate minus the team estimate, positive when the LLM overestimates
+	Bias float64
+	// Share of tickets where the LLM was at most one card away from the team
+	HitRate float64
+}
+
+// ComputeLLMAccuracy compares the LLM suggestions to the team estimates, in the units of the deck
+func ComputeLLMAccuracy(deck database.Deck, samples []LLMAccuracySample) LLMAccuracy {
+	if len(samples) == 0 {
+		return LLMAccuracy{}
+	}
+
+	var absoluteError, bias float64
+	hits := 0
+	for _, sample := range samples {
+		delta := sample.LLMEstimate - sample.TeamEstimate
+		absoluteError += math.Abs(delta)
+		bias += delta
+		if deck.StepsApart(sample.LLMEstimate, sample.TeamEstimate) <= 1 {
+			hits++
+		}
+	}
+
+	count := float64(len(samples))
+	return LLMAccuracy{
+		Tickets:           len(samples),
+		MeanAbsoluteError: absoluteError / count,
+		Bias:              bias / count,
+		HitRate:           float64(hits) / count,
+	}
+}
+
+func (a LLMAccuracy) toProps(deck database.Deck) room.LlmAccuracyProps {
+	sign := ""
+	if a.Bias > 0 {
+		sign = "+"
+	}
+	return room.LlmAccuracyProps{
+		Tickets:           a.Tickets,
+		MeanAbsoluteError: deck.FormatDeviation(a.MeanAbsoluteError),
+		Bias:              sign + deck.FormatDeviation(a.Bias),
+		HitRate:           fmt.Sprintf("%.0f%%", a.HitRate*100),
+	}
+}
+
+func (r *RoomService) llmAccuracySamples(ctx context.Context, roomIDs []uint) ([]LLMAccuracySample, error) {
+	var samples []LLMAccuracySample
+	if err := r.db.DB.WithContext(ctx).Raw(`
+		SELECT t.id                                                   AS ticket_id,
+		       t.room_id                                              AS room_id,
+		       le.estimate                                            AS llm_estimate,
+		       PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY e.estimate) AS team_estimate
+		FROM tickets t
+		         JOIN estimates le ON t.llm_estimate_id = le.id AND le.deleted_at IS NULL
+		         JOIN estimates e ON t.id = e.ticket_id AND e.user_id IS NOT NULL
+		    AND e.kind = '' AND e.round = t.current_round AND e.deleted_at IS NULL
+		WHERE t.closed_at IS NOT NULL
+		  AND t.deleted_at IS NULL
+		  AND t.room_id IN ?
+		GROUP BY t.id, le.estimate
+		ORDER BY t.id`, roomIDs).
+		Scan(&samples).Error; err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// GetLLMAccuracy compares the LLM suggestions of the room's closed tickets to
+// the final estimates of the team
+func (r *RoomService) GetLLMAccuracy(ctx context.Context, roomID uint) (room.LlmAccuracyProps, error) {
+	var estimationRoom database.Room
+	if err := r.db.DB.WithContext(ctx).Select("id", "estimation_scale", "custom_scale").
+		First(&estimationRoom, roomID).Error; err != nil {
+		return room.LlmAccuracyProps{}, err
+	}
+
+	samples, err := r.llmAccuracySamples(ctx, []uint{roomID})
+	if err != nil {
+		return room.LlmAccuracyProps{}, err
+	}
+
+	deck := estimationRoom.Deck()
+	return ComputeLLMAccuracy(deck, samples).toProps(deck), nil
+}
+
+// GetOwnerLLMAccuracy reports the LLM accuracy of each room of the owner
+// estimating in hours, along with all of them together. Rooms without closed
+// tickets estimated by the LLM are left out.
+func (r *RoomService) GetOwnerLLMAccuracy(ctx context.Context, ownerID uint) (room.LlmAccuracyReportProps, error) {
+	var report room.LlmAccuracyReportProps
+
+	var rooms []database.Room
+	if err := r.db.DB.WithContext(ctx).Select("id", "name").
+		Where("created_by = ? AND estimation_scale = ?", ownerID, database.ScaleHours).
+		Order("id").
+		Find(&rooms).Error; err != nil {
+		return report, err
+	}
+	if len(rooms) == 0 {
+		return report, nil
+	}
+
+	roomIDs := make([]uint, len(rooms))
+	for i, ownedRoom := range rooms {
+		roomIDs[i] = ownedRoom.ID
+	}
+	samples, err := r.llmAccuracySamples(ctx, roomIDs)
+	if err != nil {
+		return report, err
+	}
+
+	samplesByRoom := make(map[uint][]LLMAccuracySample)
+	for _, sample := range samples {
+		samplesByRoom[sample.RoomID] = append(samplesByRoom[sample.RoomID], sample)
+	}
+
+	deck := database.NewDeck(database.ScaleHours, "")
+	for _, ownedRoom := range rooms {
+		roomSamples, ok := samplesByRoom[ownedRoom.ID]
+		if !ok {
+			continue
+		}
+		report.Rooms = append(report.Rooms, room.LlmRoomAccuracyProps{
+			RoomID:   ownedRoom.ID,
+			RoomName: ownedRoom.Name,
+			Accuracy: ComputeLLMAccuracy(deck, roomSamples).toProps(deck),
+		})
+	}
+	report.Overall = ComputeLLMAccuracy(deck, samples).toProps(deck)
+
+	return report, nil
+}
@@ -0,0 +1,390 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/openai/openai-go/v2"
+	"github.com/openai/openai-go/v2/option"
+)
+
+const (
+	ProviderOpenAI    = "openai"
+	ProviderOllama    = "ollama"
+	ProviderHeuristic = "heuristic"
+
+	defaultOpenAIModel = "google/gemini-2.5-flash-lite"
+	defaultOllamaURL   = "http://localhost:11434"
+	defaultOllamaModel = "llama3.2"
+)
+
+var ErrUnknownLLMProvider = errors.New("unknown LLM provider")
+
+// EstimationPrompt is what an Estimator knows about the ticket it estimates
+type EstimationPrompt struct {
+	TicketKey   string
+	Description string
+	// Similar tickets the team already estimated, most similar first
+	Examples []EstimationExample
+}
+
+// Estimator recommends an estimate for a ticket
+type Estimator interface {
+	Estimate(ctx context.Context, prompt EstimationPrompt) (RecommendedEstimate, error)
+}
+
+const estimationSystemPrompt = `You are a ticket recommender. You will be given a Jira ticket key and description.
+	You will be asked to estimate the work required for the ticket.
+	Your response should be a JSON object with the following keys:
+
+- weekEstimate: Estimate for the ticket in weeks. Minimum is 0.
+- dayEstimate: Estimate for the ticket in days. Minimum is 0, maximum is 7.
+- hourEstimate: Estimate for the ticket in hours. Minimum is 0, maximum is 8.
+
+You will be given the following information:
+
+- ticketKey: The Jira ticket key.
+- ticketDescription: The Jira ticket description.
+
+You will be asked to estimate the work required for the ticket. Your response should be a JSON object with the following keys:
+
+- weekEstimate: Estimate for the ticket in weeks. Minimum is 0.
+- dayEstimate: Estimate for the ticket in days. Minimum is 0, maximum is 7.
+- hourEstimate: Estimate for the ticket in hours. Minimum is 0, maximum is 8.
+- rationale: Short explanation of the estimate, at most three sentences.
+- risks: Key risks and unknowns which could make the ticket take longer, at most five short items.
+- confidence: Confidence in the estimate, one of low, medium or high. Use low for vague descriptions.
+`
+
+func (p EstimationPrompt) userMessage() string {
+	message := fmt.Sprintf(`Ticket key: %s.
+				Ticket description: %s
+				`, p.TicketKey, p.Description)
+	if len(p.Examples) == 0 {
+		return message
+	}
+
+	var examples strings.Builder
+	examples.WriteString("\nThe team already estimated these similar tickets, calibrate your estimate to them:\n")
+	for _, example := range p.Examples {
+		estimate := recommendedEstimateFromHours(int32(math.Round(example.Estimate)))
+		fmt.Fprintf(&examples, "- %s %s: %s (%dw %dd %dh)\n", example.TicketKey, example.Name, example.Description,
+			estimate.WeekEstimate, estimate.DayEstimate, estimate.HourEstimate)
+	}
+
+	return message + examples.String()
+}
+
+func parseRecommendedEstimate(content string) (RecommendedEstimate, error) {
+	var estimateRecommendation RecommendedEstimate
+	if err := json.Unmarshal([]byte(content), &estimateRecommendation); err != nil {
+		slog.Error("Error parsing generated recomendation", "error", err)
+		return RecommendedEstimate{}, err
+	}
+
+	slog.Debug("Generated estimate recommendation", "estimate", estimateRecommendation)
+	return estimateRecommendation, nil
+}
+
+// OpenAIEstimator talks to any OpenAI compatible chat completions endpoint,
+// e.g. OpenRouter, OpenAI or a llama.cpp server
+type OpenAIEstimator struct {
+	client *openai.Client
+	model  string
+}
+
+func (o *OpenAIEstimator) Estimate(ctx context.Context, prompt EstimationPrompt) (RecommendedEstimate, error) {
+	schemaParam := openai.ResponseFormatJSONSchemaJSONSchemaParam{
+		Name:        "ticket_estimate",
+		Description: openai.String("Estimate for the required work for a Jira ticket."),
+		Schema:      RecommendedEstimateSchema,
+		Strict:      openai.Bool(true),
+	}
+
+	chat, err := o.client.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
+		Messages: []openai.ChatCompletionMessageParamUnion{
+			openai.SystemMessage(estimationSystemPrompt),
+			openai.UserMessage(prompt.userMessage()),
+		},
+		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
+			OfJSONSchema: &openai.ResponseFormatJSONSchemaParam{JSONSchema: schemaParam},
+		},
+		Model: o.model,
+	})
+	if err != nil {
+		slog.Error("Error generating recomendation", "error", err)
+		return RecommendedEstimate{}, err
+	}
+	if len(chat.Choices) == 0 {
+		return RecommendedEstimate{}, errors.New("no choices in completion")
+	}
+
+	return parseRecommendedEstimate(chat.Choices[0].Message.Content)
+}
+
+func NewOpenAIEstimator(baseURL string, apiKey string, model string) *OpenAIEstimator {
+	client := openai.NewClient(
+		option.WithAPIKey(apiKey),
+		option.WithBaseURL(baseURL),
+	)
+
+	return &OpenAIEstimator{client: &client, model: model}
+}
+
+// OllamaEstimator uses the native chat API of a local Ollama server
+type OllamaEstimator struct {
+	baseURL    string
+	model      string
+	httpClient *http.Client
+}
+
+type ollamaMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type ollamaChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+	Format   any             `json:"format"`
+}
+
+// Longer error responses are cut off, the start is enough to tell what happened
+const ollamaErrorBodyLimit = 4 << 10
+
+type ollamaChatResponse struct {
+	Message ollamaMessage `json:"message"`
+}
+
+func (o *OllamaEstimator) Estimate(ctx context.Context, prompt EstimationPrompt) (RecommendedEstimate, error) {
+	body, err := json.Marshal(ollamaChatRequest{
+		Model: o.model,
+		Messages: []ollamaMessage{
+			{Role: "system", Content: estimationSystemPrompt},
+			{Role: "user", Content: prompt.userMessage()},
+		},
+		Stream: false,
+		Format: RecommendedEstimateSchema,
+	})
+	if err != nil {
+		return RecommendedEstimate{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return RecommendedEstimate{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := o.httpClient.Do(req)
+	if err != nil {
+		return RecommendedEstimate{}, err
+	}
+	defer res.Body.Close()
+
+	// Errors may come from a proxy in front of ollama, so the body isn't
+	// necessarily JSON
+	if res.StatusCode != http.StatusOK {
+		errorBody, _ := io.ReadAll(io.LimitReader(res.Body, ollamaErrorBodyLimit))
+		return RecommendedEstimate{}, fmt.Errorf("ollama responded with %d: %s", res.StatusCode, strings.TrimSpace(string(errorBody)))
+	}
+
+	var chat ollamaChatResponse
+	if err := json.NewDecoder(res.Body).Decode(&chat); err != nil {
+		return RecommendedEstimate{}, fmt.Errorf("decoding ollama response: %w", err)
+	}
+
+	return parseRecommendedEstimate(chat.Message.Content)
+}
+
+func NewOllamaEstimator(baseURL string, model string) *OllamaEstimator {
+	return &OllamaEstimator{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		model:      model,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// HeuristicEstimator estimates from similar tickets, or from the size of the
+// description when there are none. It needs no model, which makes it useful for
+// tests and air-gapped deployments.
+type HeuristicEstimator struct{}
+
+// Words hinting at work that usually takes longer than the description suggests
+var heuristicComplexityWords = []string{
+	"migrate", "migration", "refactor", "integration", "security",
+	"performance", "database", "concurrency", "legacy", "investigate",
+}
+
+func (HeuristicEstimator) Estimate(ctx context.Context, prompt EstimationPrompt) (RecommendedEstimate, error) {
+	// Similar tickets estimated by the team are a better guess than the description
+	if len(prompt.Examples) > 0 {
+		var weightedHours, totalWeight float64
+		for _, example := range prompt.Examples {
+			weightedHours += example.Estimate * example.Similarity
+			totalWeight += example.Similarity
+		}
+		if totalWeight > 0 {
+			estimate := recommendedEstimateFromHours(int32(math.Round(weightedHours / totalWeight)))
+			estimate.Rationale = fmt.Sprintf("Weighted average of %d similar tickets the team already estimated, most similar is %q.",
+				len(prompt.Examples), prompt.Examples[0].Name)
+			estimate.Risks = heuristicRisks(strings.ToLower(prompt.Description))
+			estimate.Confidence = string(database.LLMConfidenceMedium)
+			return estimate, nil
+		}
+	}
+
+	description := strings.ToLower(prompt.Description)
+	words := len(strings.Fields(description))
+
+	var hours int32
+	switch {
+	case words < 20:
+		hours = 2
+	case words < 60:
+		hours = 4
+	case words < 150:
+		hours = 8
+	case words < 300:
+		hours = 16
+	default:
+		hours = 24
+	}
+
+	risks := heuristicRisks(description)
+	hours += int32(4 * len(risks))
+
+	estimate := recommendedEstimateFromHours(hours)
+	estimate.Rationale = fmt.Sprintf("Based on the length of the description (%d words) and %d complexity hints, without similar tickets to compare to.",
+		words, len(risks))
+	estimate.Risks = risks
+	estimate.Confidence = string(database.LLMConfidenceLow)
+	return estimate, nil
+}
+
+// heuristicRisks lists the complexity words found in the description
+func heuristicRisks(description string) []string {
+	risks := []string{}
+	for _, word := range heuristicComplexityWords {
+		if strings.Contains(description, word) {
+			risks = append(risks, fmt.Sprintf("Mentions %s", word))
+		}
+	}
+	return risks
+}
+
+func recommendedEstimateFromHours(hours int32) RecommendedEstimate {
+	return RecommendedEstimate{
+		WeekEstimate: hours / 40,
+		DayEstimate:  (hours % 40) / 8,
+		HourEstimate: hours % 8,
+	}
+}
+
+// Estimators holds the configured estimators, rooms pick one of them by name
+type Estimators struct {
+	estimators      map[string]Estimator
+	defaultProvider string
+}
+
+// Get returns the estimator of the provider, or the default one if the
+// provider is empty or not configured
+func (e *Estimators) Get(provider string) (string, Estimator) {
+	if estimator, ok := e.estimators[provider]; ok {
+		return provider, estimator
+	}
+	return e.defaultProvider, e.estimators[e.defaultProvider]
+}
+
+func (e *Estimators) Default() string {
+	return e.defaultProvider
+}
+
+func (e *Estimators) IsConfigured(provider string) bool {
+	_, ok := e.estimators[provider]
+	return ok
+}
+
+// Providers returns the names of the configured providers
+func (e *Estimators) Providers() []string {
+	providers := make([]string, 0, len(e.estimators))
+	for provider := range e.estimators {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+func NewEstimators(defaultProvider string, estimators map[string]Estimator) (*Estimators, error) {
+	if _, ok := estimators[defaultProvider]; !ok {
+		return nil, fmt.Errorf("%w: %q is not configured", ErrUnknownLLMProvider, defaultProvider)
+	}
+
+	return &Estimators{
+		estimators:      estimators,
+		defaultProvider: defaultProvider,
+	}, nil
+}
+
+func getEnv(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// NewEstimatorsFromEnv configures the estimators from the environment:
+//
+//   - LLM_PROVIDER: default provider, one of openai, ollama or heuristic
+//   - LLM_BASE_URL, LLM_API_KEY, LLM_MODEL: OpenAI compatible endpoint,
+//     OPENROUTER_BASE_URL and OPENROUTER_API_KEY are still read as fallback
+//   - OLLAMA_BASE_URL, OLLAMA_MODEL: local Ollama server
+//
+// The heuristic estimator is always available.
+func NewEstimatorsFromEnv() (*Estimators, error) {
+	estimators := map[string]Estimator{
+		ProviderHeuristic: HeuristicEstimator{},
+	}
+
+	if apiKey := getEnv("LLM_API_KEY", "OPENROUTER_API_KEY"); apiKey != "" {
+		model := getEnv("LLM_MODEL")
+		if model == "" {
+			model = defaultOpenAIModel
+		}
+		estimators[ProviderOpenAI] = NewOpenAIEstimator(getEnv("LLM_BASE_URL", "OPENROUTER_BASE_URL"), apiKey, model)
+	}
+
+	if baseURL, model := getEnv("OLLAMA_BASE_URL"), getEnv("OLLAMA_MODEL"); baseURL != "" || model != "" {
+		if baseURL == "" {
+			baseURL = defaultOllamaURL
+		}
+		if model == "" {
+			model = defaultOllamaModel
+		}
+		estimators[ProviderOllama] = NewOllamaEstimator(baseURL, model)
+	}
+
+	defaultProvider := getEnv("LLM_PROVIDER")
+	if defaultProvider == "" {
+		defaultProvider = ProviderHeuristic
+		if _, ok := estimators[ProviderOpenAI]; ok {
+			defaultProvider = ProviderOpenAI
+		}
+	}
+
+	return NewEstimators(defaultProvider, estimators)
+}
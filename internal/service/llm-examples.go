@@ -0,0 +1,163 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"gorm.io/gorm"
+)
+
+const (
+	// How many closed tickets are given to the LLM as examples, unless
+	// LLM_EXAMPLES says otherwise
+	defaultLLMFewShotExamples = 5
+	// How many of the closed tickets sharing the most words with the estimated
+	// one are ranked, so large rooms don't load every ticket they ever closed
+	llmExampleCandidates = 500
+)
+
+// llmFewShotExamplesFromEnv reads how many examples the LLM gets from
+// LLM_EXAMPLES, 0 leaves them out
+func llmFewShotExamplesFromEnv() int {
+	value := getEnv("LLM_EXAMPLES")
+	if value == "" {
+		return defaultLLMFewShotExamples
+	}
+	examples, err := strconv.Atoi(value)
+	if err != nil || examples < 0 {
+		slog.Warn("Ignoring invalid LLM_EXAMPLES", slog.String("value", value))
+		return defaultLLMFewShotExamples
+	}
+	return examples
+}
+
+// EstimationExample is a closed ticket along with the team's final estimate
+type EstimationExample struct {
+	TicketID    uint
+	RoomID      uint
+	TicketKey   string
+	Name        string
+	Description string
+	// Final median estimate of the team, in hours
+	Estimate   float64
+	Similarity float64
+}
+
+var similarityStopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "with": true, "that": true, "this": true,
+	"from": true, "into": true, "are": true, "was": true, "should": true, "when": true,
+	"can": true, "not": true, "all": true, "add": true, "use": true, "have": true,
+}
+
+func similarityTokens(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) < 3 || similarityStopWords[word] {
+			continue
+		}
+		tokens[word] = true
+	}
+	return tokens
+}
+
+func jaccardSimilarity(a map[string]bool, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+	intersection := 0
+	for token := range a {
+		if b[token] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
+
+// RankSimilarTickets returns up to n candidates most similar to the text, by
+// the Jaccard similarity of their words. Candidates with nothing in common
+// with the text are left out.
+func RankSimilarTickets(text string, candidates []EstimationExample, n int) []EstimationExample {
+	target := similarityTokens(text)
+
+	ranked := make([]EstimationExample, 0, len(candidates))
+	for _, candidate := range candidates {
+		candidate.Similarity = jaccardSimilarity(target, similarityTokens(candidate.Name+" "+candidate.Description))
+		if candidate.Similarity > 0 {
+			ranked = append(ranked, candidate)
+		}
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Similarity > ranked[j].Similarity
+	})
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+
+	return ranked
+}
+
+// findEstimationExamples picks the closed tickets most similar to the job's
+// ticket, from the same room or other rooms of the room owner estimating in hours
+func (l *LLMService) findEstimationExamples(ctx context.Context, db *gorm.DB, job *database.LLMJob, room database.Room) ([]EstimationExample, error) {
+	if l.fewShotExamples == 0 {
+		return nil, nil
+	}
+
+	// The ticket may have been renamed or edited since the job was queued
+	text := job.Description
+	var ticket database.Ticket
+	if err := db.WithContext(ctx).Select("name", "description").First(&ticket, job.TicketID).Error; err == nil {
+		text = ticket.Name + " " + ticket.Description
+	}
+
+	tokens := similarityTokens(text)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	// Only tickets sharing a word can be similar, Postgres finds those with the
+	// most words in common before they are ranked here
+	words := make([]string, 0, len(tokens))
+	for token := range tokens {
+		words = append(words, token)
+	}
+	slices.Sort(words)
+	query := strings.Join(words, " | ")
+
+	var candidates []EstimationExample
+	if err := db.WithContext(ctx).Raw(`
+		SELECT t.id                                                   AS ticket_id,
+		       t.room_id                                              AS room_id,
+		       COALESCE(t.jira_key, '')                               AS ticket_key,
+		       t.name                                                 AS name,
+		       t.description                                          AS description,
+		       PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY e.estimate) AS estimate
+		FROM tickets t
+		         JOIN rooms r ON t.room_id = r.id AND r.deleted_at IS NULL
+		         JOIN estimates e ON t.id = e.ticket_id AND e.user_id IS NOT NULL
+		    AND e.kind = '' AND e.round = t.current_round AND e.deleted_at IS NULL
+		WHERE t.closed_at IS NOT NULL
+		  AND t.deleted_at IS NULL
+		  AND t.id <> ?
+		  AND (t.room_id = ? OR r.created_by = ?)
+		  AND r.estimation_scale = ?
+		  AND to_tsvector('simple', t.name || ' ' || COALESCE(t.description, '')) @@ to_tsquery('simple', ?)
+		GROUP BY t.id
+		ORDER BY ts_rank(to_tsvector('simple', t.name || ' ' || COALESCE(t.description, '')),
+		                 to_tsquery('simple', ?)) DESC,
+		         t.closed_at DESC
+		LIMIT ?`, job.TicketID, room.ID, room.CreatedBy, database.ScaleHours, query, query, llmExampleCandidates).
+		Scan(&candidates).Error; err != nil {
+		return nil, err
+	}
+
+	return RankSimilarTickets(text, candidates, l.fewShotExamples), nil
+}
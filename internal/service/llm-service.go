@@ -2,25 +2,28 @@ package service
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/invopop/jsonschema"
-	"github.com/labstack/gommon/log"
 	"github.com/markojerkic/spring-planing/internal/database"
-	"github.com/openai/openai-go/v2"
-	"github.com/openai/openai-go/v2/option"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type LLMService struct {
-	openRouterClient *openai.Client
-	requestChan      chan LLMRequest
+	estimators       *Estimators
+	wake             chan struct{}
+	stop             chan struct{}
+	workers          sync.WaitGroup
 	db               *database.Database
 	webSocketService *WebSocketService
+	// How many similar closed tickets are given to the estimator
+	fewShotExamples int
 }
 
 type LLMRequest struct {
@@ -28,13 +31,15 @@ type LLMRequest struct {
 	Description string
 	RoomID      uint
 	TicketID    uint
-	RetryCount  uint
 }
 
 type RecommendedEstimate struct {
-	WeekEstimate int32 `json:"weekEstimate" form:"weekEstimate" default:"0" jsonschema_description:"Estimate for the ticket in weeks. Minimum is 0."`
-	DayEstimate  int32 `json:"dayEstimate" form:"dayEstimate" default:"0" jsonschema_description:"Estimate for the ticket in days. Minimum is 0, maximum is 7."`
-	HourEstimate int32 `json:"hourEstimate" form:"hourEstimate" default:"0" jsonschema_description:"Estimate for the ticket in hours. Minimum is 0, maximum is 8."`
+	WeekEstimate int32    `json:"weekEstimate" form:"weekEstimate" default:"0" jsonschema_description:"Estimate for the ticket in weeks. Minimum is 0."`
+	DayEstimate  int32    `json:"dayEstimate" form:"dayEstimate" default:"0" jsonschema_description:"Estimate for the ticket in days. Minimum is 0, maximum is 7."`
+	HourEstimate int32    `json:"hourEstimate" form:"hourEstimate" default:"0" jsonschema_description:"Estimate for the ticket in hours. Minimum is 0, maximum is 8."`
+	Rationale    string   `json:"rationale" jsonschema_description:"Short explanation of the estimate, at most three sentences."`
+	Risks        []string `json:"risks" jsonschema_description:"Key risks and unknowns which could make the ticket take longer."`
+	Confidence   string   `json:"confidence" jsonschema:"enum=low,enum=medium,enum=high" jsonschema_description:"Confidence in the estimate, one of low, medium or high."`
 }
 
 func GenerateSchema[T any]() any {
@@ -51,166 +56,312 @@ func GenerateSchema[T any]() any {
 
 var RecommendedEstimateSchema = GenerateSchema[RecommendedEstimate]()
 
-func (l *LLMService) processRequests() {
-	for req := range l.requestChan {
-		log.Debug("Processing LLM request", "ticket", req.TicketKey, "description", req.Description)
-
-		var isLLMEnabled bool
-		if err := l.db.DB.WithContext(context.Background()).
-			Model(&database.Room{}).
-			Select("allow_llm_estimation").
-			Where("id = ?", req.RoomID).
-			Scan(&isLLMEnabled).Error; err != nil {
-			slog.Error("Error reading room", "error", err)
-			return
-		}
+func (r RecommendedEstimate) Hours() float64 {
+	return float64(r.WeekEstimate*5*8 + r.DayEstimate*8 + r.HourEstimate)
+}
 
-		if !isLLMEnabled {
-			slog.Debug("LLM estimation is disabled for room", "room", req.RoomID)
-			return
+// llmConfidence returns the confidence of the recommendation, models ignoring
+// the schema are assumed to be guessing
+func (r RecommendedEstimate) llmConfidence() database.LLMConfidence {
+	switch confidence := database.LLMConfidence(strings.ToLower(strings.TrimSpace(r.Confidence))); confidence {
+	case database.LLMConfidenceLow, database.LLMConfidenceMedium, database.LLMConfidenceHigh:
+		return confidence
+	default:
+		return database.LLMConfidenceLow
+	}
+}
+
+const (
+	llmWorkers     = 10
+	llmMaxAttempts = 5
+	// Jobs left running for longer than this are assumed to belong to a crashed
+	// instance and are picked up again
+	llmJobLease       = 2 * time.Minute
+	llmPollInterval   = 5 * time.Second
+	llmBackoffBase    = 10 * time.Second
+	llmBackoffMaximum = 10 * time.Minute
+)
+
+// errLLMJobSkipped marks jobs which can't succeed, so they aren't retried
+var errLLMJobSkipped = errors.New("llm estimation skipped")
+
+// LLMBackoff returns how long to wait before retrying a job which failed the given number of times
+func LLMBackoff(attempts int) time.Duration {
+	backoff := llmBackoffBase
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= llmBackoffMaximum {
+			return llmBackoffMaximum
 		}
+	}
+	return backoff
+}
 
-		slog.Info("Processing LLM request", "ticket", req.TicketID)
+// Enqueue queues an LLM estimate of the ticket. It should be called with the
+// transaction that creates the ticket, so the job is only queued if the ticket is.
+func (l *LLMService) Enqueue(tx *gorm.DB, req LLMRequest) error {
+	var room database.Room
+	if err := tx.Select("id", "allow_llm_estimation", "estimation_scale").
+		First(&room, req.RoomID).Error; err != nil {
+		return err
+	}
+	if !room.AllowLLMEstimation || !room.Deck().IsTimeBased() {
+		return nil
+	}
 
-		llmCtx, cancelLlm := context.WithTimeout(context.Background(), 4*time.Second)
-		defer cancelLlm()
+	job := database.LLMJob{
+		TicketID:    req.TicketID,
+		RoomID:      req.RoomID,
+		TicketKey:   req.TicketKey,
+		Description: req.Description,
+		Status:      database.LLMJobPending,
+		RunAfter:    time.Now(),
+	}
+	return tx.Create(&job).Error
+}
 
-		estimate, err := l.generateEstimate(llmCtx, req.TicketKey, req.Description)
-		if err != nil {
-			slog.Error("Error generating estimate", "ticket", req.TicketKey, "error", err)
-			if req.RetryCount < 3 {
-				slog.Debug("Retrying LLM request", "ticket", req.TicketKey, "description", req.Description, "retryCount", req.RetryCount)
-				go func() {
-					l.requestChan <- LLMRequest{
-						TicketKey:   req.TicketKey,
-						Description: req.Description,
-						RoomID:      req.RoomID,
-						TicketID:    req.TicketID,
-						RetryCount:  req.RetryCount + 1,
-					}
-				}()
-			}
-			return
+// Wake lets an idle worker know new jobs were queued
+func (l *LLMService) Wake() {
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// claimJob marks the next due job as running, skipping jobs claimed by other
+// workers or instances
+func (l *LLMService) claimJob(ctx context.Context) (*database.LLMJob, error) {
+	var job database.LLMJob
+	err := l.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("(status = ? AND run_after <= ?) OR (status = ? AND started_at < ?)",
+				database.LLMJobPending, now, database.LLMJobRunning, now.Add(-llmJobLease)).
+			Order("run_after").
+			First(&job).Error; err != nil {
+			return err
 		}
 
-		timeoutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		err = l.db.DB.WithContext(timeoutCtx).Transaction(func(tx *gorm.DB) error {
+		job.Status = database.LLMJobRunning
+		job.Attempts++
+		job.StartedAt = &now
+		return tx.Select("status", "attempts", "started_at").Save(&job).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
 
-			estimate := database.Estimate{
-				TicketID: req.TicketID,
-				Estimate: int(estimate.WeekEstimate*5*8 + estimate.DayEstimate*8 + estimate.HourEstimate),
-			}
-			if err := tx.Create(&estimate).Error; err != nil {
-				return err
-			}
-			slog.Debug("Estimate saved", "estimate", estimate.ID)
+	return &job, nil
+}
 
-			if err := tx.Model(&database.Ticket{}).
-				Where("id = ?", req.TicketID).
-				Update("llm_estimate_id", estimate.ID).Error; err != nil {
-				return err
-			}
+// Stop lets the workers finish their current job and waits until they exit.
+// Unfinished jobs stay queued for other instances.
+func (l *LLMService) Stop() {
+	close(l.stop)
+	l.workers.Wait()
+}
 
-			return nil
-		})
-		if err != nil {
-			slog.Error("Error saving estimate", "error", err)
+func (l *LLMService) worker() {
+	defer l.workers.Done()
+	ticker := time.NewTicker(llmPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		default:
 		}
 
-		formatedEstimate := fmt.Sprintf("%dw %dd %dh", estimate.WeekEstimate, estimate.DayEstimate, estimate.HourEstimate)
+		job, err := l.claimJob(context.Background())
+		if err != nil {
+			slog.Error("Error claiming LLM job", slog.Any("error", err))
+		}
+		if job == nil {
+			select {
+			case <-l.wake:
+			case <-ticker.C:
+			case <-l.stop:
+				return
+			}
+			continue
+		}
 
-		go func() {
-			l.webSocketService.SendLLMRecommendation(req.TicketID, &req.TicketKey, req.RoomID, formatedEstimate)
-		}()
+		l.runJob(job)
 	}
 }
 
-func (l *LLMService) generateEstimate(ctx context.Context, ticketKey string, ticketDescription string) (RecommendedEstimate, error) {
-	schemaParam := openai.ResponseFormatJSONSchemaJSONSchemaParam{
-		Name:        "ticket_estimate",
-		Description: openai.String("Estimate for the required work for a Jira ticket."),
-		Schema:      RecommendedEstimateSchema,
-		Strict:      openai.Bool(true),
-	}
+// runJob runs a claimed job and records its outcome. A failing or panicking
+// job never takes the worker down with it.
+func (l *LLMService) runJob(job *database.LLMJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("LLM job panicked", slog.Any("job", job.ID), slog.Any("panic", r))
+			l.finishJob(job, fmt.Errorf("panic: %v", r))
+		}
+	}()
+	l.webSocketService.SendLLMJobStatus(job.RoomID, job.StatusProps(false))
 
-	systemPrompt := `You are a ticket recommender. You will be given a Jira ticket key and description.
-	You will be asked to estimate the work required for the ticket.
-	Your response should be a JSON object with the following keys:
+	slog.Info("Processing LLM request", "ticket", job.TicketID, "attempt", job.Attempts)
+	l.finishJob(job, l.processJob(job))
+}
 
-- weekEstimate: Estimate for the ticket in weeks. Minimum is 0.
-- dayEstimate: Estimate for the ticket in days. Minimum is 0, maximum is 7.
-- hourEstimate: Estimate for the ticket in hours. Minimum is 0, maximum is 8.
+func (l *LLMService) processJob(job *database.LLMJob) error {
+	var room database.Room
+	if err := l.db.DB.WithContext(context.Background()).
+		Select("id", "created_by", "allow_llm_estimation", "estimation_scale", "llm_provider").
+		First(&room, job.RoomID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: room was deleted", errLLMJobSkipped)
+		}
+		return err
+	}
 
-You will be given the following information:
+	if !room.AllowLLMEstimation {
+		return fmt.Errorf("%w: LLM estimation is disabled for the room", errLLMJobSkipped)
+	}
 
-- ticketKey: The Jira ticket key.
-- ticketDescription: The Jira ticket description.
+	// The LLM recommends estimates in time, which can't be mapped onto a card deck
+	if !room.Deck().IsTimeBased() {
+		return fmt.Errorf("%w: LLM estimation is only supported for rooms estimating in hours", errLLMJobSkipped)
+	}
 
-You will be asked to estimate the work required for the ticket. Your response should be a JSON object with the following keys:
+	llmCtx, cancelLlm := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelLlm()
 
-- weekEstimate: Estimate for the ticket in weeks. Minimum is 0.
-- dayEstimate: Estimate for the ticket in days. Minimum is 0, maximum is 7.
-- hourEstimate: Estimate for the ticket in hours. Minimum is 0, maximum is 8.
-`
+	examples, err := l.findEstimationExamples(llmCtx, l.db.DB, job, room)
+	if err != nil {
+		return err
+	}
 
-	chat, err := l.openRouterClient.Chat.Completions.New(ctx, openai.ChatCompletionNewParams{
-		Messages: []openai.ChatCompletionMessageParamUnion{
-			openai.SystemMessage(systemPrompt),
-			openai.UserMessage(fmt.Sprintf(`Ticket key: %s.
-				Ticket description: %s
-				`, ticketKey, ticketDescription)),
-		},
-		ResponseFormat: openai.ChatCompletionNewParamsResponseFormatUnion{
-			OfJSONSchema: &openai.ResponseFormatJSONSchemaParam{JSONSchema: schemaParam},
-		},
-		Model: "google/gemini-2.5-flash-lite",
+	provider, estimator := l.estimators.Get(room.LLMProvider)
+	job.Provider = provider
+	recommended, err := estimator.Estimate(llmCtx, EstimationPrompt{
+		TicketKey:   job.TicketKey,
+		Description: job.Description,
+		Examples:    examples,
 	})
-
 	if err != nil {
-		slog.Error("Error generating recomendation", "error", err)
-		return RecommendedEstimate{}, err
+		return err
 	}
 
-	var estimateRecommendation RecommendedEstimate
-	err = json.Unmarshal([]byte(chat.Choices[0].Message.Content), &estimateRecommendation)
-	if err != nil {
-		slog.Error("Error parsing generated recomendation", "error", err)
-		return RecommendedEstimate{}, err
+	var (
+		savedEstimate  database.Estimate
+		recommendation database.LLMRecommendation
+	)
+	timeoutCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := l.db.DB.WithContext(timeoutCtx).Transaction(func(tx *gorm.DB) error {
+		estimate := database.Estimate{
+			TicketID: job.TicketID,
+			Estimate: recommended.Hours(),
+		}
+		if err := tx.Create(&estimate).Error; err != nil {
+			return err
+		}
+		slog.Debug("Estimate saved", "estimate", estimate.ID)
+
+		recommendation = database.LLMRecommendation{
+			EstimateID: estimate.ID,
+			Rationale:  recommended.Rationale,
+			Risks:      recommended.Risks,
+			Confidence: recommended.llmConfidence(),
+		}
+		if err := tx.Create(&recommendation).Error; err != nil {
+			return err
+		}
+		savedEstimate = estimate
+
+		// Retried jobs replace the examples of the previous attempt
+		if err := tx.Unscoped().Where("llm_job_id = ?", job.ID).Delete(&database.LLMEstimateExample{}).Error; err != nil {
+			return err
+		}
+		job.Examples = make([]database.LLMEstimateExample, len(examples))
+		for i, example := range examples {
+			job.Examples[i] = database.LLMEstimateExample{
+				LLMJobID:        job.ID,
+				ExampleTicketID: example.TicketID,
+				RoomID:          example.RoomID,
+				Name:            example.Name,
+				Estimate:        example.Estimate,
+				Similarity:      example.Similarity,
+			}
+		}
+		if len(job.Examples) > 0 {
+			if err := tx.Create(&job.Examples).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&database.Ticket{}).
+			Where("id = ?", job.TicketID).
+			Update("llm_estimate_id", estimate.ID).Error
+	}); err != nil {
+		return err
 	}
 
-	slog.Debug("Generated estimate recommendation", "estimate", estimateRecommendation)
+	llmEstimate := database.ToLlmEstimateProps(room.Deck(), savedEstimate, &recommendation)
+	l.webSocketService.SendLLMRecommendation(job.TicketID, &job.TicketKey, job.RoomID, llmEstimate)
+
+	return nil
+}
+
+// finishJob stores the outcome of a job, scheduling a retry with exponential
+// backoff if it failed and has attempts left
+func (l *LLMService) finishJob(job *database.LLMJob, jobErr error) {
+	now := time.Now()
+	switch {
+	case jobErr == nil:
+		job.Status = database.LLMJobSucceeded
+		job.FinishedAt = &now
+		job.LastError = ""
+	case errors.Is(jobErr, errLLMJobSkipped) || job.Attempts >= llmMaxAttempts:
+		slog.Error("LLM job failed", slog.Any("ticket", job.TicketID), slog.Any("error", jobErr))
+		job.Status = database.LLMJobFailed
+		job.FinishedAt = &now
+		job.LastError = jobErr.Error()
+	default:
+		slog.Debug("Retrying LLM job", slog.Any("ticket", job.TicketID), slog.Int("attempts", job.Attempts), slog.Any("error", jobErr))
+		job.Status = database.LLMJobPending
+		job.RunAfter = now.Add(LLMBackoff(job.Attempts))
+		job.LastError = jobErr.Error()
+	}
 
-	return estimateRecommendation, nil
+	if err := l.db.DB.Select("status", "run_after", "finished_at", "last_error", "provider").
+		Save(job).Error; err != nil {
+		slog.Error("Error saving LLM job", slog.Any("job", job.ID), slog.Any("error", err))
+		return
+	}
+	l.webSocketService.SendLLMJobStatus(job.RoomID, job.StatusProps(false))
 }
 
-func NewLLMService(webSocketService *WebSocketService, db *database.Database) *LLMService {
+func NewLLMService(webSocketService *WebSocketService, db *database.Database, estimators *Estimators) *LLMService {
 	if webSocketService == nil {
 		panic("webSocketService cannot be nil")
 	}
 	if db == nil {
 		panic("db cannot be nil")
 	}
-
-	client := openai.NewClient(
-		option.WithAPIKey(os.Getenv("OPENROUTER_API_KEY")),
-		option.WithBaseURL(os.Getenv("OPENROUTER_BASE_URL")),
-	)
+	if estimators == nil {
+		panic("estimators cannot be nil")
+	}
 
 	service := &LLMService{
-		openRouterClient: &client,
-		requestChan:      make(chan LLMRequest, 100),
+		estimators:       estimators,
+		wake:             make(chan struct{}, 1),
+		stop:             make(chan struct{}),
+		fewShotExamples:  llmFewShotExamplesFromEnv(),
 		webSocketService: webSocketService,
 		db:               db,
 	}
 
-	for range 10 {
-		go service.processRequests()
+	service.workers.Add(llmWorkers)
+	for range llmWorkers {
+		go service.worker()
 	}
 
 	return service
 }
-
-func (l *LLMService) GetRequestChannel() chan<- LLMRequest {
-	return l.requestChan
-}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+type PresenceStatus string
+
+const (
+	PresenceOnline  PresenceStatus = "online"
+	PresenceIdle    PresenceStatus = "idle"
+	PresenceOffline PresenceStatus = "offline"
+)
+
+const (
+	// Users who left are still shown as offline for a while, so a page reload
+	// doesn't make them disappear from the roster
+	offlineRetention = 30 * time.Minute
+	// How often an instance renews the presence of its users in the store
+	presenceHeartbeat = 15 * time.Second
+	// Time allowed to save a change of presence
+	presenceSaveTimeout = 5 * time.Second
+)
+
+type UserPresence struct {
+	UserID   uint
+	Status   PresenceStatus
+	LastSeen time.Time
+}
+
+type presence struct {
+	// Open connections of the user, mapped to whether the connection is idle
+	connections map[any]bool
+	// When the last connection closed
+	leftAt time.Time
+	// Held while saving, so the store ends up with the latest status
+	saveMutex sync.Mutex
+}
+
+func (p *presence) status() PresenceStatus {
+	if len(p.connections) == 0 {
+		return PresenceOffline
+	}
+	for _, idle := range p.connections {
+		if !idle {
+			return PresenceOnline
+		}
+	}
+	return PresenceIdle
+}
+
+// PresenceService keeps track of who is connected to which room. Connections
+// are tracked by the instance they are open on, the store shares the status of
+// its users with the other instances.
+type PresenceService struct {
+	mutex sync.RWMutex
+	rooms map[uint]map[uint]*presence
+	store PresenceStore
+	// Identifies the rows of this instance in the store
+	instanceID string
+}
+
+func (p *PresenceService) userPresence(roomID uint, userID uint) *presence {
+	room, ok := p.rooms[roomID]
+	if !ok {
+		room = make(map[uint]*presence)
+		p.rooms[roomID] = room
+	}
+	userPresence, ok := room[userID]
+	if !ok {
+		userPresence = &presence{connections: make(map[any]bool)}
+		room[userID] = userPresence
+	}
+	return userPresence
+}
+
+// save stores the current status of the user on this instance
+func (p *PresenceService) save(roomID uint, userID uint, userPresence *presence) {
+	userPresence.saveMutex.Lock()
+	defer userPresence.saveMutex.Unlock()
+
+	p.mutex.RLock()
+	status := userPresence.status()
+	p.mutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), presenceSaveTimeout)
+	defer cancel()
+	if err := p.store.Save(ctx, p.instanceID, roomID, userID, status); err != nil {
+		slog.Error("Error saving presence", slog.Any("room", roomID), slog.Any("user", userID), slog.Any("error", err))
+	}
+}
+
+// Join registers a new connection of the user in the room. The connection can
+// be any comparable value identifying it, e.g. the websocket connection.
+func (p *PresenceService) Join(roomID uint, userID uint, conn any) {
+	p.mutex.Lock()
+	userPresence := p.userPresence(roomID, userID)
+	userPresence.connections[conn] = false
+	p.mutex.Unlock()
+
+	p.save(roomID, userID, userPresence)
+}
+
+func (p *PresenceService) Leave(roomID uint, userID uint, conn any) {
+	p.mutex.Lock()
+	userPresence, ok := p.rooms[roomID][userID]
+	if !ok {
+		p.mutex.Unlock()
+		return
+	}
+	delete(userPresence.connections, conn)
+	if len(userPresence.connections) == 0 {
+		userPresence.leftAt = time.Now()
+	}
+	p.mutex.Unlock()
+
+	p.save(roomID, userID, userPresence)
+}
+
+// SetIdle marks a connection as idle or active. It returns true if the status
+// of the user on this instance changed because of it.
+func (p *PresenceService) SetIdle(roomID uint, userID uint, conn any, idle bool) bool {
+	p.mutex.Lock()
+	userPresence, ok := p.rooms[roomID][userID]
+	if !ok {
+		p.mutex.Unlock()
+		return false
+	}
+	if _, ok := userPresence.connections[conn]; !ok {
+		p.mutex.Unlock()
+		return false
+	}
+	previousStatus := userPresence.status()
+	userPresence.connections[conn] = idle
+	changed := previousStatus != userPresence.status()
+	p.mutex.Unlock()
+
+	if changed {
+		p.save(roomID, userID, userPresence)
+	}
+	return changed
+}
+
+// PresentUserIDs returns the users which are online or idle in the room on
+// any instance
+func (p *PresenceService) PresentUserIDs(ctx context.Context, roomID uint) ([]uint, error) {
+	roster, err := p.store.Load(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	userIDs := make([]uint, 0, len(roster))
+	for _, userPresence := range roster {
+		if userPresence.Status != PresenceOffline {
+			userIDs = append(userIDs, userPresence.UserID)
+		}
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+
+	return userIDs, nil
+}
+
+// Roster returns everyone who is or recently was in the room, online users first
+func (p *PresenceService) Roster(ctx context.Context, roomID uint) ([]UserPresence, error) {
+	roster, err := p.store.Load(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	statusOrder := map[PresenceStatus]int{PresenceOnline: 0, PresenceIdle: 1, PresenceOffline: 2}
+	sort.Slice(roster, func(i, j int) bool {
+		if statusOrder[roster[i].Status] != statusOrder[roster[j].Status] {
+			return statusOrder[roster[i].Status] < statusOrder[roster[j].Status]
+		}
+		return roster[i].UserID < roster[j].UserID
+	})
+
+	return roster, nil
+}
+
+// heartbeat keeps the presence of this instance's users from expiring, and
+// forgets the users who left once their status was saved
+func (p *PresenceService) heartbeat() {
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.mutex.Lock()
+		for roomID, room := range p.rooms {
+			for userID, userPresence := range room {
+				if len(userPresence.connections) == 0 && time.Since(userPresence.leftAt) > presenceSaveTimeout {
+					delete(room, userID)
+				}
+			}
+			if len(room) == 0 {
+				delete(p.rooms, roomID)
+			}
+		}
+		p.mutex.Unlock()
+
+		ctx, cancel := context.WithTimeout(context.Background(), presenceHeartbeat)
+		if err := p.store.Refresh(ctx, p.instanceID); err != nil {
+			slog.Error("Error refreshing presence", slog.Any("error", err))
+		}
+		cancel()
+	}
+}
+
+// NewPresenceService keeps presence in memory, for single instance deployments
+func NewPresenceService() *PresenceService {
+	return NewPresenceServiceWithStore(NewLocalPresenceStore())
+}
+
+// NewPresenceServiceWithStore shares presence with the other instances of
+// the app using the store
+func NewPresenceServiceWithStore(store PresenceStore) *PresenceService {
+	if store == nil {
+		panic("store cannot be nil")
+	}
+
+	service := &PresenceService{
+		rooms:      make(map[uint]map[uint]*presence),
+		store:      store,
+		instanceID: rand.Text(),
+	}
+	go service.heartbeat()
+
+	return service
+}
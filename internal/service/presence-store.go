@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+)
+
+// Presence saved by an instance expires unless the instance renews it, so
+// users of a crashed instance go offline
+const presenceLease = 3 * presenceHeartbeat
+
+// PresenceStore keeps the status of users in rooms as seen by each instance
+// of the app, so every instance knows who is in a room
+type PresenceStore interface {
+	// Save records the status of the user in the room on the instance, offline
+	// once the user has no connections left there
+	Save(ctx context.Context, instanceID string, roomID uint, userID uint, status PresenceStatus) error
+	// Refresh renews the presence of the users online or idle on the instance
+	Refresh(ctx context.Context, instanceID string) error
+	// Load merges what the instances saved about the room. Users are online if
+	// they are online on any instance, users who went offline longer than
+	// offlineRetention ago are left out.
+	Load(ctx context.Context, roomID uint) ([]UserPresence, error)
+}
+
+// mergePresence combines the presence of the users on each instance
+func mergePresence(saved []UserPresence) []UserPresence {
+	statusOrder := map[PresenceStatus]int{PresenceOnline: 0, PresenceIdle: 1, PresenceOffline: 2}
+
+	merged := make([]UserPresence, 0, len(saved))
+	byUser := make(map[uint]int, len(saved))
+	for _, userPresence := range saved {
+		i, ok := byUser[userPresence.UserID]
+		if !ok {
+			byUser[userPresence.UserID] = len(merged)
+			merged = append(merged, userPresence)
+			continue
+		}
+		if statusOrder[userPresence.Status] < statusOrder[merged[i].Status] {
+			merged[i].Status = userPresence.Status
+		}
+		if userPresence.LastSeen.After(merged[i].LastSeen) {
+			merged[i].LastSeen = userPresence.LastSeen
+		}
+	}
+
+	roster := merged[:0]
+	for _, userPresence := range merged {
+		if userPresence.Status == PresenceOffline && time.Since(userPresence.LastSeen) > offlineRetention {
+			continue
+		}
+		roster = append(roster, userPresence)
+	}
+	return roster
+}
+
+type instanceUser struct {
+	instanceID string
+	userID     uint
+}
+
+// LocalPresenceStore keeps presence in memory, for single instance deployments
+type LocalPresenceStore struct {
+	mutex sync.Mutex
+	rooms map[uint]map[instanceUser]UserPresence
+}
+
+func (l *LocalPresenceStore) Save(ctx context.Context, instanceID string, roomID uint, userID uint, status PresenceStatus) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	room, ok := l.rooms[roomID]
+	if !ok {
+		room = make(map[instanceUser]UserPresence)
+		l.rooms[roomID] = room
+	}
+	room[instanceUser{instanceID, userID}] = UserPresence{UserID: userID, Status: status, LastSeen: time.Now()}
+	return nil
+}
+
+// Refresh forgets users who left long ago, the presence of running instances
+// doesn't expire in memory
+func (l *LocalPresenceStore) Refresh(ctx context.Context, instanceID string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for roomID, room := range l.rooms {
+		for key, userPresence := range room {
+			if userPresence.Status == PresenceOffline && time.Since(userPresence.LastSeen) > offlineRetention {
+				delete(room, key)
+			}
+		}
+		if len(room) == 0 {
+			delete(l.rooms, roomID)
+		}
+	}
+	return nil
+}
+
+func (l *LocalPresenceStore) Load(ctx context.Context, roomID uint) ([]UserPresence, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	saved := make([]UserPresence, 0, len(l.rooms[roomID]))
+	for _, userPresence := range l.rooms[roomID] {
+		saved = append(saved, userPresence)
+	}
+	return mergePresence(saved), nil
+}
+
+func NewLocalPresenceStore() *LocalPresenceStore {
+	return &LocalPresenceStore{rooms: make(map[uint]map[instanceUser]UserPresence)}
+}
+
+// PostgresPresenceStore keeps presence in the room_presences table, one row
+// per instance a user is connected to. Times come from the database, so the
+// clocks of the instances don't have to agree.
+type PostgresPresenceStore struct {
+	db *database.Database
+}
+
+func (p *PostgresPresenceStore) Save(ctx context.Context, instanceID string, roomID uint, userID uint, status PresenceStatus) error {
+	return p.db.DB.WithContext(ctx).Exec(`
+		INSERT INTO room_presences (instance_id, room_id, user_id, status, last_seen, expires_at)
+		VALUES (?, ?, ?, ?, now(), now() + make_interval(secs => ?))
+		ON CONFLICT (instance_id, room_id, user_id) DO UPDATE
+		    SET status     = excluded.status,
+		        last_seen  = excluded.last_seen,
+		        expires_at = excluded.expires_at`,
+		instanceID, roomID, userID, status, presenceLease.Seconds()).Error
+}
+
+// Refresh renews the lease of the instance's users, and removes users every
+// instance forgot about
+func (p *PostgresPresenceStore) Refresh(ctx context.Context, instanceID string) error {
+	if err := p.db.DB.WithContext(ctx).Exec(`
+		UPDATE room_presences
+		SET last_seen = now(), expires_at = now() + make_interval(secs => ?)
+		WHERE instance_id = ? AND status <> ?`,
+		presenceLease.Seconds(), instanceID, PresenceOffline).Error; err != nil {
+		return err
+	}
+
+	return p.db.DB.WithContext(ctx).Exec(`
+		DELETE FROM room_presences
+		WHERE expires_at < now() AND last_seen < now() - make_interval(secs => ?)`,
+		offlineRetention.Seconds()).Error
+}
+
+func (p *PostgresPresenceStore) Load(ctx context.Context, roomID uint) ([]UserPresence, error) {
+	var rows []struct {
+		UserID   uint
+		Status   PresenceStatus
+		LastSeen time.Time
+	}
+	if err := p.db.DB.WithContext(ctx).Raw(`
+		SELECT user_id,
+		       CASE WHEN expires_at > now() THEN status ELSE ? END AS status,
+		       last_seen
+		FROM room_presences
+		WHERE room_id = ?
+		  AND (expires_at > now() OR last_seen > now() - make_interval(secs => ?))`,
+		PresenceOffline, roomID, offlineRetention.Seconds()).
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	saved := make([]UserPresence, len(rows))
+	for i, row := range rows {
+		saved[i] = UserPresence{UserID: row.UserID, Status: row.Status, LastSeen: row.LastSeen}
+	}
+	return mergePresence(saved), nil
+}
+
+func NewPostgresPresenceStore(db *database.Database) *PostgresPresenceStore {
+	if db == nil {
+		panic("db cannot be nil")
+	}
+
+	return &PostgresPresenceStore{db: db}
+}
+
+// NewPresenceStoreFromEnv shares presence through Postgres unless
+// REALTIME_BACKPLANE is local, like the room events
+func NewPresenceStoreFromEnv(db *database.Database) (PresenceStore, error) {
+	switch backplane := getEnv("REALTIME_BACKPLANE"); backplane {
+	case "", BackplanePostgres:
+		return NewPostgresPresenceStore(db), nil
+	case BackplaneLocal:
+		return NewLocalPresenceStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown realtime backplane %q", backplane)
+	}
+}
+
+var _ PresenceStore = &LocalPresenceStore{}
+var _ PresenceStore = &PostgresPresenceStore{}
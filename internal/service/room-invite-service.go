@@ -0,0 +1,385 @@
+package service
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/room"
+	"github.com/markojerkic/spring-planing/internal/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidInvite    = errors.New("this invite link is invalid, expired or was revoked")
+	ErrPasscodeRequired = errors.New("this room needs a passcode")
+	ErrWrongPasscode    = errors.New("wrong passcode")
+	ErrInvalidValidity  = errors.New("invites can't expire in the past")
+	ErrTooManyAttempts  = errors.New("too many wrong passcodes, try again later")
+)
+
+const (
+	// Iterations of PBKDF2-SHA256 recommended by OWASP
+	passcodeIterations = 600_000
+	// Wrong passcodes allowed per window, for each user and for each invite.
+	// Checks in progress count too, so concurrent guesses can't get around it
+	// and hashing stays bounded.
+	passcodeUserAttempts   = 5
+	passcodeInviteAttempts = 20
+	passcodeAttemptWindow  = 15 * time.Minute
+)
+
+// RoomInviteService decides who can join a room. Rooms are only joined with
+// an invite link, knowing the room ID isn't enough.
+type RoomInviteService struct {
+	db     *database.Database
+	policy *RoomPolicy
+}
+
+// InviteLink is the path users join the room with
+func InviteLink(token string) string {
+	return "/room/join/" + token
+}
+
+// newInvite creates an invite with an unguessable token
+func newInvite(tx *gorm.DB, roomID uint, userID uint, role RoomRole, expiresAt *time.Time) (*database.RoomInvite, error) {
+	invite := database.RoomInvite{
+		RoomID:    roomID,
+		Token:     rand.Text(),
+		CreatedBy: userID,
+		Role:      role,
+		ExpiresAt: expiresAt,
+	}
+	if err := tx.Create(&invite).Error; err != nil {
+		return nil, err
+	}
+	return &invite, nil
+}
+
+// hashPasscode salts and hashes the passcode, the result is stored as
+// pbkdf2-sha256$<iterations>$<salt>$<hash>
+func hashPasscode(passcode string) (string, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, passcode, salt, passcodeIterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passcodeIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func checkPasscode(hash string, passcode string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, passcode, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// reservePasscodeAttempt counts an attempt of the key in the current window,
+// failing with ErrTooManyAttempts once there were too many
+func (r *RoomInviteService) reservePasscodeAttempt(ctx context.Context, key string, limit int) error {
+	var attempts int
+	if err := r.db.DB.WithContext(ctx).Raw(`
+		INSERT INTO passcode_attempts (key, attempts, window_ends_at)
+		VALUES (?, 1, now() + make_interval(secs => ?))
+		ON CONFLICT (key) DO UPDATE
+		    SET attempts       = CASE WHEN passcode_attempts.window_ends_at < now() THEN 1
+		                              ELSE passcode_attempts.attempts + 1 END,
+		        window_ends_at = CASE WHEN passcode_attempts.window_ends_at < now() THEN excluded.window_ends_at
+		                              ELSE passcode_attempts.window_ends_at END
+		RETURNING attempts`, key, passcodeAttemptWindow.Seconds()).
+		Scan(&attempts).Error; err != nil {
+		return err
+	}
+	if attempts > limit {
+		return ErrTooManyAttempts
+	}
+	return nil
+}
+
+// releasePasscodeAttempt stops counting an attempt which turned out right
+func (r *RoomInviteService) releasePasscodeAttempt(ctx context.Context, key string) error {
+	return r.db.DB.WithContext(ctx).Model(&database.PasscodeAttempt{}).
+		Where("key = ? AND attempts > 0", key).
+		Update("attempts", gorm.Expr("attempts - 1")).Error
+}
+
+// checkPasscodeThrottled checks the passcode unless the user or the invite
+// tried too many wrong ones lately
+func (r *RoomInviteService) checkPasscodeThrottled(ctx context.Context, invite *database.RoomInvite, userID uint, hash string, passcode string) error {
+	keys := []struct {
+		key   string
+		limit int
+	}{
+		{fmt.Sprintf("user:%d", userID), passcodeUserAttempts},
+		{fmt.Sprintf("invite:%d", invite.ID), passcodeInviteAttempts},
+	}
+	for _, key := range keys {
+		if err := r.reservePasscodeAttempt(ctx, key.key, key.limit); err != nil {
+			return err
+		}
+	}
+
+	if !checkPasscode(hash, passcode) {
+		return ErrWrongPasscode
+	}
+
+	for _, key := range keys {
+		if err := r.releasePasscodeAttempt(ctx, key.key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activeInvite finds the invite of the token, failing with ErrInvalidInvite
+// if it doesn't exist or can no longer be used
+func (r *RoomInviteService) activeInvite(ctx context.Context, token string) (*database.RoomInvite, error) {
+	var invites []database.RoomInvite
+	if err := r.db.DB.WithContext(ctx).Where("token = ?", token).Limit(1).Find(&invites).Error; err != nil {
+		return nil, err
+	}
+	if len(invites) == 0 || !invites[0].Active(time.Now()) {
+		return nil, ErrInvalidInvite
+	}
+	return &invites[0], nil
+}
+
+// InvitedRoom returns the room the invite is for
+func (r *RoomInviteService) InvitedRoom(ctx context.Context, token string) (*database.Room, error) {
+	invite, err := r.activeInvite(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var invitedRoom database.Room
+	if err := r.db.DB.WithContext(ctx).Select("id", "name").First(&invitedRoom, invite.RoomID).Error; err != nil {
+		return nil, err
+	}
+	return &invitedRoom, nil
+}
+
+// Join makes the user a member of the room of the invite, with the role of
+// the invite. Members of the room are let through without a passcode, others
+// are throttled after a few wrong ones.
+func (r *RoomInviteService) Join(ctx context.Context, token string, userID uint, passcode string) (uint, error) {
+	invite, err := r.activeInvite(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+
+	role, err := r.policy.Role(ctx, invite.RoomID, userID)
+	if err != nil {
+		return 0, err
+	}
+	if role != RoleNone {
+		return invite.RoomID, nil
+	}
+
+	var invitedRoom database.Room
+	if err := r.db.DB.WithContext(ctx).Select("id", "passcode_hash").First(&invitedRoom, invite.RoomID).Error; err != nil {
+		return 0, err
+	}
+	if invitedRoom.PasscodeHash != "" {
+		if passcode == "" {
+			return 0, ErrPasscodeRequired
+		}
+		if err := r.checkPasscodeThrottled(ctx, invite, userID, invitedRoom.PasscodeHash, passcode); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := r.db.DB.WithContext(ctx).
+		Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&database.RoomUser{RoomID: invite.RoomID, UserID: userID, Role: invite.Role}).Error; err != nil {
+		return 0, err
+	}
+	return invite.RoomID, nil
+}
+
+// ShareLink returns the link members can share the room with, the newest
+// invite that doesn't expire. Empty if the owners revoked all of them, rooms
+// from before invite links get theirs the first time it is asked for.
+func (r *RoomInviteService) ShareLink(ctx context.Context, roomID uint, userID uint) (string, error) {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionViewRoom); err != nil {
+		return "", err
+	}
+
+	var invites []database.RoomInvite
+	if err := r.db.DB.WithContext(ctx).
+		Where("room_id = ? AND role = ? AND expires_at IS NULL AND revoked_at IS NULL", roomID, RoleEstimator).
+		Order("id desc").
+		Limit(1).
+		Find(&invites).Error; err != nil {
+		return "", err
+	}
+	if len(invites) > 0 {
+		return InviteLink(invites[0].Token), nil
+	}
+
+	invite, err := r.defaultInvite(ctx, roomID)
+	if err != nil || invite == nil {
+		return "", err
+	}
+	return InviteLink(invite.Token), nil
+}
+
+// defaultInvite creates the invite rooms are created with for rooms from
+// before invite links, which never had one. Nil if the room had invites.
+func (r *RoomInviteService) defaultInvite(ctx context.Context, roomID uint) (*database.RoomInvite, error) {
+	var invite *database.RoomInvite
+	err := r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// Locked, so concurrent page loads create only one
+		var legacyRoom database.Room
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "created_by").
+			First(&legacyRoom, roomID).Error; err != nil {
+			return err
+		}
+
+		var invites int64
+		if err := tx.Unscoped().Model(&database.RoomInvite{}).Where("room_id = ?", roomID).Count(&invites).Error; err != nil {
+			return err
+		}
+		if invites > 0 {
+			return nil
+		}
+
+		var err error
+		invite, err = newInvite(tx, roomID, legacyRoom.CreatedBy, RoleEstimator, nil)
+		return err
+	})
+	return invite, err
+}
+
+// GetInvites lists the invites of the room that can still be used
+func (r *RoomInviteService) GetInvites(ctx context.Context, roomID uint, userID uint) (room.InvitesProps, error) {
+	props := room.InvitesProps{RoomID: roomID}
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionManageMembers); err != nil {
+		return props, err
+	}
+	for _, role := range RoomRoles {
+		props.Roles = append(props.Roles, string(role))
+	}
+
+	var invitedRoom database.Room
+	if err := r.db.DB.WithContext(ctx).Select("id", "passcode_hash").First(&invitedRoom, roomID).Error; err != nil {
+		return props, err
+	}
+	props.HasPasscode = invitedRoom.PasscodeHash != ""
+
+	var invites []database.RoomInvite
+	if err := r.db.DB.WithContext(ctx).
+		Where("room_id = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", roomID, time.Now()).
+		Order("id desc").
+		Find(&invites).Error; err != nil {
+		return props, err
+	}
+	for _, invite := range invites {
+		props.Invites = append(props.Invites, room.InviteProps{
+			ID:        invite.ID,
+			Link:      InviteLink(invite.Token),
+			Role:      string(invite.Role),
+			ExpiresAt: invite.ExpiresAt,
+		})
+	}
+
+	return props, nil
+}
+
+// CreateInvite creates an invite link giving the role to those who join with
+// it. It expires after validFor, or never if validFor is zero.
+func (r *RoomInviteService) CreateInvite(ctx context.Context, roomID uint, userID uint, role RoomRole, validFor time.Duration) (*database.RoomInvite, error) {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionManageMembers); err != nil {
+		return nil, err
+	}
+	if !RoleCan(role, ActionViewRoom) {
+		return nil, ErrInvalidRole
+	}
+	if validFor < 0 {
+		return nil, ErrInvalidValidity
+	}
+
+	var expiresAt *time.Time
+	if validFor > 0 {
+		expires := time.Now().Add(validFor)
+		expiresAt = &expires
+	}
+	return newInvite(r.db.DB.WithContext(ctx), roomID, userID, role, expiresAt)
+}
+
+// RevokeInvite stops anyone else from joining with the invite. Members who
+// already joined with it stay in the room.
+func (r *RoomInviteService) RevokeInvite(ctx context.Context, roomID uint, userID uint, inviteID uint) error {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionManageMembers); err != nil {
+		return err
+	}
+
+	result := r.db.DB.WithContext(ctx).Model(&database.RoomInvite{}).
+		Where("id = ? AND room_id = ? AND revoked_at IS NULL", inviteID, roomID).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// SetPasscode changes the passcode users have to enter when they join with an
+// invite, an empty passcode removes it
+func (r *RoomInviteService) SetPasscode(ctx context.Context, roomID uint, userID uint, passcode string) error {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionManageMembers); err != nil {
+		return err
+	}
+
+	var hash string
+	if passcode != "" {
+		var err error
+		if hash, err = hashPasscode(passcode); err != nil {
+			return err
+		}
+	}
+	return r.db.DB.WithContext(ctx).Model(&database.Room{}).
+		Where("id = ?", roomID).
+		Update("passcode_hash", hash).Error
+}
+
+func NewRoomInviteService(db *database.Database) *RoomInviteService {
+	if db == nil {
+		panic("db cannot be nil")
+	}
+
+	return &RoomInviteService{
+		db:     db,
+		policy: NewRoomPolicy(db),
+	}
+}
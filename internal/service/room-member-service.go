@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/room"
+	"github.com/markojerkic/spring-planing/internal/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var ErrOwnerRole = errors.New("the role of the room owner can't be changed, transfer the room first")
+
+// RoomMemberService lets owners decide who can do what in their rooms
+type RoomMemberService struct {
+	db               *database.Database
+	policy           *RoomPolicy
+	webSocketService *WebSocketService
+}
+
+// GetMembers lists the members of the room and their roles
+func (r *RoomMemberService) GetMembers(ctx context.Context, roomID uint, userID uint) (room.MembersProps, error) {
+	props := room.MembersProps{RoomID: roomID}
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionManageMembers); err != nil {
+		return props, err
+	}
+
+	var createdBy uint
+	if err := r.db.DB.WithContext(ctx).Model(&database.Room{}).
+		Select("created_by").
+		Where("id = ?", roomID).
+		Scan(&createdBy).Error; err != nil {
+		return props, err
+	}
+	props.CanTransfer = createdBy == userID
+	for _, role := range RoomRoles {
+		props.Roles = append(props.Roles, string(role))
+	}
+
+	var members []struct {
+		database.User
+		Role RoomRole
+	}
+	if err := r.db.DB.WithContext(ctx).Model(&database.User{}).
+		Select("users.*, room_users.role").
+		Joins("JOIN room_users ON room_users.user_id = users.id").
+		Where("room_users.room_id = ?", roomID).
+		Order("users.id").
+		Scan(&members).Error; err != nil {
+		return props, err
+	}
+
+	for _, member := range members {
+		isRoomOwner := member.ID == createdBy
+		if isRoomOwner {
+			member.Role = RoleOwner
+		}
+		props.Members = append(props.Members, room.MemberProps{
+			UserID:      member.ID,
+			Avatar:      member.Avatar(),
+			Role:        string(member.Role),
+			IsRoomOwner: isRoomOwner,
+		})
+	}
+
+	return props, nil
+}
+
+// SetRole changes the role of a member of the room. Their open connections are
+// moved to the updates of the new role.
+func (r *RoomMemberService) SetRole(ctx context.Context, roomID uint, userID uint, memberID uint, role RoomRole) error {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionManageMembers); err != nil {
+		return err
+	}
+	if !RoleCan(role, ActionViewRoom) {
+		return ErrInvalidRole
+	}
+
+	err := r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var room database.Room
+		if err := tx.Select("id", "created_by").First(&room, roomID).Error; err != nil {
+			return err
+		}
+		if room.CreatedBy == memberID {
+			return ErrOwnerRole
+		}
+
+		result := tx.Model(&database.RoomUser{}).
+			Where("room_id = ? AND user_id = ?", roomID, memberID).
+			Update("role", role)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.webSocketService.ChangeRole(roomID, memberID, role)
+	return nil
+}
+
+// TransferOwnership hands the room over to another member. Only the current
+// room owner can do it and they stay in the room as a moderator.
+func (r *RoomMemberService) TransferOwnership(ctx context.Context, roomID uint, userID uint, newOwnerID uint) error {
+	err := r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var room database.Room
+		if err := tx.Select("id", "created_by").First(&room, roomID).Error; err != nil {
+			return err
+		}
+		if room.CreatedBy != userID {
+			return ErrForbidden
+		}
+		if newOwnerID == userID {
+			return nil
+		}
+
+		result := tx.Model(&database.RoomUser{}).
+			Where("room_id = ? AND user_id = ?", roomID, newOwnerID).
+			Update("role", RoleOwner)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		// Owners of older rooms may only be the room's creator, without a membership
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "room_id"}, {Name: "user_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"role"}),
+		}).Create(&database.RoomUser{RoomID: roomID, UserID: userID, Role: RoleModerator}).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&room).Update("created_by", newOwnerID).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	r.webSocketService.ChangeRole(roomID, newOwnerID, RoleOwner)
+	r.webSocketService.ChangeRole(roomID, userID, RoleModerator)
+	return nil
+}
+
+func NewRoomMemberService(db *database.Database, webSocketService *WebSocketService) *RoomMemberService {
+	if db == nil {
+		panic("db cannot be nil")
+	}
+	if webSocketService == nil {
+		panic("webSocketService cannot be nil")
+	}
+
+	return &RoomMemberService{
+		db:               db,
+		policy:           NewRoomPolicy(db),
+		webSocketService: webSocketService,
+	}
+}
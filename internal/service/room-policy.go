@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+)
+
+var (
+	ErrForbidden   = errors.New("you are not allowed to do this in this room")
+	ErrInvalidRole = errors.New("invalid room role")
+)
+
+// RoomRole is what a user is allowed to do in a room, stored on their membership
+type RoomRole = database.RoomRole
+
+const (
+	// RoleNone is the role of users who never joined the room
+	RoleNone      RoomRole = ""
+	RoleObserver  RoomRole = "observer"
+	RoleEstimator RoomRole = "estimator"
+	RoleModerator RoomRole = "moderator"
+	RoleOwner     RoomRole = "owner"
+)
+
+type RoomAction string
+
+const (
+	// ActionViewRoom covers reading the tickets and estimates of the room and
+	// following its realtime events
+	ActionViewRoom          RoomAction = "viewRoom"
+	ActionEstimate          RoomAction = "estimate"
+	ActionWriteJiraEstimate RoomAction = "writeJiraEstimate"
+	ActionCreateTicket      RoomAction = "createTicket"
+	ActionEditTicket        RoomAction = "editTicket"
+	ActionDeleteTicket      RoomAction = "deleteTicket"
+	ActionImportTickets     RoomAction = "importTickets"
+	ActionHideTicket        RoomAction = "hideTicket"
+	ActionCloseTicket       RoomAction = "closeTicket"
+	ActionReopenTicket      RoomAction = "reopenTicket"
+	ActionStartRound        RoomAction = "startRound"
+	ActionRevealVotes       RoomAction = "revealVotes"
+	ActionFacilitate        RoomAction = "facilitate"
+	ActionConfigureLLM      RoomAction = "configureLLM"
+	ActionManageMembers     RoomAction = "manageMembers"
+	ActionDeleteRoom        RoomAction = "deleteRoom"
+)
+
+var moderatorActions = []RoomAction{
+	ActionViewRoom, ActionEstimate, ActionWriteJiraEstimate,
+	ActionCreateTicket, ActionImportTickets, ActionEditTicket, ActionDeleteTicket,
+	ActionHideTicket, ActionCloseTicket, ActionReopenTicket, ActionStartRound, ActionRevealVotes,
+	ActionFacilitate,
+}
+
+// roomPermissions lists the actions every role is allowed to do
+var roomPermissions = map[RoomRole][]RoomAction{
+	RoleObserver:  {ActionViewRoom},
+	RoleEstimator: {ActionViewRoom, ActionEstimate, ActionWriteJiraEstimate},
+	RoleModerator: moderatorActions,
+	RoleOwner:     append(slices.Clone(moderatorActions), ActionConfigureLLM, ActionManageMembers, ActionDeleteRoom),
+}
+
+// RoomRoles lists the roles members can have, from the most to the least allowed
+var RoomRoles = []RoomRole{RoleOwner, RoleModerator, RoleEstimator, RoleObserver}
+
+func RoleCan(role RoomRole, action RoomAction) bool {
+	return slices.Contains(roomPermissions[role], action)
+}
+
+func ParseRoomRole(role string) (RoomRole, error) {
+	if !slices.Contains(RoomRoles, RoomRole(role)) {
+		return RoleNone, fmt.Errorf("%w %q", ErrInvalidRole, role)
+	}
+	return RoomRole(role), nil
+}
+
+// RoomPolicy decides who can do what in a room. Every service reading or
+// changing a room checks with it, so handlers and websocket commands can't
+// forget to.
+type RoomPolicy struct {
+	db *database.Database
+}
+
+// Role returns the role of the user in the room. The user who created the
+// room, or took it over, is always an owner. Fails with gorm.ErrRecordNotFound
+// if the room doesn't exist.
+func (p *RoomPolicy) Role(ctx context.Context, roomID uint, userID uint) (RoomRole, error) {
+	var room database.Room
+	if err := p.db.DB.WithContext(ctx).Select("id", "created_by").First(&room, roomID).Error; err != nil {
+		return RoleNone, err
+	}
+	if room.CreatedBy == userID {
+		return RoleOwner, nil
+	}
+
+	var members []database.RoomUser
+	if err := p.db.DB.WithContext(ctx).
+		Where("room_id = ? AND user_id = ?", roomID, userID).
+		Limit(1).
+		Find(&members).Error; err != nil {
+		return RoleNone, err
+	}
+	if len(members) == 0 {
+		return RoleNone, nil
+	}
+	return members[0].Role, nil
+}
+
+// Authorize fails with ErrForbidden unless the user's role in the room allows the action
+func (p *RoomPolicy) Authorize(ctx context.Context, roomID uint, userID uint, action RoomAction) (RoomRole, error) {
+	role, err := p.Role(ctx, roomID, userID)
+	if err != nil {
+		return RoleNone, err
+	}
+	if !RoleCan(role, action) {
+		return role, ErrForbidden
+	}
+	return role, nil
+}
+
+// AuthorizeTicket authorizes the action in the room of the ticket and returns the room
+func (p *RoomPolicy) AuthorizeTicket(ctx context.Context, ticketID uint, userID uint, action RoomAction) (uint, error) {
+	var ticket database.Ticket
+	if err := p.db.DB.WithContext(ctx).Select("id", "room_id").First(&ticket, ticketID).Error; err != nil {
+		return 0, err
+	}
+	if _, err := p.Authorize(ctx, ticket.RoomID, userID, action); err != nil {
+		return 0, err
+	}
+	return ticket.RoomID, nil
+}
+
+func NewRoomPolicy(db *database.Database) *RoomPolicy {
+	if db == nil {
+		panic("db cannot be nil")
+	}
+
+	return &RoomPolicy{db: db}
+}
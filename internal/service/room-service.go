@@ -3,15 +3,19 @@ package service
 import (
 	"context"
 	"errors"
-	"log/slog"
+	"fmt"
 
+	"github.com/markojerkic/spring-planing/cmd/web/components/room"
 	"github.com/markojerkic/spring-planing/internal/database"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type RoomService struct {
 	db                *database.Database
 	roomTicketService *RoomTicketService
+	presenceService   *PresenceService
+	policy            *RoomPolicy
 }
 
 type RoomTicket struct {
@@ -21,8 +25,32 @@ type RoomTicket struct {
 	IsClosed bool   `json:"isClosed"`
 }
 
+type CreateRoomForm struct {
+	RoomName        string
+	AllowLLM        bool
+	EstimationScale string
+	CustomScale     string
+	// Ask for optimistic, most likely and pessimistic estimates
+	ThreePoint bool
+	// Passcode invited users have to enter to join, optional
+	Passcode string
+}
+
+// roomTotal is the sum of the closed tickets' estimates. Three-point rooms
+// also get the standard deviation of the sum, assuming the tickets are
+// independent of each other.
+type roomTotal struct {
+	TotalEstimate float64
+	TotalStdDev   float64
+}
+
 func (r *RoomService) GetTotalEstimateOfRoom(ctx context.Context, roomID uint) (string, error) {
-	var totalEstimatedHours int
+	var room database.Room
+	if err := r.db.DB.WithContext(ctx).Select("id", "estimation_scale", "custom_scale", "three_point").First(&room, roomID).Error; err != nil {
+		return "", err
+	}
+
+	var total roomTotal
 	if err := r.db.DB.Raw(`
 		WITH
 		  avg_estimates AS (
@@ -31,32 +59,50 @@ func (r *RoomService) GetTotalEstimateOfRoom(ctx context.Context, roomID uint) (
 				ORDER BY
 				  estimate
 			  ) AS median_estimate,
+			  COALESCE(AVG((pessimistic - optimistic) / 6), 0) AS pert_std_dev,
 			  room_id
 			FROM
 			  estimates
 			  JOIN tickets ON tickets.id = estimates.ticket_id
 			  AND tickets.closed_at IS NOT NULL
+			  AND tickets.deleted_at IS NULL
 			WHERE estimates.user_id IS NOT NULL
+			  AND estimates.kind = ''
+			  AND estimates.round = tickets.current_round
 			GROUP BY
 			  ticket_id,
 			  room_id
 		  )
 		SELECT
-		  COALESCE(SUM(median_estimate), 0) AS total_avg_estimate
+		  COALESCE(SUM(median_estimate), 0) AS total_estimate,
+		  SQRT(COALESCE(SUM(pert_std_dev * pert_std_dev), 0)) AS total_std_dev
 		FROM
 		  avg_estimates
 		WHERE
 		  room_id = ?;
 		`, roomID).
-		First(&totalEstimatedHours).
+		Scan(&total).
 		Error; err != nil {
 		return "", err
 	}
 
-	return prettyPrintEstimate(totalEstimatedHours), nil
+	deck := room.Deck()
+	if room.ThreePoint {
+		return fmt.Sprintf("%s (%s)", deck.FormatTotal(total.TotalEstimate),
+			deck.FormatTotalRange(total.TotalEstimate, total.TotalStdDev)), nil
+	}
+	return deck.FormatTotal(total.TotalEstimate), nil
+}
+
+// GetTicketList lists the tickets of the room for one of its participants
+func (r *RoomService) GetTicketList(ctx context.Context, roomID uint, userID uint) ([]RoomTicket, error) {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionViewRoom); err != nil {
+		return nil, err
+	}
+	return r.ticketList(ctx, roomID)
 }
 
-func (r *RoomService) GetTicketList(ctx context.Context, roomID uint) ([]RoomTicket, error) {
+func (r *RoomService) ticketList(ctx context.Context, roomID uint) ([]RoomTicket, error) {
 	tickets := make([]database.Ticket, 0)
 	if err := r.db.DB.Model(&database.Ticket{}).
 		Select("id, name, hidden, closed_at").
@@ -78,17 +124,38 @@ func (r *RoomService) GetTicketList(ctx context.Context, roomID uint) ([]RoomTic
 	return ticketDtos, nil
 }
 
-func (r *RoomService) GetIsOwner(ctx context.Context, roomID uint, userID uint) bool {
-	var room database.Room
-	if err := r.db.DB.First(&room, roomID).Error; err != nil {
-		slog.Error("Error reading room", slog.Any("err", err))
-		return false
+// Authorize returns the role of the user in the room, failing with
+// ErrForbidden if the role doesn't allow the action
+func (r *RoomService) Authorize(ctx context.Context, roomID uint, userID uint, action RoomAction) (RoomRole, error) {
+	return r.policy.Authorize(ctx, roomID, userID, action)
+}
+
+// UpdateLLMSettings turns LLM estimation of the room on or off and picks its
+// provider. It returns the updated room, whose deck tells whether the LLM can
+// estimate its tickets.
+func (r *RoomService) UpdateLLMSettings(ctx context.Context, roomID uint, userID uint, allowLLM bool, llmProvider string) (*database.Room, error) {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionConfigureLLM); err != nil {
+		return nil, err
 	}
 
-	return userID == room.CreatedBy
+	var room database.Room
+	if err := r.db.DB.WithContext(ctx).Model(&room).
+		Clauses(clause.Returning{}).
+		Where("id = ?", roomID).
+		Updates(map[string]any{
+			"allow_llm_estimation": allowLLM,
+			"llm_provider":         llmProvider,
+		}).Error; err != nil {
+		return nil, err
+	}
+	return &room, nil
 }
 
 func (r *RoomService) DeleteRoom(ctx context.Context, roomID uint, userID uint) ([]database.Room, error) {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionDeleteRoom); err != nil {
+		return nil, err
+	}
+
 	var rooms []database.Room
 	err := r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		var room database.Room
@@ -96,10 +163,6 @@ func (r *RoomService) DeleteRoom(ctx context.Context, roomID uint, userID uint)
 			return err
 		}
 
-		if room.CreatedBy != userID {
-			return gorm.ErrRecordNotFound
-		}
-
 		if err := tx.Delete(&room).Error; err != nil {
 			return err
 		}
@@ -139,9 +202,27 @@ func (r *RoomService) GetUsersRooms(ctx context.Context, userID int32) ([]databa
 	return rooms, nil
 }
 
-func (r *RoomService) CreateRoom(ctx context.Context, userID uint, roomName string, allowLLM bool) (*database.Room, error) {
+func (r *RoomService) CreateRoom(ctx context.Context, userID uint, form CreateRoomForm) (*database.Room, error) {
+	scale, err := database.ParseEstimationScale(form.EstimationScale)
+	if err != nil {
+		return nil, err
+	}
+	var customScale string
+	if scale == database.ScaleCustom {
+		if customScale, err = database.ParseCustomScale(form.CustomScale); err != nil {
+			return nil, err
+		}
+	}
+
+	var passcodeHash string
+	if form.Passcode != "" {
+		if passcodeHash, err = hashPasscode(form.Passcode); err != nil {
+			return nil, err
+		}
+	}
+
 	var room database.Room
-	err := r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+	err = r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		var user database.User
 		if err := tx.First(&user, userID).Error; err != nil {
 			return err
@@ -149,8 +230,12 @@ func (r *RoomService) CreateRoom(ctx context.Context, userID uint, roomName stri
 
 		room = database.Room{
 			CreatedBy:          userID,
-			AllowLLMEstimation: allowLLM,
-			Name:               roomName,
+			AllowLLMEstimation: form.AllowLLM,
+			Name:               form.RoomName,
+			EstimationScale:    scale,
+			CustomScale:        customScale,
+			ThreePoint:         form.ThreePoint,
+			PasscodeHash:       passcodeHash,
 			Users:              []database.User{user},
 		}
 
@@ -158,7 +243,15 @@ func (r *RoomService) CreateRoom(ctx context.Context, userID uint, roomName stri
 			return err
 		}
 
-		return nil
+		if err := tx.Model(&database.RoomUser{}).
+			Where("room_id = ? AND user_id = ?", room.ID, userID).
+			Update("role", RoleOwner).Error; err != nil {
+			return err
+		}
+
+		// The link the room is shared with
+		_, err := newInvite(tx, room.ID, userID, RoleEstimator, nil)
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -167,14 +260,15 @@ func (r *RoomService) CreateRoom(ctx context.Context, userID uint, roomName stri
 	return &room, nil
 }
 
+// GetRoom loads the room for one of its members. Users join rooms with an
+// invite link, see RoomInviteService.
 func (r *RoomService) GetRoom(ctx context.Context, roomID uint, userID uint) (*database.Room, error) {
+	if _, err := r.policy.Authorize(ctx, roomID, userID, ActionViewRoom); err != nil {
+		return nil, err
+	}
+
 	var room database.Room
 	err := r.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		var user database.User
-		if err := tx.First(&user, userID).Error; err != nil {
-			return err
-		}
-
 		if err := tx.Preload("Users").
 			First(&room, roomID).Error; err != nil {
 			return err
@@ -186,22 +280,6 @@ func (r *RoomService) GetRoom(ctx context.Context, roomID uint, userID uint) (*d
 		}
 		room.TicketsWithStatistics = ticketsWithStatistics
 
-		// Check if user is in the room
-		// If not, add user to the room
-		var found bool
-		for _, u := range room.Users {
-			if u.ID == user.ID {
-				found = true
-				break
-			}
-		}
-		if !found {
-			room.Users = append(room.Users, user)
-			if err := tx.Save(&room).Error; err != nil {
-				return err
-			}
-		}
-
 		return nil
 	})
 	if err != nil {
@@ -211,9 +289,111 @@ func (r *RoomService) GetRoom(ctx context.Context, roomID uint, userID uint) (*d
 	return &room, nil
 }
 
-func NewRoomService(db *database.Database, roomTicketService *RoomTicketService) *RoomService {
+// GetPresenceRoster lists who is in the room and whether they voted on the
+// current ticket. That is the active ticket of the room if it has an open one,
+// otherwise the newest open ticket.
+func (r *RoomService) GetPresenceRoster(ctx context.Context, roomID uint) (room.PresenceRosterProps, error) {
+	var props room.PresenceRosterProps
+
+	var roomDetails database.Room
+	if err := r.db.DB.WithContext(ctx).
+		Select("id", "created_by", "active_ticket_id").
+		First(&roomDetails, roomID).Error; err != nil {
+		return props, err
+	}
+	createdBy := roomDetails.CreatedBy
+
+	var currentTicket database.Ticket
+	if roomDetails.ActiveTicketID != nil {
+		err := r.db.DB.WithContext(ctx).
+			Select("id", "name", "current_round").
+			Where("id = ? AND room_id = ? AND closed_at IS NULL", *roomDetails.ActiveTicketID, roomID).
+			First(&currentTicket).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return props, err
+		}
+	}
+	if currentTicket.ID == 0 {
+		err := r.db.DB.WithContext(ctx).
+			Select("id", "name", "current_round").
+			Where("room_id = ? AND closed_at IS NULL AND hidden = false", roomID).
+			Order("id desc").
+			First(&currentTicket).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return props, err
+		}
+	}
+
+	voted := make(map[uint]bool)
+	if currentTicket.ID != 0 {
+		props.CurrentTicket = currentTicket.Name
+
+		var voterIDs []uint
+		if err := r.db.DB.WithContext(ctx).Model(&database.Estimate{}).
+			Where("ticket_id = ? AND round = ? AND user_id IS NOT NULL", currentTicket.ID, currentTicket.CurrentRound).
+			Pluck("user_id", &voterIDs).Error; err != nil {
+			return props, err
+		}
+		for _, id := range voterIDs {
+			voted[id] = true
+		}
+	}
+
+	roster, err := r.presenceService.Roster(ctx, roomID)
+	if err != nil {
+		return props, err
+	}
+	userIDs := make([]uint, len(roster))
+	for i, presence := range roster {
+		userIDs[i] = presence.UserID
+	}
+	var users []database.User
+	if err := r.db.DB.WithContext(ctx).Find(&users, userIDs).Error; err != nil {
+		return props, err
+	}
+	usersByID := make(map[uint]database.User, len(users))
+	for _, u := range users {
+		usersByID[u.ID] = u
+	}
+	var members []database.RoomUser
+	if err := r.db.DB.WithContext(ctx).
+		Where("room_id = ? AND user_id IN ?", roomID, userIDs).
+		Find(&members).Error; err != nil {
+		return props, err
+	}
+	roles := make(map[uint]RoomRole, len(members))
+	for _, member := range members {
+		roles[member.UserID] = member.Role
+	}
+	roles[createdBy] = RoleOwner
+
+	for _, presence := range roster {
+		participant, ok := usersByID[presence.UserID]
+		if !ok {
+			participant = database.User{Model: gorm.Model{ID: presence.UserID}}
+		}
+		props.Participants = append(props.Participants, room.ParticipantProps{
+			UserID:   presence.UserID,
+			Avatar:   participant.Avatar(),
+			Status:   string(presence.Status),
+			HasVoted: voted[presence.UserID],
+			IsOwner:  roles[presence.UserID] == RoleOwner,
+			Role:     string(roles[presence.UserID]),
+		})
+	}
+
+	return props, nil
+}
+
+func NewRoomService(db *database.Database, roomTicketService *RoomTicketService, presenceService *PresenceService) *RoomService {
+	if presenceService == nil {
+		panic("presenceService cannot be nil")
+	}
+
 	return &RoomService{
 		db:                db,
 		roomTicketService: roomTicketService,
+		presenceService:   presenceService,
+		policy:            NewRoomPolicy(db),
 	}
 }
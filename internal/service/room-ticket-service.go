@@ -2,26 +2,128 @@ package service
 
 import (
 	"context"
+	"slices"
 
 	"github.com/markojerkic/spring-planing/internal/database"
 	"gorm.io/gorm"
 )
 
 type RoomTicketService struct {
-	db *database.Database
+	db              *database.Database
+	presenceService *PresenceService
 }
 
-func (r *RoomTicketService) GetTicketsOfRoom(ctx context.Context, db *gorm.DB, userID uint, roomID uint) ([]database.TicketWithEstimateStatistics, error) {
+func (r *RoomTicketService) queryTickets(ctx context.Context, db *gorm.DB, userID uint, roomID uint) ([]database.TicketWithEstimateStatistics, error) {
+	// Everyone present in the room counts towards the users who should vote,
+	// as well as anyone who already voted and left since. Observers don't vote.
+	present, err := r.presenceService.PresentUserIDs(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	presentUserIDs, err := r.voterIDs(ctx, db, roomID, present)
+	if err != nil {
+		return nil, err
+	}
+	excludedUserIDs := presentUserIDs
+	if len(excludedUserIDs) == 0 {
+		excludedUserIDs = []uint{0}
+	}
+
 	var tickets []database.TicketWithEstimateStatistics
 	if err := db.WithContext(ctx).
-		Raw(ticketQuery, userID, roomID).
+		Raw(ticketQuery, len(presentUserIDs), len(presentUserIDs), excludedUserIDs, userID, roomID).
 		Scan(&tickets).Error; err != nil {
 		return nil, err
 	}
 
+	if err := r.loadRevealedVotes(ctx, db, roomID, tickets); err != nil {
+		return nil, err
+	}
+	if err := r.loadLLMJobs(ctx, db, roomID, tickets); err != nil {
+		return nil, err
+	}
+
+	return tickets, nil
+}
+
+// voterIDs leaves out the observers of the room
+func (r *RoomTicketService) voterIDs(ctx context.Context, db *gorm.DB, roomID uint, userIDs []uint) ([]uint, error) {
+	if len(userIDs) == 0 {
+		return userIDs, nil
+	}
+
+	var observerIDs []uint
+	if err := db.WithContext(ctx).Model(&database.RoomUser{}).
+		Where("room_id = ? AND user_id IN ? AND role = ?", roomID, userIDs, RoleObserver).
+		Pluck("user_id", &observerIDs).Error; err != nil {
+		return nil, err
+	}
+
+	voterIDs := make([]uint, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if !slices.Contains(observerIDs, userID) {
+			voterIDs = append(voterIDs, userID)
+		}
+	}
+	return voterIDs, nil
+}
+
+// loadRevealedVotes loads the individual votes of the current round, but only
+// for tickets whose votes were revealed
+func (r *RoomTicketService) loadRevealedVotes(ctx context.Context, db *gorm.DB, roomID uint, tickets []database.TicketWithEstimateStatistics) error {
+	var votes []database.Estimate
+	if err := db.WithContext(ctx).
+		Preload("User").
+		Joins("JOIN tickets ON tickets.id = estimates.ticket_id AND estimates.round = tickets.current_round").
+		Where("tickets.room_id = ? AND estimates.user_id IS NOT NULL", roomID).
+		Where("(tickets.revealed_at IS NOT NULL OR tickets.closed_at IS NOT NULL)").
+		Order("estimates.kind ASC, estimates.estimate ASC").
+		Find(&votes).Error; err != nil {
+		return err
+	}
+
+	for i := range tickets {
+		for _, vote := range votes {
+			if vote.TicketID == tickets[i].ID {
+				tickets[i].Votes = append(tickets[i].Votes, vote)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *RoomTicketService) loadLLMJobs(ctx context.Context, db *gorm.DB, roomID uint, tickets []database.TicketWithEstimateStatistics) error {
+	var jobs []database.LLMJob
+	if err := db.WithContext(ctx).
+		Preload("Examples", func(db *gorm.DB) *gorm.DB {
+			return db.Order("similarity DESC")
+		}).
+		Where("room_id = ?", roomID).
+		Find(&jobs).Error; err != nil {
+		return err
+	}
+
+	for i := range tickets {
+		for j := range jobs {
+			if jobs[j].TicketID == tickets[i].ID {
+				tickets[i].LlmJob = &jobs[j]
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *RoomTicketService) GetTicketsOfRoom(ctx context.Context, db *gorm.DB, userID uint, roomID uint) ([]database.TicketWithEstimateStatistics, error) {
+	tickets, err := r.queryTickets(ctx, db, userID, roomID)
+	if err != nil {
+		return nil, err
+	}
+
 	for i := range tickets {
 		if err := db.WithContext(ctx).
-			Preload("LlmEstimate").
+			Preload("LlmEstimate.Recommendation").
 			First(&tickets[i].Ticket, tickets[i].ID).Error; err != nil {
 			continue
 		}
@@ -30,6 +132,10 @@ func (r *RoomTicketService) GetTicketsOfRoom(ctx context.Context, db *gorm.DB, u
 	return tickets, nil
 }
 
-func NewRoomTicketService(db *database.Database) *RoomTicketService {
-	return &RoomTicketService{db: db}
+func NewRoomTicketService(db *database.Database, presenceService *PresenceService) *RoomTicketService {
+	if presenceService == nil {
+		panic("presenceService cannot be nil")
+	}
+
+	return &RoomTicketService{db: db, presenceService: presenceService}
 }
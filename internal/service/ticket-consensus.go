@@ -0,0 +1,30 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+)
+
+var ErrInvalidConsensus = errors.New("invalid consensus thresholds")
+
+// UpdateConsensusThresholds sets how many cards the votes of a round can be
+// apart for a consensus and for a near consensus. Rounds further apart are
+// split and the room is asked to vote again.
+func (t *TicketService) UpdateConsensusThresholds(ctx context.Context, roomID uint, userID uint, thresholds database.ConsensusThresholds) error {
+	if _, err := t.policy.Authorize(ctx, roomID, userID, ActionFacilitate); err != nil {
+		return err
+	}
+	if !thresholds.Valid() {
+		return fmt.Errorf("%w: a near consensus can't be closer than a consensus", ErrInvalidConsensus)
+	}
+
+	return t.db.DB.WithContext(ctx).Model(&database.Room{}).
+		Where("id = ?", roomID).
+		Updates(map[string]any{
+			"consensus_steps":      thresholds.Consensus,
+			"near_consensus_steps": thresholds.Near,
+		}).Error
+}
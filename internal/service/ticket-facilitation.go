@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
+	"github.com/markojerkic/spring-planing/internal/database"
+	"gorm.io/gorm"
+)
+
+// SetFacilitated switches the room between facilitated estimation, where only
+// the active ticket can be voted on, and voting on every open ticket. Turning
+// it on makes the next open ticket active if none is.
+func (t *TicketService) SetFacilitated(ctx context.Context, roomID uint, userID uint, facilitated bool) error {
+	if _, err := t.policy.Authorize(ctx, roomID, userID, ActionFacilitate); err != nil {
+		return err
+	}
+
+	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&database.Room{}).
+			Where("id = ?", roomID).
+			Update("facilitated", facilitated).Error; err != nil {
+			return err
+		}
+		_, err := t.queueNextTicket(tx, roomID, 0)
+		return err
+	})
+	if err != nil {
+		slog.Error("Error changing facilitation of room", slog.Any("room", roomID), slog.Any("error", err))
+		return err
+	}
+
+	t.sendActiveTicket(ctx, roomID)
+
+	return nil
+}
+
+// SetActiveTicket makes the ticket the one the room is estimating, it can
+// only be an open ticket everyone sees
+func (t *TicketService) SetActiveTicket(ctx context.Context, ticketID uint, userID uint) error {
+	roomID, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionFacilitate)
+	if err != nil {
+		return err
+	}
+
+	err = t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var openTicket database.Ticket
+		if err := tx.Select("id", "closed_at", "hidden").First(&openTicket, ticketID).Error; err != nil {
+			return err
+		}
+		if openTicket.ClosedAt != nil {
+			return fmt.Errorf("%w: closed tickets can't be estimated", ErrInvalidTicket)
+		}
+		if openTicket.Hidden {
+			return fmt.Errorf("%w: hidden tickets can't be estimated", ErrInvalidTicket)
+		}
+
+		return tx.Model(&database.Room{}).
+			Where("id = ?", roomID).
+			Update("active_ticket_id", ticketID).Error
+	})
+	if err != nil {
+		slog.Error("Error setting active ticket", slog.Any("ticket", ticketID), slog.Any("error", err))
+		return err
+	}
+
+	t.sendActiveTicket(ctx, roomID)
+
+	return nil
+}
+
+// GetActiveTicket returns the ticket the room is estimating
+func (t *TicketService) GetActiveTicket(ctx context.Context, roomID uint, userID uint) (ticket.ActiveTicketProps, error) {
+	if _, err := t.policy.Authorize(ctx, roomID, userID, ActionViewRoom); err != nil {
+		return ticket.ActiveTicketProps{}, err
+	}
+	return activeTicket(t.db.DB.WithContext(ctx), roomID)
+}
+
+// sendActiveTicket tells everyone in the room which ticket is active now
+func (t *TicketService) sendActiveTicket(ctx context.Context, roomID uint) {
+	active, err := activeTicket(t.db.DB.WithContext(ctx), roomID)
+	if err != nil {
+		slog.Error("Error getting active ticket", slog.Any("room", roomID), slog.Any("error", err))
+		return
+	}
+	t.webSocketService.SetActiveTicket(roomID, active)
+}
+
+// queueNextTicket moves the room on to the next ticket once the active one,
+// afterTicketID, is closed or deleted. Facilitated rooms without an active
+// ticket get one as well, pass 0 as afterTicketID for those.
+//
+// Tickets are queued in the order they were added to the room, skipping closed
+// and hidden ones, and starting over at the oldest open ticket after the last.
+// Returns whether the active ticket changed.
+func (t *TicketService) queueNextTicket(tx *gorm.DB, roomID uint, afterTicketID uint) (bool, error) {
+	var room database.Room
+	if err := tx.Select("id", "facilitated", "active_ticket_id").First(&room, roomID).Error; err != nil {
+		return false, err
+	}
+
+	switch {
+	case room.ActiveTicketID != nil && *room.ActiveTicketID == afterTicketID:
+	case room.ActiveTicketID == nil && room.Facilitated:
+	default:
+		return false, nil
+	}
+
+	queued := func(afterID uint) (*uint, error) {
+		var next database.Ticket
+		err := tx.Select("id").
+			Where("room_id = ? AND closed_at IS NULL AND hidden = false AND id > ?", roomID, afterID).
+			Order("id").
+			First(&next).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &next.ID, nil
+	}
+
+	nextID, err := queued(afterTicketID)
+	if err != nil {
+		return false, err
+	}
+	if nextID == nil && afterTicketID != 0 {
+		if nextID, err = queued(0); err != nil {
+			return false, err
+		}
+	}
+	if nextID == nil && room.ActiveTicketID == nil {
+		return false, nil
+	}
+
+	if err := tx.Model(&database.Room{}).
+		Where("id = ?", roomID).
+		Update("active_ticket_id", nextID).Error; err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// activeTicket reads the active ticket of the room. Tickets which were closed
+// or deleted since aren't active anymore.
+func activeTicket(db *gorm.DB, roomID uint) (ticket.ActiveTicketProps, error) {
+	var room database.Room
+	if err := db.Select("id", "facilitated", "active_ticket_id").First(&room, roomID).Error; err != nil {
+		return ticket.ActiveTicketProps{}, err
+	}
+
+	props := ticket.ActiveTicketProps{Facilitated: room.Facilitated}
+	if room.ActiveTicketID == nil {
+		return props, nil
+	}
+
+	var active database.Ticket
+	err := db.Select("id", "name").
+		Where("id = ? AND room_id = ? AND closed_at IS NULL", *room.ActiveTicketID, roomID).
+		First(&active).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return props, nil
+	}
+	if err != nil {
+		return props, err
+	}
+
+	props.TicketID = active.ID
+	props.Name = active.Name
+	return props, nil
+}
@@ -2,31 +2,51 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
 	"github.com/markojerkic/spring-planing/internal/database"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var ticketQuery = `
     SELECT t.*,
-           AVG(e.estimate)                                         AS average_estimate,
-           PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY e.estimate) AS median_estimate,
-           STDDEV(e.estimate)                                      AS std_dev_estimate,
-           COUNT(DISTINCT e.id)                                    AS estimate_count,
-           COUNT(DISTINCT room_users.user_id)                      AS user_count,
-           users_estimate.estimate                                 AS users_estimate
+           AVG(e.estimate) FILTER (WHERE e.kind = '')              AS average_estimate,
+           PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY e.estimate)
+               FILTER (WHERE e.kind = '')                          AS median_estimate,
+           STDDEV(e.estimate) FILTER (WHERE e.kind = '')           AS std_dev_estimate,
+           AVG((e.pessimistic - e.optimistic) / 6)
+               FILTER (WHERE e.kind = '')                          AS pert_std_dev,
+           COUNT(e.id) FILTER (WHERE e.kind = '')                  AS value_count,
+           COUNT(DISTINCT e.user_id)                               AS estimate_count,
+           ?                                                       AS present_count,
+           ? + COUNT(DISTINCT e.user_id) FILTER (WHERE e.user_id NOT IN ?) AS user_count,
+           users_estimate.estimate                                 AS users_estimate,
+           users_estimate.kind                                     AS users_estimate_kind,
+           r.estimation_scale                                      AS estimation_scale,
+           r.custom_scale                                          AS custom_scale,
+           r.three_point                                           AS three_point,
+           r.consensus_steps                                       AS consensus_steps,
+           r.near_consensus_steps                                  AS near_consensus_steps,
+           cu.display_name                                         AS created_by_name,
+           cu.color                                                AS created_by_color
     FROM tickets t
+             JOIN rooms r ON t.room_id = r.id
+             LEFT JOIN users cu ON t.created_by = cu.id
              LEFT JOIN estimates e ON t.id = e.ticket_id AND e.user_id IS NOT NULL
+                AND e.round = t.current_round AND e.deleted_at IS NULL
              LEFT JOIN estimates users_estimate ON t.id = users_estimate.ticket_id AND users_estimate.user_id = ?
-             LEFT JOIN room_users ON t.room_id = room_users.room_id
+                AND users_estimate.round = t.current_round AND users_estimate.deleted_at IS NULL
     WHERE t.room_id = ?
       AND t.deleted_at IS NULL
-    GROUP BY t.id, t.created_at, users_estimate.estimate
+    GROUP BY t.id, t.created_at, users_estimate.estimate, users_estimate.kind, r.id, cu.id
     ORDER BY t.id DESC;`
 
 type TicketService struct {
@@ -34,6 +54,7 @@ type TicketService struct {
 	webSocketService  *WebSocketService
 	roomTicketService *RoomTicketService
 	llmService        *LLMService
+	policy            *RoomPolicy
 }
 
 type CreateTicketForm struct {
@@ -45,11 +66,90 @@ type CreateTicketForm struct {
 }
 
 type EstimateTicketForm struct {
-	TicketID     uint  `json:"ticketID" form:"ticketID" validate:"required"`
-	RoomID       uint  `json:"roomID" form:"roomID" validate:"required"`
-	WeekEstimate int32 `json:"weekEstimate" form:"weekEstimate" default:"0"`
-	DayEstimate  int32 `json:"dayEstimate" form:"dayEstimate" default:"0"`
-	HourEstimate int32 `json:"hourEstimate" form:"hourEstimate" default:"0"`
+	TicketID     uint   `json:"ticketID" form:"ticketID" validate:"required"`
+	RoomID       uint   `json:"roomID" form:"roomID" validate:"required"`
+	WeekEstimate int32  `json:"weekEstimate" form:"weekEstimate" default:"0"`
+	DayEstimate  int32  `json:"dayEstimate" form:"dayEstimate" default:"0"`
+	HourEstimate int32  `json:"hourEstimate" form:"hourEstimate" default:"0"`
+	CardEstimate string `json:"cardEstimate" form:"cardEstimate"`
+	// Set for votes without a value, the estimate is ignored then
+	Kind string `json:"kind" form:"kind"`
+	// Only used in three-point rooms, hours or a card of the deck. The
+	// estimate above is the most likely one.
+	OptimisticEstimate  string `json:"optimisticEstimate" form:"optimisticEstimate"`
+	PessimisticEstimate string `json:"pessimisticEstimate" form:"pessimisticEstimate"`
+}
+
+// UpdateTicketForm fixes the name or description of a ticket
+type UpdateTicketForm struct {
+	TicketID          uint   `json:"ticketID" form:"ticketID" validate:"required"`
+	TicketName        string `json:"ticketName" form:"ticketName" validate:"required"`
+	TicketDescription string `json:"ticketDescription" form:"ticketDescription"`
+}
+
+var (
+	ErrInvalidEstimate = errors.New("invalid estimate")
+	ErrInvalidTicket   = errors.New("invalid ticket")
+)
+
+// estimate converts the submitted form into the values stored on the estimate,
+// using the estimation deck of the room
+func (f EstimateTicketForm) estimate(room database.Room) (database.Estimate, error) {
+	kind, ok := database.ParseEstimateKind(f.Kind)
+	if !ok {
+		return database.Estimate{}, fmt.Errorf("%w: unknown kind %q", ErrInvalidEstimate, f.Kind)
+	}
+	if kind != database.EstimateValue {
+		return database.Estimate{Kind: kind}, nil
+	}
+
+	deck := room.Deck()
+	var mostLikely float64
+	if deck.IsTimeBased() {
+		mostLikely = float64(f.WeekEstimate*5*8 + f.DayEstimate*8 + f.HourEstimate)
+	} else if mostLikely, ok = deck.CardValue(f.CardEstimate); !ok {
+		return database.Estimate{}, fmt.Errorf("%w: unknown card %q", ErrInvalidEstimate, f.CardEstimate)
+	}
+	if !room.ThreePoint {
+		return database.Estimate{Estimate: mostLikely}, nil
+	}
+
+	optimistic, err := threePointValue(deck, f.OptimisticEstimate)
+	if err != nil {
+		return database.Estimate{}, err
+	}
+	pessimistic, err := threePointValue(deck, f.PessimisticEstimate)
+	if err != nil {
+		return database.Estimate{}, err
+	}
+	if optimistic > mostLikely || mostLikely > pessimistic {
+		return database.Estimate{}, fmt.Errorf("%w: the most likely estimate has to be between the optimistic and the pessimistic one", ErrInvalidEstimate)
+	}
+
+	return database.Estimate{
+		Estimate:    database.PERTExpected(optimistic, mostLikely, pessimistic),
+		Optimistic:  &optimistic,
+		MostLikely:  &mostLikely,
+		Pessimistic: &pessimistic,
+	}, nil
+}
+
+// threePointValue reads an optimistic or pessimistic estimate, in hours or as
+// a card of the deck
+func threePointValue(deck database.Deck, estimate string) (float64, error) {
+	if !deck.IsTimeBased() {
+		value, ok := deck.CardValue(estimate)
+		if !ok {
+			return 0, fmt.Errorf("%w: unknown card %q", ErrInvalidEstimate, estimate)
+		}
+		return value, nil
+	}
+
+	hours, err := strconv.ParseFloat(strings.TrimSpace(estimate), 64)
+	if err != nil || hours < 0 {
+		return 0, fmt.Errorf("%w: %q isn't a number of hours", ErrInvalidEstimate, estimate)
+	}
+	return hours, nil
 }
 
 type HideTicketDto struct {
@@ -57,7 +157,11 @@ type HideTicketDto struct {
 	IsHidden bool `json:"isHidden" form:"isHidden"`
 }
 
-func (t *TicketService) HideAllTickets(ctx context.Context, roomID uint) error {
+func (t *TicketService) HideAllTickets(ctx context.Context, roomID uint, userID uint) error {
+	if _, err := t.policy.Authorize(ctx, roomID, userID, ActionHideTicket); err != nil {
+		return err
+	}
+
 	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		if err := tx.Model(&database.Ticket{}).Where("room_id = ?", roomID).Update("hidden", true).Error; err != nil {
 			return err
@@ -72,7 +176,11 @@ func (t *TicketService) HideAllTickets(ctx context.Context, roomID uint) error {
 	return nil
 }
 
-func (t *TicketService) HideTicket(ctx context.Context, ticketID uint) (*database.Ticket, error) {
+func (t *TicketService) HideTicket(ctx context.Context, ticketID uint, userID uint) (*database.Ticket, error) {
+	if _, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionHideTicket); err != nil {
+		return nil, err
+	}
+
 	var ticket database.Ticket
 	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		if err := tx.First(&ticket, ticketID).Error; err != nil {
@@ -98,42 +206,65 @@ func (t *TicketService) HideTicket(ctx context.Context, ticketID uint) (*databas
 }
 
 func (t *TicketService) EstimateTicket(ctx context.Context, userID uint, form EstimateTicketForm) (string, error) {
+	roomID, err := t.policy.AuthorizeTicket(ctx, form.TicketID, userID, ActionEstimate)
+	if err != nil {
+		return "", err
+	}
+
 	var prettyEstimate string
-	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		estimate := database.Estimate{
-			TicketID: uint(form.TicketID),
-			Estimate: int(form.WeekEstimate*5*8 + form.DayEstimate*8 + form.HourEstimate),
-			UserID:   &userID,
+	var updatedTicket *database.TicketWithEstimateStatistics
+	err = t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var ticket database.Ticket
+		if err := tx.Preload("Room").First(&ticket, form.TicketID).Error; err != nil {
+			return err
 		}
+		deck := ticket.Room.Deck()
 
-		if err := tx.Create(&estimate).Error; err != nil {
-			slog.Error("Error creating estimate", slog.Any("error", err))
+		value, err := form.estimate(ticket.Room)
+		if err != nil {
 			return err
 		}
 
-		updatedTicket, err := t.GetTicket(ctx, tx, userID, &form.RoomID, form.TicketID)
-		if err != nil {
-			slog.Error("Error getting ticket", slog.Any("error", err))
+		if ticket.ClosedAt != nil {
+			return fmt.Errorf("%w: ticket is closed", ErrInvalidEstimate)
+		}
+		if ticket.IsRevealed() {
+			return fmt.Errorf("%w: votes of this round were already revealed", ErrInvalidEstimate)
+		}
+		if ticket.Room.Facilitated && (ticket.Room.ActiveTicketID == nil || *ticket.Room.ActiveTicketID != ticket.ID) {
+			return fmt.Errorf("%w: the room is estimating another ticket", ErrInvalidEstimate)
+		}
+
+		// Re-estimating within the same round replaces the previous estimate,
+		// also when the same user votes twice at once
+		estimate := database.Estimate{
+			TicketID:    ticket.ID,
+			UserID:      &userID,
+			Round:       ticket.CurrentRound,
+			Estimate:    value.Estimate,
+			Kind:        value.Kind,
+			Optimistic:  value.Optimistic,
+			MostLikely:  value.MostLikely,
+			Pessimistic: value.Pessimistic,
+		}
+		if err := tx.Clauses(clause.OnConflict{
+			Columns:     []clause.Column{{Name: "ticket_id"}, {Name: "user_id"}, {Name: "round"}},
+			TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "deleted_at IS NULL"}}},
+			DoUpdates: clause.AssignmentColumns([]string{
+				"estimate", "kind", "optimistic", "most_likely", "pessimistic", "updated_at",
+			}),
+		}).Create(&estimate).Error; err != nil {
+			slog.Error("Error saving estimate", slog.Any("error", err))
 			return err
 		}
 
-		var usersInRoom int
-		if err := tx.Raw("SELECT COUNT(*) FROM room_users WHERE room_id = ?",
-			updatedTicket.RoomID).Scan(&usersInRoom).Error; err != nil {
-			slog.Error("Error getting users in room", slog.Any("error", err))
+		updatedTicket, err = t.GetTicket(ctx, tx, userID, &roomID, form.TicketID)
+		if err != nil {
+			slog.Error("Error getting ticket", slog.Any("error", err))
 			return err
 		}
-		slog.Debug("Estimate ticket", slog.Any("users", usersInRoom))
-
-		prettyEstimate = prettyPrintEstimate(estimate.Estimate)
-		t.webSocketService.UpdateEstimate(updatedTicket.ID,
-			updatedTicket.JiraKey,
-			updatedTicket.RoomID,
-			prettyPrintEstimate(int(updatedTicket.AverageEstimate)),
-			prettyPrintEstimate(int(updatedTicket.MedianEstimate)),
-			fmt.Sprintf("%.2fh", updatedTicket.StdDevEstimate),
-			fmt.Sprintf("%d/%d", updatedTicket.EstimateCount, updatedTicket.UserCount),
-		)
+
+		prettyEstimate = estimate.Format(deck)
 		return nil
 	})
 	if err != nil {
@@ -141,50 +272,371 @@ func (t *TicketService) EstimateTicket(ctx context.Context, userID uint, form Es
 		return "", err
 	}
 
+	// Votes stay hidden until revealed, others only learn how many have voted
+	t.webSocketService.UpdateEstimatedBy(updatedTicket.ID,
+		updatedTicket.RoomID,
+		fmt.Sprintf("%d/%d", updatedTicket.EstimateCount, updatedTicket.UserCount),
+	)
+
+	if updatedTicket.EveryoneVoted() {
+		if err := t.finishVoting(ctx, updatedTicket.ID); err != nil {
+			slog.Error("Error finishing voting", slog.Any("ticket", updatedTicket.ID), slog.Any("error", err))
+		}
+	}
+
 	return prettyEstimate, nil
 }
 
 func (t *TicketService) CloseTicket(ctx context.Context, ticketID uint, userID uint) (*database.Ticket, error) {
+	if _, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionCloseTicket); err != nil {
+		return nil, err
+	}
+	return t.closeTicket(ctx, ticketID, userID)
+}
+
+// closeTicket closes voting on the ticket without checking the user, who may
+// be 0 when the server closes it. Only the first of concurrent closes goes
+// through, the others get ErrInvalidTicket.
+func (t *TicketService) closeTicket(ctx context.Context, ticketID uint, userID uint) (*database.Ticket, error) {
 	var ticket database.Ticket
+	var activeChanged bool
 	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
-		// Find the ticket with preloaded estimates
-		if err := tx.Preload("Estimates").First(&ticket, ticketID).Error; err != nil {
-			return err
-		}
 		now := time.Now()
-		ticket.ClosedAt = &now
+		closed := tx.Model(&database.Ticket{}).
+			Where("id = ? AND closed_at IS NULL", ticketID).
+			Updates(map[string]any{
+				"closed_at":      now,
+				"voting_ends_at": nil,
+				"revealed_at":    gorm.Expr("COALESCE(revealed_at, ?)", now),
+			})
+		if closed.Error != nil {
+			return closed.Error
+		}
+		if closed.RowsAffected == 0 {
+			if err := tx.Select("id").First(&ticket, ticketID).Error; err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: ticket is already closed", ErrInvalidTicket)
+		}
 
-		if err := tx.Save(&ticket).Error; err != nil {
+		// Find the ticket with preloaded estimates
+		if err := tx.Preload("Estimates").First(&ticket, ticketID).Error; err != nil {
 			return err
 		}
 
-		return nil
+		var err error
+		activeChanged, err = t.queueNextTicket(tx, ticket.RoomID, ticket.ID)
+		return err
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	ticketWithStats, err := t.GetTicket(ctx, t.db.DB, userID, nil, ticketID)
+	if err != nil {
+		return nil, err
+	}
 
-	ticketProps := ticketWithStats.ToDetailProp(false)
+	ticketProps := broadcastProps(ticketWithStats)
 	ticketProps.IsClosed = true
 
 	t.webSocketService.CloseTicket(ticketProps)
+	if activeChanged {
+		t.sendActiveTicket(ctx, ticket.RoomID)
+	}
 
 	return &ticket, nil
 }
 
-func (t *TicketService) GetTicketEstimates(ctx context.Context, ticketID int32) ([]string, error) {
-	estimates := make([]string, 0)
+// UpdateTicket renames the ticket or changes its description, votes are kept
+func (t *TicketService) UpdateTicket(ctx context.Context, userID uint, form UpdateTicketForm) (*database.Ticket, error) {
+	if _, err := t.policy.AuthorizeTicket(ctx, form.TicketID, userID, ActionEditTicket); err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(form.TicketName)
+	if name == "" {
+		return nil, fmt.Errorf("%w: name is required", ErrInvalidTicket)
+	}
 
+	var ticket database.Ticket
 	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&ticket, form.TicketID).Error; err != nil {
+			return err
+		}
+
+		ticket.Name = name
+		ticket.Description = strings.TrimSpace(form.TicketDescription)
+		return tx.Model(&ticket).Updates(map[string]any{
+			"name":        ticket.Name,
+			"description": ticket.Description,
+		}).Error
+	})
+	if err != nil {
+		slog.Error("Error updating ticket", slog.Any("error", err))
+		return nil, err
+	}
+
+	t.webSocketService.UpdateTicket(ticket.ID, ticket.RoomID, ticket.Name, ticket.Description)
+
+	return &ticket, nil
+}
+
+// DeleteTicket removes the ticket from the room, e.g. one imported by mistake
+func (t *TicketService) DeleteTicket(ctx context.Context, ticketID uint, userID uint) error {
+	roomID, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionDeleteTicket)
+	if err != nil {
+		return err
+	}
+
+	var activeChanged bool
+	err = t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&database.Ticket{}, ticketID).Error; err != nil {
+			return err
+		}
+
+		var err error
+		activeChanged, err = t.queueNextTicket(tx, roomID, ticketID)
+		return err
+	})
+	if err != nil {
+		slog.Error("Error deleting ticket", slog.Any("error", err))
+		return err
+	}
+
+	t.webSocketService.DeleteTicket(ticketID, roomID)
+	if activeChanged {
+		t.sendActiveTicket(ctx, roomID)
+	}
+
+	return nil
+}
+
+// ReopenTicket opens voting on a closed ticket again in a new round, the votes
+// of earlier rounds are kept as history. Facilitated rooms which ran out of
+// tickets make it the active one.
+func (t *TicketService) ReopenTicket(ctx context.Context, ticketID uint, userID uint) (*database.TicketWithEstimateStatistics, error) {
+	roomID, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionReopenTicket)
+	if err != nil {
+		return nil, err
+	}
+
+	var activeChanged bool
+	err = t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		reopened := tx.Model(&database.Ticket{}).
+			Where("id = ? AND closed_at IS NOT NULL", ticketID).
+			Updates(map[string]any{
+				"closed_at":      nil,
+				"current_round":  gorm.Expr("current_round + 1"),
+				"revealed_at":    nil,
+				"voting_ends_at": nil,
+			})
+		if reopened.Error != nil {
+			return reopened.Error
+		}
+		if reopened.RowsAffected == 0 {
+			return fmt.Errorf("%w: ticket isn't closed", ErrInvalidTicket)
+		}
+
+		var err error
+		activeChanged, err = t.queueNextTicket(tx, roomID, 0)
+		return err
+	})
+	if err != nil {
+		slog.Error("Error reopening ticket", slog.Any("error", err))
+		return nil, err
+	}
+
+	ticketWithStats, err := t.GetTicket(ctx, t.db.DB, userID, &roomID, ticketID)
+	if err != nil {
+		return nil, err
+	}
+
+	t.webSocketService.ReopenTicket(broadcastProps(ticketWithStats))
+	if activeChanged {
+		t.sendActiveTicket(ctx, roomID)
+	}
+
+	return ticketWithStats, nil
+}
+
+// StartNewRound archives the votes of the current round and opens a new one.
+// Only open tickets can get a new round.
+func (t *TicketService) StartNewRound(ctx context.Context, ticketID uint, userID uint) (*database.TicketWithEstimateStatistics, error) {
+	if _, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionStartRound); err != nil {
+		return nil, err
+	}
+
+	var ticket database.Ticket
+	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&ticket, ticketID).Error; err != nil {
+			return err
+		}
+
+		if ticket.ClosedAt != nil {
+			return fmt.Errorf("%w: ticket is closed", ErrInvalidTicket)
+		}
+
+		return tx.Model(&ticket).
+			Updates(map[string]any{
+				"current_round":  gorm.Expr("current_round + 1"),
+				"revealed_at":    nil,
+				"voting_ends_at": nil,
+			}).Error
+	})
+	if err != nil {
+		slog.Error("Error starting new round", slog.Any("error", err))
+		return nil, err
+	}
+
+	ticketWithStats, err := t.GetTicket(ctx, t.db.DB, userID, &ticket.RoomID, ticketID)
+	if err != nil {
+		return nil, err
+	}
+
+	t.webSocketService.StartNewRound(broadcastProps(ticketWithStats))
+
+	return ticketWithStats, nil
+}
+
+// RevealTicket reveals the votes of the current round to everyone in the room.
+func (t *TicketService) RevealTicket(ctx context.Context, ticketID uint, userID uint) (*database.TicketWithEstimateStatistics, error) {
+	if _, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionRevealVotes); err != nil {
+		return nil, err
+	}
+	return t.revealTicket(ctx, ticketID, userID)
+}
+
+// revealTicket reveals the votes without checking the user, who may be 0 when
+// the server reveals them. Votes which were already revealed aren't sent again.
+func (t *TicketService) revealTicket(ctx context.Context, ticketID uint, userID uint) (*database.TicketWithEstimateStatistics, error) {
+	var ticket database.Ticket
+	var revealed bool
+	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&ticket, ticketID).Error; err != nil {
+			return err
+		}
+
+		reveal := tx.Model(&database.Ticket{}).
+			Where("id = ? AND revealed_at IS NULL", ticketID).
+			Updates(map[string]any{
+				"revealed_at":    time.Now(),
+				"voting_ends_at": nil,
+			})
+		revealed = reveal.RowsAffected > 0
+		return reveal.Error
+	})
+	if err != nil {
+		slog.Error("Error revealing ticket", slog.Any("error", err))
+		return nil, err
+	}
+
+	ticketWithStats, err := t.GetTicket(ctx, t.db.DB, userID, &ticket.RoomID, ticketID)
+	if err != nil {
+		return nil, err
+	}
+
+	if revealed {
+		t.webSocketService.RevealTicket(broadcastProps(ticketWithStats))
+	}
+
+	return ticketWithStats, nil
+}
+
+// broadcastProps renders the ticket as seen by any participant, without the
+// estimate of the user who triggered the broadcast
+func broadcastProps(ticketWithStats *database.TicketWithEstimateStatistics) ticket.TicketDetailProps {
+	props := ticketWithStats.ToDetailProp(false)
+	props.HasEstimate = false
+	props.UserEstimate = ""
+	return props
+}
+
+type estimationRoundStatistics struct {
+	Round           int
+	AverageEstimate float64
+	MedianEstimate  float64
+	StdDevEstimate  float64
+	MinEstimate     float64
+	MaxEstimate     float64
+	PertStdDev      float64
+	ValueCount      int
+}
+
+// GetTicketEstimates returns the estimates of every voting round of the ticket,
+// so the popup can show how the spread converged
+func (t *TicketService) GetTicketEstimates(ctx context.Context, ticketID int32, userID uint) ([]ticket.EstimationRoundProps, error) {
+	if _, err := t.policy.AuthorizeTicket(ctx, uint(ticketID), userID, ActionViewRoom); err != nil {
+		return nil, err
+	}
+
+	rounds := make([]ticket.EstimationRoundProps, 0)
+
+	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var dbTicket database.Ticket
+		if err := tx.Preload("Room").First(&dbTicket, ticketID).Error; err != nil {
+			return err
+		}
+		deck := dbTicket.Room.Deck()
+
+		var statistics []estimationRoundStatistics
+		if err := tx.Raw(`
+			SELECT round,
+			       COALESCE(AVG(estimate) FILTER (WHERE kind = ''), 0)    AS average_estimate,
+			       COALESCE(PERCENTILE_CONT(0.5) WITHIN GROUP (ORDER BY estimate)
+			                    FILTER (WHERE kind = ''), 0)              AS median_estimate,
+			       COALESCE(STDDEV(estimate) FILTER (WHERE kind = ''), 0) AS std_dev_estimate,
+			       COALESCE(MIN(estimate) FILTER (WHERE kind = ''), 0)    AS min_estimate,
+			       COALESCE(MAX(estimate) FILTER (WHERE kind = ''), 0)    AS max_estimate,
+			       COALESCE(AVG((pessimistic - optimistic) / 6)
+			                    FILTER (WHERE kind = ''), 0)              AS pert_std_dev,
+			       COUNT(*) FILTER (WHERE kind = '')                      AS value_count
+			FROM estimates
+			WHERE ticket_id = ? AND user_id IS NOT NULL AND deleted_at IS NULL
+			GROUP BY round
+			ORDER BY round`, ticketID).
+			Scan(&statistics).Error; err != nil {
+			return err
+		}
+
 		var dbEstimates []database.Estimate
-		if err := tx.Where("ticket_id = ? AND user_id IS NOT NULL", ticketID).Order("estimate ASC").Find(&dbEstimates).Error; err != nil {
+		if err := tx.Preload("User").Where("ticket_id = ? AND user_id IS NOT NULL", ticketID).Order("kind ASC, estimate ASC").Find(&dbEstimates).Error; err != nil {
 			return err
 		}
 
-		for _, e := range dbEstimates {
-			estimates = append(estimates, prettyPrintEstimate(e.Estimate))
+		for _, s := range statistics {
+			if s.Round == dbTicket.CurrentRound && !dbTicket.IsRevealed() {
+				continue
+			}
+			round := ticket.EstimationRoundProps{
+				Round:           s.Round,
+				IsCurrent:       s.Round == dbTicket.CurrentRound,
+				Estimates:       make([]ticket.VoteProps, 0),
+				AverageEstimate: deck.Format(s.AverageEstimate),
+				MedianEstimate:  deck.Format(s.MedianEstimate),
+				StdEstimate:     deck.FormatDeviation(s.StdDevEstimate),
+				Spread:          fmt.Sprintf("%s – %s", deck.Format(s.MinEstimate), deck.Format(s.MaxEstimate)),
+			}
+			if dbTicket.Room.ThreePoint {
+				round.ExpectedRange = deck.FormatRange(s.AverageEstimate, s.PertStdDev)
+			}
+			if s.ValueCount == 0 {
+				round.AverageEstimate, round.MedianEstimate, round.StdEstimate, round.Spread = "-", "-", "-", "-"
+				round.ExpectedRange = ""
+			}
+			var votes []database.Estimate
+			for _, e := range dbEstimates {
+				if e.Round == s.Round {
+					votes = append(votes, e)
+				}
+			}
+			consensus := database.ClassifyRound(deck, votes, dbTicket.Room.ConsensusThresholds())
+			for _, e := range votes {
+				vote := e.ToVoteProps(deck)
+				vote.Outlier = consensus.Outlier(e)
+				round.Estimates = append(round.Estimates, vote)
+			}
+			round.Consensus = consensus.ToProps()
+			rounds = append(rounds, round)
 		}
 
 		return nil
@@ -194,11 +646,19 @@ func (t *TicketService) GetTicketEstimates(ctx context.Context, ticketID int32)
 		return nil, err
 	}
 
-	return estimates, nil
+	return rounds, nil
+}
+
+// GetAuthorizedTicket returns the ticket if the user may do the action in its room
+func (t *TicketService) GetAuthorizedTicket(ctx context.Context, userID uint, ticketID uint, action RoomAction) (*database.TicketWithEstimateStatistics, error) {
+	roomID, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, action)
+	if err != nil {
+		return nil, err
+	}
+	return t.GetTicket(ctx, t.db.DB, userID, &roomID, ticketID)
 }
 
 func (t *TicketService) GetTicket(ctx context.Context, db *gorm.DB, userID uint, roomID *uint, ticketID uint) (*database.TicketWithEstimateStatistics, error) {
-	var tickets []database.TicketWithEstimateStatistics
 	var foundRoomId *uint
 
 	if roomID != nil {
@@ -212,9 +672,8 @@ func (t *TicketService) GetTicket(ctx context.Context, db *gorm.DB, userID uint,
 		foundRoomId = &ticket.RoomID
 	}
 
-	if err := db.WithContext(ctx).
-		Raw(ticketQuery, userID, *foundRoomId).
-		Scan(&tickets).Error; err != nil {
+	tickets, err := t.roomTicketService.queryTickets(ctx, db, userID, *foundRoomId)
+	if err != nil {
 		slog.Error("Error getting ticket", slog.Int("userID", int(userID)),
 			slog.Int("ticketID", int(ticketID)), slog.Any("error", err))
 		return nil, err
@@ -235,12 +694,16 @@ func (t *TicketService) GetTicket(ctx context.Context, db *gorm.DB, userID uint,
 }
 
 func (t *TicketService) BulkImportTickets(ctx context.Context, userID uint, roomID uint, tickets []CreateTicketForm) ([]ticket.TicketDetailProps, error) {
+	if _, err := t.policy.Authorize(ctx, roomID, userID, ActionImportTickets); err != nil {
+		return nil, err
+	}
+
 	databaseTickets := make([]database.Ticket, len(tickets))
 	for i, ticket := range tickets {
 		databaseTickets[i] = database.Ticket{
 			Name:        ticket.TicketName,
 			Description: ticket.TicketDescription,
-			RoomID:      uint(ticket.RoomID),
+			RoomID:      roomID,
 			CreatedBy:   uint(userID),
 		}
 		if ticket.JiraKey != "" {
@@ -250,6 +713,7 @@ func (t *TicketService) BulkImportTickets(ctx context.Context, userID uint, room
 
 	var allRoomTickets []ticket.TicketDetailProps
 	var importedTickets []ticket.TicketDetailProps
+	var activeChanged bool
 
 	err := t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
 		// Create tickets in the database
@@ -258,28 +722,36 @@ func (t *TicketService) BulkImportTickets(ctx context.Context, userID uint, room
 		}
 
 		slog.Debug("Created tickets", slog.Any("tickets", databaseTickets))
-		go func() {
-			for _, ticket := range databaseTickets {
-				var jiraTicket CreateTicketForm
-				for _, t := range tickets {
-					if t.JiraKey == *ticket.JiraKey {
-						jiraTicket = t
-						break
-					}
-				}
-				if jiraTicket.JiraKey == "" {
-					slog.Error("Jira ticket not found", slog.Any("ticket", ticket))
-					continue
+		for _, ticket := range databaseTickets {
+			if ticket.JiraKey == nil {
+				continue
+			}
+			var jiraTicket CreateTicketForm
+			for _, t := range tickets {
+				if t.JiraKey == *ticket.JiraKey {
+					jiraTicket = t
+					break
 				}
+			}
+			if jiraTicket.JiraKey == "" {
+				slog.Error("Jira ticket not found", slog.Any("ticket", ticket))
+				continue
+			}
 
-				t.llmService.GetRequestChannel() <- LLMRequest{
-					TicketKey:   *ticket.JiraKey,
-					Description: jiraTicket.TicketDescription,
-					RoomID:      roomID,
-					TicketID:    ticket.ID,
-				}
+			if err := t.llmService.Enqueue(tx, LLMRequest{
+				TicketKey:   *ticket.JiraKey,
+				Description: jiraTicket.TicketDescription,
+				RoomID:      roomID,
+				TicketID:    ticket.ID,
+			}); err != nil {
+				return err
 			}
-		}()
+		}
+
+		var err error
+		if activeChanged, err = t.queueNextTicket(tx, roomID, 0); err != nil {
+			return err
+		}
 
 		// Create a map of the newly imported ticket IDs
 		databaseTicketsMap := make(map[uint]bool)
@@ -322,13 +794,22 @@ func (t *TicketService) BulkImportTickets(ctx context.Context, userID uint, room
 		return nil, err
 	}
 
+	t.llmService.Wake()
 	t.webSocketService.BulkImportTickets(importedTickets)
+	if activeChanged {
+		t.sendActiveTicket(ctx, roomID)
+	}
 	return allRoomTickets, nil
 }
 
 func (t *TicketService) CreateTicket(ctx echo.Context, userID uint, form CreateTicketForm) (uint, []database.TicketWithEstimateStatistics, error) {
+	if _, err := t.policy.Authorize(ctx.Request().Context(), form.RoomID, userID, ActionCreateTicket); err != nil {
+		return 0, nil, err
+	}
+
 	var tickets []database.TicketWithEstimateStatistics
 	var ticketID uint
+	var activeChanged bool
 
 	err := t.db.DB.WithContext(ctx.Request().Context()).Transaction(func(tx *gorm.DB) error {
 		ticket := database.Ticket{
@@ -348,6 +829,22 @@ func (t *TicketService) CreateTicket(ctx echo.Context, userID uint, form CreateT
 
 		ticketID = ticket.ID
 
+		var err error
+		if activeChanged, err = t.queueNextTicket(tx, form.RoomID, 0); err != nil {
+			return err
+		}
+
+		if form.JiraKey != "" && form.TicketFullDescription != "" {
+			if err := t.llmService.Enqueue(tx, LLMRequest{
+				TicketKey:   form.JiraKey,
+				Description: form.TicketDescription,
+				RoomID:      form.RoomID,
+				TicketID:    ticketID,
+			}); err != nil {
+				return err
+			}
+		}
+
 		roomTickets, err := t.roomTicketService.GetTicketsOfRoom(ctx.Request().Context(), tx, userID, form.RoomID)
 		if err != nil {
 			return err
@@ -365,18 +862,12 @@ func (t *TicketService) CreateTicket(ctx echo.Context, userID uint, form CreateT
 	isOwner := savedTicket.CreatedBy == userID
 
 	t.webSocketService.SendNewTicket(savedTicket.ToDetailProp(isOwner))
-
-	if form.JiraKey != "" && form.TicketFullDescription != "" {
-		go func() {
-			t.llmService.GetRequestChannel() <- LLMRequest{
-				TicketKey:   form.JiraKey,
-				Description: form.TicketDescription,
-				RoomID:      form.RoomID,
-				TicketID:    ticketID,
-			}
-		}()
+	if activeChanged {
+		t.sendActiveTicket(ctx.Request().Context(), form.RoomID)
 	}
 
+	t.llmService.Wake()
+
 	return ticketID, tickets, nil
 }
 
@@ -384,20 +875,19 @@ func NewTicketService(db *database.Database,
 	roomTicketService *RoomTicketService,
 	llmService *LLMService,
 	webSocketService *WebSocketService) *TicketService {
+	if llmService == nil {
+		panic("llmService cannot be nil")
+	}
+	if webSocketService == nil {
+		panic("webSocketService cannot be nil")
+	}
 
 	ticketService := &TicketService{
 		db:                db,
 		webSocketService:  webSocketService,
 		roomTicketService: roomTicketService,
 		llmService:        llmService,
+		policy:            NewRoomPolicy(db),
 	}
 	return ticketService
 }
-
-func prettyPrintEstimate(estimate int) string {
-	weeks := estimate / 40
-	days := (estimate % 40) / 8
-	hours := estimate % 8
-
-	return fmt.Sprintf("%dw %dd %dh", weeks, days, hours)
-}
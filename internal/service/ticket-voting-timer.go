@@ -0,0 +1,152 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"gorm.io/gorm"
+)
+
+const maxVotingTimer = time.Hour
+
+var ErrInvalidTimer = errors.New("invalid voting timer")
+
+// ParseAutoFinish reads the auto-finish policy of a room, empty for none
+func ParseAutoFinish(autoFinish string) (database.AutoFinish, error) {
+	switch f := database.AutoFinish(autoFinish); f {
+	case database.AutoFinishOff, database.AutoFinishReveal, database.AutoFinishClose:
+		return f, nil
+	default:
+		return "", fmt.Errorf("%w: unknown auto-finish %q", ErrInvalidTimer, autoFinish)
+	}
+}
+
+// UpdateVotingSettings sets the default voting timer of the room, 0 for none,
+// and what happens once everyone voted or a timer ran out
+func (t *TicketService) UpdateVotingSettings(ctx context.Context, roomID uint, userID uint, timer time.Duration, autoFinish database.AutoFinish) error {
+	if _, err := t.policy.Authorize(ctx, roomID, userID, ActionFacilitate); err != nil {
+		return err
+	}
+	if timer < 0 || timer > maxVotingTimer {
+		return fmt.Errorf("%w: the timer can run for at most %s", ErrInvalidTimer, maxVotingTimer)
+	}
+
+	return t.db.DB.WithContext(ctx).Model(&database.Room{}).
+		Where("id = ?", roomID).
+		Updates(map[string]any{
+			"voting_timer_seconds": int(timer.Seconds()),
+			"auto_finish":          autoFinish,
+		}).Error
+}
+
+// StartVotingTimer starts the countdown of the current round of the ticket,
+// with the default timer of the room if the length is 0. Starting it again
+// restarts it.
+func (t *TicketService) StartVotingTimer(ctx context.Context, ticketID uint, userID uint, length time.Duration) (time.Time, error) {
+	roomID, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionFacilitate)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var endsAt time.Time
+	err = t.db.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var ticket database.Ticket
+		if err := tx.Preload("Room").First(&ticket, ticketID).Error; err != nil {
+			return err
+		}
+		if ticket.IsRevealed() {
+			return fmt.Errorf("%w: votes of this round were already revealed", ErrInvalidTimer)
+		}
+
+		if length == 0 {
+			length = time.Duration(ticket.Room.VotingTimerSeconds) * time.Second
+		}
+		if length <= 0 || length > maxVotingTimer {
+			return fmt.Errorf("%w: the timer runs for up to %s", ErrInvalidTimer, maxVotingTimer)
+		}
+
+		endsAt = time.Now().Add(length).Truncate(time.Second)
+		return tx.Model(&ticket).Update("voting_ends_at", endsAt).Error
+	})
+	if err != nil {
+		slog.Error("Error starting voting timer", slog.Any("ticket", ticketID), slog.Any("error", err))
+		return time.Time{}, err
+	}
+
+	t.webSocketService.SetVotingTimer(roomID, ticketID, &endsAt)
+
+	return endsAt, nil
+}
+
+// StopVotingTimer stops the countdown of the ticket, voting goes on
+func (t *TicketService) StopVotingTimer(ctx context.Context, ticketID uint, userID uint) error {
+	roomID, err := t.policy.AuthorizeTicket(ctx, ticketID, userID, ActionFacilitate)
+	if err != nil {
+		return err
+	}
+
+	if err := t.db.DB.WithContext(ctx).Model(&database.Ticket{}).
+		Where("id = ?", ticketID).
+		Update("voting_ends_at", nil).Error; err != nil {
+		slog.Error("Error stopping voting timer", slog.Any("ticket", ticketID), slog.Any("error", err))
+		return err
+	}
+
+	t.webSocketService.SetVotingTimer(roomID, ticketID, nil)
+
+	return nil
+}
+
+// expireVotingTimer finishes voting on the ticket once its timer ran out. The
+// timer is claimed first, so only one instance acts on it.
+func (t *TicketService) expireVotingTimer(ctx context.Context, ticket database.Ticket) error {
+	claim := t.db.DB.WithContext(ctx).Model(&database.Ticket{}).
+		Where("id = ? AND voting_ends_at = ?", ticket.ID, ticket.VotingEndsAt).
+		Update("voting_ends_at", nil)
+	if claim.Error != nil {
+		return claim.Error
+	}
+	if claim.RowsAffected == 0 {
+		return nil
+	}
+
+	// Clients count down on their own, they only need to know about it when
+	// nothing else changes on the ticket
+	t.webSocketService.SetVotingTimer(ticket.RoomID, ticket.ID, ticket.VotingEndsAt)
+
+	return t.finishVoting(ctx, ticket.ID)
+}
+
+// finishVoting applies the auto-finish policy of the room to the ticket, once
+// everyone present voted on it or its timer ran out
+func (t *TicketService) finishVoting(ctx context.Context, ticketID uint) error {
+	var ticket database.Ticket
+	if err := t.db.DB.WithContext(ctx).Preload("Room").First(&ticket, ticketID).Error; err != nil {
+		return err
+	}
+	if ticket.ClosedAt != nil {
+		return nil
+	}
+
+	switch ticket.Room.AutoFinish {
+	case database.AutoFinishReveal:
+		if ticket.IsRevealed() {
+			return nil
+		}
+		_, err := t.revealTicket(ctx, ticketID, 0)
+		return err
+	case database.AutoFinishClose:
+		// Another instance or the owner may have closed it in the meantime
+		_, err := t.closeTicket(ctx, ticketID, 0)
+		if errors.Is(err, ErrInvalidTicket) {
+			return nil
+		}
+		return err
+	default:
+		return nil
+	}
+}
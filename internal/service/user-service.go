@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+)
+
+const maxDisplayNameLength = 32
+
+var ErrInvalidProfile = errors.New("invalid profile")
+
+type UserService struct {
+	db *database.Database
+}
+
+type UpdateProfileForm struct {
+	DisplayName string `json:"displayName" form:"displayName"`
+	Color       string `json:"color" form:"color"`
+}
+
+func (f UpdateProfileForm) validate() (UpdateProfileForm, error) {
+	form := UpdateProfileForm{
+		DisplayName: strings.Join(strings.Fields(f.DisplayName), " "),
+		Color:       f.Color,
+	}
+
+	if form.DisplayName == "" {
+		return form, fmt.Errorf("%w: display name is required", ErrInvalidProfile)
+	}
+	if utf8.RuneCountInString(form.DisplayName) > maxDisplayNameLength {
+		return form, fmt.Errorf("%w: display name can have at most %d characters", ErrInvalidProfile, maxDisplayNameLength)
+	}
+	if form.Color != "" && !database.IsAvatarColor(form.Color) {
+		return form, fmt.Errorf("%w: unknown color %q", ErrInvalidProfile, form.Color)
+	}
+
+	return form, nil
+}
+
+func (u *UserService) UpdateProfile(ctx context.Context, userID uint, form UpdateProfileForm) (*database.User, error) {
+	form, err := form.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var user database.User
+	if err := u.db.DB.WithContext(ctx).First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+
+	user.DisplayName = form.DisplayName
+	user.Color = form.Color
+	if err := u.db.DB.WithContext(ctx).
+		Model(&user).
+		Select("display_name", "color").
+		Updates(&user).Error; err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func NewUserService(db *database.Database) *UserService {
+	return &UserService{db: db}
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+)
+
+const votingTimerPollInterval = time.Second
+
+// VotingTimerService finishes voting on tickets whose timer ran out, whether
+// or not anyone who could do it by hand is still in the room
+type VotingTimerService struct {
+	db            *database.Database
+	ticketService *TicketService
+}
+
+// expireTimers acts on every timer which ran out since the last poll
+func (v *VotingTimerService) expireTimers(ctx context.Context) {
+	var tickets []database.Ticket
+	if err := v.db.DB.WithContext(ctx).
+		Select("id", "room_id", "voting_ends_at").
+		Where("voting_ends_at <= ? AND closed_at IS NULL", time.Now()).
+		Find(&tickets).Error; err != nil {
+		slog.Error("Error getting expired voting timers", slog.Any("error", err))
+		return
+	}
+
+	for _, ticket := range tickets {
+		if err := v.ticketService.expireVotingTimer(ctx, ticket); err != nil {
+			slog.Error("Error expiring voting timer", slog.Any("ticket", ticket.ID), slog.Any("error", err))
+		}
+	}
+}
+
+func (v *VotingTimerService) worker() {
+	ticker := time.NewTicker(votingTimerPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		v.expireTimers(context.Background())
+	}
+}
+
+func NewVotingTimerService(db *database.Database, ticketService *TicketService) *VotingTimerService {
+	if db == nil {
+		panic("db cannot be nil")
+	}
+	if ticketService == nil {
+		panic("ticketService cannot be nil")
+	}
+
+	service := &VotingTimerService{
+		db:            db,
+		ticketService: ticketService,
+	}
+	go service.worker()
+
+	return service
+}
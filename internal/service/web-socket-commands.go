@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrUnknownCommand = errors.New("unknown command")
+	ErrInvalidCommand = errors.New("invalid command")
+)
+
+// CommandHandler carries out the commands clients send over the websocket.
+// The result is sent back with the acknowledgement.
+type CommandHandler interface {
+	HandleCommand(ctx context.Context, client *Client, command JSONCommand) (any, error)
+}
+
+// commandErrorCode tells the client why the command failed, without leaking
+// unexpected errors
+func commandErrorCode(err error) (JSONCommandErrorCode, string) {
+	switch {
+	case errors.Is(err, ErrUnknownCommand):
+		return CommandErrorUnknown, err.Error()
+	case errors.Is(err, ErrInvalidCommand), errors.Is(err, ErrInvalidEstimate), errors.Is(err, ErrInvalidTicket),
+		errors.Is(err, ErrInvalidTimer):
+		return CommandErrorInvalid, err.Error()
+	case errors.Is(err, ErrForbidden):
+		return CommandErrorForbidden, err.Error()
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return CommandErrorNotFound, "ticket not found"
+	default:
+		return CommandErrorInternal, "something went wrong"
+	}
+}
+
+func decodeCommandData[T any](command JSONCommand) (T, error) {
+	var data T
+	if len(command.Data) == 0 {
+		return data, nil
+	}
+	if err := json.Unmarshal(command.Data, &data); err != nil {
+		return data, fmt.Errorf("%w: %s", ErrInvalidCommand, err.Error())
+	}
+	return data, nil
+}
+
+// WebSocketCommandService runs the commands of websocket clients with the
+// user of the connection, the same way as the matching HTTP endpoints
+type WebSocketCommandService struct {
+	db               *database.Database
+	ticketService    *TicketService
+	roomService      *RoomService
+	presenceService  *PresenceService
+	webSocketService *WebSocketService
+}
+
+func (s *WebSocketCommandService) HandleCommand(ctx context.Context, client *Client, command JSONCommand) (any, error) {
+	switch command.Command {
+	case CommandPing:
+		return s.ping(client, command)
+	case CommandVote:
+		return s.vote(ctx, client, command)
+	case CommandReveal:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.ticketService.RevealTicket(ctx, ticketID, client.userID)
+		return nil, err
+	case CommandClose:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.ticketService.CloseTicket(ctx, ticketID, client.userID)
+		return nil, err
+	case CommandReopen:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.ticketService.ReopenTicket(ctx, ticketID, client.userID)
+		return nil, err
+	case CommandUpdate:
+		return nil, s.update(ctx, client, command)
+	case CommandDelete:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ticketService.DeleteTicket(ctx, ticketID, client.userID)
+	case CommandStartRound:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.ticketService.StartNewRound(ctx, ticketID, client.userID)
+		return nil, err
+	case CommandHide:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		ticket, err := s.ticketService.HideTicket(ctx, ticketID, client.userID)
+		if err != nil {
+			return nil, err
+		}
+		return JSONHiddenData{TicketID: ticket.ID, IsHidden: ticket.Hidden}, nil
+	case CommandHideAll:
+		return nil, s.ticketService.HideAllTickets(ctx, client.roomID, client.userID)
+	case CommandActivate:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ticketService.SetActiveTicket(ctx, ticketID, client.userID)
+	case CommandStartTimer:
+		return s.startTimer(ctx, client, command)
+	case CommandStopTimer:
+		ticketID, err := s.commandTicket(ctx, client, command)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ticketService.StopVotingTimer(ctx, ticketID, client.userID)
+	case CommandFacilitate:
+		facilitate, err := decodeCommandData[JSONFacilitateCommand](command)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.ticketService.SetFacilitated(ctx, client.roomID, client.userID, facilitate.Facilitated)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownCommand, command.Command)
+	}
+}
+
+func (s *WebSocketCommandService) ping(client *Client, command JSONCommand) (any, error) {
+	ping, err := decodeCommandData[JSONPingCommand](command)
+	if err != nil {
+		return nil, err
+	}
+	if ping.Idle != nil && s.presenceService.SetIdle(client.roomID, client.userID, client.conn, *ping.Idle) {
+		s.webSocketService.SendPresence(client.roomID)
+	}
+	return JSONPingResult{ServerTime: time.Now()}, nil
+}
+
+func (s *WebSocketCommandService) vote(ctx context.Context, client *Client, command JSONCommand) (any, error) {
+	vote, err := decodeCommandData[JSONVoteCommand](command)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ticketOfRoom(ctx, client.roomID, vote.TicketID); err != nil {
+		return nil, err
+	}
+
+	estimate, err := s.ticketService.EstimateTicket(ctx, client.userID, EstimateTicketForm{
+		TicketID:            vote.TicketID,
+		RoomID:              client.roomID,
+		WeekEstimate:        vote.WeekEstimate,
+		DayEstimate:         vote.DayEstimate,
+		HourEstimate:        vote.HourEstimate,
+		CardEstimate:        vote.CardEstimate,
+		Kind:                vote.Kind,
+		OptimisticEstimate:  vote.OptimisticEstimate,
+		PessimisticEstimate: vote.PessimisticEstimate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return JSONVoteResult{TicketID: vote.TicketID, Estimate: estimate}, nil
+}
+
+func (s *WebSocketCommandService) update(ctx context.Context, client *Client, command JSONCommand) error {
+	update, err := decodeCommandData[JSONUpdateTicketCommand](command)
+	if err != nil {
+		return err
+	}
+	if err := s.ticketOfRoom(ctx, client.roomID, update.TicketID); err != nil {
+		return err
+	}
+
+	_, err = s.ticketService.UpdateTicket(ctx, client.userID, UpdateTicketForm{
+		TicketID:          update.TicketID,
+		TicketName:        update.Name,
+		TicketDescription: update.Description,
+	})
+	return err
+}
+
+func (s *WebSocketCommandService) startTimer(ctx context.Context, client *Client, command JSONCommand) (any, error) {
+	start, err := decodeCommandData[JSONStartTimerCommand](command)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.ticketOfRoom(ctx, client.roomID, start.TicketID); err != nil {
+		return nil, err
+	}
+
+	endsAt, err := s.ticketService.StartVotingTimer(ctx, start.TicketID, client.userID, time.Duration(start.Seconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return JSONTimerData{TicketID: start.TicketID, EndsAt: &endsAt}, nil
+}
+
+// commandTicket returns the ticket the command is about, if it is in the
+// client's room. The ticket service checks whether the user may act on it.
+func (s *WebSocketCommandService) commandTicket(ctx context.Context, client *Client, command JSONCommand) (uint, error) {
+	data, err := decodeCommandData[JSONTicketCommand](command)
+	if err != nil {
+		return 0, err
+	}
+	if err := s.ticketOfRoom(ctx, client.roomID, data.TicketID); err != nil {
+		return 0, err
+	}
+	return data.TicketID, nil
+}
+
+// ticketOfRoom makes sure clients only act on tickets of the room they are connected to
+func (s *WebSocketCommandService) ticketOfRoom(ctx context.Context, roomID uint, ticketID uint) error {
+	if ticketID == 0 {
+		return fmt.Errorf("%w: ticketID is required", ErrInvalidCommand)
+	}
+	var count int64
+	if err := s.db.DB.WithContext(ctx).Model(&database.Ticket{}).
+		Where("id = ? AND room_id = ?", ticketID, roomID).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+func NewWebSocketCommandService(db *database.Database,
+	ticketService *TicketService,
+	roomService *RoomService,
+	presenceService *PresenceService,
+	webSocketService *WebSocketService) *WebSocketCommandService {
+	if db == nil {
+		panic("db cannot be nil")
+	}
+	if ticketService == nil {
+		panic("ticketService cannot be nil")
+	}
+	if roomService == nil {
+		panic("roomService cannot be nil")
+	}
+	if presenceService == nil {
+		panic("presenceService cannot be nil")
+	}
+	if webSocketService == nil {
+		panic("webSocketService cannot be nil")
+	}
+
+	return &WebSocketCommandService{
+		db:               db,
+		ticketService:    ticketService,
+		roomService:      roomService,
+		presenceService:  presenceService,
+		webSocketService: webSocketService,
+	}
+}
+
+var _ CommandHandler = &WebSocketCommandService{}
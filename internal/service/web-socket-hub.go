@@ -0,0 +1,385 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Messages queued for a client before it is considered too slow and evicted
+	clientSendQueue = 64
+	// Time allowed to write a single message to a client
+	clientWriteWait = 10 * time.Second
+	// Time allowed to read the next pong from a client
+	clientPongWait = 60 * time.Second
+	// Clients are pinged a bit more often than the pong wait, so healthy
+	// connections never hit the read deadline
+	clientPingPeriod = clientPongWait * 9 / 10
+)
+
+// WebSocketConn is the part of *websocket.Conn the hub writes to
+type WebSocketConn interface {
+	WriteMessage(messageType int, data []byte) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Client is a single connection registered in the hub. Only its writer
+// goroutine ever writes to the connection.
+type Client struct {
+	conn     WebSocketConn
+	protocol Protocol
+	roomID   uint
+	userID   uint
+	send     chan []byte
+	// Closed once the client is unregistered, stops the writer
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mutex sync.Mutex
+	// Changes when the role of the user in the room changes
+	route Route
+	// Sequence number of the newest event queued for the client
+	lastSeq uint64
+	// Live events are held back while missed events are replayed
+	replaying bool
+	pending   []RoomEvent
+}
+
+// queue queues the event unless the client already got it, and reports
+// whether there was room for it. Must be called with the client's lock held.
+func (c *Client) queue(event RoomEvent, frame []byte) bool {
+	if event.Seq != 0 && event.Seq <= c.lastSeq {
+		return true
+	}
+	select {
+	case c.send <- frame:
+		c.lastSeq = max(c.lastSeq, event.Seq)
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) Route() Route {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.route
+}
+
+// frame returns the event's payload in the client's protocol with its sequence
+// number, or nil if the event has nothing for the client
+func (c *Client) frame(event RoomEvent) []byte {
+	if !c.Route().Matches(event.Route) {
+		return nil
+	}
+	payload := event.Payload
+	if c.protocol == ProtocolJSON {
+		payload = event.JSONPayload
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	return sequencedFrame(event.Seq, payload)
+}
+
+func (c *Client) RoomID() uint {
+	return c.roomID
+}
+
+func (c *Client) UserID() uint {
+	return c.userID
+}
+
+// Hub keeps the connected clients indexed by room. Broadcasts never block, a
+// client whose send queue is full is evicted instead of stalling the others.
+type Hub struct {
+	mutex     sync.RWMutex
+	rooms     map[uint]map[*Client]bool
+	queueSize int
+	// Called once for every client leaving the hub, outside of the hub's lock
+	onRemove func(*Client)
+}
+
+// Register adds the connection to the room and starts its writer goroutine
+func (h *Hub) Register(conn WebSocketConn, roomID uint, userID uint, route Route, protocol Protocol) *Client {
+	return h.register(conn, roomID, userID, route, protocol, 0, false)
+}
+
+// Resume adds a reconnecting client which already got the events up to
+// lastSeq. Live events are held back until Replay sends the missed ones.
+func (h *Hub) Resume(conn WebSocketConn, roomID uint, userID uint, route Route, protocol Protocol, lastSeq uint64) *Client {
+	return h.register(conn, roomID, userID, route, protocol, lastSeq, true)
+}
+
+func (h *Hub) register(conn WebSocketConn, roomID uint, userID uint, route Route, protocol Protocol, lastSeq uint64, replaying bool) *Client {
+	client := &Client{
+		conn:      conn,
+		route:     route,
+		protocol:  protocol,
+		roomID:    roomID,
+		userID:    userID,
+		send:      make(chan []byte, h.queueSize),
+		done:      make(chan struct{}),
+		lastSeq:   lastSeq,
+		replaying: replaying,
+	}
+
+	h.mutex.Lock()
+	room, ok := h.rooms[roomID]
+	if !ok {
+		room = make(map[*Client]bool)
+		h.rooms[roomID] = room
+	}
+	room[client] = true
+	h.mutex.Unlock()
+
+	go h.writePump(client)
+
+	return client
+}
+
+// Unregister removes the client from its room and closes its connection. It is
+// safe to call more than once, e.g. from both the reader and the writer.
+func (h *Hub) Unregister(client *Client) {
+	h.mutex.Lock()
+	room := h.rooms[client.roomID]
+	_, ok := room[client]
+	delete(room, client)
+	if len(room) == 0 {
+		delete(h.rooms, client.roomID)
+	}
+	h.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	client.closeOnce.Do(func() {
+		close(client.done)
+		client.conn.Close()
+	})
+	if h.onRemove != nil {
+		h.onRemove(client)
+	}
+}
+
+// Replay sends the missed events of a resumed client, followed by the live
+// events held back in the meantime. Unlike broadcasts it waits for the
+// client's queue, since the log can hold more events than the queue.
+func (h *Hub) Replay(client *Client, missed []RoomEvent) {
+	for _, event := range missed {
+		if !h.replayEvent(client, event) {
+			return
+		}
+	}
+
+	for {
+		client.mutex.Lock()
+		pending := client.pending
+		client.pending = nil
+		if len(pending) == 0 {
+			client.replaying = false
+			client.mutex.Unlock()
+			return
+		}
+		client.mutex.Unlock()
+
+		for _, event := range pending {
+			if !h.replayEvent(client, event) {
+				return
+			}
+		}
+	}
+}
+
+// replayEvent waits until the event is queued, reporting false if the client
+// left in the meantime
+func (h *Hub) replayEvent(client *Client, event RoomEvent) bool {
+	frame := client.frame(event)
+	client.mutex.Lock()
+	seen := event.Seq != 0 && event.Seq <= client.lastSeq
+	client.mutex.Unlock()
+	if seen || frame == nil {
+		return true
+	}
+
+	select {
+	case client.send <- frame:
+	case <-client.done:
+		return false
+	}
+
+	client.mutex.Lock()
+	client.lastSeq = max(client.lastSeq, event.Seq)
+	client.mutex.Unlock()
+	return true
+}
+
+// Broadcast queues the event for every client in its room whose route
+// matches, e.g. room/1/* for everyone or room/1/owner for the owner only, in
+// the client's protocol
+func (h *Hub) Broadcast(event RoomEvent) {
+	var slow []*Client
+
+	h.mutex.RLock()
+	for client := range h.rooms[event.RoomID] {
+		frame := client.frame(event)
+		if frame == nil {
+			continue
+		}
+
+		client.mutex.Lock()
+		fits := true
+		if client.replaying {
+			client.pending = append(client.pending, event)
+			fits = len(client.pending) <= h.queueSize
+		} else {
+			fits = client.queue(event, frame)
+		}
+		client.mutex.Unlock()
+
+		if !fits {
+			slow = append(slow, client)
+		}
+	}
+	h.mutex.RUnlock()
+
+	for _, client := range slow {
+		h.evict(client)
+	}
+}
+
+// Reply queues a message for the client only, e.g. the answer to its command.
+// Replies aren't room events, so they have no sequence number.
+func (h *Hub) Reply(client *Client, payload []byte) {
+	client.mutex.Lock()
+	fits := client.queue(RoomEvent{}, payload)
+	client.mutex.Unlock()
+
+	if !fits {
+		h.evict(client)
+	}
+}
+
+func (h *Hub) evict(client *Client) {
+	slog.Warn("Evicting slow websocket client", slog.Any("room", client.roomID), slog.Any("user", client.userID))
+	h.Unregister(client)
+}
+
+// sequencedFrame adds the sequence number of an event to its payload, as the
+// seq field of JSON messages or a leading comment of HTML fragments, which
+// htmx ignores when swapping
+func sequencedFrame(seq uint64, payload []byte) []byte {
+	if seq == 0 {
+		return payload
+	}
+	if bytes.HasPrefix(payload, []byte("{")) {
+		return append(fmt.Appendf(nil, `{"seq":%d,`, seq), payload[1:]...)
+	}
+	return append(fmt.Appendf(nil, "<!--seq:%d-->", seq), payload...)
+}
+
+// FrameSeq returns the sequence number of the event a frame was made of, or 0
+// for replies and other unsequenced frames
+func FrameSeq(frame []byte) uint64 {
+	head := string(frame[:min(len(frame), 32)])
+	var seq uint64
+	if _, err := fmt.Sscanf(head, "<!--seq:%d-->", &seq); err == nil {
+		return seq
+	}
+	if _, err := fmt.Sscanf(head, `{"seq":%d,`, &seq); err == nil {
+		return seq
+	}
+	return 0
+}
+
+// Reroute changes the route of the user's clients in the room, e.g. after
+// their role changed, and returns them
+func (h *Hub) Reroute(roomID uint, userID uint, route Route) []*Client {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var clients []*Client
+	for client := range h.rooms[roomID] {
+		if client.userID == userID {
+			client.mutex.Lock()
+			client.route = route
+			client.mutex.Unlock()
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// RoomsOfUser returns the rooms the user has at least one connection in
+func (h *Hub) RoomsOfUser(userID uint) []uint {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	var roomIDs []uint
+	for roomID, room := range h.rooms {
+		for client := range room {
+			if client.userID == userID {
+				roomIDs = append(roomIDs, roomID)
+				break
+			}
+		}
+	}
+	return roomIDs
+}
+
+// ClientCount returns the number of connections in the room
+func (h *Hub) ClientCount(roomID uint) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	return len(h.rooms[roomID])
+}
+
+// writePump is the only goroutine writing to the client's connection. It also
+// pings the client so dead connections are noticed by the reader.
+func (h *Hub) writePump(client *Client) {
+	ticker := time.NewTicker(clientPingPeriod)
+	defer func() {
+		ticker.Stop()
+		h.Unregister(client)
+	}()
+
+	for {
+		select {
+		case <-client.done:
+			return
+		case data := <-client.send:
+			client.conn.SetWriteDeadline(time.Now().Add(clientWriteWait))
+			if err := client.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				slog.Debug("Error writing websocket message", slog.Any("error", err))
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(clientWriteWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// NewHub creates a hub queueing up to queueSize messages per client. onRemove
+// is called for every client leaving the hub and may be nil.
+func NewHub(queueSize int, onRemove func(*Client)) *Hub {
+	if queueSize < 1 {
+		panic("queueSize must be positive")
+	}
+
+	return &Hub{
+		rooms:     make(map[uint]map[*Client]bool),
+		queueSize: queueSize,
+		onRemove:  onRemove,
+	}
+}
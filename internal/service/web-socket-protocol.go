@@ -0,0 +1,471 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/invopop/jsonschema"
+	"github.com/markojerkic/spring-planing/cmd/web/components/room"
+	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
+)
+
+// Protocol is the format room events are sent to a websocket client in
+type Protocol string
+
+const (
+	// Rendered templ fragments swapped in by HTMX, used by the web app
+	ProtocolHTML Protocol = "html"
+	// Typed JSON messages for CLIs, bots and other clients
+	ProtocolJSON Protocol = "json"
+
+	// JSONProtocolVersion is bumped on breaking changes to the JSON messages
+	JSONProtocolVersion = 1
+	// JSONSubprotocol negotiates the JSON protocol through Sec-WebSocket-Protocol
+	JSONSubprotocol = "sprint-planning.v1.json"
+)
+
+// ParseProtocol returns the protocol asked for with the protocol query
+// parameter or the negotiated subprotocol, HTML if neither is set
+func ParseProtocol(query string, subprotocol string) (Protocol, error) {
+	if subprotocol == JSONSubprotocol {
+		return ProtocolJSON, nil
+	}
+	switch protocol := Protocol(query); protocol {
+	case "", ProtocolHTML:
+		return ProtocolHTML, nil
+	case ProtocolJSON:
+		return ProtocolJSON, nil
+	default:
+		return "", fmt.Errorf("unknown websocket protocol %q", query)
+	}
+}
+
+// JSONMessageType names a message of the JSON protocol
+type JSONMessageType string
+
+const (
+	JSONTicketsCreated    JSONMessageType = "ticket.created"
+	JSONTicketClosed      JSONMessageType = "ticket.closed"
+	JSONTicketReopened    JSONMessageType = "ticket.reopened"
+	JSONTicketUpdated     JSONMessageType = "ticket.updated"
+	JSONTicketDeleted     JSONMessageType = "ticket.deleted"
+	JSONTicketRevealed    JSONMessageType = "ticket.revealed"
+	JSONTicketRoundStart  JSONMessageType = "ticket.roundStarted"
+	JSONTicketEstimatedBy JSONMessageType = "ticket.estimatedBy"
+	JSONTicketHidden      JSONMessageType = "ticket.hidden"
+	JSONTicketTimer       JSONMessageType = "ticket.timer"
+	JSONTicketList        JSONMessageType = "room.ticketList"
+	JSONTotalEstimate     JSONMessageType = "room.totalEstimate"
+	JSONResync            JSONMessageType = "room.resync"
+	JSONRoleChanged       JSONMessageType = "room.roleChanged"
+	JSONActiveTicket      JSONMessageType = "room.activeTicket"
+	JSONPresenceRoster    JSONMessageType = "presence.roster"
+	JSONLLMRecommendation JSONMessageType = "llm.recommendation"
+	JSONLLMJobStatus      JSONMessageType = "llm.jobStatus"
+	// Replies to commands, only sent to the client which sent the command
+	JSONCommandAck   JSONMessageType = "command.ack"
+	JSONCommandError JSONMessageType = "command.error"
+)
+
+// JSONEnvelope wraps every message of the JSON protocol. The seq field of
+// sequenced events is added in front of it when sending.
+type JSONEnvelope struct {
+	Version int             `json:"v" jsonschema_description:"Version of the JSON protocol."`
+	Type    JSONMessageType `json:"type" jsonschema_description:"Type of the message, decides the schema of data."`
+	RoomID  uint            `json:"roomID"`
+	Data    any             `json:"data"`
+}
+
+type JSONVote struct {
+	Voter    string `json:"voter" jsonschema_description:"Display name of the voter."`
+	Estimate string `json:"estimate"`
+	Kind     string `json:"kind,omitempty" jsonschema:"enum=unsure,enum=break,enum=abstain" jsonschema_description:"Set for votes without a value."`
+	Outlier  string `json:"outlier,omitempty" jsonschema:"enum=lowest,enum=highest" jsonschema_description:"Set for the lowest and the highest votes of a round without consensus."`
+}
+
+type JSONConsensus struct {
+	Level  string `json:"level" jsonschema:"enum=consensus,enum=near,enum=split"`
+	Steps  int    `json:"steps" jsonschema_description:"Cards of the deck between the lowest and the highest vote."`
+	Revote bool   `json:"revote" jsonschema_description:"The votes are too far apart, a new round is recommended."`
+}
+
+type JSONLLMEstimate struct {
+	TicketID   uint     `json:"ticketID"`
+	Estimate   string   `json:"estimate"`
+	Rationale  string   `json:"rationale,omitempty"`
+	Risks      []string `json:"risks,omitempty"`
+	Confidence string   `json:"confidence,omitempty" jsonschema:"enum=low,enum=medium,enum=high"`
+}
+
+type JSONTicket struct {
+	ID          uint    `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	JiraKey     *string `json:"jiraKey"`
+	IsClosed    bool    `json:"isClosed"`
+	IsHidden    bool    `json:"isHidden"`
+	IsRevealed  bool    `json:"isRevealed"`
+	Round       int     `json:"round" jsonschema_description:"Voting round, starting at 1."`
+	EstimatedBy string  `json:"estimatedBy" jsonschema_description:"How many of the present users voted, e.g. 2/3."`
+	// Only set once the votes are revealed
+	AverageEstimate string         `json:"averageEstimate,omitempty"`
+	MedianEstimate  string         `json:"medianEstimate,omitempty"`
+	StdEstimate     string         `json:"stdEstimate,omitempty"`
+	ExpectedRange   string         `json:"expectedRange,omitempty" jsonschema_description:"Range the estimate likely falls in, only for three-point rooms."`
+	Votes           []JSONVote     `json:"votes,omitempty" jsonschema_description:"Votes of the current round, only set once revealed."`
+	Consensus       *JSONConsensus `json:"consensus,omitempty" jsonschema_description:"How close the votes are, only set once revealed with at least two votes."`
+	// Cards of the room's deck, empty when estimating in hours
+	EstimationCards []string         `json:"estimationCards,omitempty"`
+	LLMEstimate     *JSONLLMEstimate `json:"llmEstimate,omitempty"`
+}
+
+type JSONTicketsCreatedData struct {
+	Tickets []JSONTicket `json:"tickets"`
+}
+
+type JSONTicketData struct {
+	Ticket JSONTicket `json:"ticket"`
+}
+
+type JSONTicketUpdatedData struct {
+	TicketID    uint   `json:"ticketID"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type JSONTicketDeletedData struct {
+	TicketID uint `json:"ticketID"`
+}
+
+type JSONEstimatedByData struct {
+	TicketID    uint   `json:"ticketID"`
+	EstimatedBy string `json:"estimatedBy"`
+}
+
+type JSONHiddenData struct {
+	TicketID uint `json:"ticketID" jsonschema_description:"Hidden or shown ticket, 0 for every ticket of the room."`
+	IsHidden bool `json:"isHidden"`
+}
+
+type JSONTimerData struct {
+	TicketID uint       `json:"ticketID"`
+	EndsAt   *time.Time `json:"endsAt" jsonschema_description:"When voting ends, in the past once the timer ran out and null if it was stopped."`
+}
+
+type JSONTicketListData struct {
+	Tickets []RoomTicket `json:"tickets"`
+}
+
+type JSONTotalEstimateData struct {
+	Total string `json:"total" jsonschema_description:"Sum of the closed tickets' estimates."`
+}
+
+type JSONResyncData struct{}
+
+// JSONRoleChangedData is sent to the member whose role changed, the messages
+// they get from then on are the ones of the new role
+type JSONRoleChangedData struct {
+	Role string `json:"role" jsonschema:"enum=owner,enum=moderator,enum=estimator,enum=observer"`
+}
+
+// JSONActiveTicketData names the ticket the room is estimating
+type JSONActiveTicketData struct {
+	TicketID    uint   `json:"ticketID" jsonschema_description:"Active ticket, 0 if none is."`
+	Name        string `json:"name,omitempty"`
+	Facilitated bool   `json:"facilitated" jsonschema_description:"Whether only the active ticket can be voted on."`
+}
+
+type JSONParticipant struct {
+	UserID   uint   `json:"userID"`
+	Name     string `json:"name"`
+	Status   string `json:"status" jsonschema:"enum=online,enum=idle,enum=offline"`
+	HasVoted bool   `json:"hasVoted"`
+	IsOwner  bool   `json:"isOwner"`
+	Role     string `json:"role" jsonschema:"enum=owner,enum=moderator,enum=estimator,enum=observer"`
+}
+
+type JSONPresenceData struct {
+	CurrentTicket string            `json:"currentTicket"`
+	Participants  []JSONParticipant `json:"participants"`
+}
+
+type JSONExample struct {
+	Name       string `json:"name"`
+	Estimate   string `json:"estimate"`
+	Similarity string `json:"similarity"`
+}
+
+type JSONLLMJobStatusData struct {
+	TicketID  uint          `json:"ticketID"`
+	Status    string        `json:"status" jsonschema:"enum=pending,enum=running,enum=succeeded,enum=failed"`
+	Attempts  int           `json:"attempts"`
+	LastError string        `json:"lastError,omitempty"`
+	Examples  []JSONExample `json:"examples,omitempty"`
+	// Examples from other rooms of the owner are only counted
+	OtherRoomExamples int `json:"otherRoomExamples,omitempty"`
+}
+
+type JSONCommandAckData struct {
+	ID      string          `json:"id" jsonschema_description:"ID of the acknowledged command."`
+	Command JSONCommandName `json:"command"`
+	Result  any             `json:"result,omitempty" jsonschema_description:"Result of the command, if it has one."`
+}
+
+// JSONCommandErrorCode tells clients why a command failed
+type JSONCommandErrorCode string
+
+const (
+	CommandErrorInvalid   JSONCommandErrorCode = "invalid"
+	CommandErrorForbidden JSONCommandErrorCode = "forbidden"
+	CommandErrorNotFound  JSONCommandErrorCode = "notFound"
+	CommandErrorUnknown   JSONCommandErrorCode = "unknownCommand"
+	CommandErrorInternal  JSONCommandErrorCode = "internal"
+)
+
+type JSONCommandErrorData struct {
+	ID      string               `json:"id" jsonschema_description:"ID of the failed command."`
+	Command JSONCommandName      `json:"command"`
+	Code    JSONCommandErrorCode `json:"code" jsonschema:"enum=invalid,enum=forbidden,enum=notFound,enum=unknownCommand,enum=internal"`
+	Error   string               `json:"error"`
+}
+
+// JSONCommandName names a command clients send over the websocket
+type JSONCommandName string
+
+const (
+	CommandVote       JSONCommandName = "vote"
+	CommandReveal     JSONCommandName = "reveal"
+	CommandClose      JSONCommandName = "close"
+	CommandReopen     JSONCommandName = "reopen"
+	CommandUpdate     JSONCommandName = "update"
+	CommandDelete     JSONCommandName = "delete"
+	CommandStartRound JSONCommandName = "startRound"
+	CommandHide       JSONCommandName = "hide"
+	CommandHideAll    JSONCommandName = "hideAll"
+	CommandActivate   JSONCommandName = "activate"
+	CommandFacilitate JSONCommandName = "facilitate"
+	CommandStartTimer JSONCommandName = "startTimer"
+	CommandStopTimer  JSONCommandName = "stopTimer"
+	CommandPing       JSONCommandName = "ping"
+)
+
+// JSONCommand is sent by clients to act on their room without an HTTP
+// request. Every command is answered with command.ack or command.error.
+type JSONCommand struct {
+	ID      string          `json:"id" jsonschema_description:"Chosen by the client to match the reply to the command."`
+	Command JSONCommandName `json:"command"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type JSONVoteCommand struct {
+	TicketID     uint   `json:"ticketID"`
+	WeekEstimate int32  `json:"weekEstimate,omitempty"`
+	DayEstimate  int32  `json:"dayEstimate,omitempty"`
+	HourEstimate int32  `json:"hourEstimate,omitempty"`
+	CardEstimate string `json:"cardEstimate,omitempty" jsonschema_description:"Card of the room's deck, for rooms not estimating in hours."`
+	Kind         string `json:"kind,omitempty" jsonschema:"enum=unsure,enum=break,enum=abstain" jsonschema_description:"Responds without a value, which is left out of the statistics."`
+	// The estimate above is the most likely one in three-point rooms
+	OptimisticEstimate  string `json:"optimisticEstimate,omitempty" jsonschema_description:"Hours or a card of the deck, only for three-point rooms."`
+	PessimisticEstimate string `json:"pessimisticEstimate,omitempty" jsonschema_description:"Hours or a card of the deck, only for three-point rooms."`
+}
+
+type JSONVoteResult struct {
+	TicketID uint   `json:"ticketID"`
+	Estimate string `json:"estimate"`
+}
+
+type JSONTicketCommand struct {
+	TicketID uint `json:"ticketID"`
+}
+
+type JSONUpdateTicketCommand struct {
+	TicketID    uint   `json:"ticketID"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type JSONStartTimerCommand struct {
+	TicketID uint `json:"ticketID"`
+	Seconds  int  `json:"seconds,omitempty" jsonschema_description:"Length of the timer, the room's default if not set."`
+}
+
+type JSONFacilitateCommand struct {
+	Facilitated bool `json:"facilitated" jsonschema_description:"Vote on the active ticket only, or on every open ticket."`
+}
+
+type JSONPingCommand struct {
+	Idle *bool `json:"idle,omitempty" jsonschema_description:"Whether the user went idle, presence is left as is if not set."`
+}
+
+type JSONPingResult struct {
+	ServerTime time.Time `json:"serverTime"`
+}
+
+// jsonMessageData documents the data sent with each message type
+var jsonMessageData = map[JSONMessageType]struct {
+	description string
+	data        any
+}{
+	JSONTicketsCreated:    {"Tickets were added to the room.", JSONTicketsCreatedData{}},
+	JSONTicketClosed:      {"A ticket was closed with the final estimate.", JSONTicketData{}},
+	JSONTicketReopened:    {"A closed ticket was opened again in a new round, earlier votes are kept as history.", JSONTicketData{}},
+	JSONTicketUpdated:     {"The name or description of a ticket changed.", JSONTicketUpdatedData{}},
+	JSONTicketDeleted:     {"A ticket was removed from the room.", JSONTicketDeletedData{}},
+	JSONTicketRevealed:    {"The votes of a ticket were revealed.", JSONTicketData{}},
+	JSONTicketRoundStart:  {"Voting on a ticket started over.", JSONTicketData{}},
+	JSONTicketEstimatedBy: {"Someone voted on a ticket.", JSONEstimatedByData{}},
+	JSONTicketHidden:      {"Tickets were hidden or shown, hidden tickets are only shown to owners and moderators.", JSONHiddenData{}},
+	JSONTicketTimer:       {"The voting timer of a ticket was started, stopped or ran out.", JSONTimerData{}},
+	JSONTicketList:        {"The tickets of the room changed.", JSONTicketListData{}},
+	JSONTotalEstimate:     {"The total estimate of the room changed.", JSONTotalEstimateData{}},
+	JSONResync:            {"Missed events are no longer kept, fetch the room again.", JSONResyncData{}},
+	JSONRoleChanged:       {"Your role in the room changed, sent to that member only.", JSONRoleChangedData{}},
+	JSONActiveTicket:      {"The ticket the room is estimating changed, or facilitation was switched on or off.", JSONActiveTicketData{}},
+	JSONPresenceRoster:    {"Who is in the room and who voted on the current ticket.", JSONPresenceData{}},
+	JSONLLMRecommendation: {"The LLM suggested an estimate for a ticket.", JSONLLMEstimate{}},
+	JSONLLMJobStatus:      {"Progress of an LLM estimate, sent to owners and moderators only.", JSONLLMJobStatusData{}},
+	JSONCommandAck:        {"A command succeeded.", JSONCommandAckData{}},
+	JSONCommandError:      {"A command failed.", JSONCommandErrorData{}},
+}
+
+// jsonCommandData documents the data of each command and its result
+var jsonCommandData = map[JSONCommandName]struct {
+	description string
+	data        any
+	result      any
+}{
+	CommandVote:       {"Vote on a ticket of the room.", JSONVoteCommand{}, JSONVoteResult{}},
+	CommandReveal:     {"Reveal the votes of a ticket, owner and moderators only.", JSONTicketCommand{}, nil},
+	CommandClose:      {"Close voting on a ticket, owner and moderators only.", JSONTicketCommand{}, nil},
+	CommandReopen:     {"Open voting on a closed ticket again, owner and moderators only.", JSONTicketCommand{}, nil},
+	CommandUpdate:     {"Change the name and description of a ticket, owner and moderators only.", JSONUpdateTicketCommand{}, nil},
+	CommandDelete:     {"Remove a ticket from the room, owner and moderators only.", JSONTicketCommand{}, nil},
+	CommandStartRound: {"Start a new voting round of a ticket, owner and moderators only.", JSONTicketCommand{}, nil},
+	CommandHide:       {"Hide or show a ticket, owner and moderators only.", JSONTicketCommand{}, JSONHiddenData{}},
+	CommandHideAll:    {"Hide every ticket of the room, owner and moderators only.", struct{}{}, nil},
+	CommandActivate:   {"Make a ticket the one the room is estimating, owner and moderators only.", JSONTicketCommand{}, nil},
+	CommandStartTimer: {"Start the voting timer of a ticket, owner and moderators only.", JSONStartTimerCommand{}, JSONTimerData{}},
+	CommandStopTimer:  {"Stop the voting timer of a ticket, owner and moderators only.", JSONTicketCommand{}, nil},
+	CommandFacilitate: {"Switch between voting on the active ticket only and on every open ticket, owner and moderators only.", JSONFacilitateCommand{}, nil},
+	CommandPing:       {"Keep the connection alive and update presence.", JSONPingCommand{}, JSONPingResult{}},
+}
+
+// JSONProtocolSchema documents the JSON protocol, the envelopes and the JSON
+// schema of the data of each message type and command
+func JSONProtocolSchema() map[string]any {
+	reflector := jsonschema.Reflector{DoNotReference: true}
+
+	messages := make(map[JSONMessageType]any, len(jsonMessageData))
+	for messageType, message := range jsonMessageData {
+		schema := reflector.Reflect(message.data)
+		schema.Description = message.description
+		messages[messageType] = schema
+	}
+
+	commands := make(map[JSONCommandName]any, len(jsonCommandData))
+	for name, command := range jsonCommandData {
+		schema := reflector.Reflect(command.data)
+		schema.Description = command.description
+		documented := map[string]any{"data": schema}
+		if command.result != nil {
+			documented["result"] = reflector.Reflect(command.result)
+		}
+		commands[name] = documented
+	}
+
+	return map[string]any{
+		"version":         JSONProtocolVersion,
+		"subprotocol":     JSONSubprotocol,
+		"envelope":        reflector.Reflect(JSONEnvelope{}),
+		"messages":        messages,
+		"commandEnvelope": reflector.Reflect(JSONCommand{}),
+		"commands":        commands,
+	}
+}
+
+// encodeJSONMessage wraps the data of a message in the envelope
+func encodeJSONMessage(roomID uint, messageType JSONMessageType, data any) ([]byte, error) {
+	return json.Marshal(JSONEnvelope{
+		Version: JSONProtocolVersion,
+		Type:    messageType,
+		RoomID:  roomID,
+		Data:    data,
+	})
+}
+
+func toJSONLLMEstimate(ticketID uint, props ticket.LlmEstimateProps) *JSONLLMEstimate {
+	return &JSONLLMEstimate{
+		TicketID:   ticketID,
+		Estimate:   props.Estimate,
+		Rationale:  props.Rationale,
+		Risks:      props.Risks,
+		Confidence: props.Confidence,
+	}
+}
+
+// toJSONTicket converts the props the ticket is rendered with, so both
+// protocols send the same state. Per user fields like their own vote are left out.
+func toJSONTicket(props ticket.TicketDetailProps) JSONTicket {
+	jsonTicket := JSONTicket{
+		ID:              props.ID,
+		Name:            props.Name,
+		Description:     props.Description,
+		JiraKey:         props.JiraKey,
+		IsClosed:        props.IsClosed,
+		IsHidden:        props.IsHidden,
+		IsRevealed:      props.IsRevealed,
+		Round:           props.Round,
+		EstimatedBy:     props.EstimatedBy,
+		EstimationCards: props.EstimationCards,
+	}
+	if props.IsRevealed || props.IsClosed {
+		jsonTicket.AverageEstimate = props.AverageEstimate
+		jsonTicket.MedianEstimate = props.MedianEstimate
+		jsonTicket.StdEstimate = props.StdEstimate
+		jsonTicket.ExpectedRange = props.ExpectedRange
+	}
+	for _, vote := range props.Votes {
+		jsonTicket.Votes = append(jsonTicket.Votes, JSONVote{Voter: vote.Voter.Name, Estimate: vote.Estimate, Kind: vote.Kind, Outlier: vote.Outlier})
+	}
+	if props.Consensus != nil {
+		jsonTicket.Consensus = &JSONConsensus{
+			Level:  props.Consensus.Level,
+			Steps:  props.Consensus.Steps,
+			Revote: props.Consensus.Revote,
+		}
+	}
+	if props.LlmEstimate != nil {
+		jsonTicket.LLMEstimate = toJSONLLMEstimate(props.ID, *props.LlmEstimate)
+	}
+	return jsonTicket
+}
+
+func toJSONPresence(props room.PresenceRosterProps) JSONPresenceData {
+	participants := make([]JSONParticipant, len(props.Participants))
+	for i, participant := range props.Participants {
+		participants[i] = JSONParticipant{
+			UserID:   participant.UserID,
+			Name:     participant.Avatar.Name,
+			Status:   participant.Status,
+			HasVoted: participant.HasVoted,
+			IsOwner:  participant.IsOwner,
+			Role:     participant.Role,
+		}
+	}
+	return JSONPresenceData{CurrentTicket: props.CurrentTicket, Participants: participants}
+}
+
+func toJSONLLMJobStatus(props ticket.LlmJobStatusProps) JSONLLMJobStatusData {
+	status := JSONLLMJobStatusData{
+		TicketID:          props.TicketID,
+		Status:            props.Status,
+		Attempts:          props.Attempts,
+		LastError:         props.LastError,
+		OtherRoomExamples: props.OtherRoomExamples,
+	}
+	for _, example := range props.Examples {
+		status.Examples = append(status.Examples, JSONExample(example))
+	}
+	return status
+}
@@ -3,120 +3,252 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"log/slog"
 	"sync"
 	"time"
 
+	"github.com/a-h/templ"
 	"github.com/gorilla/websocket"
+	"github.com/markojerkic/spring-planing/cmd/web/components/room"
 	"github.com/markojerkic/spring-planing/cmd/web/components/ticket"
 )
 
-var subscriptions = make(map[*websocket.Conn]Route)
-var mutex = sync.RWMutex{}
+type jsonMessage[T any] struct {
+	MessageType string `json:"messageType"`
+	Data        T      `json:"data"`
+}
 
-func getMatchingSubscriptions(route Route) []*websocket.Conn {
-	mutex.RLock()
-	defer mutex.RUnlock()
+// presenceUpdate is sent by the client when the user goes idle or comes back
+type presenceUpdate struct {
+	Idle bool `json:"idle"`
+}
+
+type WebSocketService struct {
+	hub             *Hub
+	backplane       Backplane
+	roomService     *RoomService
+	presenceService *PresenceService
+	commands        CommandHandler
+	// Held while registering clients and checking whether the last one left a
+	// room, so the backplane doesn't forget a room someone just joined
+	roomsMutex sync.Mutex
+	// Clients of one way streams by the ID they post their messages with
+	streamsMutex sync.Mutex
+	streams      map[string]*Client
+}
+
+var ErrStreamNotFound = errors.New("stream not found")
+
+// Time allowed to carry out a command of a client
+const commandTimeout = 10 * time.Second
+
+// publish sends the event to the matching connections of the room on every instance
+func (w *WebSocketService) publish(event RoomEvent) {
+	if err := w.backplane.Publish(context.Background(), event); err != nil {
+		slog.Error("Error publishing room event", slog.Any("room", event.RoomID), slog.Any("error", err))
+	}
+}
+
+// htmlFragment is an update rendered for the HTML clients of the route
+type htmlFragment struct {
+	route Route
+	html  []byte
+}
 
-	conns := make([]*websocket.Conn, 0, len(subscriptions))
+// roleRoute is the route of the connections of members with the role. Owners
+// and moderators share one, since they see the same controls.
+func roleRoute(roomID uint, role RoomRole) Route {
+	switch role {
+	case RoleOwner, RoleModerator:
+		return Route(fmt.Sprintf("room/%d/owner", roomID))
+	case RoleObserver:
+		return Route(fmt.Sprintf("room/%d/observer", roomID))
+	default:
+		return Route(fmt.Sprintf("room/%d/estimator", roomID))
+	}
+}
 
-	for conn, subRoute := range subscriptions {
-		if subRoute.Matches(route) {
-			conns = append(conns, conn)
+// participantFragments renders an update for estimators and for observers,
+// who see the tickets without the estimation form
+func participantFragments(roomID uint, render func(observer bool) templ.Component) ([]htmlFragment, error) {
+	fragments := make([]htmlFragment, 0, 2)
+	for _, role := range []RoomRole{RoleEstimator, RoleObserver} {
+		rendered := new(bytes.Buffer)
+		if err := render(role == RoleObserver).Render(context.Background(), rendered); err != nil {
+			return nil, err
 		}
+		fragments = append(fragments, htmlFragment{roleRoute(roomID, role), rendered.Bytes()})
 	}
+	return fragments, nil
+}
 
-	return conns
+func observed(props ticket.TicketDetailProps, observer bool) ticket.TicketDetailProps {
+	props.IsObserver = observer
+	return props
 }
 
-type jsonMessage[T any] struct {
-	MessageType string `json:"messageType"`
-	Data        T      `json:"data"`
+// send publishes an update of the room in both protocols, so they never drift
+// apart. HTML clients get the fragments rendered for their route, JSON clients
+// matching jsonRoute get the message.
+func (w *WebSocketService) send(roomID uint, jsonRoute Route, messageType JSONMessageType, data any, fragments ...htmlFragment) {
+	jsonPayload, err := encodeJSONMessage(roomID, messageType, data)
+	if err != nil {
+		slog.Error("Error marshalling json message", slog.Any("type", messageType), slog.Any("error", err))
+	}
+
+	for _, fragment := range fragments {
+		event := RoomEvent{Type: RoomEventMessage, RoomID: roomID, Route: fragment.route, Payload: fragment.html}
+		if fragment.route == jsonRoute {
+			event.JSONPayload, jsonPayload = jsonPayload, nil
+		}
+		w.publish(event)
+	}
+	if jsonPayload != nil {
+		w.publish(RoomEvent{Type: RoomEventMessage, RoomID: roomID, Route: jsonRoute, JSONPayload: jsonPayload})
+	}
 }
 
-type message struct {
-	conn   *websocket.Conn
-	data   *[]byte
-	roomID uint
+// deliver sends an event published by any instance to the local connections
+func (w *WebSocketService) deliver(event RoomEvent) {
+	switch event.Type {
+	case RoomEventMessage:
+		w.hub.Broadcast(event)
+	case RoomEventPresence:
+		w.sendLocalPresence(event)
+	case RoomEventRoleChanged:
+		w.rerouteLocal(event)
+	case RoomEventResync:
+		resync, err := resyncEvent(event.RoomID, event.Route, 0)
+		if err != nil {
+			log.Printf("Error marshalling dto: %v", err)
+			return
+		}
+		w.hub.Broadcast(resync)
+	}
 }
 
-var buffer = make(chan message, 100)
+// removeClient lets the others in the room know the user left. Rooms without
+// connections left are no longer delivered to the instance.
+func (w *WebSocketService) removeClient(client *Client) {
+	w.streamsMutex.Lock()
+	for streamID, streamClient := range w.streams {
+		if streamClient == client {
+			delete(w.streams, streamID)
+		}
+	}
+	w.streamsMutex.Unlock()
 
-type WebSocketService struct {
-	roomService *RoomService
+	w.roomsMutex.Lock()
+	if w.hub.ClientCount(client.roomID) == 0 {
+		w.backplane.Forget(client.roomID)
+	}
+	w.roomsMutex.Unlock()
+
+	w.presenceService.Leave(client.roomID, client.userID, client.conn)
+	go w.SendPresence(client.roomID)
 }
 
-func writePump() {
-	for msg := range buffer {
-		if err := msg.conn.WriteMessage(websocket.TextMessage, *msg.data); err != nil {
-			log.Printf("Error writing message: %v", err)
-			removeConnection(msg.conn)
+func (w *WebSocketService) handleMessage(client *Client, data []byte) {
+	var msg jsonMessage[json.RawMessage]
+	if err := json.Unmarshal(data, &msg); err != nil {
+		w.replyError(client, JSONCommand{}, fmt.Errorf("%w: %s", ErrInvalidCommand, err.Error()))
+		return
+	}
+
+	// Sent by the room page when the user goes idle or comes back
+	if msg.MessageType == "presence" {
+		var update presenceUpdate
+		if err := json.Unmarshal(msg.Data, &update); err != nil {
+			return
 		}
+		if w.presenceService.SetIdle(client.roomID, client.userID, client.conn, update.Idle) {
+			w.SendPresence(client.roomID)
+		}
+		return
+	}
+
+	var command JSONCommand
+	if err := json.Unmarshal(data, &command); err != nil {
+		w.replyError(client, command, fmt.Errorf("%w: %s", ErrInvalidCommand, err.Error()))
+		return
 	}
+	w.runCommand(client, command)
 }
 
-// removeConnection removes a connection from a room and cleans up empty rooms
-func removeConnection(conn *websocket.Conn) {
-	mutex.Lock()
-	defer mutex.Unlock()
+// OnCommand sets the handler of the commands clients send over the websocket
+func (w *WebSocketService) OnCommand(commands CommandHandler) {
+	w.commands = commands
+}
+
+// runCommand carries out the command as the user of the connection and
+// replies to the client only
+func (w *WebSocketService) runCommand(client *Client, command JSONCommand) {
+	if w.commands == nil {
+		w.replyError(client, command, fmt.Errorf("%w %q", ErrUnknownCommand, command.Command))
+		return
+	}
 
-	delete(subscriptions, conn)
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+
+	result, err := w.commands.HandleCommand(ctx, client, command)
+	if err != nil {
+		w.replyError(client, command, err)
+		return
+	}
+	w.reply(client, JSONCommandAck, JSONCommandAckData{ID: command.ID, Command: command.Command, Result: result})
+}
+
+func (w *WebSocketService) replyError(client *Client, command JSONCommand, err error) {
+	code, message := commandErrorCode(err)
+	if code == CommandErrorInternal {
+		slog.Error("Error running websocket command", slog.Any("command", command.Command), slog.Any("error", err))
+	}
+	w.reply(client, JSONCommandError, JSONCommandErrorData{ID: command.ID, Command: command.Command, Code: code, Error: message})
+}
+
+func (w *WebSocketService) reply(client *Client, messageType JSONMessageType, data any) {
+	payload, err := encodeJSONMessage(client.roomID, messageType, data)
+	if err != nil {
+		slog.Error("Error marshalling json message", slog.Any("type", messageType), slog.Any("error", err))
+		return
+	}
+	w.hub.Reply(client, payload)
 }
 
 // readPump reads from the websocket connection to detect disconnects
-func (w *WebSocketService) readPump(conn *websocket.Conn, route Route) {
+func (w *WebSocketService) readPump(conn *websocket.Conn, client *Client) {
 	defer func() {
-		conn.Close()
-		removeConnection(conn)
-		log.Printf("Connection closed for room %s", string(route))
+		w.hub.Unregister(client)
+		log.Printf("Connection closed for room %s", string(client.Route()))
 	}()
 
-	// Set read deadline
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(clientPongWait))
 	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(clientPongWait))
 		return nil
 	})
 
 	// Read messages from the websocket
 	for {
-		_, _, err := conn.ReadMessage()
+		_, data, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Error reading message: %v", err)
 			}
 			break
 		}
-	}
-}
-
-// CleanupInactiveConnections periodically checks and removes inactive connections
-func (w *WebSocketService) CleanupInactiveConnections() {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
-
-	for {
-		<-ticker.C
-		mutex.Lock()
-		// Log current state
-		slog.Debug("Checking for inactive connections. Current rooms", slog.Int("rooms", len(subscriptions)))
-
-		for conn, topic := range subscriptions {
-			if err := conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(10*time.Second)); err != nil {
-				log.Printf("Failed to ping client in room %s: %v", topic, err)
-				delete(subscriptions, conn)
-				conn.Close()
-			}
-		}
-		mutex.Unlock()
+		w.handleMessage(client, data)
 	}
 }
 
 func (w *WebSocketService) sendRefreshedTicketList(roomId uint) {
-	tickets, err := w.roomService.GetTicketList(context.Background(), roomId)
+	tickets, err := w.roomService.ticketList(context.Background(), roomId)
 	if err != nil {
 		log.Printf("Error getting ticket list: %v", err)
 		return
@@ -131,12 +263,22 @@ func (w *WebSocketService) sendRefreshedTicketList(roomId uint) {
 		return
 	}
 
-	mutex.RLock()
-	conns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/*", roomId)))
-	mutex.RUnlock()
-	for _, conn := range conns {
-		buffer <- message{conn: conn, data: &bytes, roomID: roomId}
+	route := Route(fmt.Sprintf("room/%d/*", roomId))
+	w.send(roomId, route, JSONTicketList, JSONTicketListData{Tickets: tickets}, htmlFragment{route, bytes})
+}
+
+// sendTotalEstimate refreshes the total estimate of the room, which changes
+// whenever a ticket is closed, reopened or deleted
+func (w *WebSocketService) sendTotalEstimate(roomID uint) {
+	estimate, err := w.roomService.GetTotalEstimateOfRoom(context.Background(), roomID)
+	if err != nil {
+		slog.Error("Error getting total estimate", slog.Any("room", roomID), slog.Any("error", err))
+		return
 	}
+
+	everyone := Route(fmt.Sprintf("room/%d/*", roomID))
+	bytes := fmt.Appendf(nil, `<div hx-swap-oob="innerHtml:#total-estimated">%s</div>`, estimate)
+	w.send(roomID, everyone, JSONTotalEstimate, JSONTotalEstimateData{Total: estimate}, htmlFragment{everyone, bytes})
 }
 
 func (w *WebSocketService) HideTicketsOfRoom(roomID uint, isHidden bool) {
@@ -152,13 +294,10 @@ func (w *WebSocketService) HideTicketsOfRoom(roomID uint, isHidden bool) {
 		return
 	}
 
-	mutex.RLock()
-	conns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/*", roomID)))
-	mutex.RUnlock()
-	for _, conn := range conns {
-		buffer <- message{conn: conn, data: &jsonDto, roomID: roomID}
-	}
+	route := Route(fmt.Sprintf("room/%d/*", roomID))
+	w.send(roomID, route, JSONTicketHidden, JSONHiddenData(dto), htmlFragment{route, jsonDto})
 	w.sendRefreshedTicketList(roomID)
+	w.SendPresence(roomID)
 }
 
 func (w *WebSocketService) HideTicket(ticketID uint, roomID uint, isHidden bool) {
@@ -175,77 +314,135 @@ func (w *WebSocketService) HideTicket(ticketID uint, roomID uint, isHidden bool)
 		return
 	}
 
-	mutex.RLock()
-	conns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/estimator", roomID)))
-	mutex.RUnlock()
-	for _, conn := range conns {
-		buffer <- message{conn: conn, data: &jsonDto, roomID: roomID}
-	}
+	// Owners and moderators keep seeing hidden tickets in the page
+	w.send(roomID, Route(fmt.Sprintf("room/%d/*", roomID)), JSONTicketHidden, JSONHiddenData(dto),
+		htmlFragment{roleRoute(roomID, RoleEstimator), jsonDto},
+		htmlFragment{roleRoute(roomID, RoleObserver), jsonDto})
 	w.sendRefreshedTicketList(roomID)
-
+	w.SendPresence(roomID)
 }
 
 func (w *WebSocketService) CloseTicket(tticket ticket.TicketDetailProps) {
-	renderedTicket := new(bytes.Buffer)
-	if err := ticket.ClosedTicketUpdate(tticket, false).
-		Render(context.Background(), renderedTicket); err != nil {
+	fragments, err := participantFragments(tticket.RoomID, func(observer bool) templ.Component {
+		return ticket.TicketUpdate(observed(tticket, observer), false, false)
+	})
+	if err != nil {
 		log.Printf("Error rendering ticket thumbnail: %v", err)
 		return
 	}
 	log.Printf("Closing ticket and sending render %d for roomID %d", tticket.ID, tticket.RoomID)
 
-	bytes := renderedTicket.Bytes()
+	everyone := Route(fmt.Sprintf("room/%d/*", tticket.RoomID))
+	w.send(tticket.RoomID, everyone, JSONTicketClosed, JSONTicketData{Ticket: toJSONTicket(tticket)}, fragments...)
 
-	mutex.RLock()
-	estimatorConns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/estimator", tticket.RoomID)))
-	allConns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/*", tticket.RoomID)))
-	mutex.RUnlock()
-	for _, conn := range estimatorConns {
-		buffer <- message{conn: conn, data: &bytes, roomID: tticket.RoomID}
+	w.sendTotalEstimate(tticket.RoomID)
+	w.sendRefreshedTicketList(tticket.RoomID)
+	w.SendPresence(tticket.RoomID)
+}
+
+// UpdateTicket changes the name and description of the ticket on every page,
+// keeping the votes shown to each user
+func (w *WebSocketService) UpdateTicket(ticketID uint, roomID uint, name string, description string) {
+	rendered := new(bytes.Buffer)
+	if err := ticket.TicketTextUpdate(ticketID, name, description).Render(context.Background(), rendered); err != nil {
+		log.Printf("Error rendering ticket thumbnail: %v", err)
+		return
 	}
 
-	if estimate, err := w.roomService.GetTotalEstimateOfRoom(context.Background(), tticket.RoomID); err == nil {
-		bytes = fmt.Appendf(nil, `<div hx-swap-oob="innerHtml:#total-estimated">%s</div>`, estimate)
-		for _, conn := range allConns {
-			buffer <- message{conn: conn, data: &bytes, roomID: tticket.RoomID}
-		}
+	route := Route(fmt.Sprintf("room/%d/*", roomID))
+	w.send(roomID, route, JSONTicketUpdated, JSONTicketUpdatedData{TicketID: ticketID, Name: name, Description: description},
+		htmlFragment{route, rendered.Bytes()})
+	w.sendRefreshedTicketList(roomID)
+	w.SendPresence(roomID)
+}
+
+// DeleteTicket removes the ticket from every page of the room
+func (w *WebSocketService) DeleteTicket(ticketID uint, roomID uint) {
+	route := Route(fmt.Sprintf("room/%d/*", roomID))
+	bytes := fmt.Appendf(nil, `<div hx-swap-oob="delete:ui-flashing-div[data-ticket-id='%d']"></div>`, ticketID)
+	w.send(roomID, route, JSONTicketDeleted, JSONTicketDeletedData{TicketID: ticketID}, htmlFragment{route, bytes})
+
+	w.sendTotalEstimate(roomID)
+	w.sendRefreshedTicketList(roomID)
+	w.SendPresence(roomID)
+}
+
+// ReopenTicket sends the reopened ticket to everyone in the room, with the
+// controls of owners and moderators for them
+func (w *WebSocketService) ReopenTicket(tticket ticket.TicketDetailProps) {
+	fragments, err := participantFragments(tticket.RoomID, func(observer bool) templ.Component {
+		return ticket.TicketUpdate(observed(tticket, observer), false, true)
+	})
+	if err != nil {
+		log.Printf("Error rendering ticket thumbnail: %v", err)
+		return
 	}
+	ownerRender := new(bytes.Buffer)
+	if err := ticket.TicketUpdate(tticket, true, true).Render(context.Background(), ownerRender); err != nil {
+		log.Printf("Error rendering ticket thumbnail: %v", err)
+		return
+	}
+	fragments = append(fragments, htmlFragment{roleRoute(tticket.RoomID, RoleOwner), ownerRender.Bytes()})
+
+	w.send(tticket.RoomID, Route(fmt.Sprintf("room/%d/*", tticket.RoomID)), JSONTicketReopened, JSONTicketData{Ticket: toJSONTicket(tticket)},
+		fragments...)
+	w.sendTotalEstimate(tticket.RoomID)
 	w.sendRefreshedTicketList(tticket.RoomID)
+	w.SendPresence(tticket.RoomID)
+}
 
+// StartNewRound sends the reset ticket to estimators, so the estimation form
+// is shown again for the new voting round
+func (w *WebSocketService) StartNewRound(tticket ticket.TicketDetailProps) {
+	fragments, err := participantFragments(tticket.RoomID, func(observer bool) templ.Component {
+		return ticket.TicketUpdate(observed(tticket, observer), false, true)
+	})
+	if err != nil {
+		log.Printf("Error rendering ticket thumbnail: %v", err)
+		return
+	}
+
+	w.send(tticket.RoomID, Route(fmt.Sprintf("room/%d/*", tticket.RoomID)), JSONTicketRoundStart, JSONTicketData{Ticket: toJSONTicket(tticket)},
+		fragments...)
+	w.SendPresence(tticket.RoomID)
 }
 
 func llmRecomendationDeltaRender(ticketID uint, content *bytes.Buffer) string {
 	return fmt.Sprintf(`<div hx-swap-oob="outerHtml:form[data-estimation-form='%d' ] > span.llm-recommendation">%s</div>`, ticketID, content.String())
 }
 
-func (w *WebSocketService) SendLLMRecommendation(ticketID uint, jiraKey *string, roomID uint, llmRecommendation string) {
+func (w *WebSocketService) SendLLMRecommendation(ticketID uint, jiraKey *string, roomID uint, llmRecommendation ticket.LlmEstimateProps) {
 	llmEstimate := new(bytes.Buffer)
 	if err := ticket.LlmEstimate(llmRecommendation).Render(context.Background(), llmEstimate); err != nil {
 		slog.Error("Error rendering llm estimate", "error", err)
 		return
 	}
 
-	mutex.RLock()
-	conns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/*", roomID)))
-	mutex.RUnlock()
-
 	deltaBytes := []byte(llmRecomendationDeltaRender(ticketID, llmEstimate))
 
-	for _, conn := range conns {
-		buffer <- message{conn: conn, data: &deltaBytes, roomID: roomID}
+	route := Route(fmt.Sprintf("room/%d/*", roomID))
+	w.send(roomID, route, JSONLLMRecommendation, toJSONLLMEstimate(ticketID, llmRecommendation), htmlFragment{route, deltaBytes})
+}
+
+// SendLLMJobStatus lets the room owner know how the LLM estimate of a ticket is
+// going. Moderators get it too, so examples from the owner's other rooms must
+// already be left out of the status.
+func (w *WebSocketService) SendLLMJobStatus(roomID uint, status *ticket.LlmJobStatusProps) {
+	renderedStatus := new(bytes.Buffer)
+	if err := ticket.UpdatedLlmJobStatus(*status).
+		Render(context.Background(), renderedStatus); err != nil {
+		slog.Error("Error rendering llm job status", "error", err)
+		return
 	}
+	bytes := renderedStatus.Bytes()
 
+	route := Route(fmt.Sprintf("room/%d/owner", roomID))
+	w.send(roomID, route, JSONLLMJobStatus, toJSONLLMJobStatus(*status), htmlFragment{route, bytes})
 }
 
-func (w *WebSocketService) UpdateEstimate(ticketID uint,
-	jiraKey *string,
-	roomID uint,
-	averageEstimate string,
-	medianEstimate string,
-	stdEstimate string,
-	estimatedBy string) {
+func (w *WebSocketService) UpdateEstimatedBy(ticketID uint, roomID uint, estimatedBy string) {
 	renderedTicket := new(bytes.Buffer)
-	if err := ticket.UpdatedEstimationDetail(ticketID, averageEstimate, medianEstimate, stdEstimate, estimatedBy).
+	if err := ticket.UpdatedEstimatedBy(ticketID, estimatedBy).
 		Render(context.Background(), renderedTicket); err != nil {
 		log.Printf("Error rendering ticket thumbnail: %v", err)
 		return
@@ -253,29 +450,47 @@ func (w *WebSocketService) UpdateEstimate(ticketID uint,
 
 	bytes := renderedTicket.Bytes()
 
-	mutex.RLock()
-	conns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/*", roomID)))
-	mutex.RUnlock()
-	for _, conn := range conns {
-		buffer <- message{conn: conn, data: &bytes, roomID: roomID}
+	route := Route(fmt.Sprintf("room/%d/*", roomID))
+	w.send(roomID, route, JSONTicketEstimatedBy, JSONEstimatedByData{TicketID: ticketID, EstimatedBy: estimatedBy}, htmlFragment{route, bytes})
+	w.SendPresence(roomID)
+}
+
+// RevealTicket sends the revealed votes and statistics to every connection in
+// the room at once, rendered with the controls of owners and moderators for them
+func (w *WebSocketService) RevealTicket(tticket ticket.TicketDetailProps) {
+	fragments, err := participantFragments(tticket.RoomID, func(observer bool) templ.Component {
+		return ticket.TicketUpdate(observed(tticket, observer), false, true)
+	})
+	if err != nil {
+		log.Printf("Error rendering ticket thumbnail: %v", err)
+		return
 	}
+	ownerRender := new(bytes.Buffer)
+	if err := ticket.TicketUpdate(tticket, true, true).
+		Render(context.Background(), ownerRender); err != nil {
+		log.Printf("Error rendering ticket thumbnail: %v", err)
+		return
+	}
+
+	fragments = append(fragments, htmlFragment{roleRoute(tticket.RoomID, RoleOwner), ownerRender.Bytes()})
+
+	w.send(tticket.RoomID, Route(fmt.Sprintf("room/%d/*", tticket.RoomID)), JSONTicketRevealed, JSONTicketData{Ticket: toJSONTicket(tticket)},
+		fragments...)
 }
 
+// SendNewTicket adds the ticket to the page of everyone in the room. The
+// member who added it gets it too, in case they have the room open elsewhere.
 func (w *WebSocketService) SendNewTicket(tticket ticket.TicketDetailProps) {
-	renderedTicket := new(bytes.Buffer)
-	if err := ticket.CreatedTicketUpdate(tticket, true).
-		Render(context.Background(), renderedTicket); err != nil {
+	fragments, err := w.createdTicketFragments(tticket.RoomID, []ticket.TicketDetailProps{tticket})
+	if err != nil {
 		log.Printf("Error rendering ticket thumbnail: %v", err)
 		return
 	}
-	bytes := renderedTicket.Bytes()
-	mutex.RLock()
-	conns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/estimator", tticket.RoomID)))
-	mutex.RUnlock()
-	for _, conn := range conns {
-		buffer <- message{conn: conn, data: &bytes, roomID: tticket.RoomID}
-	}
+	w.send(tticket.RoomID, Route(fmt.Sprintf("room/%d/*", tticket.RoomID)), JSONTicketsCreated,
+		JSONTicketsCreatedData{Tickets: []JSONTicket{toJSONTicket(tticket)}},
+		fragments...)
 	w.sendRefreshedTicketList(tticket.RoomID)
+	w.SendPresence(tticket.RoomID)
 }
 
 func (w *WebSocketService) BulkImportTickets(tickets []ticket.TicketDetailProps) {
@@ -283,70 +498,320 @@ func (w *WebSocketService) BulkImportTickets(tickets []ticket.TicketDetailProps)
 		return
 	}
 
-	aggregatedRenderedTickets := new(bytes.Buffer)
 	slog.Debug("Bulk importing tickets", slog.Any("ticket num", len(tickets)))
-	for i := len(tickets) - 1; i >= 0; i-- {
-		renderedTicket := new(bytes.Buffer)
-		tticket := tickets[i]
-		if err := ticket.CreatedTicketUpdate(tticket, i == 0).
-			Render(context.Background(), renderedTicket); err != nil {
-			log.Printf("Error rendering ticket thumbnail: %v", err)
-			return
-		}
-		bytes := renderedTicket.Bytes()
-		aggregatedRenderedTickets.Write(bytes)
+	fragments, err := w.createdTicketFragments(tickets[0].RoomID, tickets)
+	if err != nil {
+		log.Printf("Error rendering ticket thumbnail: %v", err)
+		return
 	}
-	mutex.RLock()
-	conns := getMatchingSubscriptions(Route(fmt.Sprintf("room/%d/estimator", tickets[0].RoomID)))
-	mutex.RUnlock()
-	bytes := aggregatedRenderedTickets.Bytes()
 
-	for _, conn := range conns {
-		buffer <- message{conn: conn, data: &bytes, roomID: tickets[0].RoomID}
+	created := JSONTicketsCreatedData{Tickets: make([]JSONTicket, len(tickets))}
+	for i, tticket := range tickets {
+		created.Tickets[i] = toJSONTicket(tticket)
 	}
+	w.send(tickets[0].RoomID, Route(fmt.Sprintf("room/%d/*", tickets[0].RoomID)), JSONTicketsCreated, created,
+		fragments...)
 	w.sendRefreshedTicketList(tickets[0].RoomID)
+	w.SendPresence(tickets[0].RoomID)
 }
 
-func (w *WebSocketService) Register(conn *websocket.Conn, roomID uint, isOwner bool) {
-	mutex.Lock()
+// createdTicketFragments renders new tickets, newest first, for every role.
+// Owners and moderators get them with their controls.
+func (w *WebSocketService) createdTicketFragments(roomID uint, tickets []ticket.TicketDetailProps) ([]htmlFragment, error) {
+	created := func(isRoomOwner bool, observer bool) templ.Component {
+		components := make([]templ.Component, 0, len(tickets))
+		for i := len(tickets) - 1; i >= 0; i-- {
+			components = append(components, ticket.CreatedTicketUpdate(observed(tickets[i], observer), isRoomOwner, i == 0))
+		}
+		return templ.Join(components...)
+	}
 
-	var routeSuffix string
-	if isOwner {
-		routeSuffix = "owner"
-	} else {
-		routeSuffix = "estimator"
+	fragments, err := participantFragments(roomID, func(observer bool) templ.Component {
+		return created(false, observer)
+	})
+	if err != nil {
+		return nil, err
+	}
+	ownerRender := new(bytes.Buffer)
+	if err := created(true, false).Render(context.Background(), ownerRender); err != nil {
+		return nil, err
 	}
+	return append(fragments, htmlFragment{roleRoute(roomID, RoleOwner), ownerRender.Bytes()}), nil
+}
 
-	route := Route(fmt.Sprintf("room/%d/%s", roomID, routeSuffix))
-	subscriptions[conn] = route
-	mutex.Unlock()
+// SendPresence sends the current presence roster to everyone in the room
+func (w *WebSocketService) SendPresence(roomID uint) {
+	if err := w.backplane.Notify(context.Background(), RoomEvent{
+		Type:   RoomEventPresence,
+		RoomID: roomID,
+		Route:  Route(fmt.Sprintf("room/%d/*", roomID)),
+	}); err != nil {
+		slog.Error("Error publishing presence", slog.Any("room", roomID), slog.Any("error", err))
+	}
+}
 
-	// Set up ping/pong to keep connection alive
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		return nil
+// sendLocalPresence renders the presence roster for the connections of this instance
+func (w *WebSocketService) sendLocalPresence(event RoomEvent) {
+	roster, err := w.roomService.GetPresenceRoster(context.Background(), event.RoomID)
+	if err != nil {
+		slog.Error("Error getting presence roster", slog.Any("error", err))
+		return
+	}
+
+	renderedRoster := new(bytes.Buffer)
+	if err := room.UpdatedPresenceRoster(roster).
+		Render(context.Background(), renderedRoster); err != nil {
+		log.Printf("Error rendering presence roster: %v", err)
+		return
+	}
+
+	jsonRoster, err := encodeJSONMessage(event.RoomID, JSONPresenceRoster, toJSONPresence(roster))
+	if err != nil {
+		slog.Error("Error marshalling json message", slog.Any("type", JSONPresenceRoster), slog.Any("error", err))
+	}
+
+	event.Type = RoomEventMessage
+	event.Payload = renderedRoster.Bytes()
+	event.JSONPayload = jsonRoster
+	w.hub.Broadcast(event)
+}
+
+// SetActiveTicket points everyone in the room to the ticket it is estimating,
+// see ticket.ActiveTicket
+func (w *WebSocketService) SetActiveTicket(roomID uint, active ticket.ActiveTicketProps) {
+	rendered := new(bytes.Buffer)
+	if err := ticket.ActiveTicket(active, true).Render(context.Background(), rendered); err != nil {
+		log.Printf("Error rendering active ticket: %v", err)
+		return
+	}
+
+	route := Route(fmt.Sprintf("room/%d/*", roomID))
+	w.send(roomID, route, JSONActiveTicket, JSONActiveTicketData{
+		TicketID:    active.TicketID,
+		Name:        active.Name,
+		Facilitated: active.Facilitated,
+	}, htmlFragment{route, rendered.Bytes()})
+	w.SendPresence(roomID)
+}
+
+// SetVotingTimer starts, stops or ends the countdown of the ticket on every
+// page of the room
+func (w *WebSocketService) SetVotingTimer(roomID uint, ticketID uint, endsAt *time.Time) {
+	rendered := new(bytes.Buffer)
+	if err := ticket.VotingTimer(ticketID, endsAt, true).Render(context.Background(), rendered); err != nil {
+		log.Printf("Error rendering voting timer: %v", err)
+		return
+	}
+
+	route := Route(fmt.Sprintf("room/%d/*", roomID))
+	w.send(roomID, route, JSONTicketTimer, JSONTimerData{TicketID: ticketID, EndsAt: endsAt},
+		htmlFragment{route, rendered.Bytes()})
+}
+
+type roleChange struct {
+	UserID uint     `json:"userID"`
+	Role   RoomRole `json:"role"`
+}
+
+// ChangeRole moves the connections of the member to the route of their new
+// role on every instance and tells them about it, the room page reloads to
+// show what the role can do
+func (w *WebSocketService) ChangeRole(roomID uint, userID uint, role RoomRole) {
+	payload, err := json.Marshal(roleChange{UserID: userID, Role: role})
+	if err != nil {
+		log.Printf("Error marshalling dto: %v", err)
+		return
+	}
+	w.publish(RoomEvent{
+		Type:    RoomEventRoleChanged,
+		RoomID:  roomID,
+		Route:   Route(fmt.Sprintf("room/%d/*", roomID)),
+		Payload: payload,
+	})
+	w.SendPresence(roomID)
+}
+
+// rerouteLocal applies a role change to the connections of this instance
+func (w *WebSocketService) rerouteLocal(event RoomEvent) {
+	var change roleChange
+	if err := json.Unmarshal(event.Payload, &change); err != nil {
+		slog.Error("Invalid role change", slog.Any("room", event.RoomID), slog.Any("error", err))
+		return
+	}
+
+	html, err := json.Marshal(jsonMessage[JSONRoleChangedData]{
+		MessageType: "roleChanged",
+		Data:        JSONRoleChangedData{Role: string(change.Role)},
 	})
+	if err != nil {
+		log.Printf("Error marshalling dto: %v", err)
+		return
+	}
+	jsonPayload, err := encodeJSONMessage(event.RoomID, JSONRoleChanged, JSONRoleChangedData{Role: string(change.Role)})
+	if err != nil {
+		log.Printf("Error marshalling dto: %v", err)
+		return
+	}
 
-	// Start a goroutine to read from the websocket to detect disconnects
-	go w.readPump(conn, route)
+	for _, client := range w.hub.Reroute(event.RoomID, change.UserID, roleRoute(event.RoomID, change.Role)) {
+		if client.protocol == ProtocolJSON {
+			w.hub.Reply(client, jsonPayload)
+		} else {
+			w.hub.Reply(client, html)
+		}
+	}
 }
 
-func NewWebSocketService(roomService *RoomService) *WebSocketService {
-	if roomService == nil {
-		panic("roomService cannot be nil")
+// SendPresenceOfUser refreshes the presence roster of every room the user is
+// connected to, e.g. after they changed their name
+func (w *WebSocketService) SendPresenceOfUser(userID uint) {
+	for _, roomID := range w.hub.RoomsOfUser(userID) {
+		w.SendPresence(roomID)
 	}
+}
 
-	service := &WebSocketService{
-		roomService: roomService,
+// LastSeq returns the sequence number of the newest event of the room, pages
+// connect with it so they don't miss events sent while they were loading
+func (w *WebSocketService) LastSeq(ctx context.Context, roomID uint) uint64 {
+	seq, err := w.backplane.LastSeq(ctx, roomID)
+	if err != nil {
+		slog.Error("Error getting last room event", slog.Any("room", roomID), slog.Any("error", err))
 	}
+	return seq
+}
 
-	for range 30 {
-		go writePump()
+// replay sends a reconnecting client the events it missed. If they are no
+// longer kept, the client is told to fetch the room again instead.
+func (w *WebSocketService) replay(client *Client, lastSeq uint64) {
+	missed, err := w.backplane.EventsSince(context.Background(), client.roomID, lastSeq)
+	if err == nil {
+		// Role changes only move the connections open at the time
+		messages := make([]RoomEvent, 0, len(missed))
+		for _, event := range missed {
+			if event.Type == RoomEventMessage {
+				messages = append(messages, event)
+			}
+		}
+		w.hub.Replay(client, messages)
+		return
+	}
+	if !errors.Is(err, ErrEventLogRolledOver) {
+		slog.Error("Error replaying room events", slog.Any("room", client.roomID), slog.Any("error", err))
 	}
 
-	// Start the cleanup routine
-	go service.CleanupInactiveConnections()
+	resync, err := resyncEvent(client.roomID, client.Route(), w.LastSeq(context.Background(), client.roomID))
+	if err != nil {
+		log.Printf("Error marshalling dto: %v", err)
+		return
+	}
+	w.hub.Replay(client, []RoomEvent{resync})
+}
+
+// resyncEvent tells the clients of the route to fetch the whole room again
+func resyncEvent(roomID uint, route Route, seq uint64) (RoomEvent, error) {
+	resync, err := json.Marshal(jsonMessage[any]{MessageType: "resync"})
+	if err != nil {
+		return RoomEvent{}, err
+	}
+	jsonResync, err := encodeJSONMessage(roomID, JSONResync, JSONResyncData{})
+	if err != nil {
+		return RoomEvent{}, err
+	}
+	return RoomEvent{
+		Type:        RoomEventMessage,
+		RoomID:      roomID,
+		Seq:         seq,
+		Route:       route,
+		Payload:     resync,
+		JSONPayload: jsonResync,
+	}, nil
+}
+
+// register starts sending room events to the connection in the protocol.
+// Clients reconnecting pass the sequence number of the last event they got, to
+// get the missed ones.
+func (w *WebSocketService) register(conn WebSocketConn, roomID uint, userID uint, role RoomRole, protocol Protocol, lastSeq *uint64) *Client {
+	route := roleRoute(roomID, role)
+
+	// Joined before registering, so a client dropped right away still leaves
+	w.presenceService.Join(roomID, userID, conn)
+	var client *Client
+	w.roomsMutex.Lock()
+	w.backplane.Watch(roomID)
+	if lastSeq == nil {
+		client = w.hub.Register(conn, roomID, userID, route, protocol)
+	} else {
+		client = w.hub.Resume(conn, roomID, userID, route, protocol, *lastSeq)
+	}
+	w.roomsMutex.Unlock()
+	if lastSeq != nil {
+		go w.replay(client, *lastSeq)
+	}
+	go w.SendPresence(roomID)
+
+	return client
+}
+
+// Register starts sending room events to the websocket and reading the
+// commands the client sends
+func (w *WebSocketService) Register(conn *websocket.Conn, roomID uint, userID uint, role RoomRole, protocol Protocol, lastSeq *uint64) {
+	client := w.register(conn, roomID, userID, role, protocol, lastSeq)
+	go w.readPump(conn, client)
+}
+
+// RegisterStream starts sending room events to a one way connection, like
+// server-sent events, for clients which can't open a websocket. What they
+// would send over the websocket is posted to PostToStream with the returned ID.
+func (w *WebSocketService) RegisterStream(conn WebSocketConn, roomID uint, userID uint, role RoomRole, protocol Protocol, lastSeq *uint64) (*Client, string) {
+	streamID := rand.Text()
+	client := w.register(conn, roomID, userID, role, protocol, lastSeq)
+
+	w.streamsMutex.Lock()
+	w.streams[streamID] = client
+	w.streamsMutex.Unlock()
+
+	return client, streamID
+}
+
+// PostToStream handles a message of a stream's client, as if it was sent over
+// a websocket. Only the user who opened the stream can post to it.
+func (w *WebSocketService) PostToStream(streamID string, userID uint, data []byte) error {
+	w.streamsMutex.Lock()
+	client, ok := w.streams[streamID]
+	w.streamsMutex.Unlock()
+	if !ok || client.userID != userID {
+		return ErrStreamNotFound
+	}
+
+	w.handleMessage(client, data)
+	return nil
+}
+
+// Disconnect stops sending room events to the client, e.g. once its stream
+// was closed
+func (w *WebSocketService) Disconnect(client *Client) {
+	w.hub.Unregister(client)
+}
+
+func NewWebSocketService(roomService *RoomService, presenceService *PresenceService, backplane Backplane) *WebSocketService {
+	if roomService == nil {
+		panic("roomService cannot be nil")
+	}
+	if presenceService == nil {
+		panic("presenceService cannot be nil")
+	}
+	if backplane == nil {
+		panic("backplane cannot be nil")
+	}
+
+	service := &WebSocketService{
+		roomService:     roomService,
+		presenceService: presenceService,
+		backplane:       backplane,
+		streams:         make(map[string]*Client),
+	}
+	service.hub = NewHub(clientSendQueue, service.removeClient)
+	backplane.Subscribe(service.deliver)
 
 	return service
 }
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalBackplaneDeliversPublishedEvents(t *testing.T) {
+	backplane := service.NewLocalBackplane()
+
+	var delivered []service.RoomEvent
+	backplane.Subscribe(func(event service.RoomEvent) { delivered = append(delivered, event) })
+
+	event := service.RoomEvent{Type: service.RoomEventMessage, RoomID: 3, Route: service.Route("room/3/*")}
+	assert.NoError(t, backplane.Publish(t.Context(), event))
+	assert.NoError(t, backplane.Publish(t.Context(), event))
+
+	// Events are numbered per room
+	assert.Len(t, delivered, 2)
+	assert.Equal(t, uint64(1), delivered[0].Seq)
+	assert.Equal(t, uint64(2), delivered[1].Seq)
+	assert.Equal(t, event.Route, delivered[1].Route)
+}
+
+func TestLocalBackplaneNotify(t *testing.T) {
+	backplane := service.NewLocalBackplane()
+
+	var delivered []service.RoomEvent
+	backplane.Subscribe(func(event service.RoomEvent) { delivered = append(delivered, event) })
+
+	assert.NoError(t, backplane.Publish(t.Context(), service.RoomEvent{Type: service.RoomEventMessage, RoomID: 3}))
+	assert.NoError(t, backplane.Notify(t.Context(), service.RoomEvent{Type: service.RoomEventPresence, RoomID: 3}))
+
+	// Notices are delivered without a sequence number and aren't kept for replays
+	assert.Len(t, delivered, 2)
+	assert.Equal(t, service.RoomEventPresence, delivered[1].Type)
+	assert.Zero(t, delivered[1].Seq)
+
+	lastSeq, err := backplane.LastSeq(t.Context(), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), lastSeq)
+	missed, err := backplane.EventsSince(t.Context(), 3, 0)
+	assert.NoError(t, err)
+	assert.Len(t, missed, 1)
+}
+
+func TestLocalBackplaneEventsSince(t *testing.T) {
+	backplane := service.NewLocalBackplane()
+	for range 300 {
+		assert.NoError(t, backplane.Publish(t.Context(), service.RoomEvent{Type: service.RoomEventMessage, RoomID: 1}))
+	}
+	assert.NoError(t, backplane.Publish(t.Context(), service.RoomEvent{Type: service.RoomEventMessage, RoomID: 2}))
+
+	lastSeq, err := backplane.LastSeq(t.Context(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(300), lastSeq)
+
+	missed, err := backplane.EventsSince(t.Context(), 1, 295)
+	assert.NoError(t, err)
+	assert.Len(t, missed, 5)
+	assert.Equal(t, uint64(296), missed[0].Seq)
+
+	upToDate, err := backplane.EventsSince(t.Context(), 1, 300)
+	assert.NoError(t, err)
+	assert.Empty(t, upToDate)
+
+	// Only the newest events are kept
+	_, err = backplane.EventsSince(t.Context(), 1, 10)
+	assert.ErrorIs(t, err, service.ErrEventLogRolledOver)
+
+	// The client saw events from before a restart
+	_, err = backplane.EventsSince(t.Context(), 2, 5)
+	assert.ErrorIs(t, err, service.ErrEventLogRolledOver)
+}
+
+func (r *RoomServiceSuite) TestPostgresBackplane() {
+	t := r.T()
+
+	// Sequence numbers are kept on the room
+	room, err := r.roomService.CreateRoom(t.Context(), 1, service.CreateRoomForm{RoomName: "backplane"})
+	assert.NoError(t, err)
+
+	received := make(chan service.RoomEvent, 10)
+	backplane := service.NewPostgresBackplane(r.db)
+	backplane.Subscribe(func(event service.RoomEvent) { received <- event })
+	backplane.Watch(room.ID)
+
+	published := service.RoomEvent{
+		Type:    service.RoomEventMessage,
+		RoomID:  room.ID,
+		Route:   service.Route(fmt.Sprintf("room/%d/*", room.ID)),
+		Payload: []byte(`<div id="update"></div>`),
+	}
+	// The listener connects in the background, publish until it hears about it
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, backplane.Publish(t.Context(), published))
+		select {
+		case event := <-received:
+			assert.NotZero(t, event.Seq)
+			published.Seq = event.Seq
+			assert.Equal(t, published, event)
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 10*time.Second, 10*time.Millisecond)
+
+	lastSeq, err := backplane.LastSeq(t.Context(), room.ID)
+	assert.NoError(t, err)
+	missed, err := backplane.EventsSince(t.Context(), room.ID, lastSeq-1)
+	assert.NoError(t, err)
+	assert.Len(t, missed, 1)
+	assert.Equal(t, lastSeq, missed[0].Seq)
+
+	// Rooms without connections on the instance aren't delivered, but still kept
+	for delivered := published.Seq; delivered < lastSeq; {
+		select {
+		case event := <-received:
+			delivered = event.Seq
+		case <-time.After(5 * time.Second):
+			t.Fatal("events published while connecting weren't delivered")
+		}
+	}
+	backplane.Forget(room.ID)
+	assert.NoError(t, backplane.Publish(t.Context(), published))
+	select {
+	case event := <-received:
+		t.Fatalf("forgotten room delivered event %d", event.Seq)
+	case <-time.After(500 * time.Millisecond):
+	}
+	missed, err = backplane.EventsSince(t.Context(), room.ID, lastSeq)
+	assert.NoError(t, err)
+	assert.Len(t, missed, 1)
+}
+
+func (r *RoomServiceSuite) TestPostgresBackplaneDelivery() {
+	t := r.T()
+
+	slowRoom, err := r.roomService.CreateRoom(t.Context(), 1, service.CreateRoomForm{RoomName: "slow"})
+	assert.NoError(t, err)
+	room, err := r.roomService.CreateRoom(t.Context(), 1, service.CreateRoomForm{RoomName: "fast"})
+	assert.NoError(t, err)
+
+	received := make(chan service.RoomEvent, 10)
+	unblock := make(chan struct{})
+	backplane := service.NewPostgresBackplane(r.db)
+	backplane.Subscribe(func(event service.RoomEvent) {
+		if event.RoomID == slowRoom.ID {
+			<-unblock
+		}
+		received <- event
+	})
+	backplane.Watch(slowRoom.ID)
+	backplane.Watch(room.ID)
+	next := func() service.RoomEvent {
+		select {
+		case event := <-received:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("no room event delivered")
+			return service.RoomEvent{}
+		}
+	}
+
+	published := service.RoomEvent{Type: service.RoomEventMessage, RoomID: room.ID, Route: service.Route(fmt.Sprintf("room/%d/*", room.ID))}
+	var lastSeq uint64
+	assert.Eventually(t, func() bool {
+		assert.NoError(t, backplane.Publish(t.Context(), published))
+		select {
+		case event := <-received:
+			lastSeq = event.Seq
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}, 10*time.Second, 10*time.Millisecond)
+	// Events published while the listener was connecting may come late
+	seq, err := backplane.LastSeq(t.Context(), room.ID)
+	assert.NoError(t, err)
+	for lastSeq < seq {
+		lastSeq = next().Seq
+	}
+
+	// A room whose connections are slow doesn't hold up the others
+	assert.NoError(t, backplane.Publish(t.Context(), service.RoomEvent{Type: service.RoomEventMessage, RoomID: slowRoom.ID}))
+
+	// Notices are delivered after the events published before them, and aren't kept
+	assert.NoError(t, backplane.Publish(t.Context(), published))
+	assert.NoError(t, backplane.Notify(t.Context(), service.RoomEvent{Type: service.RoomEventPresence, RoomID: room.ID, Route: published.Route}))
+	assert.Equal(t, lastSeq+1, next().Seq)
+	notice := next()
+	assert.Equal(t, service.RoomEventPresence, notice.Type)
+	assert.Zero(t, notice.Seq)
+	seq, err = backplane.LastSeq(t.Context(), room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, lastSeq+1, seq)
+	lastSeq = seq
+
+	// Events pruned before they were delivered make the room's connections resync
+	assert.NoError(t, r.db.DB.Exec("UPDATE rooms SET event_seq = event_seq + 2 WHERE id = ?", room.ID).Error)
+	assert.NoError(t, r.db.DB.Create(&database.RoomEvent{RoomID: room.ID, Seq: lastSeq + 2, Type: string(service.RoomEventMessage), Route: string(published.Route)}).Error)
+	assert.NoError(t, backplane.Publish(t.Context(), published))
+	assert.Equal(t, service.RoomEventResync, next().Type)
+	assert.Equal(t, lastSeq+2, next().Seq)
+	assert.Equal(t, lastSeq+3, next().Seq)
+
+	// Events published while the listener reconnects are caught up on
+	assert.NoError(t, r.db.DB.Exec("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE query LIKE 'LISTEN %'").Error)
+	assert.NoError(t, backplane.Publish(t.Context(), published))
+	assert.Equal(t, lastSeq+4, next().Seq)
+
+	close(unblock)
+	slow := next()
+	assert.Equal(t, slowRoom.ID, slow.RoomID)
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func votesOf(estimates ...float64) []database.Estimate {
+	votes := make([]database.Estimate, len(estimates))
+	for i, estimate := range estimates {
+		userID := uint(i + 1)
+		votes[i] = database.Estimate{UserID: &userID, Estimate: estimate}
+	}
+	return votes
+}
+
+func TestClassifyRound(t *testing.T) {
+	fibonacci := database.NewDeck(database.ScaleFibonacci, "")
+	hours := database.NewDeck(database.ScaleHours, "")
+
+	testCases := []struct {
+		name       string
+		deck       database.Deck
+		votes      []database.Estimate
+		thresholds database.ConsensusThresholds
+		level      database.Consensus
+		steps      int
+		lowest     []uint
+		highest    []uint
+	}{
+		{
+			name:       "single vote",
+			deck:       fibonacci,
+			votes:      votesOf(5),
+			thresholds: database.DefaultConsensusThresholds,
+			level:      database.ConsensusNone,
+		},
+		{
+			name:       "same card",
+			deck:       fibonacci,
+			votes:      votesOf(5, 5, 5),
+			thresholds: database.DefaultConsensusThresholds,
+			level:      database.ConsensusFull,
+		},
+		{
+			name:       "neighbouring cards",
+			deck:       fibonacci,
+			votes:      votesOf(3, 5, 5),
+			thresholds: database.DefaultConsensusThresholds,
+			level:      database.ConsensusNear,
+			steps:      1,
+			lowest:     []uint{1},
+			highest:    []uint{2, 3},
+		},
+		{
+			name:       "far apart",
+			deck:       fibonacci,
+			votes:      votesOf(2, 5, 13),
+			thresholds: database.DefaultConsensusThresholds,
+			level:      database.ConsensusSplit,
+			steps:      4,
+			lowest:     []uint{1},
+			highest:    []uint{3},
+		},
+		{
+			name:       "wider thresholds",
+			deck:       fibonacci,
+			votes:      votesOf(2, 5, 13),
+			thresholds: database.ConsensusThresholds{Consensus: 1, Near: 4},
+			level:      database.ConsensusNear,
+			steps:      4,
+			lowest:     []uint{1},
+			highest:    []uint{3},
+		},
+		{
+			name:       "hours round to steps",
+			deck:       hours,
+			votes:      votesOf(7, 8, 9),
+			thresholds: database.DefaultConsensusThresholds,
+			level:      database.ConsensusFull,
+		},
+		{
+			name:       "hours a day against a week",
+			deck:       hours,
+			votes:      votesOf(8, 40),
+			thresholds: database.DefaultConsensusThresholds,
+			level:      database.ConsensusSplit,
+			steps:      3,
+			lowest:     []uint{1},
+			highest:    []uint{2},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			consensus := database.ClassifyRound(tc.deck, tc.votes, tc.thresholds)
+			assert.Equal(t, tc.level, consensus.Level)
+			assert.Equal(t, tc.steps, consensus.Steps)
+			assert.Equal(t, tc.lowest, consensus.LowestVoters)
+			assert.Equal(t, tc.highest, consensus.HighestVoters)
+			assert.Equal(t, tc.level == database.ConsensusSplit, consensus.Revote())
+		})
+	}
+}
+
+func TestClassifyRoundSkipsLLMEstimates(t *testing.T) {
+	deck := database.NewDeck(database.ScaleFibonacci, "")
+	roundVotes := append(votesOf(5, 5), database.Estimate{Estimate: 21})
+
+	consensus := database.ClassifyRound(deck, roundVotes, database.DefaultConsensusThresholds)
+	assert.Equal(t, database.ConsensusFull, consensus.Level)
+	assert.Empty(t, consensus.Outlier(roundVotes[2]))
+}
+
+func TestConsensusThresholdsValid(t *testing.T) {
+	assert.True(t, database.DefaultConsensusThresholds.Valid())
+	assert.True(t, database.ConsensusThresholds{Consensus: 1, Near: 1}.Valid())
+	assert.False(t, database.ConsensusThresholds{Consensus: 2, Near: 1}.Valid())
+	assert.False(t, database.ConsensusThresholds{Consensus: -1, Near: 1}.Valid())
+}
+
+func TestClassifyRoundSkipsVotesWithoutValue(t *testing.T) {
+	deck := database.NewDeck(database.ScaleFibonacci, "")
+	roundVotes := votesOf(5, 5, 0)
+	roundVotes[2].Kind = database.EstimateUnsure
+
+	consensus := database.ClassifyRound(deck, roundVotes, database.DefaultConsensusThresholds)
+	assert.Equal(t, database.ConsensusFull, consensus.Level)
+	assert.Empty(t, consensus.Outlier(roundVotes[2]))
+}
+
+func (r *RoomServiceSuite) TestConsensus() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "consensus", EstimationScale: "fibonacci"})
+	assert.NoError(t, err)
+	voter := database.User{DisplayName: "voter"}
+	assert.NoError(t, r.db.DB.Create(&voter).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&voter))
+	split := database.Ticket{Name: "split", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&split).Error)
+
+	app := r.newApp()
+
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: split.ID, RoomID: room.ID, CardEstimate: "2"})
+	assert.NoError(t, err)
+	_, err = app.ticketService.EstimateTicket(ctx, voter.ID, service.EstimateTicketForm{TicketID: split.ID, RoomID: room.ID, CardEstimate: "13"})
+	assert.NoError(t, err)
+
+	revealed, err := app.ticketService.RevealTicket(ctx, split.ID, 1)
+	assert.NoError(t, err)
+	props := revealed.ToDetailProp(true)
+	if assert.NotNil(t, props.Consensus) {
+		assert.Equal(t, "split", props.Consensus.Level)
+		assert.Equal(t, 4, props.Consensus.Steps)
+		assert.True(t, props.Consensus.Revote)
+	}
+	if assert.Len(t, props.Votes, 2) {
+		assert.Equal(t, "lowest", props.Votes[0].Outlier)
+		assert.Equal(t, "highest", props.Votes[1].Outlier)
+	}
+
+	// Wider thresholds make the same votes a near consensus
+	assert.ErrorIs(t, app.ticketService.UpdateConsensusThresholds(ctx, room.ID, 1,
+		database.ConsensusThresholds{Consensus: 2, Near: 1}), service.ErrInvalidConsensus)
+	assert.NoError(t, app.ticketService.UpdateConsensusThresholds(ctx, room.ID, 1,
+		database.ConsensusThresholds{Consensus: 1, Near: 4}))
+	rounds, err := app.ticketService.GetTicketEstimates(ctx, int32(split.ID), 1)
+	assert.NoError(t, err)
+	if assert.Len(t, rounds, 1) && assert.NotNil(t, rounds[0].Consensus) {
+		assert.Equal(t, "near", rounds[0].Consensus.Level)
+		assert.False(t, rounds[0].Consensus.Revote)
+	}
+}
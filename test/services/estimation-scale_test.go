@@ -0,0 +1,110 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeckFormat(t *testing.T) {
+	testCases := []struct {
+		deck     database.Deck
+		estimate float64
+		expected string
+	}{
+		{
+			deck:     database.NewDeck(database.ScaleHours, ""),
+			estimate: 53,
+			expected: "1w 1d 5h",
+		},
+		{
+			deck:     database.NewDeck(database.ScaleFibonacci, ""),
+			estimate: 4.26,
+			expected: "4.3 pts",
+		},
+		{
+			deck:     database.NewDeck(database.ScaleModifiedFibonacci, ""),
+			estimate: 0.5,
+			expected: "0.5 pts",
+		},
+		{
+			deck:     database.NewDeck(database.ScaleTShirt, ""),
+			estimate: 4.2,
+			expected: "L",
+		},
+		{
+			deck:     database.NewDeck(database.ScaleCustom, "small, medium, large"),
+			estimate: 2,
+			expected: "medium",
+		},
+		{
+			deck:     database.NewDeck(database.ScaleCustom, "1, 2, 4"),
+			estimate: 4,
+			expected: "4 pts",
+		},
+	}
+
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, testCase.deck.Format(testCase.estimate), string(testCase.deck.Scale))
+	}
+}
+
+func TestDeckCardValue(t *testing.T) {
+	deck := database.NewDeck(database.ScaleTShirt, "")
+
+	value, ok := deck.CardValue("XL")
+	assert.True(t, ok)
+	assert.Equal(t, 8.0, value)
+
+	_, ok = deck.CardValue("XXXL")
+	assert.False(t, ok)
+
+	assert.Empty(t, database.NewDeck(database.ScaleHours, "").CardLabels())
+}
+
+func TestParseCustomScale(t *testing.T) {
+	scale, err := database.ParseCustomScale(" S, M ,, L ")
+	assert.NoError(t, err)
+	assert.Equal(t, "S,M,L", scale)
+
+	_, err = database.ParseCustomScale("S")
+	assert.ErrorIs(t, err, database.ErrInvalidEstimationScale)
+
+	_, err = database.ParseCustomScale("S, S")
+	assert.ErrorIs(t, err, database.ErrInvalidEstimationScale)
+
+	_, err = database.ParseEstimationScale("bananas")
+	assert.ErrorIs(t, err, database.ErrInvalidEstimationScale)
+}
+
+func TestEstimateFormat(t *testing.T) {
+	deck := database.NewDeck(database.ScaleFibonacci, "")
+
+	assert.Equal(t, "5 pts", database.Estimate{Estimate: 5}.Format(deck))
+	assert.Equal(t, "?", database.Estimate{Kind: database.EstimateUnsure}.Format(deck))
+	assert.Equal(t, "☕", database.Estimate{Kind: database.EstimateBreak}.Format(deck))
+	assert.Equal(t, "Abstain", database.Estimate{Kind: database.EstimateAbstain}.Format(deck))
+
+	kind, ok := database.ParseEstimateKind("abstain")
+	assert.True(t, ok)
+	assert.Equal(t, database.EstimateAbstain, kind)
+	_, ok = database.ParseEstimateKind("later")
+	assert.False(t, ok)
+}
+
+func TestPERT(t *testing.T) {
+	assert.InDelta(t, 5.0, database.PERTExpected(2, 4, 12), 0.001)
+	assert.InDelta(t, 10.0/6, database.PERTStdDev(2, 12), 0.001)
+
+	hours := database.NewDeck(database.ScaleHours, "")
+	assert.Equal(t, "0w 0d 2h – 0w 1d 0h", hours.FormatRange(5, 1.5))
+	// Ranges don't go below zero
+	assert.Equal(t, "0w 0d 0h – 0w 0d 5h", hours.FormatRange(1, 2))
+	assert.Equal(t, "10 pts – 30 pts", database.NewDeck(database.ScaleFibonacci, "").FormatTotalRange(20, 5))
+
+	optimistic, mostLikely, pessimistic := 2.0, 3.0, 8.0
+	estimate := database.Estimate{Optimistic: &optimistic, MostLikely: &mostLikely, Pessimistic: &pessimistic}
+	assert.True(t, estimate.IsThreePoint())
+	assert.Equal(t, "2 pts / 3 pts / 8 pts", estimate.Format(database.NewDeck(database.ScaleFibonacci, "")))
+}
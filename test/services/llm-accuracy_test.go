@@ -0,0 +1,45 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestComputeLLMAccuracy(t *testing.T) {
+	deck := database.NewDeck(database.ScaleHours, "")
+
+	accuracy := service.ComputeLLMAccuracy(deck, []service.LLMAccuracySample{
+		// Exact
+		{LLMEstimate: 8, TeamEstimate: 8},
+		// One step over, 16h is next to 8h
+		{LLMEstimate: 16, TeamEstimate: 8},
+		// Two steps under
+		{LLMEstimate: 2, TeamEstimate: 8},
+		// Rounded to the same step
+		{LLMEstimate: 5, TeamEstimate: 4},
+	})
+
+	assert.Equal(t, 4, accuracy.Tickets)
+	assert.InDelta(t, (0+8+6+1)/4.0, accuracy.MeanAbsoluteError, 0.0001)
+	assert.InDelta(t, (0+8-6+1)/4.0, accuracy.Bias, 0.0001)
+	assert.InDelta(t, 0.75, accuracy.HitRate, 0.0001)
+}
+
+func TestComputeLLMAccuracyWithoutSamples(t *testing.T) {
+	accuracy := service.ComputeLLMAccuracy(database.NewDeck(database.ScaleHours, ""), nil)
+	assert.Equal(t, service.LLMAccuracy{}, accuracy)
+}
+
+func TestDeckStepsApart(t *testing.T) {
+	fibonacci := database.NewDeck(database.ScaleFibonacci, "")
+	assert.Equal(t, 0, fibonacci.StepsApart(5, 5))
+	assert.Equal(t, 1, fibonacci.StepsApart(5, 8))
+	assert.Equal(t, 2, fibonacci.StepsApart(13, 5))
+
+	hours := database.NewDeck(database.ScaleHours, "")
+	assert.Equal(t, 1, hours.StepsApart(40, 24))
+	assert.Equal(t, 3, hours.StepsApart(1, 8))
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeuristicEstimator(t *testing.T) {
+	estimator := service.HeuristicEstimator{}
+
+	small, err := estimator.Estimate(t.Context(), service.EstimationPrompt{Description: "Fix typo in footer"})
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), small.Hours())
+	assert.Equal(t, "low", small.Confidence)
+	assert.Empty(t, small.Risks)
+
+	// Same input, same estimate
+	again, _ := estimator.Estimate(t.Context(), service.EstimationPrompt{Description: "Fix typo in footer"})
+	assert.Equal(t, small, again)
+
+	large, err := estimator.Estimate(t.Context(), service.EstimationPrompt{
+		Description: "Migrate the legacy database " + strings.Repeat("word ", 200),
+	})
+	assert.NoError(t, err)
+	// 16h for the length, 4h more for each of migrate, legacy and database
+	assert.Equal(t, float64(16+4+4+4), large.Hours())
+	assert.Equal(t, []string{"Mentions migrate", "Mentions database", "Mentions legacy"}, large.Risks)
+	assert.NotEmpty(t, large.Rationale)
+}
+
+func TestOllamaEstimator(t *testing.T) {
+	var request map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/chat", r.URL.Path)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"message":{"role":"assistant","content":"{\"weekEstimate\":0,\"dayEstimate\":1,\"hourEstimate\":4,\"rationale\":\"Small form\",\"risks\":[\"SSO\"],\"confidence\":\"high\"}"},"done":true}`))
+	}))
+	defer server.Close()
+
+	estimator := service.NewOllamaEstimator(server.URL+"/", "llama3.2")
+	estimate, err := estimator.Estimate(t.Context(), service.EstimationPrompt{TicketKey: "SP-1", Description: "Add login"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, service.RecommendedEstimate{
+		DayEstimate:  1,
+		HourEstimate: 4,
+		Rationale:    "Small form",
+		Risks:        []string{"SSO"},
+		Confidence:   "high",
+	}, estimate)
+	assert.Equal(t, "llama3.2", request["model"])
+	assert.Equal(t, false, request["stream"])
+	assert.NotNil(t, request["format"])
+}
+
+func TestOllamaEstimatorError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"model not found"}`))
+	}))
+	defer server.Close()
+
+	estimator := service.NewOllamaEstimator(server.URL, "missing")
+	_, err := estimator.Estimate(t.Context(), service.EstimationPrompt{Description: "Add login"})
+
+	assert.ErrorContains(t, err, "404")
+	assert.ErrorContains(t, err, "model not found")
+}
+
+func TestOllamaEstimatorErrorWithoutJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html><body>502 Bad Gateway</body></html>\n"))
+	}))
+	defer server.Close()
+
+	estimator := service.NewOllamaEstimator(server.URL, "llama3.2")
+	_, err := estimator.Estimate(t.Context(), service.EstimationPrompt{Description: "Add login"})
+
+	assert.EqualError(t, err, "ollama responded with 502: <html><body>502 Bad Gateway</body></html>")
+}
+
+func TestEstimatorsFallBackToDefault(t *testing.T) {
+	estimators, err := service.NewEstimators(service.ProviderHeuristic, map[string]service.Estimator{
+		service.ProviderHeuristic: service.HeuristicEstimator{},
+	})
+	assert.NoError(t, err)
+
+	provider, _ := estimators.Get(service.ProviderOllama)
+	assert.Equal(t, service.ProviderHeuristic, provider)
+	assert.Equal(t, []string{service.ProviderHeuristic}, estimators.Providers())
+
+	_, err = service.NewEstimators(service.ProviderOpenAI, map[string]service.Estimator{})
+	assert.ErrorIs(t, err, service.ErrUnknownLLMProvider)
+}
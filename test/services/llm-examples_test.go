@@ -0,0 +1,116 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRankSimilarTickets(t *testing.T) {
+	candidates := []service.EstimationExample{
+		{TicketID: 1, Name: "Login page", Description: "Add OAuth login with Jira"},
+		{TicketID: 2, Name: "Footer", Description: "Fix typo in the footer"},
+		{TicketID: 3, Name: "Logout", Description: "Add logout button to the Jira login header"},
+		{TicketID: 4, Name: "Login", Description: "OAuth login with Jira, Github and Gitlab"},
+	}
+
+	ranked := service.RankSimilarTickets("OAuth login with Jira", candidates, 2)
+
+	assert.Len(t, ranked, 2)
+	assert.Equal(t, uint(1), ranked[0].TicketID)
+	assert.Equal(t, uint(4), ranked[1].TicketID)
+	assert.Greater(t, ranked[0].Similarity, ranked[1].Similarity)
+	assert.LessOrEqual(t, ranked[0].Similarity, 1.0)
+}
+
+func TestRankSimilarTicketsSkipsUnrelated(t *testing.T) {
+	candidates := []service.EstimationExample{
+		{TicketID: 1, Name: "Footer", Description: "Fix typo in the footer"},
+	}
+
+	assert.Empty(t, service.RankSimilarTickets("OAuth login with Jira", candidates, 5))
+	assert.Empty(t, service.RankSimilarTickets("", candidates, 5))
+}
+
+func TestHeuristicEstimatorUsesExamples(t *testing.T) {
+	estimate, err := service.HeuristicEstimator{}.Estimate(t.Context(), service.EstimationPrompt{
+		Description: "Fix typo in footer",
+		Examples: []service.EstimationExample{
+			{Estimate: 16, Similarity: 0.75},
+			{Estimate: 8, Similarity: 0.25},
+		},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, float64(14), estimate.Hours())
+}
+
+func TestLLMJobStatusExamplesOfOtherRooms(t *testing.T) {
+	job := database.LLMJob{TicketID: 1, RoomID: 1, Status: database.LLMJobSucceeded, Examples: []database.LLMEstimateExample{
+		{RoomID: 1, Name: "Login page", Estimate: 4, Similarity: 0.8},
+		{RoomID: 2, Name: "Secret project", Estimate: 8, Similarity: 0.5},
+	}}
+
+	// Moderators see the owner's other rooms were used, but not their tickets
+	status := job.StatusProps(false)
+	assert.Len(t, status.Examples, 1)
+	assert.Equal(t, "Login page", status.Examples[0].Name)
+	assert.Equal(t, 1, status.OtherRoomExamples)
+
+	status = job.StatusProps(true)
+	assert.Len(t, status.Examples, 2)
+	assert.Equal(t, "Secret project", status.Examples[1].Name)
+	assert.Zero(t, status.OtherRoomExamples)
+}
+
+func (r *RoomServiceSuite) TestLLMExamples() {
+	t := r.T()
+	ctx := t.Context()
+	t.Setenv("LLM_EXAMPLES", "1")
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "examples"})
+	assert.NoError(t, err)
+	assert.NoError(t, r.db.DB.Model(room).Update("allow_llm_estimation", true).Error)
+
+	closeTicket := func(name string, description string, closedAt time.Time, hours float64) database.Ticket {
+		ticket := database.Ticket{Name: name, Description: description, RoomID: room.ID, CreatedBy: 1, ClosedAt: &closedAt}
+		assert.NoError(t, r.db.DB.Create(&ticket).Error)
+		userID := uint(1)
+		assert.NoError(t, r.db.DB.Create(&database.Estimate{TicketID: ticket.ID, UserID: &userID, Estimate: hours, Round: 1}).Error)
+		return ticket
+	}
+	// The similar tickets were closed long before many unrelated ones
+	login := closeTicket("OAuth login page", "Login with Jira OAuth", time.Now().Add(-30*24*time.Hour), 16)
+	closeTicket("OAuth logout", "Logout from Jira", time.Now().Add(-30*24*time.Hour), 4)
+	for i := range 510 {
+		closeTicket(fmt.Sprintf("Footer %d", i), "Fix typo in the footer", time.Now(), 1)
+	}
+
+	// Only the description is known to the job, the name makes the login page the closest
+	estimated := database.Ticket{Name: "OAuth login", Description: "Support Jira accounts", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&estimated).Error)
+	job := database.LLMJob{
+		TicketID: estimated.ID, RoomID: room.ID, Description: estimated.Description,
+		Status: database.LLMJobPending, RunAfter: time.Now(),
+	}
+	assert.NoError(t, r.db.DB.Create(&job).Error)
+
+	// The LLM workers of the app pick up the job
+	r.newApp()
+
+	assert.Eventually(t, func() bool {
+		var finished database.LLMJob
+		return r.db.DB.First(&finished, job.ID).Error == nil && finished.Status == database.LLMJobSucceeded
+	}, 10*time.Second, 20*time.Millisecond)
+
+	var examples []database.LLMEstimateExample
+	assert.NoError(t, r.db.DB.Where("llm_job_id = ?", job.ID).Find(&examples).Error)
+	if assert.Len(t, examples, 1) {
+		assert.Equal(t, login.ID, examples[0].ExampleTicketID)
+		assert.Equal(t, 16.0, examples[0].Estimate)
+	}
+}
@@ -0,0 +1,148 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm/clause"
+)
+
+func TestLLMBackoff(t *testing.T) {
+	// Doubles with every failed attempt
+	assert.Equal(t, 10*time.Second, service.LLMBackoff(0))
+	assert.Equal(t, 10*time.Second, service.LLMBackoff(1))
+	assert.Equal(t, 20*time.Second, service.LLMBackoff(2))
+	assert.Equal(t, 40*time.Second, service.LLMBackoff(3))
+	assert.Equal(t, 320*time.Second, service.LLMBackoff(6))
+
+	// Until it reaches the maximum
+	assert.Equal(t, 10*time.Minute, service.LLMBackoff(7))
+	assert.Equal(t, 10*time.Minute, service.LLMBackoff(100))
+}
+
+// estimatorFunc lets tests give the LLM workers estimators that fail
+type estimatorFunc func(ctx context.Context, prompt service.EstimationPrompt) (service.RecommendedEstimate, error)
+
+func (f estimatorFunc) Estimate(ctx context.Context, prompt service.EstimationPrompt) (service.RecommendedEstimate, error) {
+	return f(ctx, prompt)
+}
+
+func (r *RoomServiceSuite) TestLLMJobs() {
+	t := r.T()
+	ctx := t.Context()
+
+	roomWith := func(name string, provider string, allowLLM bool) *database.Room {
+		room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: name})
+		assert.NoError(t, err)
+		assert.NoError(t, r.db.DB.Model(room).Updates(map[string]any{
+			"allow_llm_estimation": allowLLM,
+			"llm_provider":         provider,
+		}).Error)
+		return room
+	}
+	working := roomWith("working", service.ProviderHeuristic, true)
+	failing := roomWith("failing", "failing", true)
+	panicking := roomWith("panicking", "panicking", true)
+	disabled := roomWith("disabled", service.ProviderHeuristic, false)
+
+	queue := func(room *database.Room, name string, job database.LLMJob) database.LLMJob {
+		ticket := database.Ticket{Name: name, Description: "Fix typo in footer", RoomID: room.ID, CreatedBy: 1}
+		assert.NoError(t, r.db.DB.Create(&ticket).Error)
+		job.TicketID = ticket.ID
+		job.RoomID = room.ID
+		job.Description = ticket.Description
+		if job.Status == "" {
+			job.Status = database.LLMJobPending
+			job.RunAfter = time.Now()
+		}
+		assert.NoError(t, r.db.DB.Create(&job).Error)
+		return job
+	}
+	reload := func(job database.LLMJob) database.LLMJob {
+		var reloaded database.LLMJob
+		assert.NoError(t, r.db.DB.First(&reloaded, job.ID).Error)
+		return reloaded
+	}
+	finished := func(job database.LLMJob, status database.LLMJobStatus) func() bool {
+		return func() bool { return reload(job).Status == status }
+	}
+
+	leaseExpired, leased := time.Now().Add(-time.Hour), time.Now()
+	free := queue(working, "free", database.LLMJob{})
+	locked := queue(working, "locked", database.LLMJob{})
+	expired := queue(working, "expired", database.LLMJob{
+		Status: database.LLMJobRunning, Attempts: 1, StartedAt: &leaseExpired,
+	})
+	running := queue(working, "running", database.LLMJob{
+		Status: database.LLMJobRunning, Attempts: 1, StartedAt: &leased,
+	})
+	retried := queue(failing, "retried", database.LLMJob{})
+	exhausted := queue(failing, "exhausted", database.LLMJob{Attempts: 4})
+	panicked := queue(panicking, "panicked", database.LLMJob{})
+	skipped := queue(disabled, "skipped", database.LLMJob{})
+
+	// Another instance is busy with the locked job, the workers skip it
+	tx := r.db.DB.Begin()
+	assert.NoError(t, tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&database.LLMJob{}, locked.ID).Error)
+
+	estimators, err := service.NewEstimators(service.ProviderHeuristic, map[string]service.Estimator{
+		service.ProviderHeuristic: service.HeuristicEstimator{},
+		"failing": estimatorFunc(func(context.Context, service.EstimationPrompt) (service.RecommendedEstimate, error) {
+			return service.RecommendedEstimate{}, errors.New("estimator is down")
+		}),
+		"panicking": estimatorFunc(func(context.Context, service.EstimationPrompt) (service.RecommendedEstimate, error) {
+			panic("estimator broke")
+		}),
+	})
+	assert.NoError(t, err)
+	app := r.newAppWith(service.NewPresenceService(), estimators)
+
+	assert.Eventually(t, finished(free, database.LLMJobSucceeded), 5*time.Second, 20*time.Millisecond)
+
+	// Jobs of crashed instances are picked up again once their lease ran out
+	assert.Eventually(t, finished(expired, database.LLMJobSucceeded), 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 2, reload(expired).Attempts)
+
+	// Failed jobs are retried later, until they run out of attempts
+	assert.Eventually(t, func() bool { return reload(retried).LastError != "" }, 5*time.Second, 20*time.Millisecond)
+	retriedJob := reload(retried)
+	assert.Equal(t, database.LLMJobPending, retriedJob.Status)
+	assert.Equal(t, 1, retriedJob.Attempts)
+	assert.Equal(t, "estimator is down", retriedJob.LastError)
+	assert.WithinDuration(t, time.Now().Add(service.LLMBackoff(1)), retriedJob.RunAfter, 2*time.Second)
+	assert.Nil(t, retriedJob.FinishedAt)
+
+	assert.Eventually(t, finished(exhausted, database.LLMJobFailed), 5*time.Second, 20*time.Millisecond)
+	exhaustedJob := reload(exhausted)
+	assert.Equal(t, 5, exhaustedJob.Attempts)
+	assert.Equal(t, "estimator is down", exhaustedJob.LastError)
+	assert.NotNil(t, exhaustedJob.FinishedAt)
+
+	// Jobs which can't succeed fail right away, panics are retried like errors
+	assert.Eventually(t, finished(skipped, database.LLMJobFailed), 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, 1, reload(skipped).Attempts)
+	assert.Contains(t, reload(skipped).LastError, "disabled")
+	assert.Eventually(t, func() bool { return reload(panicked).LastError != "" }, 5*time.Second, 20*time.Millisecond)
+	assert.Equal(t, database.LLMJobPending, reload(panicked).Status)
+	assert.Contains(t, reload(panicked).LastError, "estimator broke")
+
+	// Neither the locked job nor one which is still leased was touched
+	lockedJob := reload(locked)
+	assert.Equal(t, database.LLMJobPending, lockedJob.Status)
+	assert.Equal(t, 0, lockedJob.Attempts)
+	runningJob := reload(running)
+	assert.Equal(t, database.LLMJobRunning, runningJob.Status)
+	assert.Equal(t, 1, runningJob.Attempts)
+
+	// The workers keep going after the failures
+	assert.NoError(t, tx.Rollback().Error)
+	after := queue(working, "after", database.LLMJob{})
+	app.llmService.Wake()
+	assert.Eventually(t, finished(locked, database.LLMJobSucceeded), 10*time.Second, 20*time.Millisecond)
+	assert.Eventually(t, finished(after, database.LLMJobSucceeded), 10*time.Second, 20*time.Millisecond)
+}
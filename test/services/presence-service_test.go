@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func presentUserIDs(t *testing.T, presence *service.PresenceService, roomID uint) []uint {
+	t.Helper()
+	userIDs, err := presence.PresentUserIDs(context.Background(), roomID)
+	require.NoError(t, err)
+	return userIDs
+}
+
+func roster(t *testing.T, presence *service.PresenceService, roomID uint) []service.UserPresence {
+	t.Helper()
+	roster, err := presence.Roster(context.Background(), roomID)
+	require.NoError(t, err)
+	return roster
+}
+
+func TestPresenceJoinAndLeave(t *testing.T) {
+	presence := service.NewPresenceService()
+	firstTab, secondTab := new(int), new(int)
+
+	presence.Join(1, 10, firstTab)
+	presence.Join(1, 10, secondTab)
+	presence.Join(1, 11, new(int))
+	presence.Join(2, 12, new(int))
+
+	assert.Equal(t, []uint{10, 11}, presentUserIDs(t, presence, 1))
+
+	// The user is still present while one of their tabs is open
+	presence.Leave(1, 10, firstTab)
+	assert.Equal(t, []uint{10, 11}, presentUserIDs(t, presence, 1))
+
+	presence.Leave(1, 10, secondTab)
+	assert.Equal(t, []uint{11}, presentUserIDs(t, presence, 1))
+
+	roster := roster(t, presence, 1)
+	assert.Len(t, roster, 2)
+	assert.Equal(t, uint(11), roster[0].UserID)
+	assert.Equal(t, service.PresenceOnline, roster[0].Status)
+	assert.Equal(t, uint(10), roster[1].UserID)
+	assert.Equal(t, service.PresenceOffline, roster[1].Status)
+}
+
+func TestPresenceIdle(t *testing.T) {
+	presence := service.NewPresenceService()
+	firstTab, secondTab := new(int), new(int)
+
+	presence.Join(1, 10, firstTab)
+	presence.Join(1, 10, secondTab)
+
+	assert.False(t, presence.SetIdle(1, 10, firstTab, true), "other tab is still active")
+	assert.True(t, presence.SetIdle(1, 10, secondTab, true))
+	assert.Equal(t, service.PresenceIdle, roster(t, presence, 1)[0].Status)
+
+	// Idle users still count as present
+	assert.Equal(t, []uint{10}, presentUserIDs(t, presence, 1))
+
+	assert.True(t, presence.SetIdle(1, 10, firstTab, false))
+	assert.Equal(t, service.PresenceOnline, roster(t, presence, 1)[0].Status)
+
+	assert.False(t, presence.SetIdle(1, 99, firstTab, true), "unknown users are ignored")
+}
+
+func TestPresenceAcrossInstances(t *testing.T) {
+	store := service.NewLocalPresenceStore()
+	first := service.NewPresenceServiceWithStore(store)
+	second := service.NewPresenceServiceWithStore(store)
+	firstTab, secondTab := new(int), new(int)
+
+	first.Join(1, 10, firstTab)
+	second.Join(1, 10, secondTab)
+	second.Join(1, 11, new(int))
+
+	// Both instances see the users of the other one
+	assert.Equal(t, []uint{10, 11}, presentUserIDs(t, first, 1))
+	assert.Equal(t, []uint{10, 11}, presentUserIDs(t, second, 1))
+
+	// Online on one instance beats idle on another
+	assert.True(t, first.SetIdle(1, 10, firstTab, true))
+	assert.Equal(t, service.PresenceOnline, roster(t, second, 1)[0].Status)
+	assert.True(t, second.SetIdle(1, 10, secondTab, true))
+	assert.Equal(t, service.PresenceIdle, roster(t, first, 1)[1].Status)
+
+	// Leaving one instance doesn't take the user offline on the other
+	first.Leave(1, 10, firstTab)
+	assert.Equal(t, []uint{10, 11}, presentUserIDs(t, first, 1))
+
+	second.Leave(1, 10, secondTab)
+	assert.Equal(t, []uint{11}, presentUserIDs(t, first, 1))
+	assert.Equal(t, service.PresenceOffline, roster(t, first, 1)[1].Status)
+}
+
+func (r *RoomServiceSuite) TestSharedPresence() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "replicas"})
+	assert.NoError(t, err)
+	voter := database.User{DisplayName: "voter"}
+	assert.NoError(t, r.db.DB.Create(&voter).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&voter))
+	voted := database.Ticket{Name: "voted", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&voted).Error)
+
+	// Two instances of the app behind a load balancer
+	newInstance := func() (*service.PresenceService, *service.TicketService) {
+		instance := r.newAppWith(service.NewPresenceServiceWithStore(service.NewPostgresPresenceStore(r.db)), r.heuristicEstimators())
+		return instance.presenceService, instance.ticketService
+	}
+	firstPresence, firstTickets := newInstance()
+	secondPresence, secondTickets := newInstance()
+
+	// The owner is connected to one instance, the voter to the other
+	firstPresence.Join(room.ID, 1, "owner's tab")
+	secondPresence.Join(room.ID, voter.ID, "voter's tab")
+	for _, presenceService := range []*service.PresenceService{firstPresence, secondPresence} {
+		userIDs, err := presenceService.PresentUserIDs(ctx, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, []uint{1, voter.ID}, userIDs)
+	}
+
+	// The ticket closes once everyone voted, whichever instance they are on
+	assert.NoError(t, firstTickets.UpdateVotingSettings(ctx, room.ID, 1, 0, database.AutoFinishClose))
+	_, err = firstTickets.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: voted.ID, RoomID: room.ID, HourEstimate: 3})
+	assert.NoError(t, err)
+	var closed database.Ticket
+	assert.NoError(t, r.db.DB.First(&closed, voted.ID).Error)
+	assert.Nil(t, closed.ClosedAt, "the voter on the other instance didn't vote yet")
+	_, err = secondTickets.EstimateTicket(ctx, voter.ID, service.EstimateTicketForm{TicketID: voted.ID, RoomID: room.ID, HourEstimate: 5})
+	assert.NoError(t, err)
+	assert.NoError(t, r.db.DB.First(&closed, voted.ID).Error)
+	assert.NotNil(t, closed.ClosedAt)
+
+	// Leaving is seen by the other instance
+	secondPresence.Leave(room.ID, voter.ID, "voter's tab")
+	userIDs, err := firstPresence.PresentUserIDs(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{1}, userIDs)
+	roster, err := firstPresence.Roster(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Len(t, roster, 2)
+	assert.Equal(t, service.PresenceOffline, roster[1].Status)
+
+	// Users of an instance which stopped renewing its presence go offline
+	secondPresence.Join(room.ID, voter.ID, "voter's new tab")
+	assert.NoError(t, r.db.DB.Model(&database.RoomPresence{}).
+		Where("user_id = ?", voter.ID).
+		Update("expires_at", time.Now().Add(-time.Second)).Error)
+	userIDs, err = firstPresence.PresentUserIDs(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{1}, userIDs)
+
+	// And voting doesn't wait for them
+	next := database.Ticket{Name: "next", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&next).Error)
+	_, err = firstTickets.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: next.ID, RoomID: room.ID, HourEstimate: 2})
+	assert.NoError(t, err)
+	var closedNext database.Ticket
+	assert.NoError(t, r.db.DB.First(&closedNext, next.ID).Error)
+	assert.NotNil(t, closedNext.ClosedAt)
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func (r *RoomServiceSuite) TestRoomInvites() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "invites"})
+	assert.NoError(t, err)
+	guest := database.User{DisplayName: "guest"}
+	assert.NoError(t, r.db.DB.Create(&guest).Error)
+	stakeholder := database.User{DisplayName: "stakeholder"}
+	assert.NoError(t, r.db.DB.Create(&stakeholder).Error)
+	invites := service.NewRoomInviteService(r.db)
+
+	// Knowing the room ID isn't enough to get in
+	_, err = r.roomService.GetRoom(ctx, room.ID, guest.ID)
+	assert.ErrorIs(t, err, service.ErrForbidden)
+	_, err = invites.ShareLink(ctx, room.ID, guest.ID)
+	assert.ErrorIs(t, err, service.ErrForbidden)
+
+	// Rooms are created with a link to share them with
+	shareLink, err := invites.ShareLink(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(shareLink, "/room/join/"))
+	token := strings.TrimPrefix(shareLink, "/room/join/")
+
+	_, err = invites.Join(ctx, "guessed", guest.ID, "")
+	assert.ErrorIs(t, err, service.ErrInvalidInvite)
+
+	// Passcodes are asked for when joining, not from members
+	assert.ErrorIs(t, invites.SetPasscode(ctx, room.ID, guest.ID, "secret"), service.ErrForbidden)
+	assert.NoError(t, invites.SetPasscode(ctx, room.ID, 1, "secret"))
+	_, err = invites.Join(ctx, token, guest.ID, "")
+	assert.ErrorIs(t, err, service.ErrPasscodeRequired)
+	_, err = invites.Join(ctx, token, guest.ID, "wrong")
+	assert.ErrorIs(t, err, service.ErrWrongPasscode)
+	roomID, err := invites.Join(ctx, token, guest.ID, "secret")
+	assert.NoError(t, err)
+	assert.Equal(t, room.ID, roomID)
+	roomID, err = invites.Join(ctx, token, 1, "")
+	assert.NoError(t, err)
+	assert.Equal(t, room.ID, roomID)
+
+	joined, err := r.roomService.GetRoom(ctx, room.ID, guest.ID)
+	assert.NoError(t, err)
+	assert.Len(t, joined.Users, 2)
+
+	// Invites give their role, until they are revoked
+	assert.NoError(t, invites.SetPasscode(ctx, room.ID, 1, ""))
+	_, err = invites.CreateInvite(ctx, room.ID, guest.ID, service.RoleObserver, 0)
+	assert.ErrorIs(t, err, service.ErrForbidden)
+	_, err = invites.CreateInvite(ctx, room.ID, 1, service.RoleObserver, -time.Hour)
+	assert.ErrorIs(t, err, service.ErrInvalidValidity)
+	observerInvite, err := invites.CreateInvite(ctx, room.ID, 1, service.RoleObserver, time.Hour)
+	assert.NoError(t, err)
+	assert.NotNil(t, observerInvite.ExpiresAt)
+
+	list, err := invites.GetInvites(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.False(t, list.HasPasscode)
+	assert.Len(t, list.Invites, 2)
+
+	assert.NoError(t, invites.RevokeInvite(ctx, room.ID, 1, observerInvite.ID))
+	assert.ErrorIs(t, invites.RevokeInvite(ctx, room.ID, 1, observerInvite.ID), gorm.ErrRecordNotFound)
+	_, err = invites.Join(ctx, observerInvite.Token, stakeholder.ID, "")
+	assert.ErrorIs(t, err, service.ErrInvalidInvite)
+
+	observerInvite, err = invites.CreateInvite(ctx, room.ID, 1, service.RoleObserver, time.Hour)
+	assert.NoError(t, err)
+	_, err = invites.Join(ctx, observerInvite.Token, stakeholder.ID, "")
+	assert.NoError(t, err)
+	role, err := service.NewRoomPolicy(r.db).Role(ctx, room.ID, stakeholder.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, service.RoleObserver, role)
+
+	// Expired invites can't be used
+	assert.NoError(t, r.db.DB.Model(observerInvite).Update("expires_at", time.Now().Add(-time.Minute)).Error)
+	_, err = invites.Join(ctx, observerInvite.Token, 1000, "")
+	assert.ErrorIs(t, err, service.ErrInvalidInvite)
+}
+
+func (r *RoomServiceSuite) TestPasscodeThrottling() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "throttled", Passcode: "secret"})
+	assert.NoError(t, err)
+	invites := service.NewRoomInviteService(r.db)
+	shareLink, err := invites.ShareLink(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	token := strings.TrimPrefix(shareLink, "/room/join/")
+	guest := func(name string) uint {
+		user := database.User{DisplayName: name}
+		assert.NoError(t, r.db.DB.Create(&user).Error)
+		return user.ID
+	}
+
+	// A user gets a few guesses, then even the right passcode is refused
+	guesser := guest("guesser")
+	for range 5 {
+		_, err = invites.Join(ctx, token, guesser, "wrong")
+		assert.ErrorIs(t, err, service.ErrWrongPasscode)
+	}
+	_, err = invites.Join(ctx, token, guesser, "secret")
+	assert.ErrorIs(t, err, service.ErrTooManyAttempts)
+
+	// Right passcodes don't count towards the limit of the invite
+	for i := range 10 {
+		_, err = invites.Join(ctx, token, guest(fmt.Sprintf("teammate %d", i)), "secret")
+		assert.NoError(t, err)
+	}
+
+	// Guessing with many users locks the invite
+	for i := range 15 {
+		_, err = invites.Join(ctx, token, guest(fmt.Sprintf("bot %d", i)), "wrong")
+		assert.ErrorIs(t, err, service.ErrWrongPasscode)
+	}
+	_, err = invites.Join(ctx, token, guest("late teammate"), "secret")
+	assert.ErrorIs(t, err, service.ErrTooManyAttempts)
+
+	// Until the window is over
+	assert.NoError(t, r.db.DB.Model(&database.PasscodeAttempt{}).
+		Where("1 = 1").
+		Update("window_ends_at", time.Now().Add(-time.Second)).Error)
+	_, err = invites.Join(ctx, token, guesser, "secret")
+	assert.NoError(t, err)
+}
+
+func (r *RoomServiceSuite) TestShareLinkOfOldRooms() {
+	t := r.T()
+	ctx := t.Context()
+
+	// Rooms from before invite links had none
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "old"})
+	assert.NoError(t, err)
+	assert.NoError(t, r.db.DB.Unscoped().Where("room_id = ?", room.ID).Delete(&database.RoomInvite{}).Error)
+
+	invites := service.NewRoomInviteService(r.db)
+	shareLink, err := invites.ShareLink(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(shareLink, "/room/join/"))
+	again, err := invites.ShareLink(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, shareLink, again)
+
+	// Revoking it doesn't bring it back
+	list, err := invites.GetInvites(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.Len(t, list.Invites, 1)
+	assert.NoError(t, invites.RevokeInvite(ctx, room.ID, 1, list.Invites[0].ID))
+	shareLink, err = invites.ShareLink(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, shareLink)
+}
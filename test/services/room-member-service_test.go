@@ -0,0 +1,91 @@
+package services
+
+import (
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func (r *RoomServiceSuite) TestRoomMembers() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "members"})
+	assert.NoError(t, err)
+	member := database.User{DisplayName: "member"}
+	assert.NoError(t, r.db.DB.Create(&member).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&member))
+	observer := database.User{DisplayName: "observer"}
+	assert.NoError(t, r.db.DB.Create(&observer).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&observer))
+	ticket := database.Ticket{Name: "ticket", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&ticket).Error)
+
+	app := r.newApp()
+	members := service.NewRoomMemberService(r.db, app.webSocketService)
+
+	var creator database.RoomUser
+	assert.NoError(t, r.db.DB.Where("room_id = ? AND user_id = ?", room.ID, 1).First(&creator).Error)
+	assert.Equal(t, service.RoleOwner, creator.Role)
+
+	// Only owners manage members, and the room owner's role is fixed
+	assert.ErrorIs(t, members.SetRole(ctx, room.ID, member.ID, observer.ID, service.RoleObserver), service.ErrForbidden)
+	assert.ErrorIs(t, members.SetRole(ctx, room.ID, 1, 1, service.RoleEstimator), service.ErrOwnerRole)
+	assert.ErrorIs(t, members.SetRole(ctx, room.ID, 1, member.ID, service.RoleNone), service.ErrInvalidRole)
+	assert.ErrorIs(t, members.SetRole(ctx, room.ID, 1, member.ID+1000, service.RoleObserver), gorm.ErrRecordNotFound)
+	assert.NoError(t, members.SetRole(ctx, room.ID, 1, observer.ID, service.RoleObserver))
+	assert.NoError(t, members.SetRole(ctx, room.ID, 1, member.ID, service.RoleModerator))
+
+	list, err := members.GetMembers(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.True(t, list.CanTransfer)
+	roles := make(map[uint]string)
+	for _, m := range list.Members {
+		roles[m.UserID] = m.Role
+	}
+	assert.Equal(t, map[uint]string{1: "owner", member.ID: "moderator", observer.ID: "observer"}, roles)
+
+	// Moderators run the estimation, observers only watch
+	_, err = app.ticketService.RevealTicket(ctx, ticket.ID, member.ID)
+	assert.NoError(t, err)
+	_, err = app.ticketService.EstimateTicket(ctx, observer.ID, service.EstimateTicketForm{
+		TicketID: ticket.ID, RoomID: room.ID, HourEstimate: 2,
+	})
+	assert.ErrorIs(t, err, service.ErrForbidden)
+	_, err = members.GetMembers(ctx, room.ID, member.ID)
+	assert.ErrorIs(t, err, service.ErrForbidden)
+
+	// Present observers aren't counted among those who should vote
+	for _, userID := range []uint{1, member.ID, observer.ID} {
+		app.presenceService.Join(room.ID, userID, userID)
+	}
+	tickets, err := app.roomTicketService.GetTicketsOfRoom(ctx, r.db.DB, 1, room.ID)
+	assert.NoError(t, err)
+	assert.Len(t, tickets, 1)
+	assert.Equal(t, 2, tickets[0].UserCount)
+
+	// Only the room owner hands the room over, and stays as a moderator. Owners
+	// of older rooms are only the room's creator, without a membership.
+	assert.ErrorIs(t, members.TransferOwnership(ctx, room.ID, member.ID, member.ID), service.ErrForbidden)
+	assert.ErrorIs(t, members.TransferOwnership(ctx, room.ID, 1, member.ID+1000), gorm.ErrRecordNotFound)
+	assert.NoError(t, r.db.DB.Where("room_id = ? AND user_id = ?", room.ID, 1).Delete(&database.RoomUser{}).Error)
+	assert.NoError(t, members.TransferOwnership(ctx, room.ID, 1, member.ID))
+
+	var transferred database.Room
+	assert.NoError(t, r.db.DB.First(&transferred, room.ID).Error)
+	assert.Equal(t, member.ID, transferred.CreatedBy)
+	policy := service.NewRoomPolicy(r.db)
+	for userID, expected := range map[uint]service.RoomRole{
+		1:           service.RoleModerator,
+		member.ID:   service.RoleOwner,
+		observer.ID: service.RoleObserver,
+	} {
+		role, err := policy.Role(ctx, room.ID, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, role)
+	}
+	assert.ErrorIs(t, members.SetRole(ctx, room.ID, 1, member.ID, service.RoleEstimator), service.ErrForbidden)
+	assert.ErrorIs(t, members.SetRole(ctx, room.ID, member.ID, member.ID, service.RoleEstimator), service.ErrOwnerRole)
+	assert.NoError(t, members.SetRole(ctx, room.ID, member.ID, 1, service.RoleEstimator))
+}
@@ -0,0 +1,220 @@
+package services
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestRoomRolePermissions(t *testing.T) {
+	tests := []struct {
+		action  service.RoomAction
+		allowed []service.RoomRole
+	}{
+		{service.ActionViewRoom, []service.RoomRole{service.RoleOwner, service.RoleModerator, service.RoleEstimator, service.RoleObserver}},
+		{service.ActionEstimate, []service.RoomRole{service.RoleOwner, service.RoleModerator, service.RoleEstimator}},
+		{service.ActionWriteJiraEstimate, []service.RoomRole{service.RoleOwner, service.RoleModerator, service.RoleEstimator}},
+		{service.ActionCreateTicket, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionImportTickets, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionEditTicket, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionDeleteTicket, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionHideTicket, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionCloseTicket, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionReopenTicket, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionStartRound, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionRevealVotes, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionFacilitate, []service.RoomRole{service.RoleOwner, service.RoleModerator}},
+		{service.ActionConfigureLLM, []service.RoomRole{service.RoleOwner}},
+		{service.ActionManageMembers, []service.RoomRole{service.RoleOwner}},
+		{service.ActionDeleteRoom, []service.RoomRole{service.RoleOwner}},
+	}
+
+	roles := []service.RoomRole{
+		service.RoleOwner, service.RoleModerator, service.RoleEstimator, service.RoleObserver, service.RoleNone,
+	}
+	for _, test := range tests {
+		for _, role := range roles {
+			assert.Equal(t, slices.Contains(test.allowed, role), service.RoleCan(role, test.action),
+				"%q doing %q", role, test.action)
+		}
+	}
+}
+
+func (r *RoomServiceSuite) TestRoomPolicy() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "policy"})
+	assert.NoError(t, err)
+	member := database.User{DisplayName: "member"}
+	assert.NoError(t, r.db.DB.Create(&member).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&member))
+	outsider := database.User{DisplayName: "outsider"}
+	assert.NoError(t, r.db.DB.Create(&outsider).Error)
+	ticket := database.Ticket{Name: "ticket", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&ticket).Error)
+
+	policy := service.NewRoomPolicy(r.db)
+	for userID, expected := range map[uint]service.RoomRole{
+		1:           service.RoleOwner,
+		member.ID:   service.RoleEstimator,
+		outsider.ID: service.RoleNone,
+	} {
+		role, err := policy.Role(ctx, room.ID, userID)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, role)
+	}
+	_, err = policy.Role(ctx, room.ID+1000, 1)
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	app := r.newApp()
+
+	createTicketContext := func() echo.Context {
+		return echo.New().NewContext(httptest.NewRequest("POST", "/ticket", nil), httptest.NewRecorder())
+	}
+
+	// One check for every route reading or changing the room, in the order of the routers
+	routes := map[string]func(userID uint) error{
+		"GET /room/:id (JSON)": func(userID uint) error {
+			_, err := app.roomService.GetTicketList(ctx, room.ID, userID)
+			return err
+		},
+		"DELETE /room/:id": func(userID uint) error {
+			_, err := app.roomService.DeleteRoom(ctx, room.ID, userID)
+			return err
+		},
+		"POST /room/allow-llm-estimation": func(userID uint) error {
+			_, err := app.roomService.UpdateLLMSettings(ctx, room.ID, userID, true, "")
+			return err
+		},
+		"POST /room/:id/facilitation": func(userID uint) error {
+			return app.ticketService.SetFacilitated(ctx, room.ID, userID, true)
+		},
+		"POST /room/:id/voting": func(userID uint) error {
+			return app.ticketService.UpdateVotingSettings(ctx, room.ID, userID, time.Minute, database.AutoFinishClose)
+		},
+		"POST /room/:id/consensus": func(userID uint) error {
+			return app.ticketService.UpdateConsensusThresholds(ctx, room.ID, userID, database.DefaultConsensusThresholds)
+		},
+		"POST /ticket": func(userID uint) error {
+			_, _, err := app.ticketService.CreateTicket(createTicketContext(), userID, service.CreateTicketForm{
+				TicketName: "new", TicketDescription: "description", RoomID: room.ID,
+			})
+			return err
+		},
+		"POST /ticket/hide": func(userID uint) error {
+			_, err := app.ticketService.HideTicket(ctx, ticket.ID, userID)
+			return err
+		},
+		"POST /ticket/hide-all": func(userID uint) error {
+			return app.ticketService.HideAllTickets(ctx, room.ID, userID)
+		},
+		"POST /ticket/estimate": func(userID uint) error {
+			_, err := app.ticketService.EstimateTicket(ctx, userID, service.EstimateTicketForm{
+				TicketID: ticket.ID, RoomID: room.ID, HourEstimate: 2,
+			})
+			return err
+		},
+		"POST /ticket/close": func(userID uint) error {
+			_, err := app.ticketService.CloseTicket(ctx, ticket.ID, userID)
+			return err
+		},
+		"POST /ticket/round": func(userID uint) error {
+			_, err := app.ticketService.StartNewRound(ctx, ticket.ID, userID)
+			return err
+		},
+		"POST /ticket/reveal": func(userID uint) error {
+			_, err := app.ticketService.RevealTicket(ctx, ticket.ID, userID)
+			return err
+		},
+		"POST /ticket/reopen": func(userID uint) error {
+			_, err := app.ticketService.ReopenTicket(ctx, ticket.ID, userID)
+			return err
+		},
+		"POST /ticket/update": func(userID uint) error {
+			_, err := app.ticketService.UpdateTicket(ctx, userID, service.UpdateTicketForm{
+				TicketID: ticket.ID, TicketName: "renamed",
+			})
+			return err
+		},
+		"POST /ticket/delete": func(userID uint) error {
+			return app.ticketService.DeleteTicket(ctx, ticket.ID, userID)
+		},
+		"POST /ticket/activate": func(userID uint) error {
+			return app.ticketService.SetActiveTicket(ctx, ticket.ID, userID)
+		},
+		"POST /ticket/timer": func(userID uint) error {
+			_, err := app.ticketService.StartVotingTimer(ctx, ticket.ID, userID, time.Minute)
+			return err
+		},
+		"POST /ticket/timer/stop": func(userID uint) error {
+			return app.ticketService.StopVotingTimer(ctx, ticket.ID, userID)
+		},
+		"GET /ticket/estimates/:id": func(userID uint) error {
+			_, err := app.ticketService.GetTicketEstimates(ctx, int32(ticket.ID), userID)
+			return err
+		},
+		"POST /jira/bulk/import": func(userID uint) error {
+			_, err := app.ticketService.BulkImportTickets(ctx, userID, room.ID, nil)
+			return err
+		},
+		"POST /jira/ticket/:type": func(userID uint) error {
+			_, err := app.ticketService.GetAuthorizedTicket(ctx, userID, ticket.ID, service.ActionWriteJiraEstimate)
+			return err
+		},
+		"GET /ws/:id": func(userID uint) error {
+			_, err := app.roomService.Authorize(ctx, room.ID, userID, service.ActionViewRoom)
+			return err
+		},
+	}
+	membersCan := []string{
+		"GET /room/:id (JSON)", "POST /ticket/estimate", "GET /ticket/estimates/:id",
+		"POST /jira/ticket/:type", "GET /ws/:id",
+	}
+
+	for route, call := range routes {
+		assert.ErrorIs(t, call(outsider.ID), service.ErrForbidden, route)
+		if slices.Contains(membersCan, route) {
+			assert.NoError(t, call(member.ID), route)
+		} else {
+			assert.ErrorIs(t, call(member.ID), service.ErrForbidden, route)
+		}
+	}
+
+	// Nothing changed for those who weren't allowed to
+	var unchanged database.Ticket
+	assert.NoError(t, r.db.DB.First(&unchanged, ticket.ID).Error)
+	assert.False(t, unchanged.Hidden)
+	assert.Nil(t, unchanged.ClosedAt)
+	assert.Equal(t, 1, unchanged.CurrentRound)
+	assert.Equal(t, "ticket", unchanged.Name)
+
+	// The owner can do everything, the room is deleted last
+	_, err = app.ticketService.HideTicket(ctx, ticket.ID, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, app.ticketService.HideAllTickets(ctx, room.ID, 1))
+	_, err = app.ticketService.RevealTicket(ctx, ticket.ID, 1)
+	assert.NoError(t, err)
+	_, err = app.ticketService.StartNewRound(ctx, ticket.ID, 1)
+	assert.NoError(t, err)
+	_, err = app.ticketService.CloseTicket(ctx, ticket.ID, 1)
+	assert.NoError(t, err)
+	_, err = app.ticketService.ReopenTicket(ctx, ticket.ID, 1)
+	assert.NoError(t, err)
+	_, err = app.ticketService.UpdateTicket(ctx, 1, service.UpdateTicketForm{TicketID: ticket.ID, TicketName: "renamed"})
+	assert.NoError(t, err)
+	assert.NoError(t, app.ticketService.SetActiveTicket(ctx, ticket.ID, 1))
+	assert.NoError(t, app.ticketService.SetFacilitated(ctx, room.ID, 1, true))
+	assert.NoError(t, app.ticketService.DeleteTicket(ctx, ticket.ID, 1))
+	_, err = app.roomService.UpdateLLMSettings(ctx, room.ID, 1, true, "")
+	assert.NoError(t, err)
+	_, err = app.roomService.DeleteRoom(ctx, room.ID, 1)
+	assert.NoError(t, err)
+}
@@ -40,12 +40,13 @@ func (r *RoomServiceSuite) TearDownSubTest() {
 // SetupSubTest implements suite.SetupSubTest.
 func (r *RoomServiceSuite) SetupTest() {
 	// Prepare user with id 1
+	// Kept between tests, every test of the suite needs it
 	var savedUser database.User
-	err := r.db.DB.Create(&database.User{
+	err := r.db.DB.FirstOrCreate(&savedUser, database.User{
 		Model: gorm.Model{
 			ID: 1,
 		},
-	}).Scan(&savedUser).Error
+	}).Error
 	assert.NoError(r.T(), err)
 }
 
@@ -78,7 +79,8 @@ func (r *RoomServiceSuite) SetupSuite() {
 
 	db := database.New(connString)
 	r.db = db // Add this line
-	r.roomService = service.NewRoomService(db)
+	presenceService := service.NewPresenceService()
+	r.roomService = service.NewRoomService(db, service.NewRoomTicketService(db, presenceService), presenceService)
 
 }
 
@@ -96,20 +98,90 @@ var _ suite.SetupAllSuite = &RoomServiceSuite{}
 var _ suite.SetupTestSuite = &RoomServiceSuite{}
 var _ suite.TearDownSubTest = &RoomServiceSuite{}
 
+// roomApp holds the services of one instance of the app, wired like the server
+// does, with room events kept in the process
+type roomApp struct {
+	presenceService   *service.PresenceService
+	roomTicketService *service.RoomTicketService
+	roomService       *service.RoomService
+	webSocketService  *service.WebSocketService
+	llmService        *service.LLMService
+	ticketService     *service.TicketService
+}
+
+// newApp wires the services of an instance whose LLM workers estimate with
+// the heuristic
+func (r *RoomServiceSuite) newApp() roomApp {
+	return r.newAppWith(service.NewPresenceService(), r.heuristicEstimators())
+}
+
+func (r *RoomServiceSuite) heuristicEstimators() *service.Estimators {
+	estimators, err := service.NewEstimators(service.ProviderHeuristic, map[string]service.Estimator{
+		service.ProviderHeuristic: service.HeuristicEstimator{},
+	})
+	assert.NoError(r.T(), err)
+	return estimators
+}
+
+// newAppWith wires the services around the presence service and the
+// estimators. The LLM workers stop with the test.
+func (r *RoomServiceSuite) newAppWith(presenceService *service.PresenceService, estimators *service.Estimators) roomApp {
+	roomTicketService := service.NewRoomTicketService(r.db, presenceService)
+	roomService := service.NewRoomService(r.db, roomTicketService, presenceService)
+	webSocketService := service.NewWebSocketService(roomService, presenceService, service.NewLocalBackplane())
+	llmService := service.NewLLMService(webSocketService, r.db, estimators)
+	r.T().Cleanup(llmService.Stop)
+
+	return roomApp{
+		presenceService:   presenceService,
+		roomTicketService: roomTicketService,
+		roomService:       roomService,
+		webSocketService:  webSocketService,
+		llmService:        llmService,
+		ticketService:     service.NewTicketService(r.db, roomTicketService, llmService, webSocketService),
+	}
+}
+
 func (r *RoomServiceSuite) TestCreateRoom() {
 	t := r.T()
 	ctx := t.Context()
 
-	room, err := r.roomService.CreateRoom(ctx, 1, "roomName")
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "roomName"})
 
 	assert.NoError(t, err, "Error creating room")
 	assert.Equal(t, "roomName", room.Name)
+	assert.Equal(t, database.ScaleHours, room.EstimationScale)
 	assert.Equal(t, uint(1), room.CreatedBy)
 	assert.Equal(t, 1, len(room.Users))
 	assert.Equal(t, 0, len(room.Tickets))
 
 }
 
+func (r *RoomServiceSuite) TestLLMSettings() {
+	t := r.T()
+	ctx := t.Context()
+
+	hours, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "hours"})
+	assert.NoError(t, err)
+	cards, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "cards", EstimationScale: "fibonacci"})
+	assert.NoError(t, err)
+
+	updated, err := r.roomService.UpdateLLMSettings(ctx, hours.ID, 1, true, "heuristic")
+	assert.NoError(t, err)
+	assert.True(t, updated.AllowLLMEstimation)
+	assert.Equal(t, "heuristic", updated.LLMProvider)
+	assert.True(t, updated.Deck().IsTimeBased())
+
+	// The owner is told a card deck gets no LLM estimates
+	updated, err = r.roomService.UpdateLLMSettings(ctx, cards.ID, 1, true, "")
+	assert.NoError(t, err)
+	assert.True(t, updated.AllowLLMEstimation)
+	assert.False(t, updated.Deck().IsTimeBased())
+
+	_, err = r.roomService.UpdateLLMSettings(ctx, cards.ID, 2, false, "")
+	assert.ErrorIs(t, err, service.ErrForbidden)
+}
+
 func TestRoomServiceSuite(t *testing.T) {
 	suite.Run(t, new(RoomServiceSuite))
 }
@@ -0,0 +1,433 @@
+package services
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func (r *RoomServiceSuite) TestHiddenVotes() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "hidden"})
+	assert.NoError(t, err)
+	voter := database.User{DisplayName: "voter"}
+	assert.NoError(t, r.db.DB.Create(&voter).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&voter))
+	hidden := database.Ticket{Name: "hidden", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&hidden).Error)
+
+	app := r.newApp()
+	deck := database.NewDeck(database.ScaleHours, "")
+
+	vote := func(userID uint, hours int32) {
+		t.Helper()
+		_, err := app.ticketService.EstimateTicket(ctx, userID, service.EstimateTicketForm{TicketID: hidden.ID, RoomID: room.ID, HourEstimate: hours})
+		assert.NoError(t, err)
+	}
+	vote(1, 2)
+	vote(voter.ID, 6)
+
+	// Only the number of votes is known until they are revealed
+	unrevealed, err := app.ticketService.GetAuthorizedTicket(ctx, 1, hidden.ID, service.ActionViewRoom)
+	assert.NoError(t, err)
+	props := unrevealed.ToDetailProp(true)
+	assert.False(t, props.IsRevealed)
+	assert.Equal(t, 2, unrevealed.EstimateCount)
+	assert.Empty(t, props.AverageEstimate)
+	assert.Empty(t, props.MedianEstimate)
+	assert.Empty(t, props.StdEstimate)
+	assert.Empty(t, props.Votes)
+	assert.Nil(t, props.Consensus)
+	assert.Equal(t, "Your estimate: "+deck.Format(2), props.UserEstimate)
+	rounds, err := app.ticketService.GetTicketEstimates(ctx, int32(hidden.ID), 1)
+	assert.NoError(t, err)
+	assert.Empty(t, rounds)
+
+	revealed, err := app.ticketService.RevealTicket(ctx, hidden.ID, 1)
+	assert.NoError(t, err)
+	props = revealed.ToDetailProp(true)
+	assert.True(t, props.IsRevealed)
+	assert.Equal(t, deck.Format(4), props.AverageEstimate)
+	assert.Equal(t, deck.Format(4), props.MedianEstimate)
+	assert.Equal(t, deck.FormatDeviation(math.Sqrt(8)), props.StdEstimate)
+	assert.Len(t, props.Votes, 2)
+
+	// The popup shows revealed rounds only, not the one being voted on
+	_, err = app.ticketService.StartNewRound(ctx, hidden.ID, 1)
+	assert.NoError(t, err)
+	vote(1, 8)
+	rounds, err = app.ticketService.GetTicketEstimates(ctx, int32(hidden.ID), 1)
+	assert.NoError(t, err)
+	if assert.Len(t, rounds, 1) {
+		assert.Equal(t, 1, rounds[0].Round)
+		assert.Len(t, rounds[0].Estimates, 2)
+	}
+	unrevealed, err = app.ticketService.GetAuthorizedTicket(ctx, 1, hidden.ID, service.ActionViewRoom)
+	assert.NoError(t, err)
+	assert.Empty(t, unrevealed.ToDetailProp(true).AverageEstimate)
+}
+
+func (r *RoomServiceSuite) TestVotingRounds() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "rounds"})
+	assert.NoError(t, err)
+	rounds := database.Ticket{Name: "rounds", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&rounds).Error)
+
+	app := r.newApp()
+	deck := database.NewDeck(database.ScaleHours, "")
+
+	vote := func(hours int32) error {
+		_, err := app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: rounds.ID, RoomID: room.ID, HourEstimate: hours})
+		return err
+	}
+	votesOfRound := func(round int) []database.Estimate {
+		var votes []database.Estimate
+		assert.NoError(t, r.db.DB.Where("ticket_id = ? AND round = ?", rounds.ID, round).Find(&votes).Error)
+		return votes
+	}
+
+	// Voting again replaces the vote, also when both votes arrive at once
+	assert.NoError(t, vote(2))
+	var wg sync.WaitGroup
+	for hours := int32(3); hours <= 8; hours++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, vote(hours))
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, vote(4))
+	if votes := votesOfRound(1); assert.Len(t, votes, 1) {
+		assert.Equal(t, 4.0, votes[0].Estimate)
+	}
+
+	// A new round starts without votes and keeps the old ones as history
+	revealed, err := app.ticketService.RevealTicket(ctx, rounds.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, deck.Format(4), revealed.ToDetailProp(true).AverageEstimate)
+	newRound, err := app.ticketService.StartNewRound(ctx, rounds.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, newRound.CurrentRound)
+	assert.Equal(t, 0, newRound.EstimateCount)
+	assert.False(t, newRound.IsRevealed())
+
+	// Statistics only count the votes of the current round
+	assert.NoError(t, vote(8))
+	assert.Len(t, votesOfRound(1), 1)
+	revealed, err = app.ticketService.RevealTicket(ctx, rounds.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, revealed.EstimateCount)
+	assert.Equal(t, deck.Format(8), revealed.ToDetailProp(true).AverageEstimate)
+
+	history, err := app.ticketService.GetTicketEstimates(ctx, int32(rounds.ID), 1)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		assert.Equal(t, 1, history[0].Round)
+		assert.False(t, history[0].IsCurrent)
+		assert.Equal(t, deck.Format(4), history[0].AverageEstimate)
+		assert.Len(t, history[0].Estimates, 1)
+		assert.Equal(t, 2, history[1].Round)
+		assert.True(t, history[1].IsCurrent)
+		assert.Equal(t, deck.Format(8), history[1].AverageEstimate)
+	}
+
+	// Closed tickets can't get another round
+	_, err = app.ticketService.CloseTicket(ctx, rounds.ID, 1)
+	assert.NoError(t, err)
+	_, err = app.ticketService.StartNewRound(ctx, rounds.ID, 1)
+	assert.ErrorIs(t, err, service.ErrInvalidTicket)
+}
+
+func (r *RoomServiceSuite) TestTicketLifecycle() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "lifecycle"})
+	assert.NoError(t, err)
+	ticket := database.Ticket{Name: "tpyo", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&ticket).Error)
+	imported := database.Ticket{Name: "imported by mistake", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&imported).Error)
+
+	app := r.newApp()
+
+	_, err = app.ticketService.UpdateTicket(ctx, 1, service.UpdateTicketForm{TicketID: ticket.ID, TicketName: "  "})
+	assert.ErrorIs(t, err, service.ErrInvalidTicket)
+	updated, err := app.ticketService.UpdateTicket(ctx, 1, service.UpdateTicketForm{
+		TicketID: ticket.ID, TicketName: "typo", TicketDescription: "fixed description",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "typo", updated.Name)
+	assert.Equal(t, "fixed description", updated.Description)
+
+	for _, id := range []uint{ticket.ID, imported.ID} {
+		_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: id, RoomID: room.ID, HourEstimate: 4})
+		assert.NoError(t, err)
+		_, err = app.ticketService.CloseTicket(ctx, id, 1)
+		assert.NoError(t, err)
+	}
+	total, err := app.roomService.GetTotalEstimateOfRoom(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0w 1d 0h", total)
+
+	// Deleted tickets no longer count towards the room
+	assert.NoError(t, app.ticketService.DeleteTicket(ctx, imported.ID, 1))
+	assert.ErrorIs(t, app.ticketService.DeleteTicket(ctx, imported.ID, 1), gorm.ErrRecordNotFound)
+	tickets, err := app.roomService.GetTicketList(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.Len(t, tickets, 1)
+	total, err = app.roomService.GetTotalEstimateOfRoom(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0w 0d 4h", total)
+
+	// Reopening starts a new round, the votes are kept as history
+	reopened, err := app.ticketService.ReopenTicket(ctx, ticket.ID, 1)
+	assert.NoError(t, err)
+	assert.Nil(t, reopened.ClosedAt)
+	assert.Equal(t, 2, reopened.CurrentRound)
+	assert.Equal(t, 0, reopened.EstimateCount)
+	assert.False(t, reopened.IsRevealed())
+	rounds, err := app.ticketService.GetTicketEstimates(ctx, int32(ticket.ID), 1)
+	assert.NoError(t, err)
+	if assert.Len(t, rounds, 1) {
+		assert.Len(t, rounds[0].Estimates, 1)
+	}
+	total, err = app.roomService.GetTotalEstimateOfRoom(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0w 0d 0h", total)
+
+	// Only closed tickets can be reopened
+	_, err = app.ticketService.ReopenTicket(ctx, ticket.ID, 1)
+	assert.ErrorIs(t, err, service.ErrInvalidTicket)
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: ticket.ID, RoomID: room.ID, HourEstimate: 6})
+	assert.NoError(t, err)
+}
+
+func (r *RoomServiceSuite) TestFacilitation() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "facilitated"})
+	assert.NoError(t, err)
+	first := database.Ticket{Name: "first", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&first).Error)
+	hidden := database.Ticket{Name: "hidden", Description: "description", RoomID: room.ID, CreatedBy: 1, Hidden: true}
+	assert.NoError(t, r.db.DB.Create(&hidden).Error)
+	last := database.Ticket{Name: "last", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&last).Error)
+
+	app := r.newApp()
+
+	vote := func(ticketID uint) error {
+		_, err := app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: ticketID, RoomID: room.ID, HourEstimate: 2})
+		return err
+	}
+	assertActive := func(ticketID uint) {
+		t.Helper()
+		active, err := app.ticketService.GetActiveTicket(ctx, room.ID, 1)
+		assert.NoError(t, err)
+		assert.True(t, active.Facilitated)
+		assert.Equal(t, ticketID, active.TicketID)
+	}
+
+	// Every open ticket can be voted on until the room is facilitated
+	assert.NoError(t, vote(last.ID))
+	assert.NoError(t, app.ticketService.SetFacilitated(ctx, room.ID, 1, true))
+	assertActive(first.ID)
+	assert.ErrorIs(t, vote(last.ID), service.ErrInvalidEstimate)
+	assert.NoError(t, vote(first.ID))
+
+	presence, err := app.roomService.GetPresenceRoster(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", presence.CurrentTicket)
+
+	// Closing the active ticket moves on to the next one, skipping hidden tickets
+	_, err = app.ticketService.CloseTicket(ctx, first.ID, 1)
+	assert.NoError(t, err)
+	assertActive(last.ID)
+	assert.ErrorIs(t, app.ticketService.SetActiveTicket(ctx, first.ID, 1), service.ErrInvalidTicket)
+
+	assert.ErrorIs(t, app.ticketService.SetActiveTicket(ctx, hidden.ID, 1), service.ErrInvalidTicket)
+	assertActive(last.ID)
+
+	// Deleting the active ticket moves on as well
+	assert.NoError(t, r.db.DB.Model(&hidden).Update("hidden", false).Error)
+	assert.NoError(t, app.ticketService.SetActiveTicket(ctx, hidden.ID, 1))
+	assertActive(hidden.ID)
+	assert.NoError(t, app.ticketService.DeleteTicket(ctx, hidden.ID, 1))
+	assertActive(last.ID)
+
+	// Nothing is active once every ticket is closed, until one is reopened
+	_, err = app.ticketService.CloseTicket(ctx, last.ID, 1)
+	assert.NoError(t, err)
+	assertActive(0)
+	_, err = app.ticketService.ReopenTicket(ctx, last.ID, 1)
+	assert.NoError(t, err)
+	assertActive(last.ID)
+	assert.NoError(t, vote(last.ID))
+	_, err = app.ticketService.CloseTicket(ctx, last.ID, 1)
+	assert.NoError(t, err)
+	assertActive(0)
+
+	assert.NoError(t, app.ticketService.SetFacilitated(ctx, room.ID, 1, false))
+	active, err := app.ticketService.GetActiveTicket(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.False(t, active.Facilitated)
+}
+
+func (r *RoomServiceSuite) TestVotesWithoutValue() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "unsure"})
+	assert.NoError(t, err)
+	voter := database.User{DisplayName: "voter"}
+	assert.NoError(t, r.db.DB.Create(&voter).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&voter))
+	mixed := database.Ticket{Name: "mixed", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&mixed).Error)
+	abstained := database.Ticket{Name: "abstained", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&abstained).Error)
+
+	app := r.newApp()
+	deck := database.NewDeck(database.ScaleHours, "")
+
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: mixed.ID, RoomID: room.ID, HourEstimate: 4})
+	assert.NoError(t, err)
+	estimate, err := app.ticketService.EstimateTicket(ctx, voter.ID, service.EstimateTicketForm{TicketID: mixed.ID, RoomID: room.ID, HourEstimate: 40, Kind: "unsure"})
+	assert.NoError(t, err)
+	assert.Equal(t, "?", estimate)
+	_, err = app.ticketService.EstimateTicket(ctx, voter.ID, service.EstimateTicketForm{TicketID: mixed.ID, RoomID: room.ID, Kind: "later"})
+	assert.ErrorIs(t, err, service.ErrInvalidEstimate)
+
+	// The unsure voter responded, but doesn't drag the statistics down
+	_, err = app.ticketService.CloseTicket(ctx, mixed.ID, 1)
+	assert.NoError(t, err)
+	closed, err := app.ticketService.GetAuthorizedTicket(ctx, 1, mixed.ID, service.ActionViewRoom)
+	assert.NoError(t, err)
+	props := closed.ToDetailProp(true)
+	assert.Equal(t, "2/2", props.EstimatedBy)
+	assert.Equal(t, deck.Format(4), props.AverageEstimate)
+	assert.Equal(t, deck.Format(4), props.MedianEstimate)
+	assert.Nil(t, props.Consensus)
+
+	total, err := app.roomService.GetTotalEstimateOfRoom(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, deck.FormatTotal(4), total)
+
+	rounds, err := app.ticketService.GetTicketEstimates(ctx, int32(mixed.ID), 1)
+	assert.NoError(t, err)
+	if assert.Len(t, rounds, 1) && assert.Len(t, rounds[0].Estimates, 2) {
+		assert.Equal(t, deck.Format(4), rounds[0].Estimates[0].Estimate)
+		assert.Equal(t, "?", rounds[0].Estimates[1].Estimate)
+		assert.Equal(t, deck.Format(4), rounds[0].MedianEstimate)
+	}
+
+	// Without any value there are no statistics to show
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: abstained.ID, RoomID: room.ID, Kind: "abstain"})
+	assert.NoError(t, err)
+	revealed, err := app.ticketService.RevealTicket(ctx, abstained.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "-", revealed.ToDetailProp(true).AverageEstimate)
+}
+
+func (r *RoomServiceSuite) TestConcurrentClose() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "concurrent"})
+	assert.NoError(t, err)
+	tickets := make([]database.Ticket, 3)
+	for i := range tickets {
+		tickets[i] = database.Ticket{Name: fmt.Sprintf("ticket %d", i), Description: "description", RoomID: room.ID, CreatedBy: 1}
+		assert.NoError(t, r.db.DB.Create(&tickets[i]).Error)
+	}
+
+	app := r.newApp()
+	assert.NoError(t, app.ticketService.SetFacilitated(ctx, room.ID, 1, true))
+
+	// The owner closing the ticket while the server does races, only one
+	// close may move the room on to the next ticket
+	var wg sync.WaitGroup
+	var closes atomic.Int32
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := app.ticketService.CloseTicket(ctx, tickets[0].ID, 1)
+			if err == nil {
+				closes.Add(1)
+				return
+			}
+			assert.ErrorIs(t, err, service.ErrInvalidTicket)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), closes.Load())
+
+	active, err := app.ticketService.GetActiveTicket(ctx, room.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, tickets[1].ID, active.TicketID)
+}
+
+func (r *RoomServiceSuite) TestThreePointEstimates() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "pert", ThreePoint: true})
+	assert.NoError(t, err)
+	assert.True(t, room.ThreePoint)
+	voter := database.User{DisplayName: "voter"}
+	assert.NoError(t, r.db.DB.Create(&voter).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&voter))
+	pert := database.Ticket{Name: "pert", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&pert).Error)
+
+	app := r.newApp()
+
+	// The most likely estimate has to be between the other two
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{
+		TicketID: pert.ID, RoomID: room.ID, HourEstimate: 4, OptimisticEstimate: "6", PessimisticEstimate: "12",
+	})
+	assert.ErrorIs(t, err, service.ErrInvalidEstimate)
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{
+		TicketID: pert.ID, RoomID: room.ID, HourEstimate: 4,
+	})
+	assert.ErrorIs(t, err, service.ErrInvalidEstimate)
+
+	// Expected values of 5 hours, with standard deviations of 10/6 and 2/6
+	estimate, err := app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{
+		TicketID: pert.ID, RoomID: room.ID, HourEstimate: 4, OptimisticEstimate: "2", PessimisticEstimate: "12",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "0w 0d 2h / 0w 0d 4h / 0w 1d 4h", estimate)
+	_, err = app.ticketService.EstimateTicket(ctx, voter.ID, service.EstimateTicketForm{
+		TicketID: pert.ID, RoomID: room.ID, HourEstimate: 5, OptimisticEstimate: "4", PessimisticEstimate: "6",
+	})
+	assert.NoError(t, err)
+
+	revealed, err := app.ticketService.RevealTicket(ctx, pert.ID, 1)
+	assert.NoError(t, err)
+	props := revealed.ToDetailProp(true)
+	assert.True(t, props.ThreePoint)
+	assert.Equal(t, "0w 0d 5h", props.AverageEstimate)
+	assert.Equal(t, "0w 0d 3h – 0w 0d 7h", props.ExpectedRange)
+
+	_, err = app.ticketService.CloseTicket(ctx, pert.ID, 1)
+	assert.NoError(t, err)
+	total, err := app.roomService.GetTotalEstimateOfRoom(ctx, room.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "0w 0d 5h (0w 0d 3h – 0w 0d 7h)", total)
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestUserName(t *testing.T) {
+	anonymous := database.User{Model: gorm.Model{ID: 7}}
+	assert.Equal(t, "User #7", anonymous.Name())
+	assert.Equal(t, "?", anonymous.Initials())
+
+	named := database.User{Model: gorm.Model{ID: 7}, DisplayName: "ana marija horvat"}
+	assert.Equal(t, "ana marija horvat", named.Name())
+	assert.Equal(t, "AM", named.Initials())
+
+	emoji := database.User{DisplayName: "🙂 Šime"}
+	assert.Equal(t, "Š", emoji.Initials())
+}
+
+func TestUserAvatarColor(t *testing.T) {
+	picked := database.User{Model: gorm.Model{ID: 1}, Color: database.AvatarColors[3]}
+	assert.Equal(t, database.AvatarColors[3], picked.AvatarColor())
+
+	// Users without a color keep the same one derived from their ID
+	unpicked := database.User{Model: gorm.Model{ID: 10}}
+	assert.Equal(t, database.AvatarColors[10%len(database.AvatarColors)], unpicked.AvatarColor())
+
+	invalid := database.User{Model: gorm.Model{ID: 10}, Color: "red; background: url(x)"}
+	assert.Equal(t, unpicked.AvatarColor(), invalid.AvatarColor())
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func (r *RoomServiceSuite) TestVotingTimer() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "timer"})
+	assert.NoError(t, err)
+	timed := database.Ticket{Name: "timed", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&timed).Error)
+	voted := database.Ticket{Name: "voted", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&voted).Error)
+
+	app := r.newApp()
+
+	// Rooms without a default timer need the length of each timer
+	_, err = app.ticketService.StartVotingTimer(ctx, timed.ID, 1, 0)
+	assert.ErrorIs(t, err, service.ErrInvalidTimer)
+	assert.ErrorIs(t, app.ticketService.UpdateVotingSettings(ctx, room.ID, 1, 2*time.Hour, database.AutoFinishOff), service.ErrInvalidTimer)
+	_, err = service.ParseAutoFinish("later")
+	assert.ErrorIs(t, err, service.ErrInvalidTimer)
+
+	assert.NoError(t, app.ticketService.UpdateVotingSettings(ctx, room.ID, 1, time.Minute, database.AutoFinishReveal))
+	endsAt, err := app.ticketService.StartVotingTimer(ctx, timed.ID, 1, 0)
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), endsAt, 2*time.Second)
+
+	// The server reveals the votes once the timer ran out, with nobody in the room
+	assert.NoError(t, r.db.DB.Model(&timed).Update("voting_ends_at", time.Now().Add(-time.Second)).Error)
+	service.NewVotingTimerService(r.db, app.ticketService)
+	assert.Eventually(t, func() bool {
+		var revealed database.Ticket
+		return r.db.DB.First(&revealed, timed.ID).Error == nil && revealed.RevealedAt != nil && revealed.VotingEndsAt == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	_, err = app.ticketService.StartVotingTimer(ctx, timed.ID, 1, time.Minute)
+	assert.ErrorIs(t, err, service.ErrInvalidTimer)
+
+	// Or once everyone present voted
+	voter := database.User{DisplayName: "voter"}
+	assert.NoError(t, r.db.DB.Create(&voter).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&voter))
+	assert.NoError(t, app.ticketService.UpdateVotingSettings(ctx, room.ID, 1, 0, database.AutoFinishClose))
+
+	// Without anyone present, e.g. votes sent over HTTP, voting goes on
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: voted.ID, RoomID: room.ID, HourEstimate: 3})
+	assert.NoError(t, err)
+	var closed database.Ticket
+	assert.NoError(t, r.db.DB.First(&closed, voted.ID).Error)
+	assert.Nil(t, closed.ClosedAt)
+
+	app.presenceService.Join(room.ID, 1, "owner's tab")
+	app.presenceService.Join(room.ID, voter.ID, "voter's tab")
+	_, err = app.ticketService.EstimateTicket(ctx, 1, service.EstimateTicketForm{TicketID: voted.ID, RoomID: room.ID, HourEstimate: 3})
+	assert.NoError(t, err)
+	assert.NoError(t, r.db.DB.First(&closed, voted.ID).Error)
+	assert.Nil(t, closed.ClosedAt)
+	_, err = app.ticketService.EstimateTicket(ctx, voter.ID, service.EstimateTicketForm{TicketID: voted.ID, RoomID: room.ID, HourEstimate: 5})
+	assert.NoError(t, err)
+	assert.NoError(t, r.db.DB.First(&closed, voted.ID).Error)
+	assert.NotNil(t, closed.ClosedAt)
+
+	// Closing it again changes nothing
+	_, err = app.ticketService.CloseTicket(ctx, voted.ID, 1)
+	assert.ErrorIs(t, err, service.ErrInvalidTicket)
+	var closedAgain database.Ticket
+	assert.NoError(t, r.db.DB.First(&closedAgain, voted.ID).Error)
+	assert.True(t, closed.ClosedAt.Equal(*closedAgain.ClosedAt))
+}
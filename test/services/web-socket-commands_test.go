@@ -0,0 +1,64 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/markojerkic/spring-planing/internal/database"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func (r *RoomServiceSuite) TestWebSocketCommands() {
+	t := r.T()
+	ctx := t.Context()
+
+	room, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "commands"})
+	assert.NoError(t, err)
+	otherRoom, err := r.roomService.CreateRoom(ctx, 1, service.CreateRoomForm{RoomName: "other"})
+	assert.NoError(t, err)
+	estimatorUser := database.User{DisplayName: "estimator"}
+	assert.NoError(t, r.db.DB.Create(&estimatorUser).Error)
+	assert.NoError(t, r.db.DB.Model(room).Association("Users").Append(&estimatorUser))
+	ticket := database.Ticket{Name: "ticket", Description: "description", RoomID: room.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&ticket).Error)
+	otherTicket := database.Ticket{Name: "other", Description: "description", RoomID: otherRoom.ID, CreatedBy: 1}
+	assert.NoError(t, r.db.DB.Create(&otherTicket).Error)
+
+	app := r.newApp()
+	commands := service.NewWebSocketCommandService(r.db, app.ticketService, app.roomService, app.presenceService, app.webSocketService)
+
+	hub := service.NewHub(8, nil)
+	owner := hub.Register(newFakeConn(), room.ID, 1, service.Route(fmt.Sprintf("room/%d/owner", room.ID)), service.ProtocolJSON)
+	estimator := hub.Register(newFakeConn(), room.ID, estimatorUser.ID, service.Route(fmt.Sprintf("room/%d/estimator", room.ID)), service.ProtocolJSON)
+
+	command := func(name service.JSONCommandName, data string) service.JSONCommand {
+		return service.JSONCommand{ID: "1", Command: name, Data: json.RawMessage(data)}
+	}
+
+	result, err := commands.HandleCommand(ctx, estimator, command(service.CommandVote, fmt.Sprintf(`{"ticketID":%d,"hourEstimate":3}`, ticket.ID)))
+	assert.NoError(t, err)
+	assert.Equal(t, service.JSONVoteResult{TicketID: ticket.ID, Estimate: "0w 0d 3h"}, result)
+
+	_, err = commands.HandleCommand(ctx, estimator, command(service.CommandClose, fmt.Sprintf(`{"ticketID":%d}`, ticket.ID)))
+	assert.ErrorIs(t, err, service.ErrForbidden)
+
+	_, err = commands.HandleCommand(ctx, owner, command(service.CommandClose, fmt.Sprintf(`{"ticketID":%d}`, otherTicket.ID)))
+	assert.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	_, err = commands.HandleCommand(ctx, owner, command(service.CommandVote, `{"ticketID":"one"}`))
+	assert.ErrorIs(t, err, service.ErrInvalidCommand)
+
+	_, err = commands.HandleCommand(ctx, owner, command("dance", ""))
+	assert.ErrorIs(t, err, service.ErrUnknownCommand)
+
+	_, err = commands.HandleCommand(ctx, owner, command(service.CommandReveal, fmt.Sprintf(`{"ticketID":%d}`, ticket.ID)))
+	assert.NoError(t, err)
+	_, err = commands.HandleCommand(ctx, owner, command(service.CommandClose, fmt.Sprintf(`{"ticketID":%d}`, ticket.ID)))
+	assert.NoError(t, err)
+
+	var closed database.Ticket
+	assert.NoError(t, r.db.DB.First(&closed, ticket.ID).Error)
+	assert.NotNil(t, closed.ClosedAt)
+}
@@ -0,0 +1,290 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConn records the messages written to it and notices concurrent writes,
+// which gorilla doesn't allow on a real connection
+type fakeConn struct {
+	mutex      sync.Mutex
+	messages   []string
+	writing    atomic.Int32
+	concurrent atomic.Bool
+	// Writes wait for the channel, or until the connection is closed
+	block     chan struct{}
+	failWrite bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{closed: make(chan struct{})}
+}
+
+func (f *fakeConn) WriteMessage(messageType int, data []byte) error {
+	if f.writing.Add(1) > 1 {
+		f.concurrent.Store(true)
+	}
+	defer f.writing.Add(-1)
+
+	if f.failWrite {
+		return errors.New("broken pipe")
+	}
+	if f.block != nil {
+		select {
+		case <-f.block:
+		case <-f.closed:
+			return errors.New("connection closed")
+		}
+	}
+
+	if messageType == websocket.TextMessage {
+		f.mutex.Lock()
+		f.messages = append(f.messages, string(data))
+		f.mutex.Unlock()
+	}
+	return nil
+}
+
+func (f *fakeConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (f *fakeConn) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *fakeConn) received() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.messages...)
+}
+
+func (f *fakeConn) isClosed() bool {
+	select {
+	case <-f.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestHubBroadcastsToMatchingClientsOfRoom(t *testing.T) {
+	hub := service.NewHub(8, nil)
+	owner, estimator, otherRoom := newFakeConn(), newFakeConn(), newFakeConn()
+	hub.Register(owner, 1, 10, service.Route("room/1/owner"), service.ProtocolHTML)
+	hub.Register(estimator, 1, 11, service.Route("room/1/estimator"), service.ProtocolHTML)
+	hub.Register(otherRoom, 2, 12, service.Route("room/2/estimator"), service.ProtocolHTML)
+
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Route: service.Route("room/1/*"), Payload: []byte("everyone")})
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Route: service.Route("room/1/owner"), Payload: []byte("owner")})
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Route: service.Route("room/1/estimator"), Payload: []byte("estimators")})
+
+	assert.Eventually(t, func() bool { return len(owner.received()) == 2 && len(estimator.received()) == 2 },
+		time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"everyone", "owner"}, owner.received())
+	assert.Equal(t, []string{"everyone", "estimators"}, estimator.received())
+	assert.Empty(t, otherRoom.received())
+}
+
+func TestHubEvictsSlowClient(t *testing.T) {
+	var removed atomic.Int32
+	hub := service.NewHub(2, func(*service.Client) { removed.Add(1) })
+
+	slow := newFakeConn()
+	slow.block = make(chan struct{})
+	fast := newFakeConn()
+	hub.Register(slow, 1, 10, service.Route("room/1/estimator"), service.ProtocolHTML)
+	hub.Register(fast, 1, 11, service.Route("room/1/estimator"), service.ProtocolHTML)
+
+	for i := range 10 {
+		hub.Broadcast(service.RoomEvent{RoomID: 1, Route: service.Route("room/1/*"), Payload: fmt.Appendf(nil, "message %d", i)})
+		// Let the fast client keep up
+		assert.Eventually(t, func() bool { return len(fast.received()) == i+1 }, time.Second, time.Millisecond)
+	}
+
+	assert.Eventually(t, slow.isClosed, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 1, hub.ClientCount(1))
+	assert.Equal(t, int32(1), removed.Load())
+	assert.Len(t, fast.received(), 10)
+	assert.False(t, fast.isClosed())
+}
+
+func TestHubRemovesClientOnWriteError(t *testing.T) {
+	var removed atomic.Int32
+	hub := service.NewHub(8, func(*service.Client) { removed.Add(1) })
+
+	broken := newFakeConn()
+	broken.failWrite = true
+	client := hub.Register(broken, 1, 10, service.Route("room/1/estimator"), service.ProtocolHTML)
+
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Route: service.Route("room/1/*"), Payload: []byte("hello")})
+
+	assert.Eventually(t, broken.isClosed, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, hub.ClientCount(1))
+
+	// Unregistering again, e.g. from the reader, is a no-op
+	hub.Unregister(client)
+	assert.Equal(t, int32(1), removed.Load())
+}
+
+func TestHubRoomsOfUser(t *testing.T) {
+	hub := service.NewHub(8, nil)
+	first := hub.Register(newFakeConn(), 1, 10, service.Route("room/1/owner"), service.ProtocolHTML)
+	hub.Register(newFakeConn(), 1, 10, service.Route("room/1/owner"), service.ProtocolHTML)
+	hub.Register(newFakeConn(), 2, 10, service.Route("room/2/estimator"), service.ProtocolHTML)
+	hub.Register(newFakeConn(), 3, 11, service.Route("room/3/estimator"), service.ProtocolHTML)
+
+	assert.ElementsMatch(t, []uint{1, 2}, hub.RoomsOfUser(10))
+	assert.Equal(t, 2, hub.ClientCount(1))
+
+	hub.Unregister(first)
+	assert.Equal(t, 1, hub.ClientCount(1))
+	assert.Empty(t, hub.RoomsOfUser(12))
+}
+
+func TestHubReroutesClientsOfUser(t *testing.T) {
+	hub := service.NewHub(8, nil)
+	promoted, otherRoom, other := newFakeConn(), newFakeConn(), newFakeConn()
+	hub.Register(promoted, 1, 10, service.Route("room/1/estimator"), service.ProtocolHTML)
+	hub.Register(otherRoom, 2, 10, service.Route("room/2/estimator"), service.ProtocolHTML)
+	hub.Register(other, 1, 11, service.Route("room/1/estimator"), service.ProtocolHTML)
+
+	rerouted := hub.Reroute(1, 10, service.Route("room/1/owner"))
+	assert.Len(t, rerouted, 1)
+	assert.Equal(t, service.Route("room/1/owner"), rerouted[0].Route())
+
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Route: service.Route("room/1/owner"), Payload: []byte("owner")})
+	hub.Broadcast(service.RoomEvent{RoomID: 2, Route: service.Route("room/2/estimator"), Payload: []byte("estimators")})
+
+	assert.Eventually(t, func() bool { return len(promoted.received()) == 1 && len(otherRoom.received()) == 1 },
+		time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"owner"}, promoted.received())
+	assert.Equal(t, []string{"estimators"}, otherRoom.received())
+	assert.Empty(t, other.received())
+}
+
+func TestHubConcurrentBroadcasts(t *testing.T) {
+	hub := service.NewHub(1000, nil)
+	conns := make([]*fakeConn, 5)
+	for i := range conns {
+		conns[i] = newFakeConn()
+		hub.Register(conns[i], 1, uint(i), service.Route("room/1/estimator"), service.ProtocolHTML)
+	}
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 20 {
+				hub.Broadcast(service.RoomEvent{RoomID: 1, Route: service.Route("room/1/*"), Payload: fmt.Appendf(nil, "%d-%d", i, j)})
+			}
+		}()
+	}
+	// Clients come and go while broadcasting
+	for i := range 10 {
+		client := hub.Register(newFakeConn(), 1, uint(100+i), service.Route("room/1/owner"), service.ProtocolHTML)
+		hub.Unregister(client)
+	}
+	wg.Wait()
+
+	for _, conn := range conns {
+		assert.Eventually(t, func() bool { return len(conn.received()) == 200 }, time.Second, 5*time.Millisecond)
+		assert.False(t, conn.concurrent.Load(), "connection was written to concurrently")
+	}
+}
+
+func TestHubAddsSequenceNumbers(t *testing.T) {
+	hub := service.NewHub(8, nil)
+	conn := newFakeConn()
+	hub.Register(conn, 1, 10, service.Route("room/1/estimator"), service.ProtocolHTML)
+
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 1, Route: service.Route("room/1/*"), Payload: []byte(`<div id="a"></div>`)})
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 2, Route: service.Route("room/1/*"), Payload: []byte(`{"messageType":"hideTicket"}`)})
+	// Already sent
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 2, Route: service.Route("room/1/*"), Payload: []byte("again")})
+
+	assert.Eventually(t, func() bool { return len(conn.received()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{`<!--seq:1--><div id="a"></div>`, `{"seq":2,"messageType":"hideTicket"}`}, conn.received())
+}
+
+func TestHubReplaysMissedEventsBeforeLiveOnes(t *testing.T) {
+	hub := service.NewHub(2, nil)
+	conn := newFakeConn()
+	client := hub.Resume(conn, 1, 10, service.Route("room/1/estimator"), service.ProtocolHTML, 3)
+
+	// Live events arriving while replaying are held back
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 8, Route: service.Route("room/1/*"), Payload: []byte("8")})
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 9, Route: service.Route("room/1/*"), Payload: []byte("9")})
+
+	// More missed events than fit into the queue, one of them for the owner only
+	missed := []service.RoomEvent{}
+	for seq := uint64(4); seq <= 8; seq++ {
+		route := service.Route("room/1/*")
+		if seq == 5 {
+			route = service.Route("room/1/owner")
+		}
+		missed = append(missed, service.RoomEvent{RoomID: 1, Seq: seq, Route: route, Payload: fmt.Appendf(nil, "%d", seq)})
+	}
+	hub.Replay(client, missed)
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 10, Route: service.Route("room/1/*"), Payload: []byte("10")})
+
+	assert.Eventually(t, func() bool { return len(conn.received()) == 6 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{
+		"<!--seq:4-->4", "<!--seq:6-->6", "<!--seq:7-->7", "<!--seq:8-->8", "<!--seq:9-->9", "<!--seq:10-->10",
+	}, conn.received())
+	assert.False(t, conn.isClosed())
+}
+
+func TestHubSendsEventsInClientsProtocol(t *testing.T) {
+	hub := service.NewHub(8, nil)
+	htmlConn, jsonConn := newFakeConn(), newFakeConn()
+	hub.Register(htmlConn, 1, 10, service.Route("room/1/estimator"), service.ProtocolHTML)
+	hub.Register(jsonConn, 1, 11, service.Route("room/1/owner"), service.ProtocolJSON)
+
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 1, Route: service.Route("room/1/*"),
+		Payload: []byte("<div></div>"), JSONPayload: []byte(`{"v":1}`)})
+	// Rendered for estimators only, JSON clients get the update with another event
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 2, Route: service.Route("room/1/*"), Payload: []byte("<p></p>")})
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 3, Route: service.Route("room/1/*"), JSONPayload: []byte(`{"v":1,"type":"ticket.closed"}`)})
+
+	assert.Eventually(t, func() bool { return len(htmlConn.received()) == 2 && len(jsonConn.received()) == 2 },
+		time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"<!--seq:1--><div></div>", "<!--seq:2--><p></p>"}, htmlConn.received())
+	assert.Equal(t, []string{`{"seq":1,"v":1}`, `{"seq":3,"v":1,"type":"ticket.closed"}`}, jsonConn.received())
+}
+
+func TestHubRepliesToSingleClient(t *testing.T) {
+	hub := service.NewHub(8, nil)
+	sender, other := newFakeConn(), newFakeConn()
+	client := hub.Register(sender, 1, 10, service.Route("room/1/estimator"), service.ProtocolJSON)
+	hub.Register(other, 1, 11, service.Route("room/1/estimator"), service.ProtocolJSON)
+
+	hub.Broadcast(service.RoomEvent{RoomID: 1, Seq: 4, Route: service.Route("room/1/*"), JSONPayload: []byte(`{"v":1}`)})
+	hub.Reply(client, []byte(`{"v":1,"type":"command.ack"}`))
+
+	assert.Eventually(t, func() bool { return len(sender.received()) == 2 }, time.Second, 5*time.Millisecond)
+	// Replies don't take a sequence number
+	assert.Equal(t, []string{`{"seq":4,"v":1}`, `{"v":1,"type":"command.ack"}`}, sender.received())
+	assert.Eventually(t, func() bool { return len(other.received()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{`{"seq":4,"v":1}`}, other.received())
+}
+
+func TestFrameSeq(t *testing.T) {
+	assert.Equal(t, uint64(12), service.FrameSeq([]byte(`<!--seq:12--><div id="a"></div>`)))
+	assert.Equal(t, uint64(7), service.FrameSeq([]byte(`{"seq":7,"v":1,"type":"ticket.closed"}`)))
+	assert.Equal(t, uint64(0), service.FrameSeq([]byte(`{"v":1,"type":"command.ack"}`)))
+	assert.Equal(t, uint64(0), service.FrameSeq([]byte(`<div id="a"></div>`)))
+}
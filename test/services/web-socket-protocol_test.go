@@ -0,0 +1,96 @@
+package services
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProtocol(t *testing.T) {
+	tests := []struct {
+		query       string
+		subprotocol string
+		expected    service.Protocol
+		isError     bool
+	}{
+		{"", "", service.ProtocolHTML, false},
+		{"html", "", service.ProtocolHTML, false},
+		{"json", "", service.ProtocolJSON, false},
+		{"", service.JSONSubprotocol, service.ProtocolJSON, false},
+		{"xml", "", "", true},
+	}
+
+	for _, test := range tests {
+		protocol, err := service.ParseProtocol(test.query, test.subprotocol)
+		if test.isError {
+			assert.Error(t, err, test.query)
+			continue
+		}
+		assert.NoError(t, err, test.query)
+		assert.Equal(t, test.expected, protocol, test.query)
+	}
+}
+
+func TestJSONProtocolSchemaDocumentsEveryMessage(t *testing.T) {
+	schema := service.JSONProtocolSchema()
+	assert.Equal(t, service.JSONProtocolVersion, schema["version"])
+
+	// The schema is served as JSON
+	encoded, err := json.Marshal(schema)
+	assert.NoError(t, err)
+
+	var decoded struct {
+		Messages map[string]struct {
+			Description string         `json:"description"`
+			Properties  map[string]any `json:"properties"`
+		} `json:"messages"`
+	}
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+
+	for _, messageType := range []service.JSONMessageType{
+		service.JSONTicketsCreated, service.JSONTicketClosed, service.JSONTicketRevealed,
+		service.JSONTicketRoundStart, service.JSONTicketEstimatedBy, service.JSONTicketHidden,
+		service.JSONTicketList, service.JSONTotalEstimate, service.JSONResync, service.JSONRoleChanged,
+		service.JSONPresenceRoster, service.JSONLLMRecommendation, service.JSONLLMJobStatus,
+		service.JSONTicketReopened, service.JSONTicketUpdated, service.JSONTicketDeleted,
+		service.JSONActiveTicket, service.JSONTicketTimer,
+	} {
+		message, ok := decoded.Messages[string(messageType)]
+		assert.True(t, ok, messageType)
+		assert.NotEmpty(t, message.Description, messageType)
+	}
+	assert.Contains(t, decoded.Messages[string(service.JSONTicketClosed)].Properties, "ticket")
+}
+
+func TestJSONProtocolSchemaDocumentsEveryCommand(t *testing.T) {
+	encoded, err := json.Marshal(service.JSONProtocolSchema())
+	assert.NoError(t, err)
+
+	var decoded struct {
+		Commands map[string]struct {
+			Data struct {
+				Description string         `json:"description"`
+				Properties  map[string]any `json:"properties"`
+			} `json:"data"`
+			Result map[string]any `json:"result"`
+		} `json:"commands"`
+	}
+	assert.NoError(t, json.Unmarshal(encoded, &decoded))
+
+	for _, name := range []service.JSONCommandName{
+		service.CommandVote, service.CommandReveal, service.CommandClose, service.CommandStartRound,
+		service.CommandHide, service.CommandHideAll, service.CommandPing,
+		service.CommandReopen, service.CommandUpdate, service.CommandDelete,
+		service.CommandActivate, service.CommandFacilitate, service.CommandStartTimer, service.CommandStopTimer,
+	} {
+		command, ok := decoded.Commands[string(name)]
+		assert.True(t, ok, name)
+		assert.NotEmpty(t, command.Data.Description, name)
+	}
+	assert.Contains(t, decoded.Commands[string(service.CommandVote)].Data.Properties, "ticketID")
+	assert.NotEmpty(t, decoded.Commands[string(service.CommandVote)].Result)
+	assert.Empty(t, decoded.Commands[string(service.CommandClose)].Result)
+	assert.Contains(t, decoded.Commands[string(service.CommandUpdate)].Data.Properties, "name")
+}
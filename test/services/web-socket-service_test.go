@@ -0,0 +1,40 @@
+package services
+
+import (
+	"strings"
+	"time"
+
+	"github.com/markojerkic/spring-planing/internal/service"
+	"github.com/stretchr/testify/assert"
+)
+
+func (r *RoomServiceSuite) TestEventStream() {
+	t := r.T()
+
+	room, err := r.roomService.CreateRoom(t.Context(), 1, service.CreateRoomForm{RoomName: "stream"})
+	assert.NoError(t, err)
+
+	app := r.newApp()
+
+	conn := newFakeConn()
+	client, streamID := app.webSocketService.RegisterStream(conn, room.ID, 1, service.RoleOwner, service.ProtocolJSON, nil)
+	assert.NotEmpty(t, streamID)
+
+	// Only the user who opened the stream can post to it
+	assert.ErrorIs(t, app.webSocketService.PostToStream(streamID, 2, []byte(`{"id":"1","command":"ping"}`)), service.ErrStreamNotFound)
+	assert.NoError(t, app.webSocketService.PostToStream(streamID, 1, []byte(`{"id":"1","command":"ping"}`)))
+
+	// Replies go over the stream, like over a websocket
+	assert.Eventually(t, func() bool {
+		for _, message := range conn.received() {
+			if strings.Contains(message, `"type":"command.`) {
+				return true
+			}
+		}
+		return false
+	}, time.Second, 5*time.Millisecond)
+
+	app.webSocketService.Disconnect(client)
+	assert.True(t, conn.isClosed())
+	assert.ErrorIs(t, app.webSocketService.PostToStream(streamID, 1, []byte(`{"id":"2","command":"ping"}`)), service.ErrStreamNotFound)
+}